@@ -2,31 +2,79 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+	"viktig/internal/certs"
+	"viktig/internal/communities"
 	"viktig/internal/config"
+	"viktig/internal/conversations"
 	"viktig/internal/entities"
+	"viktig/internal/health"
+	"viktig/internal/metrics"
+	"viktig/internal/mutes"
+	"viktig/internal/pipeline"
 	"viktig/internal/queue"
+	"viktig/internal/ratelimit"
 	"viktig/internal/services/forwarder"
 	"viktig/internal/services/http_server"
+	"viktig/internal/services/reminder"
+	"viktig/internal/services/tg_bot"
 	"viktig/internal/services/vk_users_getter"
+	"viktig/internal/sinks"
+	"viktig/internal/sinks/discord"
+	"viktig/internal/sinks/email"
+	"viktig/internal/sinks/jsonl"
+	"viktig/internal/sinks/matrix"
+	"viktig/internal/sinks/mattermost"
+	"viktig/internal/sinks/slack"
+	"viktig/internal/sinks/webhook"
+	"viktig/internal/storage"
+	"viktig/internal/supervisor"
+	"viktig/internal/tracing"
 
 	"github.com/cosiner/flag"
 	"github.com/xlab/closer"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// httpServerPolicy gives up sooner than the default one since HttpServer failures,
+// such as the port being in use, are unlikely to be resolved by restarts.
+var httpServerPolicy = supervisor.Policy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     10 * time.Second,
+	MaxRestarts:    3,
+	Window:         time.Minute,
+}
+
+// queueStallThreshold is how long a queue may not be taken from while there are messages waiting
+// before the app is considered not ready.
+const queueStallThreshold = 30 * time.Second
+
 type Params struct {
 	ConfigPath string `names:"--config" usage:"config file path" default:"./config.yml"`
 	Host       string `names:"--host" usage:"host to bind to" default:"127.0.0.1"`
 	Port       int    `names:"--port" usage:"port to bind to" default:"1337"`
+
+	Export ExportParams `usage:"export archived messages as JSONL or CSV"`
+	Dlq    DlqParams    `usage:"inspect and replay messages that could not be forwarded"`
 }
 
 type App struct {
-	params *Params
-	cfg    *config.Config
+	params      *Params
+	cfg         *config.Config
+	tlsConfig   *tls.Config
+	acmeManager *autocert.Manager
+	storage     *storage.Storage
+	communities *communities.Manager
+	mutes       *mutes.Mutes
+	tracker     *conversations.Tracker
+	sinks       map[string]sinks.Sink
 }
 
 func New() (*App, error) {
@@ -46,70 +94,452 @@ func New() (*App, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &App{params, cfg}, nil
+	a := &App{params: params, cfg: cfg}
+	if cfg.DatabasePath != "" {
+		if err = a.setupStorage(); err != nil {
+			return nil, err
+		}
+	}
+	if params.isCommand() {
+		return a, nil
+	}
+	if cfg.Tls != nil {
+		if err = a.setupTls(); err != nil {
+			return nil, err
+		}
+	}
+	if err = a.setupCommunities(); err != nil {
+		return nil, err
+	}
+	if err = a.setupSinks(); err != nil {
+		return nil, err
+	}
+	if cfg.BotCommands {
+		if err = a.setupMutes(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AnswerTracking != nil {
+		if err = a.setupTracker(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
 }
 
 func (a App) Run() {
+	if a.params.isCommand() {
+		a.runCommand()
+		return
+	}
+	if a.cfg.Tracing != nil {
+		a.setupTracing()
+	}
+
 	errorCh := make(chan error)
 	appCtx, wg := setupContextAndWg(context.Background(), errorCh)
 
-	q1 := queue.NewQueue[entities.Message]() // callback_handler --> users_getter
-	q2 := queue.NewQueue[entities.Message]() // users_getter --> forwarder
-
-	vkUsersGetterService := vk_users_getter.New(a.cfg.VkApiToken, q1, q2, slog.Default())
+	sv := a.makeSupervisor()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		errorCh <- vkUsersGetterService.Run(appCtx)
+		errorCh <- sv.Run(appCtx)
 	}()
 
-	forwarderService := a.makeForwarder(q2)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errorCh <- forwarderService.Run(appCtx)
-	}()
+	closer.Hold()
+}
 
-	httpServer := a.makeHttpServer(q1)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errorCh <- httpServer.Run(appCtx)
-	}()
+func (a *App) setupTls() error {
+	if a.cfg.Tls.Acme == nil {
+		reloader, err := certs.NewFileReloader(a.cfg.Tls.CertFile, a.cfg.Tls.KeyFile, slog.Default())
+		if err != nil {
+			return err
+		}
+		a.tlsConfig = reloader.TLSConfig()
+		return nil
+	}
 
-	closer.Hold()
+	acmeCfg := a.cfg.Tls.Acme
+	manager, err := certs.NewAcmeManager(
+		acmeCfg.Domains,
+		acmeCfg.Email,
+		acmeCfg.CacheDir,
+		acmeCfg.DirectoryUrl,
+		acmeCfg.CaFile,
+	)
+	if err != nil {
+		return err
+	}
+	a.acmeManager = manager
+	a.tlsConfig = certs.AcmeTLSConfig(manager)
+	return nil
 }
 
-func (a App) makeHttpServer(q *queue.Queue[entities.Message]) *http_server.HttpServer {
-	communities := make(map[string]*http_server.Community)
-	for _, community := range a.cfg.Communities {
-		communities[community.HookId] = &http_server.Community{
-			SecretKey:          community.SecretKey,
-			ConfirmationString: community.ConfirmationString,
+// setupStorage opens the database. It is closed after all the services stopped.
+func (a *App) setupStorage() error {
+	s, err := storage.Open(context.Background(), a.cfg.DatabasePath)
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	a.storage = s
+	closer.Bind(func() {
+		if err := s.Close(); err != nil {
+			slog.Error(fmt.Sprintf("error closing database: %+v", err))
 		}
+	})
+	return nil
+}
+
+// setupCommunities loads the communities. They are only persisted if the admin API is enabled,
+// otherwise the config file is the only source of them.
+func (a *App) setupCommunities() error {
+	var store communities.Store
+	if len(a.cfg.AdminAuthTokens) > 0 {
+		store = a.storage
+	}
+	a.communities = communities.New(store, a.cfg.CheckCommunity, slog.Default())
+	return a.communities.Load(context.Background(), a.cfg.Communities)
+}
+
+// setupMutes loads the chats muted with bot commands, which are only kept in memory without the database
+func (a *App) setupMutes() error {
+	var store mutes.Store
+	if a.storage != nil {
+		store = a.storage
+	}
+	a.mutes = mutes.New(store)
+	return a.mutes.Load(context.Background())
+}
+
+// setupTracker loads the open conversations, which are only kept in memory without the database
+func (a *App) setupTracker() error {
+	var store conversations.Store
+	if a.storage != nil {
+		store = a.storage
+	}
+	a.tracker = conversations.New(store, slog.Default())
+	return a.tracker.Load(context.Background())
+}
+
+// setupSinks creates the sinks besides Telegram, the config is validated on load
+func (a *App) setupSinks() error {
+	a.sinks = make(map[string]sinks.Sink, len(a.cfg.Sinks))
+	for _, sinkConfig := range a.cfg.Sinks {
+		switch sinkConfig.Type {
+		case config.SinkDiscord:
+			sink, err := discord.New(
+				sinkConfig.Name,
+				sinkConfig.Discord.WebhookUrl,
+				sinkConfig.Discord.Username,
+				slog.Default(),
+			)
+			if err != nil {
+				return fmt.Errorf("sink %s: %w", sinkConfig.Name, err)
+			}
+			a.sinks[sinkConfig.Name] = sink
+		case config.SinkMatrix:
+			a.sinks[sinkConfig.Name] = matrix.New(
+				sinkConfig.Name,
+				sinkConfig.Matrix.HomeserverUrl,
+				sinkConfig.Matrix.AccessToken,
+				sinkConfig.Matrix.RoomId,
+				slog.Default(),
+			)
+		case config.SinkSlack:
+			a.sinks[sinkConfig.Name] = slack.New(sinkConfig.Name, sinkConfig.Slack.WebhookUrl, slog.Default())
+		case config.SinkMattermost:
+			a.sinks[sinkConfig.Name] = mattermost.New(
+				sinkConfig.Name,
+				sinkConfig.Mattermost.WebhookUrl,
+				sinkConfig.Mattermost.Username,
+				sinkConfig.Mattermost.Channel,
+				slog.Default(),
+			)
+		case config.SinkWebhook:
+			webhookConfig := sinkConfig.Webhook
+			retry := sinks.Retry{
+				Retries:        *webhookConfig.Retries,
+				InitialBackoff: webhookConfig.InitialBackoff,
+				MaxBackoff:     webhookConfig.MaxBackoff,
+			}
+			a.sinks[sinkConfig.Name] = webhook.New(
+				sinkConfig.Name,
+				webhookConfig.Url,
+				webhookConfig.Secret,
+				webhookConfig.Timeout,
+				retry,
+				slog.Default(),
+			)
+		case config.SinkEmail:
+			emailConfig := sinkConfig.Email
+			sink, err := email.New(sinkConfig.Name, email.Settings{
+				Host:     emailConfig.Host,
+				Port:     emailConfig.Port,
+				Security: emailConfig.Security,
+				Username: emailConfig.Username,
+				Password: emailConfig.Password,
+				From:     emailConfig.From,
+				To:       emailConfig.To,
+			}, slog.Default())
+			if err != nil {
+				return fmt.Errorf("sink %s: %w", sinkConfig.Name, err)
+			}
+			a.sinks[sinkConfig.Name] = sink
+		case config.SinkFile:
+			fileConfig := sinkConfig.File
+			file, err := jsonl.NewFile(fileConfig.Path, int64(fileConfig.MaxSizeMb)<<20, fileConfig.MaxBackups, slog.Default())
+			if err != nil {
+				return fmt.Errorf("sink %s: %w", sinkConfig.Name, err)
+			}
+			// The file is closed after all the services stopped
+			closer.Bind(func() {
+				if err := file.Close(); err != nil {
+					slog.Error(fmt.Sprintf("error closing sink %s: %+v", sinkConfig.Name, err))
+				}
+			})
+			a.sinks[sinkConfig.Name] = jsonl.New(sinkConfig.Name, file, slog.Default())
+		case config.SinkStdout:
+			a.sinks[sinkConfig.Name] = jsonl.New(sinkConfig.Name, os.Stdout, slog.Default())
+		}
+	}
+	return nil
+}
+
+// setupTracing configures trace export. Spans are flushed after all the services stopped.
+func (a App) setupTracing() {
+	shutdown, err := tracing.Setup(
+		context.Background(),
+		a.cfg.Tracing.Endpoint,
+		a.cfg.Tracing.Insecure,
+		a.cfg.Tracing.SampleRatio,
+	)
+	if err != nil {
+		slog.Error(fmt.Sprintf("error setting up tracing, continuing without it: %+v", err))
+		return
+	}
+	closer.Bind(func() {
+		if err := shutdown(context.Background()); err != nil {
+			slog.Error(fmt.Sprintf("error flushing traces: %+v", err))
+		}
+	})
+}
+
+func (a App) makeSupervisor() *supervisor.Supervisor {
+	// callback_handler --> pipeline
+	q := queue.NewBoundedQueue[entities.Message](
+		a.cfg.Queue.Capacity,
+		queue.OverflowPolicy(a.cfg.Queue.Overflow),
+		a.dropMessage,
+	)
+	forwarderService := a.makeForwarder()
+	p := pipeline.New(q, messageKey, a.cfg.Queue.Capacity, a.cfg.DrainTimeout, slog.Default())
+	p.Add("VkUsersGetter", vk_users_getter.New(a.cfg.VkApiToken, slog.Default()), a.cfg.Workers.VkUsersGetter)
+	if a.tracker != nil {
+		// Conversations are tracked before forwarding, so that replies close them even if the chat is muted
+		p.Add("ConversationTracker", a.tracker, 1)
+	}
+	forwarderStage := p.Add("Forwarder", forwarderService, a.cfg.Workers.Forwarder)
+
+	healthRegistry := health.NewRegistry()
+	httpServer := a.makeHttpServer(q, forwarderStage.In(), healthRegistry)
+	healthRegistry.Add("HttpServer", httpServer.Ready)
+	for _, stage := range p.Stages() {
+		healthRegistry.Add(stage.Name(), stage.Ready)
+		healthRegistry.Add("queue:"+stage.Name(), func() error { return stage.Stalled(queueStallThreshold) })
+	}
+	// Messages to rate limited chats and to the sinks wait in the lanes of the forwarder after leaving its queue
+	metrics.RegisterQueueDepth("ForwarderLanes", forwarderService.LaneDepth)
+	healthRegistry.Add("queue:ForwarderLanes", func() error { return forwarderService.LanesStalled(queueStallThreshold) })
+
+	a.communities.Subscribe(httpServerCommunities{httpServer})
+	a.communities.Subscribe(forwarderCommunities{forwarderService, a.cfg.InlineButtons})
+	var tgBot *tg_bot.TgBot
+	if a.cfg.BotCommands || a.cfg.InlineButtons {
+		tgBot = a.makeTgBot(forwarderService)
+		healthRegistry.Add("TgBot", tgBot.Ready)
+		a.communities.Subscribe(tgBotCommunities{tgBot})
+	}
+	var reminderService *reminder.Reminder
+	if a.tracker != nil {
+		reminderService = a.makeReminder()
+		healthRegistry.Add("Reminder", reminderService.Ready)
+		a.communities.Subscribe(reminderCommunities{reminderService})
+	}
+
+	sv := supervisor.New(slog.Default())
+	// Services are stopped in the order they are added so that each of them can drain its queue
+	sv.Add("HttpServer", httpServer, httpServerPolicy)
+	for _, stage := range p.Stages() {
+		sv.Add(stage.Name(), stage, supervisor.DefaultPolicy)
+	}
+	if tgBot != nil {
+		sv.Add("TgBot", tgBot, supervisor.DefaultPolicy)
+	}
+	if reminderService != nil {
+		sv.Add("Reminder", reminderService, supervisor.DefaultPolicy)
+	}
+	if a.acmeManager != nil && a.cfg.Tls.Acme.HttpChallengeAddress != "" {
+		sv.Add(
+			"ChallengeServer",
+			certs.NewChallengeServer(a.cfg.Tls.Acme.HttpChallengeAddress, a.acmeManager, slog.Default()),
+			httpServerPolicy,
+		)
+	}
+	return sv
+}
+
+// messageKey makes the pipeline process messages of the same VK conversation in order
+func messageKey(message entities.Message) string {
+	return message.ConversationKey()
+}
+
+// dropMessage handles a message dropped from the full queue, which is kept as a dead letter if enabled
+func (a App) dropMessage(message entities.Message) {
+	ctx := message.Context(context.Background())
+	slog.ErrorContext(ctx, "message dropped from the full queue", "message", message)
+	metrics.MessagesFailed.WithLabelValues(message.HookId, metrics.FailureReasonQueueOverflow).Inc()
+	if !a.cfg.DeadLetters {
+		return
+	}
+	if err := a.storage.AddDeadLetter(ctx, message, metrics.FailureReasonQueueOverflow, "dropped from the full queue"); err != nil {
+		slog.ErrorContext(ctx, "error storing dead letter", "err", err)
+	}
+}
+
+// makeHttpServer creates HttpServer putting messages to q. Dead letters are replayed via forwarderQueue.
+func (a App) makeHttpServer(
+	q *queue.Queue[entities.Message],
+	forwarderQueue *queue.Queue[entities.Message],
+	healthRegistry *health.Registry,
+) *http_server.HttpServer {
+	communities := make(map[string]*http_server.Community)
+	for _, community := range a.communities.Enabled() {
+		communities[community.HookId] = httpServerCommunity(community)
+	}
+	admin := http_server.Admin{AuthTokens: a.cfg.AdminAuthTokens, Communities: a.communities}
+	if a.cfg.ArchiveMessages {
+		admin.Messages = a.storage
+	}
+	if a.cfg.DeadLetters {
+		admin.DeadLetters = deadLetterQueue{Storage: a.storage, q: forwarderQueue}
 	}
 	return http_server.New(
 		a.params.Host,
 		a.params.Port,
-		a.cfg.MetricsAuthToken,
+		a.cfg.AllMetricsAuthTokens(),
 		communities,
+		admin,
 		q,
+		a.cfg.DrainTimeout,
+		a.makeCallbackProtection(),
+		a.tlsConfig,
+		healthRegistry,
 		slog.Default(),
 	)
 }
 
-func (a App) makeForwarder(q *queue.Queue[entities.Message]) *forwarder.Forwarder {
+func (a App) makeCallbackProtection() http_server.CallbackProtection {
+	cfg := a.cfg.Callback
+	protection := http_server.CallbackProtection{MaxBodySize: cfg.MaxBodySize}
+	if cfg.IpRateLimit != nil {
+		protection.IpLimiter = ratelimit.New(cfg.IpRateLimit.Rate, cfg.IpRateLimit.Burst)
+	}
+	if cfg.HookRateLimit != nil {
+		protection.HookLimiter = ratelimit.New(cfg.HookRateLimit.Rate, cfg.HookRateLimit.Burst)
+	}
+	// CIDRs are validated on config load
+	for _, cidr := range cfg.AllowedCidrs {
+		protection.AllowedNets = append(protection.AllowedNets, netip.MustParsePrefix(cidr))
+	}
+	for _, cidr := range cfg.TrustedProxies {
+		protection.TrustedProxies = append(protection.TrustedProxies, netip.MustParsePrefix(cidr))
+	}
+	return protection
+}
+
+func (a App) makeForwarder() *forwarder.Forwarder {
 	communities := make(map[string]*forwarder.Community)
-	for _, community := range a.cfg.Communities {
-		communities[community.HookId] = &forwarder.Community{TgChatId: community.TgChatId}
+	for _, community := range a.communities.Enabled() {
+		communities[community.HookId] = forwarderCommunity(community, a.cfg.InlineButtons)
+	}
+	var archive forwarder.Archive
+	if a.cfg.ArchiveMessages {
+		archive = a.storage
+	}
+	var deadLetters forwarder.DeadLetters
+	if a.cfg.DeadLetters {
+		deadLetters = a.storage
+	}
+	var chatMutes forwarder.Mutes
+	if a.mutes != nil {
+		chatMutes = a.mutes
+	}
+	var heldMessages forwarder.HeldMessages
+	if a.storage != nil {
+		heldMessages = a.storage
+	}
+	limits := forwarder.SendLimits{Global: a.cfg.Telegram.GlobalRateLimit, PerChat: a.cfg.Telegram.ChatRateLimit}
+	laneLimits := forwarder.LaneLimits{Capacity: a.cfg.Queue.Capacity, Overflow: queue.OverflowPolicy(a.cfg.Queue.Overflow)}
+	return forwarder.New(
+		a.cfg.TgBotToken,
+		communities,
+		a.sinks,
+		archive,
+		deadLetters,
+		chatMutes,
+		heldMessages,
+		limits,
+		laneLimits,
+		slog.Default(),
+	)
+}
+
+// makeTgBot creates TgBot reporting the activity of forwarderService, mutes are only set with bot commands
+func (a App) makeTgBot(forwarderService *forwarder.Forwarder) *tg_bot.TgBot {
+	communities := make(map[string]*tg_bot.Community)
+	for _, community := range a.communities.Enabled() {
+		communities[community.HookId] = tgBotCommunity(community)
+	}
+	var chatMutes tg_bot.Mutes
+	if a.mutes != nil {
+		chatMutes = a.mutes
+	}
+	return tg_bot.New(
+		a.cfg.TgBotToken,
+		a.cfg.BotCommands,
+		a.cfg.DeadLetters,
+		communities,
+		forwarderService,
+		chatMutes,
+		slog.Default(),
+	)
+}
+
+// makeReminder creates Reminder posting about the conversations open in the tracker
+func (a App) makeReminder() *reminder.Reminder {
+	communities := make(map[string]*reminder.Community)
+	for _, community := range a.communities.Enabled() {
+		communities[community.HookId] = reminderCommunity(community)
+	}
+	var chatMutes reminder.Mutes
+	if a.mutes != nil {
+		chatMutes = a.mutes
+	}
+	cfg := a.cfg.AnswerTracking
+	settings := reminder.Settings{
+		ReminderAfter:     cfg.ReminderAfter,
+		EscalateAfter:     cfg.EscalateAfter,
+		EscalationChatId:  cfg.EscalationChatId,
+		EscalationMention: cfg.EscalationMention,
 	}
-	return forwarder.New(a.cfg.TgBotToken, communities, q, slog.Default())
+	return reminder.New(a.cfg.TgBotToken, communities, a.tracker, chatMutes, settings, slog.Default())
 }
 
 // setupContextAndWg returns a context cancelled on app shutdown request and a wait group awaited on shutdown.
 //
 //	All non-nil errors received from errorCh after an app shutdown request will be logged as "App shutdown errors".
 //	If an error is received from errorCh before an app shutdown request, closer.Close will be called.
+//	Errors from failing services are handled by the supervisor, so only permanent failures end up here.
 func setupContextAndWg(parentCtx context.Context, errorCh chan error) (ctx context.Context, wg *sync.WaitGroup) {
 	wg = &sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(parentCtx)
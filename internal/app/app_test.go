@@ -0,0 +1,175 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/config"
+	"viktig/internal/entities"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/go-vk-api/vk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+const testMessagesCount = 5
+
+func TestGracefulShutdown(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		a, _ := setup(t, time.Second)
+		sent := patchServices(t, 20*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- a.makeSupervisor().Run(ctx) }()
+
+		sendMessages(t, a)
+		cancel()
+
+		assert.NoError(t, <-errCh)
+		assert.Len(t, sent(), testMessagesCount)
+		assert.ElementsMatch(t, []string{"0", "1", "2", "3", "4"}, sent())
+	})
+	t.Run("drain timeout", func(t *testing.T) {
+		a, buf := setup(t, 10*time.Millisecond)
+		sent := patchServices(t, 50*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- a.makeSupervisor().Run(ctx) }()
+
+		sendMessages(t, a)
+		cancel()
+
+		assert.NoError(t, <-errCh)
+		lost := strings.Count(buf.String(), "message lost on shutdown")
+		assert.Greater(t, lost, 0)
+		assert.Equal(t, testMessagesCount, len(sent())+lost)
+	})
+}
+
+func setup(t *testing.T, drainTimeout time.Duration) (*App, *bytes.Buffer) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	buf := &bytes.Buffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&syncWriter{w: buf}, &slog.HandlerOptions{})))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	a := &App{
+		params: &Params{Host: "127.0.0.1", Port: port},
+		cfg: &config.Config{
+			TgBotToken: "token",
+			VkApiToken: "token",
+			Communities: []*config.CommunityConfig{{
+				HookId:             "test-hook",
+				SecretKey:          "secret",
+				ConfirmationString: "confirmation",
+				TgChatId:           1234,
+			}},
+			DrainTimeout: drainTimeout,
+		},
+	}
+	require.NoError(t, a.setupCommunities())
+	return a, buf
+}
+
+// patchServices replaces VK and Telegram API calls with fakes. Returns a function listing the texts of sent messages.
+func patchServices(t *testing.T, sendDelay time.Duration) func() []string {
+	t.Helper()
+	mu := sync.Mutex{}
+	var sent []string
+
+	fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+	p := gomonkey.
+		ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+			return fakeBot, nil
+		}).
+		ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, what interface{}, _ ...interface{}) (*tele.Message, error) {
+			time.Sleep(sendDelay)
+			mu.Lock()
+			defer mu.Unlock()
+			text := what.(string)
+			sent = append(sent, text[strings.LastIndex(text, " ")+1:])
+			return &tele.Message{ID: len(sent), Chat: &tele.Chat{ID: 1234}}, nil
+		}).
+		ApplyMethod(
+			reflect.TypeOf(&vk.Client{}),
+			"CallMethod",
+			func(_ *vk.Client, _ string, _ vk.RequestParams, response interface{}) error {
+				if users, ok := response.(*[]*entities.VkUser); ok {
+					*users = []*entities.VkUser{{FirstName: "John", LastName: "Doe"}}
+				}
+				return nil
+			},
+		)
+	t.Cleanup(p.Reset)
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, sent...)
+	}
+}
+
+// sendMessages sends VK events concurrently and waits for all of them to be acknowledged.
+func sendMessages(t *testing.T, a *App) {
+	t.Helper()
+	waitForServer(t, a)
+	wg := sync.WaitGroup{}
+	for i := range testMessagesCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(
+				`{"type":"message_new","secret":"secret","object":{"message":{"from_id":1,"text":"%d"}}}`, i,
+			)
+			resp, err := http.Post(callbackUrl(a), "application/json", strings.NewReader(body))
+			if assert.NoError(t, err) {
+				_ = resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func waitForServer(t *testing.T, a *App) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort(a.params.Host, strconv.Itoa(a.params.Port)))
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}, time.Second, time.Millisecond)
+}
+
+func callbackUrl(a *App) string {
+	return fmt.Sprintf("http://%s:%d/api/vk/callback/test-hook", a.params.Host, a.params.Port)
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/export"
+	"viktig/internal/storage"
+
+	"github.com/xlab/closer"
+)
+
+var (
+	errNoDatabase          = errors.New("database_path is not set in the config")
+	errDeadLettersDisabled = errors.New("dead_letters is not enabled in the config")
+)
+
+type ExportParams struct {
+	Enable   bool
+	Format   string `names:"--format" usage:"output format" default:"jsonl" selects:"jsonl,csv"`
+	Output   string `names:"-o, --output" usage:"output file path, stdout if not set"`
+	HookId   string `names:"--hook-id" usage:"only export messages of this community"`
+	SenderId int    `names:"--sender-id" usage:"only export messages of this VK sender"`
+	From     string `names:"--from" usage:"only export messages received since this date or RFC 3339 time"`
+	To       string `names:"--to" usage:"only export messages received before this date or RFC 3339 time"`
+	Query    string `names:"-q, --query" usage:"only export messages containing all these words"`
+}
+
+type DlqParams struct {
+	Enable bool
+	List   struct {
+		Enable bool
+	} `usage:"list dead letters"`
+	Replay struct {
+		Enable bool
+		Ids    []int64 `names:"--id" usage:"dead letter ID, may be repeated"`
+		All    bool    `names:"--all" usage:"replay all dead letters"`
+	} `usage:"forward dead letters again, the forwarded ones are removed"`
+	Purge struct {
+		Enable bool
+	} `usage:"remove all dead letters"`
+}
+
+// isCommand reports whether a command was requested instead of running the services
+func (p *Params) isCommand() bool {
+	return p.Export.Enable || p.Dlq.Enable
+}
+
+// runCommand runs the requested command and exits
+func (a App) runCommand() {
+	var err error
+	ctx := context.Background()
+	switch {
+	case a.params.Export.Enable:
+		err = a.export(ctx, a.params.Export)
+	case a.params.Dlq.List.Enable:
+		err = a.listDlq(ctx, os.Stdout)
+	case a.params.Dlq.Replay.Enable:
+		err = a.replayDlq(ctx, a.params.Dlq.Replay.Ids, a.params.Dlq.Replay.All)
+	case a.params.Dlq.Purge.Enable:
+		err = a.purgeDlq(ctx)
+	default:
+		err = errors.New("no command specified, see --help")
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("command error: %+v", err))
+		closer.Exit(closer.ExitCodeErr)
+	}
+	closer.Exit(closer.ExitCodeOK)
+}
+
+func (a App) export(ctx context.Context, params ExportParams) (err error) {
+	if a.storage == nil {
+		return errNoDatabase
+	}
+	filter := storage.MessageFilter{HookId: params.HookId, VkSenderId: params.SenderId, Query: params.Query}
+	if params.From != "" {
+		if filter.From, err = export.ParseTime(params.From); err != nil {
+			return fmt.Errorf("invalid --from: %w", err)
+		}
+	}
+	if params.To != "" {
+		if filter.To, err = export.ParseTime(params.To); err != nil {
+			return fmt.Errorf("invalid --to: %w", err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if params.Output != "" {
+		f, err := os.Create(params.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = f
+	}
+	count, err := export.Write(ctx, w, params.Format, a.storage, filter)
+	if err != nil {
+		return fmt.Errorf("error exporting messages: %w", err)
+	}
+	slog.Info("exported messages", "count", count)
+	return nil
+}
+
+func (a App) listDlq(ctx context.Context, out io.Writer) error {
+	if a.storage == nil {
+		return errNoDatabase
+	}
+	if !a.cfg.DeadLetters {
+		return errDeadLettersDisabled
+	}
+	letters, err := listDeadLetters(ctx, a.storage, nil)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ID\tHOOK ID\tREASON\tATTEMPTS\tLAST FAILED AT\tERROR")
+	for _, letter := range letters {
+		_, _ = fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%d\t%s\t%s\n",
+			letter.Id,
+			letter.HookId,
+			letter.Reason,
+			letter.Attempts,
+			letter.LastFailedAt.Format(time.RFC3339),
+			letter.Error,
+		)
+	}
+	return w.Flush()
+}
+
+// replayDlq forwards the dead letters with a bot of its own, so it does not require the services to be running
+func (a App) replayDlq(ctx context.Context, ids []int64, all bool) error {
+	if a.storage == nil {
+		return errNoDatabase
+	}
+	if !a.cfg.DeadLetters {
+		return errDeadLettersDisabled
+	}
+	if all == (len(ids) > 0) {
+		return errors.New("either --id or --all must be set")
+	}
+	letters, err := listDeadLetters(ctx, a.storage, ids)
+	if err != nil {
+		return err
+	}
+	if err = a.setupCommunities(); err != nil {
+		return err
+	}
+	if err = a.setupSinks(); err != nil {
+		return err
+	}
+	messages := make([]entities.Message, 0, len(letters))
+	for _, letter := range letters {
+		messages = append(messages, letter.Message)
+	}
+	forwarded, err := a.makeForwarder().ForwardOnce(ctx, messages)
+	if err != nil {
+		return err
+	}
+	slog.Info("replayed dead letters", "forwarded", forwarded, "failed", len(messages)-forwarded)
+	return nil
+}
+
+func (a App) purgeDlq(ctx context.Context) error {
+	if a.storage == nil {
+		return errNoDatabase
+	}
+	if !a.cfg.DeadLetters {
+		return errDeadLettersDisabled
+	}
+	purged, err := a.storage.PurgeDeadLetters(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("purged dead letters", "count", purged)
+	return nil
+}
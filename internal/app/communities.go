@@ -0,0 +1,98 @@
+package app
+
+import (
+	"viktig/internal/buttons"
+	"viktig/internal/config"
+	"viktig/internal/services/forwarder"
+	"viktig/internal/services/http_server"
+	"viktig/internal/services/reminder"
+	"viktig/internal/services/tg_bot"
+)
+
+// httpServerCommunities applies community changes to HttpServer
+type httpServerCommunities struct {
+	s *http_server.HttpServer
+}
+
+func (c httpServerCommunities) SetCommunity(community *config.CommunityConfig) {
+	c.s.SetCommunity(community.HookId, httpServerCommunity(community))
+}
+
+func (c httpServerCommunities) RemoveCommunity(hookId string) {
+	c.s.RemoveCommunity(hookId)
+}
+
+// forwarderCommunities applies community changes to Forwarder
+type forwarderCommunities struct {
+	f         *forwarder.Forwarder
+	callbacks bool
+}
+
+func (c forwarderCommunities) SetCommunity(community *config.CommunityConfig) {
+	c.f.SetCommunity(community.HookId, forwarderCommunity(community, c.callbacks))
+}
+
+func (c forwarderCommunities) RemoveCommunity(hookId string) {
+	c.f.RemoveCommunity(hookId)
+}
+
+// tgBotCommunities applies community changes to TgBot
+type tgBotCommunities struct {
+	b *tg_bot.TgBot
+}
+
+func (c tgBotCommunities) SetCommunity(community *config.CommunityConfig) {
+	c.b.SetCommunity(community.HookId, tgBotCommunity(community))
+}
+
+func (c tgBotCommunities) RemoveCommunity(hookId string) {
+	c.b.RemoveCommunity(hookId)
+}
+
+// reminderCommunities applies community changes to Reminder
+type reminderCommunities struct {
+	r *reminder.Reminder
+}
+
+func (c reminderCommunities) SetCommunity(community *config.CommunityConfig) {
+	c.r.SetCommunity(community.HookId, reminderCommunity(community))
+}
+
+func (c reminderCommunities) RemoveCommunity(hookId string) {
+	c.r.RemoveCommunity(hookId)
+}
+
+func httpServerCommunity(community *config.CommunityConfig) *http_server.Community {
+	return &http_server.Community{
+		SecretKeys:         community.AllSecretKeys(),
+		ConfirmationString: community.ConfirmationString,
+	}
+}
+
+// forwarderCommunity adds the callback buttons if callbacks are handled by TgBot
+func forwarderCommunity(community *config.CommunityConfig, callbacks bool) *forwarder.Community {
+	forwarderCommunity := &forwarder.Community{
+		TgChatId: community.TgChatId,
+		Sinks:    community.Sinks,
+		Buttons:  buttons.Options{Callbacks: callbacks, VkActions: community.VkToken != ""},
+	}
+	if community.QuietHours != nil {
+		forwarderCommunity.QuietHours = community.QuietHours.Schedule()
+		forwarderCommunity.HoldQuiet = community.QuietHours.Hold
+	}
+	if community.Mode == config.ModeDigest {
+		forwarderCommunity.Digest = &forwarder.DigestSettings{
+			Interval:    community.DigestInterval(),
+			MaxMessages: community.DigestMaxMessages(),
+		}
+	}
+	return forwarderCommunity
+}
+
+func tgBotCommunity(community *config.CommunityConfig) *tg_bot.Community {
+	return &tg_bot.Community{TgChatId: community.TgChatId, VkToken: community.VkToken}
+}
+
+func reminderCommunity(community *config.CommunityConfig) *reminder.Community {
+	return &reminder.Community{TgChatId: community.TgChatId}
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"context"
+	"viktig/internal/entities"
+	"viktig/internal/queue"
+	"viktig/internal/storage"
+)
+
+// deadLetterQueue replays dead letters through the running Forwarder
+type deadLetterQueue struct {
+	*storage.Storage
+	q *queue.Queue[entities.Message]
+}
+
+func (d deadLetterQueue) ReplayDeadLetters(ctx context.Context, ids []int64) (int, error) {
+	letters, err := listDeadLetters(ctx, d.Storage, ids)
+	if err != nil {
+		return 0, err
+	}
+	for i, letter := range letters {
+		if !d.q.PutCtx(ctx, letter.Message) {
+			return i, ctx.Err()
+		}
+	}
+	return len(letters), nil
+}
+
+// listDeadLetters returns the dead letters with ids, all of them if ids are empty
+func listDeadLetters(ctx context.Context, s *storage.Storage, ids []int64) ([]*storage.DeadLetter, error) {
+	var letters []*storage.DeadLetter
+	filter := storage.DeadLetterFilter{Ids: ids}
+	for {
+		page, err := s.ListDeadLetters(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, page...)
+		if len(page) == 0 {
+			return letters, nil
+		}
+		filter.AfterId = page[len(page)-1].Id
+	}
+}
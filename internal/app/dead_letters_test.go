@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"viktig/internal/config"
+	"viktig/internal/entities"
+	"viktig/internal/queue"
+	"viktig/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	ctx := context.Background()
+	s, err := storage.Open(ctx, filepath.Join(t.TempDir(), "viktig.db"))
+	require.NoError(t, err)
+	defer s.Close()
+	for _, text := range []string{"a", "b", "c"} {
+		require.NoError(t, s.AddDeadLetter(ctx, entities.Message{HookId: "test-hook", Text: text}, "telegram_error", "error"))
+	}
+	q := queue.NewQueue[entities.Message]()
+	taken := make(chan entities.Message, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			taken <- q.Take()
+		}
+	}()
+
+	queued, err := deadLetterQueue{Storage: s, q: q}.ReplayDeadLetters(ctx, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, queued)
+	for i, text := range []string{"a", "b", "c"} {
+		message := <-taken
+		assert.Equal(t, text, message.Text)
+		assert.Equal(t, int64(i+1), message.DeadLetterId)
+	}
+}
+
+func TestPurgeDlq(t *testing.T) {
+	ctx := context.Background()
+	s, err := storage.Open(ctx, filepath.Join(t.TempDir(), "viktig.db"))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.AddDeadLetter(ctx, entities.Message{HookId: "test-hook", Text: "a"}, "telegram_error", "error"))
+
+	a := App{cfg: &config.Config{}, storage: s}
+	assert.ErrorIs(t, a.purgeDlq(ctx), errDeadLettersDisabled)
+	letters, err := s.ListDeadLetters(ctx, storage.DeadLetterFilter{})
+	require.NoError(t, err)
+	assert.Len(t, letters, 1)
+
+	a.cfg.DeadLetters = true
+	require.NoError(t, a.purgeDlq(ctx))
+	letters, err = s.ListDeadLetters(ctx, storage.DeadLetterFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
@@ -0,0 +1,128 @@
+package buttons
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"viktig/internal/entities"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Unique names of the callback buttons
+const (
+	UniqueRead     = "read"
+	UniqueAnswered = "answered"
+	UniqueBlock    = "block"
+)
+
+// maxDataLength is the Telegram limit of the callback data, including the unique name added by telebot
+const maxDataLength = 64
+
+var ErrInvalidData = errors.New("invalid callback data")
+
+// Options select the buttons added to the forwarded messages
+type Options struct {
+	// Callbacks enables the buttons handled by the bot
+	Callbacks bool
+	// VkActions enables the buttons calling the VK API, which requires a community token
+	VkActions bool
+}
+
+// Data identifies the VK object a callback button acts on
+type Data struct {
+	HookId    string
+	VkGroupId int
+	// VkId is the peer to mark as read or the user to block
+	VkId int
+}
+
+// String encodes the data with the hook ID last, so that it may contain the separator
+func (d Data) String() string {
+	return fmt.Sprintf("%d|%d|%s", d.VkGroupId, d.VkId, d.HookId)
+}
+
+func ParseData(s string) (Data, error) {
+	parts := strings.SplitN(s, "|", 3)
+	if len(parts) != 3 {
+		return Data{}, ErrInvalidData
+	}
+	groupId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Data{}, ErrInvalidData
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Data{}, ErrInvalidData
+	}
+	return Data{HookId: parts[2], VkGroupId: groupId, VkId: id}, nil
+}
+
+// Keyboard returns the inline keyboard of the forwarded message or nil if it has no buttons.
+// Callback buttons are only added to messages from users.
+func Keyboard(message entities.Message, options Options) *tele.ReplyMarkup {
+	var row []tele.InlineButton
+	if dialogUrl := message.DialogUrl(); dialogUrl != "" {
+		row = append(row, tele.InlineButton{Text: "Open dialog", URL: dialogUrl})
+	}
+	if options.Callbacks && message.IsFromUser() {
+		if options.VkActions && message.VkGroupId != 0 {
+			read := Data{HookId: message.HookId, VkGroupId: message.VkGroupId, VkId: message.VkPeerId}
+			block := Data{HookId: message.HookId, VkGroupId: message.VkGroupId, VkId: message.VkSenderId}
+			if message.VkPeerId != 0 && fits(UniqueRead, read) {
+				row = append(row, tele.InlineButton{Unique: UniqueRead, Text: "Mark as read", Data: read.String()})
+			}
+			if fits(UniqueBlock, block) {
+				row = append(row, tele.InlineButton{Unique: UniqueBlock, Text: "Block sender", Data: block.String()})
+			}
+		}
+		row = append(row, tele.InlineButton{Unique: UniqueAnswered, Text: "Mark as answered"})
+	}
+	if len(row) == 0 {
+		return nil
+	}
+	return &tele.ReplyMarkup{InlineKeyboard: [][]tele.InlineButton{row}}
+}
+
+// Without returns the keyboard without the callback button with the given unique name
+func Without(markup *tele.ReplyMarkup, unique string) *tele.ReplyMarkup {
+	result := &tele.ReplyMarkup{}
+	if markup == nil {
+		return result
+	}
+	for _, row := range markup.InlineKeyboard {
+		var kept []tele.InlineButton
+		for _, button := range row {
+			if button.Unique != unique && !strings.HasPrefix(button.Data, "\f"+unique+"|") && button.Data != "\f"+unique {
+				kept = append(kept, button)
+			}
+		}
+		if len(kept) > 0 {
+			result.InlineKeyboard = append(result.InlineKeyboard, kept)
+		}
+	}
+	return result
+}
+
+// Has reports whether the keyboard has the callback button with the given unique name and data.
+// Unlike the data of a callback query, which a client may forge, the keyboard of the message comes from Telegram.
+func Has(markup *tele.ReplyMarkup, unique string, data string) bool {
+	if markup == nil {
+		return false
+	}
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if button.Unique == unique && button.Data == data || button.Data == "\f"+unique+"|"+data {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fits reports whether the callback data is within the Telegram limit, which long hook IDs may exceed
+func fits(unique string, data Data) bool {
+	return len("\f"+unique+"|"+data.String()) <= maxDataLength
+}
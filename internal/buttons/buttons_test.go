@@ -0,0 +1,99 @@
+package buttons
+
+import (
+	"strings"
+	"testing"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestKeyboard(t *testing.T) {
+	message := entities.Message{HookId: "test-hook", VkGroupId: 10, VkPeerId: 1234, VkSenderId: 1234}
+
+	t.Run("all buttons", func(t *testing.T) {
+		markup := Keyboard(message, Options{Callbacks: true, VkActions: true})
+
+		require.Len(t, markup.InlineKeyboard, 1)
+		row := markup.InlineKeyboard[0]
+		require.Len(t, row, 4)
+		assert.Equal(t, "https://vk.com/gim10?sel=1234", row[0].URL)
+		assert.Equal(t, tele.InlineButton{Unique: UniqueRead, Text: "Mark as read", Data: "10|1234|test-hook"}, row[1])
+		assert.Equal(t, tele.InlineButton{Unique: UniqueBlock, Text: "Block sender", Data: "10|1234|test-hook"}, row[2])
+		assert.Equal(t, UniqueAnswered, row[3].Unique)
+	})
+	t.Run("without VK actions", func(t *testing.T) {
+		markup := Keyboard(message, Options{Callbacks: true})
+
+		require.Len(t, markup.InlineKeyboard[0], 2)
+		assert.Equal(t, UniqueAnswered, markup.InlineKeyboard[0][1].Unique)
+	})
+	t.Run("link only", func(t *testing.T) {
+		markup := Keyboard(message, Options{})
+
+		require.Len(t, markup.InlineKeyboard[0], 1)
+		assert.NotEmpty(t, markup.InlineKeyboard[0][0].URL)
+	})
+	t.Run("community reply", func(t *testing.T) {
+		reply := message
+		reply.VkSenderId = -10
+
+		markup := Keyboard(reply, Options{Callbacks: true, VkActions: true})
+
+		require.Len(t, markup.InlineKeyboard[0], 1)
+	})
+	t.Run("no buttons", func(t *testing.T) {
+		assert.Nil(t, Keyboard(entities.Message{VkSenderId: -10}, Options{Callbacks: true}))
+	})
+	t.Run("long hook ID", func(t *testing.T) {
+		long := message
+		long.HookId = strings.Repeat("a", 55)
+
+		markup := Keyboard(long, Options{Callbacks: true, VkActions: true})
+
+		require.Len(t, markup.InlineKeyboard[0], 2)
+		assert.Equal(t, UniqueAnswered, markup.InlineKeyboard[0][1].Unique)
+	})
+}
+
+func TestData(t *testing.T) {
+	data := Data{HookId: "hook|with|separators", VkGroupId: 10, VkId: 1234}
+
+	parsed, err := ParseData(data.String())
+
+	require.NoError(t, err)
+	assert.Equal(t, data, parsed)
+	for _, invalid := range []string{"", "10|1234", "x|1234|hook", "10|x|hook"} {
+		_, err = ParseData(invalid)
+		assert.ErrorIs(t, err, ErrInvalidData)
+	}
+}
+
+func TestWithout(t *testing.T) {
+	markup := &tele.ReplyMarkup{InlineKeyboard: [][]tele.InlineButton{{
+		{Text: "Open dialog", URL: "https://vk.com/gim10?sel=1234"},
+		{Text: "Mark as read", Data: "\fread|10|1234|test-hook"},
+		{Text: "Mark as answered", Data: "\fanswered"},
+	}}}
+
+	actual := Without(markup, UniqueAnswered)
+
+	require.Len(t, actual.InlineKeyboard, 1)
+	assert.Equal(t, markup.InlineKeyboard[0][:2], actual.InlineKeyboard[0])
+	assert.Empty(t, Without(nil, UniqueAnswered).InlineKeyboard)
+}
+
+func TestHas(t *testing.T) {
+	markup := &tele.ReplyMarkup{InlineKeyboard: [][]tele.InlineButton{{
+		{Text: "Mark as read", Data: "\fread|10|1234|test-hook"},
+		{Unique: UniqueBlock, Text: "Block sender", Data: "10|1234|test-hook"},
+	}}}
+
+	assert.True(t, Has(markup, UniqueRead, "10|1234|test-hook"))
+	assert.True(t, Has(markup, UniqueBlock, "10|1234|test-hook"))
+	assert.False(t, Has(markup, UniqueRead, "10|5678|test-hook"))
+	assert.False(t, Has(markup, UniqueAnswered, ""))
+	assert.False(t, Has(nil, UniqueRead, "10|1234|test-hook"))
+}
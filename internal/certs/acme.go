@@ -0,0 +1,86 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewAcmeManager returns a manager obtaining certificates for domains from an ACME CA, Let's Encrypt by default.
+//
+//	directoryUrl and caFile allow using another CA, e.g. a local pebble instance for testing.
+//	Certificates are stored in cacheDir to survive restarts.
+func NewAcmeManager(domains []string, email, cacheDir, directoryUrl, caFile string) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: directoryUrl}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client:     client,
+	}, nil
+}
+
+// AcmeTLSConfig returns a config serving certificates from manager and answering ACME TLS-ALPN-01 challenges.
+// HTTP/2 is not offered since it is not supported by fasthttp.
+func AcmeTLSConfig(manager *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: manager.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// ChallengeServer answers ACME HTTP-01 challenges. Not needed if the CA can use the TLS-ALPN-01 challenge
+// on the main HTTPS port.
+type ChallengeServer struct {
+	address string
+	manager *autocert.Manager
+	l       *slog.Logger
+}
+
+func NewChallengeServer(address string, manager *autocert.Manager, l *slog.Logger) *ChallengeServer {
+	return &ChallengeServer{address: address, manager: manager, l: l.With("service", "ChallengeServer")}
+}
+
+func (s *ChallengeServer) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s.manager.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		s.l.Info("stopping acme challenge server")
+		_ = server.Close()
+	}()
+
+	s.l.Info("starting acme challenge server", "address", s.address)
+	if err = server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
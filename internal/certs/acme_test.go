@@ -0,0 +1,47 @@
+package certs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+func TestNewAcmeManager(t *testing.T) {
+	t.Run("default CA", func(t *testing.T) {
+		m, err := NewAcmeManager([]string{"example.com"}, "admin@example.com", t.TempDir(), "", "")
+		require.NoError(t, err)
+
+		assert.Equal(t, "admin@example.com", m.Email)
+		assert.NoError(t, m.HostPolicy(nil, "example.com"))
+		assert.Error(t, m.HostPolicy(nil, "other.com"))
+	})
+	t.Run("custom CA", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, _ := writeCert(t, dir, "pebble")
+
+		m, err := NewAcmeManager([]string{"localhost"}, "", dir, "https://localhost:14000/dir", certFile)
+		require.NoError(t, err)
+
+		assert.Equal(t, "https://localhost:14000/dir", m.Client.DirectoryURL)
+		assert.NotNil(t, m.Client.HTTPClient)
+	})
+	t.Run("invalid CA file", func(t *testing.T) {
+		dir := t.TempDir()
+		caFile := filepath.Join(dir, "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0o600))
+
+		_, err := NewAcmeManager([]string{"localhost"}, "", dir, "https://localhost:14000/dir", caFile)
+
+		assert.Error(t, err)
+	})
+	t.Run("tls config", func(t *testing.T) {
+		m, err := NewAcmeManager([]string{"localhost"}, "", t.TempDir(), "", "")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"http/1.1", acme.ALPNProto}, AcmeTLSConfig(m).NextProtos)
+	})
+}
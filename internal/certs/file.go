@@ -0,0 +1,90 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadCheckInterval limits how often the certificate files are checked for changes
+const reloadCheckInterval = 10 * time.Second
+
+// FileReloader serves a certificate from files and reloads it when the files change,
+// so that renewed certificates are picked up without a restart.
+type FileReloader struct {
+	certFile string
+	keyFile  string
+	l        *slog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	lastCheck time.Time
+	now       func() time.Time
+}
+
+func NewFileReloader(certFile, keyFile string, l *slog.Logger) (*FileReloader, error) {
+	r := &FileReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		l:        l.With("service", "FileReloader"),
+		now:      time.Now,
+	}
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate, MinVersion: tls.VersionTLS12}
+}
+
+func (r *FileReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := r.now(); now.Sub(r.lastCheck) >= reloadCheckInterval {
+		r.lastCheck = now
+		modTimes, err := r.readModTimes()
+		if err != nil {
+			r.l.Error("error checking certificate files, serving the loaded certificate", "err", err)
+		} else if modTimes != r.modTimes {
+			if err = r.load(modTimes); err != nil {
+				r.l.Error("error reloading certificate, serving the loaded certificate", "err", err)
+			} else {
+				r.l.Info("reloaded certificate", "certFile", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *FileReloader) load(modTimes [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *FileReloader) readModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = stat.ModTime()
+	}
+	return modTimes, nil
+}
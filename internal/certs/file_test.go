@@ -0,0 +1,107 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileReloader(t *testing.T) {
+	t.Run("load", func(t *testing.T) {
+		certFile, keyFile := writeCert(t, t.TempDir(), "first")
+
+		r, err := NewFileReloader(certFile, keyFile, slog.Default())
+		require.NoError(t, err)
+
+		assert.Equal(t, "first", commonName(t, r))
+	})
+	t.Run("missing files", func(t *testing.T) {
+		dir := t.TempDir()
+		_, err := NewFileReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), slog.Default())
+		assert.Error(t, err)
+	})
+	t.Run("reload", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeCert(t, dir, "first")
+		r, err := NewFileReloader(certFile, keyFile, slog.Default())
+		require.NoError(t, err)
+		now := time.Now()
+		r.now = func() time.Time { return now }
+		assert.Equal(t, "first", commonName(t, r))
+
+		writeCert(t, dir, "second")
+		touch(t, certFile, keyFile)
+		assert.Equal(t, "first", commonName(t, r), "files are not checked until the interval passes")
+
+		now = now.Add(reloadCheckInterval)
+		assert.Equal(t, "second", commonName(t, r))
+	})
+	t.Run("keep certificate on reload error", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeCert(t, dir, "first")
+		r, err := NewFileReloader(certFile, keyFile, slog.Default())
+		require.NoError(t, err)
+		now := time.Now()
+		r.now = func() time.Time { return now }
+
+		require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+		touch(t, certFile, keyFile)
+		now = now.Add(reloadCheckInterval)
+
+		assert.Equal(t, "first", commonName(t, r))
+	})
+}
+
+func commonName(t *testing.T, r *FileReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+// touch sets the modification time of files to the future so that changes are detected regardless of FS precision
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+	future := time.Now().Add(time.Hour)
+	for _, file := range files {
+		require.NoError(t, os.Chtimes(file, future, future))
+	}
+}
+
+// writeCert writes a self-signed certificate for localhost to dir
+func writeCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
@@ -0,0 +1,246 @@
+package communities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"viktig/internal/config"
+	"viktig/internal/storage"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var (
+	ErrNotFound = errors.New("community not found")
+	ErrExists   = errors.New("community already exists")
+	ErrInvalid  = errors.New("invalid community")
+)
+
+// Store persists communities managed at runtime
+type Store interface {
+	ListCommunities(ctx context.Context) ([]*config.CommunityConfig, error)
+	SaveCommunity(ctx context.Context, community *config.CommunityConfig) error
+	DeleteCommunity(ctx context.Context, hookId string) error
+	AppliedConfigCommunities(ctx context.Context) (map[string]*config.CommunityConfig, error)
+	ApplyConfigCommunities(ctx context.Context, communities []*config.CommunityConfig) error
+}
+
+// Check checks a community against the rest of the config, e.g. that the sinks it refers to exist
+type Check func(community *config.CommunityConfig) error
+
+// Listener applies community changes to a service
+type Listener interface {
+	// SetCommunity is called when an enabled community is added or updated
+	SetCommunity(community *config.CommunityConfig)
+	// RemoveCommunity is called when a community is deleted or disabled
+	RemoveCommunity(hookId string)
+}
+
+// Manager keeps the current communities, persists changes to the store and notifies listeners about them
+type Manager struct {
+	store       Store
+	check       Check
+	mu          sync.Mutex
+	communities map[string]*config.CommunityConfig
+	listeners   []Listener
+	l           *slog.Logger
+}
+
+// New creates a manager. Changes are only kept in memory if store is nil.
+// Created and updated communities are validated and checked with check if it is not nil.
+func New(store Store, check Check, l *slog.Logger) *Manager {
+	return &Manager{
+		store:       store,
+		check:       check,
+		communities: make(map[string]*config.CommunityConfig),
+		l:           l.With("service", "Communities"),
+	}
+}
+
+// Load loads communities from the store. The communities from the config file are saved to the store
+// when they differ from the ones saved from it last time, so the changes made with the admin API are kept
+// until the community is changed in the config file.
+func (m *Manager) Load(ctx context.Context, seed []*config.CommunityConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	loaded := seed
+	if m.store != nil {
+		applied, err := m.store.AppliedConfigCommunities(ctx)
+		if err != nil {
+			return fmt.Errorf("error loading communities: %w", err)
+		}
+		var changed []*config.CommunityConfig
+		for _, community := range seed {
+			if !sameCommunity(community, applied[community.HookId]) {
+				changed = append(changed, community)
+			}
+		}
+		if len(changed) > 0 {
+			if err = m.store.ApplyConfigCommunities(ctx, changed); err != nil {
+				return fmt.Errorf("error saving communities: %w", err)
+			}
+			m.l.Info("saved communities changed in the config file", "count", len(changed))
+		}
+		if loaded, err = m.store.ListCommunities(ctx); err != nil {
+			return fmt.Errorf("error loading communities: %w", err)
+		}
+		stored := make(map[string]*config.CommunityConfig, len(loaded))
+		for _, community := range loaded {
+			stored[community.HookId] = community
+		}
+		for _, community := range seed {
+			if !sameCommunity(community, stored[community.HookId]) {
+				m.l.Warn(
+					"community in the config file differs from the database, it was changed with the admin API",
+					"hookId", community.HookId,
+				)
+			}
+		}
+	}
+	m.communities = make(map[string]*config.CommunityConfig, len(loaded))
+	for _, community := range loaded {
+		// Stored communities are kept even if the config changed since they were saved, so that they can be fixed
+		if m.check != nil {
+			if err := m.check(community); err != nil {
+				m.l.Warn("invalid community", "hookId", community.HookId, "err", err)
+			}
+		}
+		m.communities[community.HookId] = community
+	}
+	return nil
+}
+
+// Subscribe registers a listener for the changes made after the call
+func (m *Manager) Subscribe(listener Listener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, listener)
+}
+
+// List returns all communities sorted by hook ID
+func (m *Manager) List() []*config.CommunityConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	communities := make([]*config.CommunityConfig, 0, len(m.communities))
+	for _, community := range m.communities {
+		communities = append(communities, community)
+	}
+	slices.SortFunc(communities, func(a, b *config.CommunityConfig) int { return strings.Compare(a.HookId, b.HookId) })
+	return communities
+}
+
+// Enabled returns the communities that are not disabled sorted by hook ID
+func (m *Manager) Enabled() []*config.CommunityConfig {
+	return slices.DeleteFunc(m.List(), func(c *config.CommunityConfig) bool { return c.Disabled })
+}
+
+func (m *Manager) Get(hookId string) (*config.CommunityConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	community, ok := m.communities[hookId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return community, nil
+}
+
+func (m *Manager) Create(ctx context.Context, community *config.CommunityConfig) error {
+	if err := m.validate(community); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.communities[community.HookId]; ok {
+		return ErrExists
+	}
+	return m.save(ctx, community)
+}
+
+// Update replaces the community with the same hook ID
+func (m *Manager) Update(ctx context.Context, community *config.CommunityConfig) error {
+	if err := m.validate(community); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.communities[community.HookId]; !ok {
+		return ErrNotFound
+	}
+	return m.save(ctx, community)
+}
+
+func (m *Manager) SetDisabled(ctx context.Context, hookId string, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	community, ok := m.communities[hookId]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *community
+	updated.Disabled = disabled
+	return m.save(ctx, &updated)
+}
+
+func (m *Manager) Delete(ctx context.Context, hookId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.communities[hookId]; !ok {
+		return ErrNotFound
+	}
+	if m.store != nil {
+		if err := m.store.DeleteCommunity(ctx, hookId); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	delete(m.communities, hookId)
+	for _, listener := range m.listeners {
+		listener.RemoveCommunity(hookId)
+	}
+	m.l.Info("deleted community", "hookId", hookId)
+	return nil
+}
+
+func (m *Manager) validate(community *config.CommunityConfig) error {
+	if err := community.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	if m.check != nil {
+		if err := m.check(community); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) save(ctx context.Context, community *config.CommunityConfig) error {
+	if m.store != nil {
+		if err := m.store.SaveCommunity(ctx, community); err != nil {
+			return err
+		}
+	}
+	m.communities[community.HookId] = community
+	for _, listener := range m.listeners {
+		if community.Disabled {
+			listener.RemoveCommunity(community.HookId)
+		} else {
+			listener.SetCommunity(community)
+		}
+	}
+	m.l.Info("saved community", "hookId", community.HookId, "disabled", community.Disabled)
+	return nil
+}
+
+// sameCommunity reports whether the communities are equal as stored, b may be nil
+func sameCommunity(a, b *config.CommunityConfig) bool {
+	if b == nil {
+		return false
+	}
+	aData, aErr := jsoniter.MarshalToString(a)
+	bData, bErr := jsoniter.MarshalToString(b)
+	return aErr == nil && bErr == nil && aData == bData
+}
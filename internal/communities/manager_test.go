@@ -0,0 +1,117 @@
+package communities
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"viktig/internal/config"
+	"viktig/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testListener struct {
+	set     []string
+	removed []string
+}
+
+func (l *testListener) SetCommunity(community *config.CommunityConfig) {
+	l.set = append(l.set, community.HookId)
+}
+
+func (l *testListener) RemoveCommunity(hookId string) {
+	l.removed = append(l.removed, hookId)
+}
+
+func makeCommunity(hookId string) *config.CommunityConfig {
+	return &config.CommunityConfig{
+		HookId:             hookId,
+		SecretKey:          "secret",
+		ConfirmationString: "confirmation",
+		TgChatId:           1234,
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("seed", func(t *testing.T) {
+		store := openTestStorage(t)
+		m := New(store, nil, slog.Default())
+		require.NoError(t, m.Load(ctx, []*config.CommunityConfig{makeCommunity("a"), makeCommunity("b")}))
+		require.NoError(t, m.Delete(ctx, "b"))
+
+		m = New(store, nil, slog.Default())
+		require.NoError(t, m.Load(ctx, []*config.CommunityConfig{makeCommunity("a"), makeCommunity("b")}))
+		assert.Equal(t, []*config.CommunityConfig{makeCommunity("a")}, m.List())
+
+		require.NoError(t, m.Delete(ctx, "a"))
+		m = New(store, nil, slog.Default())
+		require.NoError(t, m.Load(ctx, []*config.CommunityConfig{makeCommunity("a"), makeCommunity("b")}))
+		assert.Empty(t, m.List())
+
+		// Communities changed in the config file are saved again
+		changed := makeCommunity("b")
+		changed.TgChatId = 5678
+		m = New(store, nil, slog.Default())
+		require.NoError(t, m.Load(ctx, []*config.CommunityConfig{makeCommunity("a"), changed}))
+		assert.Equal(t, []*config.CommunityConfig{changed}, m.List())
+	})
+	t.Run("changes", func(t *testing.T) {
+		store := openTestStorage(t)
+		m := New(store, nil, slog.Default())
+		require.NoError(t, m.Load(ctx, []*config.CommunityConfig{makeCommunity("a")}))
+		listener := &testListener{}
+		m.Subscribe(listener)
+
+		require.NoError(t, m.Create(ctx, makeCommunity("b")))
+		assert.ErrorIs(t, m.Create(ctx, makeCommunity("b")), ErrExists)
+		require.NoError(t, m.SetDisabled(ctx, "a", true))
+		assert.ErrorIs(t, m.Update(ctx, makeCommunity("c")), ErrNotFound)
+		require.NoError(t, m.Delete(ctx, "b"))
+		assert.ErrorIs(t, m.Delete(ctx, "b"), ErrNotFound)
+
+		assert.Equal(t, []string{"b"}, listener.set)
+		assert.Equal(t, []string{"a", "b"}, listener.removed)
+		assert.Empty(t, m.Enabled())
+		stored, err := store.ListCommunities(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, m.List(), stored)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		m := New(nil, nil, slog.Default())
+		require.NoError(t, m.Load(ctx, nil))
+		community := makeCommunity("a/b")
+		assert.ErrorIs(t, m.Create(ctx, community), ErrInvalid)
+		community = makeCommunity("a")
+		community.ConfirmationString = ""
+		assert.ErrorIs(t, m.Create(ctx, community), ErrInvalid)
+		assert.Empty(t, m.List())
+	})
+	t.Run("check", func(t *testing.T) {
+		cfg := &config.Config{Sinks: []*config.SinkConfig{{Name: "discord", Type: config.SinkDiscord}}}
+		m := New(nil, cfg.CheckCommunity, slog.Default())
+		require.NoError(t, m.Load(ctx, nil))
+
+		assert.ErrorIs(t, m.Create(ctx, makeCommunity("a")), ErrInvalid)
+		community := makeCommunity("a")
+		community.TgChatId = 0
+		community.Sinks = []string{"unknown"}
+		assert.ErrorIs(t, m.Create(ctx, community), ErrInvalid)
+		community.Sinks = []string{"discord"}
+		require.NoError(t, m.Create(ctx, community))
+		updated := *community
+		updated.Sinks = []string{"discord", "unknown"}
+		assert.ErrorIs(t, m.Update(ctx, &updated), ErrInvalid)
+	})
+}
+
+func openTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	s, err := storage.Open(context.Background(), filepath.Join(t.TempDir(), "viktig.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
@@ -1,24 +1,353 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"slices"
+	"time"
+
+	"viktig/internal/schedule"
 
 	"github.com/go-playground/validator/v10"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	TgBotToken       string             `yaml:"tg_bot_token" validate:"required"`
-	VkApiToken       string             `yaml:"vk_api_token" validate:"required"`
-	MetricsAuthToken string             `yaml:"metrics_auth_token"`
-	Communities      []*CommunityConfig `yaml:"communities" validate:"required,dive"`
+	// TgBotToken is only optional if no community is forwarded to Telegram and the bot features are disabled
+	TgBotToken       string `yaml:"tg_bot_token" validate:"required_with=BotCommands InlineButtons AnswerTracking"`
+	VkApiToken       string `yaml:"vk_api_token" validate:"required"`
+	MetricsAuthToken string `yaml:"metrics_auth_token"`
+	// MetricsAuthTokens are accepted along with MetricsAuthToken, which allows rotating tokens without downtime
+	MetricsAuthTokens []string           `yaml:"metrics_auth_tokens" validate:"dive,required"`
+	Communities       []*CommunityConfig `yaml:"communities" validate:"required,dive"`
+	// DrainTimeout limits how long each service may spend handling the remaining messages on shutdown
+	DrainTimeout time.Duration  `yaml:"drain_timeout" validate:"gte=0"`
+	Tracing      *TracingConfig `yaml:"tracing"`
+	Callback     CallbackConfig `yaml:"callback"`
+	Tls          *TlsConfig     `yaml:"tls"`
+	Queue        QueueConfig    `yaml:"queue"`
+	Workers      WorkersConfig  `yaml:"workers"`
+	Telegram     TelegramConfig `yaml:"telegram"`
+	// DatabasePath is the SQLite database keeping the app state, such as communities managed via the admin API
+	DatabasePath string `yaml:"database_path" validate:"required_with=AdminAuthTokens ArchiveMessages DeadLetters"`
+	// AdminAuthTokens enable the admin API
+	AdminAuthTokens []string `yaml:"admin_auth_tokens" validate:"dive,required"`
+	// ArchiveMessages enables storing forwarded messages in the database
+	ArchiveMessages bool `yaml:"archive_messages"`
+	// DeadLetters enables storing messages that could not be forwarded in the database, so that they can be replayed
+	DeadLetters bool `yaml:"dead_letters"`
+	// BotCommands enables handling /status, /mute, /unmute and /whoami in the destination chats.
+	// Mutes are kept in the database if DatabasePath is set.
+	BotCommands bool `yaml:"bot_commands"`
+	// InlineButtons enables the buttons of the forwarded messages handled by the bot, the dialog link is always added
+	InlineButtons bool `yaml:"inline_buttons"`
+	// AnswerTracking enables tracking VK conversations waiting for a community reply.
+	// Open conversations are kept in the database if DatabasePath is set.
+	AnswerTracking *AnswerTrackingConfig `yaml:"answer_tracking"`
+	// Sinks are the destinations besides Telegram that communities refer to by name
+	Sinks []*SinkConfig `yaml:"sinks" validate:"unique=Name,dive"`
+}
+
+const (
+	defaultDrainTimeout         = 10 * time.Second
+	defaultMaxBodySize          = 1 << 20
+	defaultQueueCapacity        = 100
+	defaultQueueOverflow        = "block"
+	defaultVkUsersGetterWorkers = 1
+	// defaultForwarderWorkers lets a slow chat not delay the others
+	defaultForwarderWorkers  = 4
+	defaultTgGlobalRateLimit = 30
+	defaultTgChatRateLimit   = 20
+	defaultReminderAfter     = 30 * time.Minute
+	defaultDigestInterval    = 15 * time.Minute
+	defaultDigestMaxMessages = 50
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultWebhookRetries    = 3
+	defaultInitialBackoff    = time.Second
+	defaultMaxBackoff        = 30 * time.Second
+	defaultFileMaxSizeMb     = 100
+)
+
+const (
+	ModeInstant = "instant"
+	ModeDigest  = "digest"
+)
+
+const (
+	// SinkTelegram is the built-in sink name, which the other sinks may not use
+	SinkTelegram   = "telegram"
+	SinkDiscord    = "discord"
+	SinkMatrix     = "matrix"
+	SinkSlack      = "slack"
+	SinkMattermost = "mattermost"
+	SinkWebhook    = "webhook"
+	SinkEmail      = "email"
+	SinkFile       = "file"
+	SinkStdout     = "stdout"
+)
+
+const (
+	EmailSecurityStartTls = "starttls"
+	EmailSecurityTls      = "tls"
+	EmailSecurityNone     = "none"
+)
+
+var defaultEmailPorts = map[string]int{
+	EmailSecurityStartTls: 587,
+	EmailSecurityTls:      465,
+	EmailSecurityNone:     25,
 }
 
 type CommunityConfig struct {
-	HookId             string `yaml:"hook_id" validate:"required"`
-	SecretKey          string `yaml:"secret_key" validate:"required"`
-	ConfirmationString string `yaml:"confirmation_string" validate:"required"`
-	TgChatId           int    `yaml:"tg_chat_id" validate:"required"`
+	HookId    string `yaml:"hook_id" json:"hook_id" validate:"required,excludesall=/?#"`
+	SecretKey string `yaml:"secret_key" json:"secret_key,omitempty" validate:"required_without=SecretKeys"`
+	// SecretKeys are accepted along with SecretKey, which allows rotating secrets without downtime
+	SecretKeys         []string `yaml:"secret_keys" json:"secret_keys,omitempty" validate:"required_without=SecretKey,dive,required"`
+	ConfirmationString string   `yaml:"confirmation_string" json:"confirmation_string" validate:"required"`
+	// TgChatId is the Telegram chat the messages are forwarded to, only optional if the community has other sinks
+	TgChatId int `yaml:"tg_chat_id" json:"tg_chat_id" validate:"required_without=Sinks"`
+	// Sinks are the names of the other sinks the messages are forwarded to
+	Sinks []string `yaml:"sinks" json:"sinks,omitempty" validate:"dive,required"`
+	// VkToken is used by the inline buttons marking messages as read and blocking senders, which requires a user token of a community admin
+	VkToken string `yaml:"vk_token" json:"vk_token,omitempty"`
+	// Mode is instant, forwarding each message, or digest, batching messages into periodic summaries
+	Mode   string        `yaml:"mode" json:"mode,omitempty" validate:"omitempty,oneof=instant digest"`
+	Digest *DigestConfig `yaml:"digest" json:"digest,omitempty"`
+	// QuietHours are when messages are sent without notification or held until their end
+	QuietHours *QuietHoursConfig `yaml:"quiet_hours" json:"quiet_hours,omitempty"`
+	// Disabled communities are kept, but their events are neither accepted nor forwarded
+	Disabled bool `yaml:"disabled" json:"disabled"`
+}
+
+// DigestConfig limits how long and how many messages are batched into a digest
+type DigestConfig struct {
+	// Interval is how long the first message of a digest waits for the others
+	Interval time.Duration `yaml:"interval" json:"interval,omitempty" validate:"gte=0"`
+	// MaxMessages posts the digest early once it has that many messages
+	MaxMessages int `yaml:"max_messages" json:"max_messages,omitempty" validate:"gte=0"`
+}
+
+// QuietHoursConfig is a weekly schedule of quiet hours
+type QuietHoursConfig struct {
+	// Timezone is an IANA time zone name, e.g. Europe/Moscow, UTC by default
+	Timezone string `yaml:"timezone" json:"timezone,omitempty" validate:"omitempty,timezone"`
+	// Hold delays the messages until the end of quiet hours instead of sending them without notification
+	Hold    bool                `yaml:"hold" json:"hold,omitempty"`
+	Windows []QuietWindowConfig `yaml:"windows" json:"windows" validate:"required,dive"`
+}
+
+type QuietWindowConfig struct {
+	// Days the window starts on, e.g. "mon-fri,sun", every day if empty
+	Days string `yaml:"days" json:"days,omitempty" validate:"weekdays"`
+	// From and To are HH:MM, the window ends on the next day if To is not after From
+	From string `yaml:"from" json:"from" validate:"clock"`
+	To   string `yaml:"to" json:"to" validate:"clock"`
+}
+
+// Schedule returns the quiet hours schedule, the config is validated on load
+func (c *QuietHoursConfig) Schedule() *schedule.Schedule {
+	location := time.UTC
+	if c.Timezone != "" {
+		location, _ = time.LoadLocation(c.Timezone)
+	}
+	windows := make([]schedule.Window, 0, len(c.Windows))
+	for _, w := range c.Windows {
+		days, _ := schedule.ParseDays(w.Days)
+		from, _ := schedule.ParseClock(w.From)
+		to, _ := schedule.ParseClock(w.To)
+		windows = append(windows, schedule.Window{Days: days, From: from, To: to})
+	}
+	return schedule.New(location, windows)
+}
+
+// SinkConfig is a destination besides Telegram, the settings of its type must be set
+type SinkConfig struct {
+	Name       string                `yaml:"name" validate:"required,ne=telegram"`
+	Type       string                `yaml:"type" validate:"required,oneof=discord matrix slack mattermost webhook email file stdout"`
+	Discord    *DiscordSinkConfig    `yaml:"discord" validate:"required_if=Type discord"`
+	Matrix     *MatrixSinkConfig     `yaml:"matrix" validate:"required_if=Type matrix"`
+	Slack      *SlackSinkConfig      `yaml:"slack" validate:"required_if=Type slack"`
+	Mattermost *MattermostSinkConfig `yaml:"mattermost" validate:"required_if=Type mattermost"`
+	Webhook    *WebhookSinkConfig    `yaml:"webhook" validate:"required_if=Type webhook"`
+	Email      *EmailSinkConfig      `yaml:"email" validate:"required_if=Type email"`
+	File       *FileSinkConfig       `yaml:"file" validate:"required_if=Type file"`
+}
+
+type DiscordSinkConfig struct {
+	WebhookUrl string `yaml:"webhook_url" validate:"required,url"`
+	// Username overrides the name of the webhook
+	Username string `yaml:"username"`
+}
+
+type MatrixSinkConfig struct {
+	HomeserverUrl string `yaml:"homeserver_url" validate:"required,url"`
+	AccessToken   string `yaml:"access_token" validate:"required"`
+	// RoomId is the internal room ID, e.g. !abcdef:example.com, which the user joins on start
+	RoomId string `yaml:"room_id" validate:"required,startswith=!"`
+}
+
+type SlackSinkConfig struct {
+	WebhookUrl string `yaml:"webhook_url" validate:"required,url"`
+}
+
+type MattermostSinkConfig struct {
+	WebhookUrl string `yaml:"webhook_url" validate:"required,url"`
+	// Username and Channel override the webhook settings if Mattermost allows integrations to
+	Username string `yaml:"username"`
+	Channel  string `yaml:"channel"`
+}
+
+// WebhookSinkConfig posts signed JSON payloads, failed requests are retried with exponential backoff
+type WebhookSinkConfig struct {
+	Url string `yaml:"url" validate:"required,url"`
+	// Secret is the key of the HMAC-SHA256 signature
+	Secret string `yaml:"secret" validate:"required"`
+	// Timeout limits each attempt
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+	// Retries is a pointer so that zero disables retries instead of setting the default
+	Retries        *int          `yaml:"retries" validate:"omitempty,gte=0"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" validate:"gte=0"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" validate:"gte=0"`
+}
+
+// EmailSinkConfig sends the messages by SMTP, the port depends on the security by default
+type EmailSinkConfig struct {
+	Host string `yaml:"host" validate:"required,hostname|ip"`
+	Port int    `yaml:"port" validate:"gte=0,lte=65535"`
+	// Security is starttls by default, tls for implicit TLS or none for local relays
+	Security string `yaml:"security" validate:"omitempty,oneof=starttls tls none"`
+	// Username enables authentication if set
+	Username string `yaml:"username"`
+	Password string `yaml:"password" validate:"required_with=Username"`
+	// From is the sender address, e.g. viktig@example.com or "Viktig <viktig@example.com>"
+	From string   `yaml:"from" validate:"required"`
+	To   []string `yaml:"to" validate:"required,dive,email"`
+}
+
+// FileSinkConfig appends the messages as JSON lines to a file, which is rotated once it exceeds MaxSizeMb
+type FileSinkConfig struct {
+	Path      string `yaml:"path" validate:"required"`
+	MaxSizeMb int    `yaml:"max_size_mb" validate:"gte=0"`
+	// MaxBackups is how many rotated files are kept, all of them if zero
+	MaxBackups int `yaml:"max_backups" validate:"gte=0"`
+}
+
+// Validate checks a community config that was not loaded from the config file, e.g. received via the admin API
+func (c *CommunityConfig) Validate() error {
+	return newValidator().Struct(c)
+}
+
+// AllMetricsAuthTokens returns all currently valid metrics auth tokens
+func (c *Config) AllMetricsAuthTokens() []string {
+	return withOptional(c.MetricsAuthTokens, c.MetricsAuthToken)
+}
+
+// AllSecretKeys returns all currently valid VK Callback API secret keys
+func (c *CommunityConfig) AllSecretKeys() []string {
+	return withOptional(c.SecretKeys, c.SecretKey)
+}
+
+// DigestInterval returns how long the messages of the community are batched, with the default applied
+func (c *CommunityConfig) DigestInterval() time.Duration {
+	if c.Digest == nil || c.Digest.Interval == 0 {
+		return defaultDigestInterval
+	}
+	return c.Digest.Interval
+}
+
+// DigestMaxMessages returns the maximum number of messages in a digest of the community, with the default applied
+func (c *CommunityConfig) DigestMaxMessages() int {
+	if c.Digest == nil || c.Digest.MaxMessages == 0 {
+		return defaultDigestMaxMessages
+	}
+	return c.Digest.MaxMessages
+}
+
+func withOptional(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	return append([]string{value}, values...)
+}
+
+// CallbackConfig limits requests to the VK callback endpoint
+type CallbackConfig struct {
+	// MaxBodySize in bytes
+	MaxBodySize   int              `yaml:"max_body_size" validate:"gte=0"`
+	IpRateLimit   *RateLimitConfig `yaml:"ip_rate_limit"`
+	HookRateLimit *RateLimitConfig `yaml:"hook_rate_limit"`
+	// AllowedCidrs restrict client IPs if not empty
+	AllowedCidrs []string `yaml:"allowed_cidrs" validate:"dive,cidr"`
+	// TrustedProxies are allowed to set the client IP with the X-Forwarded-For header
+	TrustedProxies []string `yaml:"trusted_proxies" validate:"dive,cidr"`
+}
+
+// QueueConfig limits the queues between services
+type QueueConfig struct {
+	Capacity int `yaml:"capacity" validate:"gte=0"`
+	// Overflow is what happens to new VK events when the first queue is full
+	Overflow string `yaml:"overflow" validate:"omitempty,oneof=block drop_oldest reject"`
+}
+
+// WorkersConfig sets how many messages each pipeline stage processes concurrently.
+// Messages of the same VK conversation are processed in order regardless of it.
+type WorkersConfig struct {
+	VkUsersGetter int `yaml:"vk_users_getter" validate:"gte=0"`
+	Forwarder     int `yaml:"forwarder" validate:"gte=0"`
+}
+
+// TelegramConfig limits sending messages to Telegram, the defaults match the Telegram Bot API limits
+type TelegramConfig struct {
+	// GlobalRateLimit is the number of messages per second to all chats
+	GlobalRateLimit int `yaml:"global_rate_limit" validate:"gte=0"`
+	// ChatRateLimit is the number of messages per minute to a single chat
+	ChatRateLimit int `yaml:"chat_rate_limit" validate:"gte=0"`
+}
+
+// AnswerTrackingConfig sets when reminders about unanswered VK conversations are posted to Telegram
+type AnswerTrackingConfig struct {
+	// ReminderAfter is how long a conversation may stay open before a reminder is posted to the community chat
+	ReminderAfter time.Duration `yaml:"reminder_after" validate:"gte=0"`
+	// EscalateAfter is how long a conversation may stay open before an escalation is posted, disabled if not set
+	EscalateAfter time.Duration `yaml:"escalate_after" validate:"gte=0"`
+	// EscalationChatId receives escalations instead of the community chat
+	EscalationChatId int `yaml:"escalation_chat_id"`
+	// EscalationMention is added to escalations, e.g. "@lead"
+	EscalationMention string `yaml:"escalation_mention"`
+}
+
+type RateLimitConfig struct {
+	// Rate is the number of requests allowed per second
+	Rate  float64 `yaml:"rate" validate:"gt=0"`
+	Burst int     `yaml:"burst" validate:"gt=0"`
+}
+
+// TlsConfig enables HTTPS with either a certificate from files or one obtained via ACME
+type TlsConfig struct {
+	CertFile string      `yaml:"cert_file" validate:"required_with=KeyFile,excluded_with=Acme"`
+	KeyFile  string      `yaml:"key_file" validate:"required_with=CertFile"`
+	Acme     *AcmeConfig `yaml:"acme" validate:"required_without=CertFile"`
+}
+
+type AcmeConfig struct {
+	Domains  []string `yaml:"domains" validate:"required,dive,hostname"`
+	Email    string   `yaml:"email"`
+	CacheDir string   `yaml:"cache_dir" validate:"required"`
+	// DirectoryUrl of the ACME CA, Let's Encrypt by default
+	DirectoryUrl string `yaml:"directory_url" validate:"omitempty,url"`
+	// CaFile is a PEM file with the CA certificates trusted when connecting to DirectoryUrl
+	CaFile string `yaml:"ca_file"`
+	// HttpChallengeAddress enables answering HTTP-01 challenges on this address, e.g. ":80"
+	HttpChallengeAddress string `yaml:"http_challenge_address"`
+}
+
+type TracingConfig struct {
+	// Endpoint is host:port of an OTLP HTTP receiver
+	Endpoint string `yaml:"endpoint" validate:"required"`
+	Insecure bool   `yaml:"insecure"`
+	// SampleRatio is the share of traces to sample, all traces are sampled if not set
+	SampleRatio float64 `yaml:"sample_ratio" validate:"gte=0,lte=1"`
 }
 
 func LoadConfigFromFile(path string) (cfg *Config, err error) {
@@ -35,8 +364,115 @@ func LoadConfigFromFile(path string) (cfg *Config, err error) {
 		return nil, err
 	}
 
-	if err = validator.New().Struct(cfg); err != nil {
+	if err = newValidator().Struct(cfg); err != nil {
 		return nil, err
 	}
+	if err = cfg.checkCommunities(); err != nil {
+		return nil, err
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.Callback.MaxBodySize == 0 {
+		cfg.Callback.MaxBodySize = defaultMaxBodySize
+	}
+	if cfg.Queue.Capacity == 0 {
+		cfg.Queue.Capacity = defaultQueueCapacity
+	}
+	if cfg.Queue.Overflow == "" {
+		cfg.Queue.Overflow = defaultQueueOverflow
+	}
+	if cfg.Workers.VkUsersGetter == 0 {
+		cfg.Workers.VkUsersGetter = defaultVkUsersGetterWorkers
+	}
+	if cfg.Workers.Forwarder == 0 {
+		cfg.Workers.Forwarder = defaultForwarderWorkers
+	}
+	if cfg.Telegram.GlobalRateLimit == 0 {
+		cfg.Telegram.GlobalRateLimit = defaultTgGlobalRateLimit
+	}
+	if cfg.Telegram.ChatRateLimit == 0 {
+		cfg.Telegram.ChatRateLimit = defaultTgChatRateLimit
+	}
+	if cfg.AnswerTracking != nil && cfg.AnswerTracking.ReminderAfter == 0 {
+		cfg.AnswerTracking.ReminderAfter = defaultReminderAfter
+	}
+	for _, sink := range cfg.Sinks {
+		if sink.Webhook != nil {
+			sink.Webhook.applyDefaults()
+		}
+		if sink.Email != nil {
+			sink.Email.applyDefaults()
+		}
+		if sink.File != nil && sink.File.MaxSizeMb == 0 {
+			sink.File.MaxSizeMb = defaultFileMaxSizeMb
+		}
+	}
+	if cfg.Tracing != nil && cfg.Tracing.SampleRatio == 0 {
+		cfg.Tracing.SampleRatio = 1
+	}
 	return cfg, nil
 }
+
+func (c *WebhookSinkConfig) applyDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+	if c.Retries == nil {
+		retries := defaultWebhookRetries
+		c.Retries = &retries
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = defaultInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+}
+
+func (c *EmailSinkConfig) applyDefaults() {
+	if c.Security == "" {
+		c.Security = EmailSecurityStartTls
+	}
+	if c.Port == 0 {
+		c.Port = defaultEmailPorts[c.Security]
+	}
+}
+
+// CheckCommunity checks that the community only refers to the configured sinks, and that the bot token is set
+// if it is forwarded to Telegram. Unlike Validate, it depends on the rest of the config.
+func (c *Config) CheckCommunity(community *CommunityConfig) error {
+	if community.TgChatId != 0 && c.TgBotToken == "" {
+		return errors.New("tg_bot_token is required for tg_chat_id")
+	}
+	for _, name := range community.Sinks {
+		if !slices.ContainsFunc(c.Sinks, func(sink *SinkConfig) bool { return sink.Name == name }) {
+			return fmt.Errorf("unknown sink %s", name)
+		}
+	}
+	return nil
+}
+
+// checkCommunities checks the communities of the config file with CheckCommunity
+func (c *Config) checkCommunities() error {
+	for _, community := range c.Communities {
+		if err := c.CheckCommunity(community); err != nil {
+			return fmt.Errorf("community %s: %w", community.HookId, err)
+		}
+	}
+	return nil
+}
+
+// newValidator returns a validator with the schedule validations
+func newValidator() *validator.Validate {
+	v := validator.New()
+	_ = v.RegisterValidation("weekdays", func(fl validator.FieldLevel) bool {
+		_, err := schedule.ParseDays(fl.Field().String())
+		return err == nil
+	})
+	_ = v.RegisterValidation("clock", func(fl validator.FieldLevel) bool {
+		_, err := schedule.ParseClock(fl.Field().String())
+		return err == nil
+	})
+	return v
+}
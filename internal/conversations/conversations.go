@@ -0,0 +1,181 @@
+package conversations
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/metrics"
+	"viktig/internal/storage"
+)
+
+// Store persists open conversations
+type Store interface {
+	ListConversations(ctx context.Context) ([]storage.Conversation, error)
+	SaveConversation(ctx context.Context, conversation storage.Conversation) error
+	DeleteConversation(ctx context.Context, hookId string, vkPeerId int) error
+}
+
+type key struct {
+	hookId   string
+	vkPeerId int
+}
+
+// Tracker keeps the VK conversations waiting for a community reply. A new message from a user opens a conversation,
+// a community reply closes it. Tracker is a pipeline stage tracking the messages passing through it.
+type Tracker struct {
+	store Store
+	mu    sync.Mutex
+	open  map[key]storage.Conversation
+	now   func() time.Time
+	l     *slog.Logger
+}
+
+// New creates a tracker. Conversations are only kept in memory if store is nil.
+func New(store Store, l *slog.Logger) *Tracker {
+	return &Tracker{
+		store: store,
+		open:  make(map[key]storage.Conversation),
+		now:   time.Now,
+		l:     l.With("service", "ConversationTracker"),
+	}
+}
+
+// Load loads the open conversations from the store
+func (t *Tracker) Load(ctx context.Context) error {
+	if t.store == nil {
+		return nil
+	}
+	conversations, err := t.store.ListConversations(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading conversations: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open = make(map[key]storage.Conversation, len(conversations))
+	metrics.OpenConversations.Reset()
+	for _, conversation := range conversations {
+		t.open[key{conversation.HookId, conversation.VkPeerId}] = conversation
+		metrics.OpenConversations.WithLabelValues(conversation.HookId).Inc()
+	}
+	return nil
+}
+
+func (t *Tracker) Start(_ context.Context) error {
+	return nil
+}
+
+// Process tracks the message and passes it on. Tracking errors do not affect forwarding.
+func (t *Tracker) Process(ctx context.Context, message entities.Message) (entities.Message, bool) {
+	if err := t.Track(ctx, message); err != nil {
+		t.l.ErrorContext(message.Context(ctx), "error tracking conversation", "err", err)
+	}
+	return message, true
+}
+
+func (t *Tracker) Lost(message entities.Message) {
+	t.l.ErrorContext(message.Context(context.Background()), "message lost on shutdown", "message", message)
+	metrics.MessagesFailed.WithLabelValues(message.HookId, metrics.FailureReasonLostOnShutdown).Inc()
+}
+
+// Track opens the conversation of a new message from a user and closes the conversation a community reply is sent to.
+// Edits and messages without a peer are ignored.
+func (t *Tracker) Track(ctx context.Context, message entities.Message) error {
+	if message.VkPeerId == 0 {
+		return nil
+	}
+	switch {
+	case message.Type == entities.MessageTypeNew && message.IsFromUser():
+		return t.openConversation(ctx, message)
+	case message.Type == entities.MessageTypeReply:
+		return t.closeConversation(ctx, message)
+	}
+	return nil
+}
+
+// Open returns the open conversations, the oldest first
+func (t *Tracker) Open() []storage.Conversation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conversations := make([]storage.Conversation, 0, len(t.open))
+	for _, conversation := range t.open {
+		conversations = append(conversations, conversation)
+	}
+	slices.SortFunc(conversations, func(a, b storage.Conversation) int {
+		return a.OpenedAt.Compare(b.OpenedAt)
+	})
+	return conversations
+}
+
+// SetReminders records the number of reminders posted about the conversation.
+// Does nothing if the conversation was closed or reopened since it was returned by Open.
+func (t *Tracker) SetReminders(ctx context.Context, conversation storage.Conversation, reminders int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key{conversation.HookId, conversation.VkPeerId}
+	current, ok := t.open[k]
+	if !ok || !current.OpenedAt.Equal(conversation.OpenedAt) {
+		return nil
+	}
+	current.Reminders = reminders
+	if t.store != nil {
+		if err := t.store.SaveConversation(ctx, current); err != nil {
+			return err
+		}
+	}
+	t.open[k] = current
+	return nil
+}
+
+// openConversation opens the conversation unless it is already waiting for a reply
+func (t *Tracker) openConversation(ctx context.Context, message entities.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key{message.HookId, message.VkPeerId}
+	if _, ok := t.open[k]; ok {
+		return nil
+	}
+	conversation := storage.Conversation{
+		HookId:    message.HookId,
+		VkPeerId:  message.VkPeerId,
+		VkGroupId: message.VkGroupId,
+		OpenedAt:  message.ReceivedAt,
+	}
+	if message.VkSender != nil {
+		conversation.VkSenderName = message.VkSender.FirstName + " " + message.VkSender.LastName
+	}
+	if conversation.OpenedAt.IsZero() {
+		conversation.OpenedAt = t.now()
+	}
+	if t.store != nil {
+		if err := t.store.SaveConversation(ctx, conversation); err != nil {
+			return err
+		}
+	}
+	t.open[k] = conversation
+	metrics.OpenConversations.WithLabelValues(message.HookId).Inc()
+	return nil
+}
+
+func (t *Tracker) closeConversation(ctx context.Context, message entities.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key{message.HookId, message.VkPeerId}
+	conversation, ok := t.open[k]
+	if !ok {
+		return nil
+	}
+	if t.store != nil {
+		if err := t.store.DeleteConversation(ctx, message.HookId, message.VkPeerId); err != nil {
+			return err
+		}
+	}
+	delete(t.open, k)
+	metrics.OpenConversations.WithLabelValues(message.HookId).Dec()
+	metrics.ConversationReplyTime.WithLabelValues(message.HookId).Observe(t.now().Sub(conversation.OpenedAt).Seconds())
+	return nil
+}
@@ -0,0 +1,111 @@
+package conversations
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/metrics"
+	"viktig/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	openedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	message := entities.Message{
+		HookId:     "hook",
+		Type:       entities.MessageTypeNew,
+		VkSenderId: 1,
+		VkGroupId:  10,
+		VkPeerId:   1,
+		VkSender:   &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		ReceivedAt: openedAt,
+	}
+	reply := entities.Message{HookId: "hook", Type: entities.MessageTypeReply, VkSenderId: -10, VkPeerId: 1}
+
+	t.Run("open and close", func(t *testing.T) {
+		tracker := New(nil, discardLogger())
+		later := message
+		later.ReceivedAt = openedAt.Add(time.Minute)
+		gauge := metrics.OpenConversations.WithLabelValues("hook")
+		initial := testutil.ToFloat64(gauge)
+
+		require.NoError(t, tracker.Track(ctx, message))
+		require.NoError(t, tracker.Track(ctx, later))
+
+		expected := storage.Conversation{HookId: "hook", VkPeerId: 1, VkGroupId: 10, VkSenderName: "Ivan Petrov", OpenedAt: openedAt}
+		assert.Equal(t, []storage.Conversation{expected}, tracker.Open())
+		assert.Equal(t, initial+1, testutil.ToFloat64(gauge))
+
+		require.NoError(t, tracker.Track(ctx, reply))
+
+		assert.Empty(t, tracker.Open())
+		assert.Equal(t, initial, testutil.ToFloat64(gauge))
+	})
+	t.Run("ignored", func(t *testing.T) {
+		tracker := New(nil, discardLogger())
+		edit := message
+		edit.Type = entities.MessageTypeEdit
+		noPeer := message
+		noPeer.VkPeerId = 0
+		community := message
+		community.VkSenderId = -10
+
+		for _, m := range []entities.Message{edit, noPeer, community, reply} {
+			require.NoError(t, tracker.Track(ctx, m))
+		}
+
+		assert.Empty(t, tracker.Open())
+	})
+	t.Run("persisted", func(t *testing.T) {
+		store := openTestStorage(t)
+		tracker := New(store, discardLogger())
+		other := message
+		other.VkPeerId = 2
+		other.ReceivedAt = openedAt.Add(time.Minute)
+		require.NoError(t, tracker.Track(ctx, message))
+		require.NoError(t, tracker.Track(ctx, other))
+		require.NoError(t, tracker.SetReminders(ctx, tracker.Open()[1], 1))
+		require.NoError(t, tracker.Track(ctx, reply))
+
+		tracker = New(store, discardLogger())
+		require.NoError(t, tracker.Load(ctx))
+
+		open := tracker.Open()
+		require.Len(t, open, 1)
+		assert.Equal(t, 2, open[0].VkPeerId)
+		assert.Equal(t, 1, open[0].Reminders)
+	})
+	t.Run("reminders of reopened conversation", func(t *testing.T) {
+		tracker := New(nil, discardLogger())
+		require.NoError(t, tracker.Track(ctx, message))
+		conversation := tracker.Open()[0]
+		require.NoError(t, tracker.Track(ctx, reply))
+		reopened := message
+		reopened.ReceivedAt = openedAt.Add(time.Hour)
+		require.NoError(t, tracker.Track(ctx, reopened))
+
+		require.NoError(t, tracker.SetReminders(ctx, conversation, 1))
+
+		assert.Equal(t, 0, tracker.Open()[0].Reminders)
+	})
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func openTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	s, err := storage.Open(context.Background(), filepath.Join(t.TempDir(), "viktig.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
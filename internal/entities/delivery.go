@@ -0,0 +1,24 @@
+package entities
+
+import "time"
+
+type DeliveryStatus string
+
+const (
+	DeliveryStatusSent   DeliveryStatus = "sent"
+	DeliveryStatusFailed DeliveryStatus = "failed"
+	// DeliveryStatusMuted is set for messages not sent since the chat was muted
+	DeliveryStatusMuted DeliveryStatus = "muted"
+)
+
+// Delivery is the outcome of forwarding a message
+type Delivery struct {
+	Status DeliveryStatus
+	// Error describes why the message was not delivered
+	Error string
+	// Sink is the name of the sink the message was forwarded to
+	Sink        string
+	TgChatId    int
+	TgMessageId int
+	At          time.Time
+}
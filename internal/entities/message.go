@@ -1,11 +1,60 @@
 package entities
 
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
 type Message struct {
-	HookId     string
+	HookId string
+	// EventId is the ID of the VK event the message was received in
+	EventId    string
 	Type       MessageType
 	Text       string
 	VkSenderId int
-	VkSender   *VkUser
+	// VkGroupId is the community that received the message
+	VkGroupId int
+	// VkPeerId is the conversation the message belongs to
+	VkPeerId int
+	// VkMessageId is the ID of the message within its conversation, the same for the new message and its edits
+	VkMessageId int
+	VkSender    *VkUser
+	Attachments []Attachment
+	ReceivedAt  time.Time
+	// SpanContext is the context of the span in which the message was received
+	SpanContext trace.SpanContext
+	// DeadLetterId is set when the message is replayed from the dead-letter store
+	DeadLetterId int64
+	// HeldId is set when the message held until the end of quiet hours is kept in the store
+	HeldId int64
+	// Sink is the only sink the message is forwarded to if set, e.g. when a dead letter of that sink is replayed
+	Sink string
+}
+
+// Attachment is a file or link attached to a VK message
+type Attachment struct {
+	// Type is the VK attachment type, e.g. photo or doc
+	Type  string `json:"type"`
+	Url   string `json:"url,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// IsImage reports whether the attachment can be shown as an image
+func (a Attachment) IsImage() bool {
+	return a.Url != "" && (a.Type == "photo" || a.Type == "sticker")
+}
+
+// Name returns the title of the attachment, or its type if it has none
+func (a Attachment) Name() string {
+	if a.Title != "" {
+		return a.Title
+	}
+	return a.Type
 }
 
 type MessageType int
@@ -16,6 +65,71 @@ const (
 	MessageTypeReply
 )
 
+var messageTypeNames = map[MessageType]string{
+	MessageTypeNew:   "new",
+	MessageTypeEdit:  "edit",
+	MessageTypeReply: "reply",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 func (m *Message) IsFromUser() bool {
 	return m.VkSenderId > 0
 }
+
+// SenderName returns the name of the sender if known, or their VK ID otherwise
+func (m *Message) SenderName() string {
+	if m.VkSender != nil {
+		return m.VkSender.FirstName + " " + m.VkSender.LastName
+	}
+	if m.IsFromUser() {
+		return strconv.Itoa(m.VkSenderId)
+	}
+	return strconv.Itoa(-m.VkSenderId)
+}
+
+// SenderUrl returns the VK page of the user or community that sent the message
+func (m *Message) SenderUrl() string {
+	if m.IsFromUser() {
+		return fmt.Sprintf("https://vk.com/id%d", m.VkSenderId)
+	}
+	return fmt.Sprintf("https://vk.com/club%d", -m.VkSenderId)
+}
+
+// DialogUrl returns the link to the VK conversation in the community messages, or an empty string if it is unknown
+func (m *Message) DialogUrl() string {
+	if m.VkGroupId == 0 || m.VkPeerId == 0 {
+		return ""
+	}
+	return fmt.Sprintf("https://vk.com/gim%d?sel=%d", m.VkGroupId, m.VkPeerId)
+}
+
+// ConversationKey identifies the VK conversation of the message, messages with the same key are forwarded in order.
+// Falls back to the sender if the peer is unknown.
+func (m *Message) ConversationKey() string {
+	peerId := m.VkPeerId
+	if peerId == 0 {
+		peerId = m.VkSenderId
+	}
+	return m.HookId + ":" + strconv.Itoa(peerId)
+}
+
+// Context returns ctx carrying the message span context, so that spans started with it belong to the message trace
+func (m *Message) Context(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(ctx, m.SpanContext)
+}
+
+// LogValue includes the message contents, so it should only be logged when the message can not be delivered.
+func (m Message) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("hookId", m.HookId),
+		slog.Int("type", int(m.Type)),
+		slog.Int("vkSenderId", m.VkSenderId),
+		slog.String("text", m.Text),
+	)
+}
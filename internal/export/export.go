@@ -0,0 +1,112 @@
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"viktig/internal/storage"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	FormatJsonl = "jsonl"
+	FormatCsv   = "csv"
+)
+
+const pageSize = 500
+
+var csvHeader = []string{
+	"id",
+	"event_id",
+	"hook_id",
+	"type",
+	"text",
+	"vk_sender_id",
+	"vk_sender_name",
+	"received_at",
+	"status",
+	"error",
+	"tg_chat_id",
+	"tg_message_id",
+	"processed_at",
+	"sink",
+}
+
+// Source lists archived messages page by page
+type Source interface {
+	ListMessages(ctx context.Context, filter storage.MessageFilter) ([]*storage.ArchivedMessage, error)
+}
+
+// Write writes all the messages matching filter to w in format. Returns the number of written messages.
+func Write(ctx context.Context, w io.Writer, format string, source Source, filter storage.MessageFilter) (int, error) {
+	var write func(message *storage.ArchivedMessage) error
+	var flush func() error
+	switch format {
+	case FormatJsonl:
+		encoder := jsoniter.NewEncoder(w)
+		write = func(message *storage.ArchivedMessage) error { return encoder.Encode(message) }
+		flush = func() error { return nil }
+	case FormatCsv:
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		write = func(message *storage.ArchivedMessage) error { return csvWriter.Write(csvRecord(message)) }
+		flush = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unsupported format: %s", format)
+	}
+
+	count := 0
+	filter.Limit = pageSize
+	for {
+		messages, err := source.ListMessages(ctx, filter)
+		if err != nil {
+			return count, err
+		}
+		for _, message := range messages {
+			if err = write(message); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(messages) < pageSize {
+			return count, flush()
+		}
+		filter.AfterId = messages[len(messages)-1].Id
+	}
+}
+
+// ParseTime parses an RFC 3339 time or a date, which is interpreted as midnight UTC
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func csvRecord(message *storage.ArchivedMessage) []string {
+	return []string{
+		strconv.FormatInt(message.Id, 10),
+		message.EventId,
+		message.HookId,
+		message.Type,
+		message.Text,
+		strconv.Itoa(message.VkSenderId),
+		message.VkSenderName,
+		message.ReceivedAt.Format(time.RFC3339),
+		string(message.Status),
+		message.Error,
+		strconv.Itoa(message.TgChatId),
+		strconv.Itoa(message.TgMessageId),
+		message.ProcessedAt.Format(time.RFC3339),
+		message.Sink,
+	}
+}
@@ -0,0 +1,101 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"viktig/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource struct {
+	messages []*storage.ArchivedMessage
+}
+
+func (s *fakeSource) ListMessages(_ context.Context, filter storage.MessageFilter) ([]*storage.ArchivedMessage, error) {
+	var page []*storage.ArchivedMessage
+	for _, message := range s.messages {
+		if message.Id > filter.AfterId && len(page) < filter.Limit {
+			page = append(page, message)
+		}
+	}
+	return page, nil
+}
+
+func makeSource(count int) *fakeSource {
+	s := &fakeSource{}
+	for i := 1; i <= count; i++ {
+		s.messages = append(s.messages, &storage.ArchivedMessage{
+			Id:          int64(i),
+			HookId:      "test-hook",
+			Type:        "new",
+			Text:        "Hello, \"world\"",
+			VkSenderId:  1234,
+			ReceivedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			Status:      "sent",
+			Sink:        "telegram",
+			ProcessedAt: time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC),
+		})
+	}
+	return s
+}
+
+func TestWrite(t *testing.T) {
+	t.Run("jsonl", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		count, err := Write(context.Background(), buf, FormatJsonl, makeSource(2), storage.MessageFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 2)
+		assert.JSONEq(t, `{
+			"id": 1,
+			"event_id": "",
+			"hook_id": "test-hook",
+			"type": "new",
+			"text": "Hello, \"world\"",
+			"vk_sender_id": 1234,
+			"vk_sender_name": "",
+			"received_at": "2024-05-01T12:00:00Z",
+			"status": "sent",
+			"sink": "telegram",
+			"processed_at": "2024-05-01T12:00:01Z"
+		}`, lines[0])
+	})
+	t.Run("csv", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		_, err := Write(context.Background(), buf, FormatCsv, makeSource(1), storage.MessageFilter{})
+		require.NoError(t, err)
+		assert.Equal(
+			t,
+			"id,event_id,hook_id,type,text,vk_sender_id,vk_sender_name,received_at,status,error,tg_chat_id,tg_message_id,processed_at,sink\n"+
+				"1,,test-hook,new,\"Hello, \"\"world\"\"\",1234,,2024-05-01T12:00:00Z,sent,,0,0,2024-05-01T12:00:01Z,telegram\n",
+			buf.String(),
+		)
+	})
+	t.Run("pages", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		count, err := Write(context.Background(), buf, FormatJsonl, makeSource(pageSize*2+1), storage.MessageFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, pageSize*2+1, count)
+	})
+	t.Run("unsupported format", func(t *testing.T) {
+		_, err := Write(context.Background(), &bytes.Buffer{}, "xml", makeSource(1), storage.MessageFilter{})
+		assert.EqualError(t, err, "unsupported format: xml")
+	})
+}
+
+func TestParseTime(t *testing.T) {
+	actual, err := ParseTime("2024-05-01")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), actual)
+	actual, err = ParseTime("2024-05-01T12:00:00+03:00")
+	require.NoError(t, err)
+	assert.True(t, time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC).Equal(actual))
+	_, err = ParseTime("yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package health
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrNotStarted = errors.New("not started")
+
+// Check returns nil if the component is ready or an error describing why it is not.
+type Check func() error
+
+type Registry struct {
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]Check
+}
+
+type Report struct {
+	Ready      bool                 `json:"ready"`
+	Components map[string]Component `json:"components"`
+}
+
+type Component struct {
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewRegistry() *Registry {
+	return &Registry{checks: make(map[string]Check)}
+}
+
+func (r *Registry) Add(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.checks[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.checks[name] = check
+}
+
+// Report runs all checks. The report is ready if all the components are ready.
+func (r *Registry) Report() Report {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	report := Report{Ready: true, Components: make(map[string]Component, len(r.names))}
+	for _, name := range r.names {
+		component := Component{Ready: true}
+		if err := r.checks[name](); err != nil {
+			component = Component{Ready: false, Error: err.Error()}
+			report.Ready = false
+		}
+		report.Components[name] = component
+	}
+	return report
+}
+
+// Probe holds the readiness of a service that is reported by the service itself. Not ready until SetReady is called.
+type Probe struct {
+	mu  sync.RWMutex
+	err error
+	set bool
+}
+
+func (p *Probe) SetReady() {
+	p.SetNotReady(nil)
+}
+
+func (p *Probe) SetNotReady(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+	p.set = true
+}
+
+func (p *Probe) Check() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.set {
+		return ErrNotStarted
+	}
+	return p.err
+}
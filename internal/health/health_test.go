@@ -0,0 +1,50 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		r := NewRegistry()
+		assert.Equal(t, Report{Ready: true, Components: map[string]Component{}}, r.Report())
+	})
+	t.Run("ready", func(t *testing.T) {
+		r := NewRegistry()
+		r.Add("a", func() error { return nil })
+		r.Add("b", func() error { return nil })
+
+		assert.Equal(t, Report{
+			Ready: true,
+			Components: map[string]Component{
+				"a": {Ready: true},
+				"b": {Ready: true},
+			},
+		}, r.Report())
+	})
+	t.Run("not ready", func(t *testing.T) {
+		r := NewRegistry()
+		r.Add("a", func() error { return nil })
+		r.Add("b", func() error { return errors.New("error") })
+
+		assert.Equal(t, Report{
+			Ready: false,
+			Components: map[string]Component{
+				"a": {Ready: true},
+				"b": {Ready: false, Error: "error"},
+			},
+		}, r.Report())
+	})
+}
+
+func TestProbe(t *testing.T) {
+	p := &Probe{}
+	assert.ErrorIs(t, p.Check(), ErrNotStarted)
+	p.SetReady()
+	assert.NoError(t, p.Check())
+	p.SetNotReady(errors.New("stopped"))
+	assert.EqualError(t, p.Check(), "stopped")
+}
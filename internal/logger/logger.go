@@ -6,14 +6,14 @@ import (
 )
 
 func init() {
-	var logger *slog.Logger
+	var handler slog.Handler
 	switch os.Getenv("APP_ENV") {
 	case "prod":
-		logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+		handler = slog.NewJSONHandler(os.Stdout, nil)
 	case "dev":
-		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
 	default:
-		logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		handler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
 	}
-	slog.SetDefault(logger)
+	slog.SetDefault(slog.New(traceHandler{handler}))
 }
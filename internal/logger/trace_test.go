@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceHandler(t *testing.T) {
+	t.Run("with span", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		l := slog.New(traceHandler{slog.NewTextHandler(buf, nil)}).With("service", "test")
+		spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: trace.TraceID{1},
+			SpanID:  trace.SpanID{2},
+		})
+
+		l.InfoContext(trace.ContextWithSpanContext(context.Background(), spanContext), "message")
+
+		assert.Contains(t, buf.String(), "service=test")
+		assert.Contains(t, buf.String(), "traceId=01000000000000000000000000000000")
+		assert.Contains(t, buf.String(), "spanId=0200000000000000")
+	})
+	t.Run("without span", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		l := slog.New(traceHandler{slog.NewTextHandler(buf, nil)})
+
+		l.InfoContext(context.Background(), "message")
+
+		assert.NotContains(t, buf.String(), "traceId")
+	})
+}
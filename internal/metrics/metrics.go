@@ -5,12 +5,172 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	FailureReasonUnknownHook    = "unknown_hook"
+	FailureReasonTelegramError  = "telegram_error"
+	FailureReasonSinkError      = "sink_error"
+	FailureReasonUnknownSink    = "unknown_sink"
+	FailureReasonLostOnShutdown = "lost_on_shutdown"
+	FailureReasonQueueOverflow  = "queue_overflow"
+	// FailureReasonMuted is the dead letter reason of messages not sent since the chat was muted, they are not counted as failed
+	FailureReasonMuted = "muted"
+)
+
 var (
 	VKEventsReceived = promauto.NewCounterVec(
 		prometheus.CounterOpts{Name: "viktig_vk_events_received"},
-		[]string{"type"},
+		[]string{"type", "hook_id"},
 	)
-	MessagesForwarded = promauto.NewCounter(
+	HttpRequestsRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{Name: "viktig_http_requests_rejected"},
+		[]string{"reason"},
+	)
+	MessagesForwarded = promauto.NewCounterVec(
 		prometheus.CounterOpts{Name: "viktig_messages_forwarded"},
+		[]string{"hook_id"},
+	)
+	MessagesMuted = promauto.NewCounterVec(
+		prometheus.CounterOpts{Name: "viktig_messages_muted_total"},
+		[]string{"hook_id"},
+	)
+	DigestsSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{Name: "viktig_digests_sent_total"},
+		[]string{"hook_id"},
+	)
+	MessagesFailed = promauto.NewCounterVec(
+		prometheus.CounterOpts{Name: "viktig_messages_failed_total"},
+		[]string{"hook_id", "reason"},
+	)
+	SinkDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "viktig_sink_deliveries_total",
+			Help: "Messages forwarded to sinks other than Telegram, result is sent or failed",
+		},
+		[]string{"sink", "hook_id", "result"},
+	)
+	SinkUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "viktig_sink_up",
+			Help: "1 if the sink started, 0 while starting it failed and it is retried",
+		},
+		[]string{"sink"},
+	)
+	SinkMessageLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "viktig_sink_message_latency_seconds",
+			Help:    "Time from receiving a VK event to sending the message to a sink other than Telegram",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"sink", "hook_id"},
+	)
+	MessageLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "viktig_message_latency_seconds",
+			Help:    "Time from receiving a VK event to sending the Telegram message",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"hook_id"},
+	)
+	OpenConversations = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "viktig_open_conversations",
+			Help: "VK conversations waiting for a community reply",
+		},
+		[]string{"hook_id"},
+	)
+	ConversationReplyTime = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "viktig_conversation_reply_seconds",
+			Help:    "Time from the first unanswered message of a VK conversation to the community reply",
+			Buckets: []float64{60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400},
+		},
+		[]string{"hook_id"},
+	)
+	RemindersSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "viktig_reminders_sent_total",
+			Help: "Reminders about unanswered VK conversations, level is reminder or escalation",
+		},
+		[]string{"hook_id", "level"},
+	)
+	VkApiRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "viktig_vk_api_request_duration_seconds"},
+		[]string{"method", "status"},
+	)
+	TgApiRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "viktig_tg_api_request_duration_seconds"},
+		[]string{"method", "status"},
+	)
+	SinkRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "viktig_sink_request_duration_seconds"},
+		[]string{"sink", "method", "status"},
+	)
+	TgRateLimitWait = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "viktig_tg_rate_limit_wait_seconds",
+			Help:    "Time spent waiting for the Telegram rate limits before sending a message",
+			Buckets: []float64{.01, .1, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+	)
+	CacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{Name: "viktig_cache_requests"},
+		[]string{"cache", "result"},
+	)
+	ServiceRestarts = promauto.NewCounterVec(
+		prometheus.CounterOpts{Name: "viktig_service_restarts"},
+		[]string{"service"},
+	)
+	ServiceState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "viktig_service_state",
+			Help: "0 - starting, 1 - running, 2 - restarting, 3 - failed, 4 - stopped",
+		},
+		[]string{"service"},
+	)
+	StageProcessed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "viktig_stage_processed_total",
+			Help: "Elements processed by pipeline stages, result is passed, filtered or lost",
+		},
+		[]string{"stage", "result"},
+	)
+	StageDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "viktig_stage_duration_seconds",
+			Help: "Time pipeline stages spend processing an element",
+		},
+		[]string{"stage"},
+	)
+	StageBusyWorkers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "viktig_stage_busy_workers",
+			Help: "Workers of pipeline stages processing an element",
+		},
+		[]string{"stage"},
 	)
 )
+
+// RegisterQueueCapacity exports the number of elements the queue with the given name can hold
+func RegisterQueueCapacity(queue string, capacity int) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "viktig_queue_capacity",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	})
+	gauge.Set(float64(capacity))
+	prometheus.Unregister(gauge)
+	prometheus.MustRegister(gauge)
+}
+
+// RegisterQueueDepth exports the number of elements waiting in the queue with the given name.
+// Replaces the previously registered queue with the same name.
+func RegisterQueueDepth(queue string, depth func() int) {
+	gauge := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "viktig_queue_depth",
+			ConstLabels: prometheus.Labels{"queue": queue},
+		},
+		func() float64 { return float64(depth()) },
+	)
+	prometheus.Unregister(gauge)
+	prometheus.MustRegister(gauge)
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InstrumentedTransport observes the duration of API requests. The API method is taken from the last URL path segment,
+// which is the case for both VK and Telegram APIs, unless Method is set.
+type InstrumentedTransport struct {
+	Next     http.RoundTripper
+	Duration prometheus.ObserverVec
+	// Method returns the method label of the request, e.g. for URLs containing secrets
+	Method func(req *http.Request) string
+}
+
+func (t *InstrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	start := time.Now()
+	resp, err := next.RoundTrip(req)
+	method := path.Base(req.URL.Path)
+	if t.Method != nil {
+		method = t.Method(req)
+	}
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	t.Duration.
+		With(prometheus.Labels{"method": method, "status": status}).
+		Observe(time.Since(start).Seconds())
+	return resp, err
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bottoken/getMe" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test"}, []string{"method", "status"})
+	client := &http.Client{Transport: &InstrumentedTransport{Duration: duration}}
+
+	_, err := client.Get(server.URL + "/method/users.get")
+	assert.NoError(t, err)
+	_, err = client.Get(server.URL + "/bottoken/getMe")
+	assert.NoError(t, err)
+	_, err = client.Get("http://127.0.0.1:0/bottoken/sendMessage")
+	assert.Error(t, err)
+
+	assert.Equal(t, 3, testutil.CollectAndCount(duration))
+	// no new series are created for the expected labels
+	duration.WithLabelValues("users.get", "200")
+	duration.WithLabelValues("getMe", "401")
+	duration.WithLabelValues("sendMessage", "error")
+	assert.Equal(t, 3, testutil.CollectAndCount(duration))
+}
+
+func TestInstrumentedTransportMethod(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test"}, []string{"sink", "method", "status"})
+	client := &http.Client{Transport: &InstrumentedTransport{
+		Duration: duration.MustCurryWith(prometheus.Labels{"sink": "discord"}),
+		Method:   func(req *http.Request) string { return req.Method },
+	}}
+
+	_, err := client.Post(server.URL+"/api/webhooks/1/secret-token", "application/json", nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, testutil.CollectAndCount(duration))
+	duration.WithLabelValues("discord", "POST", "200")
+	assert.Equal(t, 1, testutil.CollectAndCount(duration))
+}
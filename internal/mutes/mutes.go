@@ -0,0 +1,88 @@
+package mutes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"viktig/internal/storage"
+)
+
+// Store persists mutes
+type Store interface {
+	ListMutes(ctx context.Context) ([]storage.Mute, error)
+	SaveMute(ctx context.Context, mute storage.Mute) error
+	DeleteMute(ctx context.Context, tgChatId int) error
+}
+
+// Mutes keeps the Telegram chats forwarding to which is paused
+type Mutes struct {
+	store Store
+	mu    sync.RWMutex
+	until map[int]time.Time
+	now   func() time.Time
+}
+
+// New creates mutes. They are only kept in memory if store is nil.
+func New(store Store) *Mutes {
+	return &Mutes{store: store, until: make(map[int]time.Time), now: time.Now}
+}
+
+// Load loads the mutes from the store
+func (m *Mutes) Load(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+	mutes, err := m.store.ListMutes(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading mutes: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.until = make(map[int]time.Time, len(mutes))
+	for _, mute := range mutes {
+		m.until[mute.TgChatId] = mute.Until
+	}
+	return nil
+}
+
+// Mute pauses forwarding to the chat until the given time, or until Unmute if it is zero
+func (m *Mutes) Mute(ctx context.Context, tgChatId int, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store != nil {
+		if err := m.store.SaveMute(ctx, storage.Mute{TgChatId: tgChatId, Until: until}); err != nil {
+			return err
+		}
+	}
+	m.until[tgChatId] = until
+	return nil
+}
+
+func (m *Mutes) Unmute(ctx context.Context, tgChatId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store != nil {
+		if err := m.store.DeleteMute(ctx, tgChatId); err != nil {
+			return err
+		}
+	}
+	delete(m.until, tgChatId)
+	return nil
+}
+
+// MutedUntil reports whether the chat is muted and until when, the time is zero if the chat is muted until Unmute
+func (m *Mutes) MutedUntil(tgChatId int) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	until, ok := m.until[tgChatId]
+	if !ok || (!until.IsZero() && !m.now().Before(until)) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (m *Mutes) Muted(tgChatId int) bool {
+	_, muted := m.MutedUntil(tgChatId)
+	return muted
+}
@@ -0,0 +1,54 @@
+package mutes
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+	"viktig/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("persisted", func(t *testing.T) {
+		store := openTestStorage(t)
+		m := New(store)
+		until := time.Now().Add(time.Hour)
+		require.NoError(t, m.Mute(ctx, 1, until))
+		require.NoError(t, m.Mute(ctx, 2, time.Time{}))
+		require.NoError(t, m.Mute(ctx, 3, time.Time{}))
+		require.NoError(t, m.Unmute(ctx, 3))
+
+		m = New(store)
+		require.NoError(t, m.Load(ctx))
+		actual, muted := m.MutedUntil(1)
+		assert.True(t, muted)
+		assert.WithinDuration(t, until, actual, time.Millisecond)
+		actual, muted = m.MutedUntil(2)
+		assert.True(t, muted)
+		assert.True(t, actual.IsZero())
+		assert.False(t, m.Muted(3))
+	})
+	t.Run("expired", func(t *testing.T) {
+		m := New(nil)
+		now := time.Now()
+		m.now = func() time.Time { return now }
+		require.NoError(t, m.Mute(ctx, 1, now.Add(time.Minute)))
+		assert.True(t, m.Muted(1))
+
+		now = now.Add(time.Minute)
+		assert.False(t, m.Muted(1))
+	})
+}
+
+func openTestStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	s, err := storage.Open(context.Background(), filepath.Join(t.TempDir(), "viktig.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
@@ -0,0 +1,243 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+
+	"viktig/internal/health"
+	"viktig/internal/metrics"
+	"viktig/internal/queue"
+)
+
+const (
+	resultPassed   = "passed"
+	resultFiltered = "filtered"
+	resultLost     = "lost"
+)
+
+var errStopped = errors.New("stopped")
+
+// Stage processes the elements passing through a pipeline. Process may be called concurrently by several workers.
+type Stage[T any] interface {
+	// Start prepares the stage, e.g. checks the API credentials. It is called each time the stage is (re)started.
+	Start(ctx context.Context) error
+	// Process returns the element to pass to the next stage. The element is not passed on if ok is false.
+	Process(ctx context.Context, x T) (result T, ok bool)
+	// Lost handles an element that could not be processed within the drain timeout on shutdown
+	Lost(x T)
+}
+
+// Keyed is implemented by stages ordering elements by their own key instead of the pipeline one.
+// Elements with the same pipeline key must have the same stage key, otherwise their order is not kept.
+type Keyed[T any] interface {
+	Key(x T) string
+}
+
+// Flusher is implemented by stages buffering elements. Flush is called on shutdown after the remaining elements
+// are processed, with a context cancelled once the drain timeout passed.
+type Flusher interface {
+	Flush(ctx context.Context)
+}
+
+// Pipeline passes the elements put to its input queue through the stages in the order they were added.
+// Elements with the same key are processed by each stage in the order they were put.
+type Pipeline[T any] struct {
+	in           *queue.Queue[T]
+	key          func(T) string
+	capacity     int
+	drainTimeout time.Duration
+	stages       []*Runner[T]
+	l            *slog.Logger
+}
+
+// New creates a pipeline taking elements from in. The queues between the stages hold up to capacity elements.
+func New[T any](
+	in *queue.Queue[T],
+	key func(T) string,
+	capacity int,
+	drainTimeout time.Duration,
+	l *slog.Logger,
+) *Pipeline[T] {
+	return &Pipeline[T]{
+		in:           in,
+		key:          key,
+		capacity:     capacity,
+		drainTimeout: drainTimeout,
+		l:            l,
+	}
+}
+
+// Add appends a stage processed by the given number of workers
+func (p *Pipeline[T]) Add(name string, stage Stage[T], workers int) *Runner[T] {
+	in := p.in
+	if len(p.stages) > 0 {
+		// The previous stage is blocked if the queue is full
+		in = queue.NewBoundedQueue[T](p.capacity, queue.OverflowBlock, nil)
+		p.stages[len(p.stages)-1].out = in
+	}
+	key := p.key
+	if keyed, ok := stage.(Keyed[T]); ok {
+		key = keyed.Key
+	}
+	r := &Runner[T]{
+		name:         name,
+		stage:        stage,
+		workers:      max(workers, 1),
+		key:          key,
+		in:           in,
+		drainTimeout: p.drainTimeout,
+		l:            p.l.With("service", name),
+	}
+	p.stages = append(p.stages, r)
+	metrics.RegisterQueueDepth(name, in.Len)
+	metrics.RegisterQueueCapacity(name, in.Cap())
+	return r
+}
+
+// Stages returns the stages in the order they were added, which is also the order they should be stopped in
+func (p *Pipeline[T]) Stages() []*Runner[T] {
+	return p.stages
+}
+
+// Runner runs a stage as a service taking elements from the input queue of the stage
+type Runner[T any] struct {
+	name         string
+	stage        Stage[T]
+	workers      int
+	key          func(T) string
+	in           *queue.Queue[T]
+	out          *queue.Queue[T]
+	drainTimeout time.Duration
+	ready        health.Probe
+	l            *slog.Logger
+}
+
+func (r *Runner[T]) Name() string {
+	return r.name
+}
+
+// In returns the input queue of the stage
+func (r *Runner[T]) In() *queue.Queue[T] {
+	return r.in
+}
+
+// Ready reports whether the stage started and is processing elements
+func (r *Runner[T]) Ready() error {
+	return r.ready.Check()
+}
+
+// Stalled reports whether the input queue of the stage is not taken from, see queue.Queue.Stalled
+func (r *Runner[T]) Stalled(threshold time.Duration) error {
+	return r.in.Stalled(threshold)
+}
+
+// Run processes elements until ctx is done, then the remaining ones are processed within the drain timeout.
+// Each element is handled by the worker assigned to its key, so elements with the same key are processed in order.
+func (r *Runner[T]) Run(ctx context.Context) error {
+	if err := r.stage.Start(ctx); err != nil {
+		return err
+	}
+	r.ready.SetReady()
+	defer r.ready.SetNotReady(errStopped)
+	r.l.Info("stage is ready", "workers", r.workers)
+
+	// workCtx outlives ctx by the drain timeout, so that the taken elements can still be processed on shutdown
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	go r.cancelAfterDrain(ctx, workCtx, cancel)
+
+	shards := make([]chan T, r.workers)
+	wg := sync.WaitGroup{}
+	for i := range shards {
+		shards[i] = make(chan T)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for x := range shards[i] {
+				r.process(workCtx, x)
+			}
+		}()
+	}
+	dispatch := func(x T) {
+		select {
+		case shards[r.shard(x)] <- x:
+		case <-workCtx.Done():
+			r.lose(x)
+		}
+	}
+
+	for {
+		x, err := r.in.TakeCtx(ctx)
+		if err != nil {
+			break
+		}
+		dispatch(x)
+	}
+	r.l.Info("stopping stage")
+	for _, x := range r.in.Drain(workCtx, dispatch) {
+		r.lose(x)
+	}
+	for _, shard := range shards {
+		close(shard)
+	}
+	wg.Wait()
+	if flusher, ok := r.stage.(Flusher); ok {
+		flusher.Flush(workCtx)
+	}
+	return nil
+}
+
+func (r *Runner[T]) cancelAfterDrain(ctx context.Context, workCtx context.Context, cancel context.CancelFunc) {
+	select {
+	case <-ctx.Done():
+	case <-workCtx.Done():
+		return
+	}
+	timer := time.NewTimer(r.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		cancel()
+	case <-workCtx.Done():
+	}
+}
+
+func (r *Runner[T]) process(ctx context.Context, x T) {
+	if ctx.Err() != nil {
+		r.lose(x)
+		return
+	}
+	metrics.StageBusyWorkers.WithLabelValues(r.name).Inc()
+	start := time.Now()
+	result, ok := r.stage.Process(ctx, x)
+	metrics.StageDuration.WithLabelValues(r.name).Observe(time.Since(start).Seconds())
+	metrics.StageBusyWorkers.WithLabelValues(r.name).Dec()
+	if !ok {
+		metrics.StageProcessed.WithLabelValues(r.name, resultFiltered).Inc()
+		return
+	}
+	if r.out != nil && !r.out.PutCtx(ctx, result) {
+		r.lose(result)
+		return
+	}
+	metrics.StageProcessed.WithLabelValues(r.name, resultPassed).Inc()
+}
+
+func (r *Runner[T]) lose(x T) {
+	metrics.StageProcessed.WithLabelValues(r.name, resultLost).Inc()
+	r.stage.Lost(x)
+}
+
+// shard returns the worker processing elements with the key of x
+func (r *Runner[T]) shard(x T) int {
+	if r.workers == 1 || r.key == nil {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(r.key(x)))
+	return int(h.Sum32() % uint32(r.workers))
+}
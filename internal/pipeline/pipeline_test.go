@@ -0,0 +1,244 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type element struct {
+	key   string
+	value int
+}
+
+func TestPipeline(t *testing.T) {
+	t.Run("stages", func(t *testing.T) {
+		in := queue.NewQueue[element]()
+		p := New(in, elementKey, 10, time.Second, discardLogger())
+		double := &fakeStage{process: func(x element) (element, bool) { x.value *= 2; return x, true }}
+		odd := &fakeStage{process: func(x element) (element, bool) { return x, x.value%4 != 0 }}
+		last := &fakeStage{}
+		p.Add("double", double, 1)
+		p.Add("odd", odd, 1)
+		p.Add("last", last, 1)
+		stop := run(t, p)
+
+		for i := range 4 {
+			in.Put(element{key: "a", value: i})
+		}
+		stop()
+
+		assert.Equal(t, []int{2, 6}, last.values())
+	})
+	t.Run("ordered per key", func(t *testing.T) {
+		in := queue.NewQueue[element]()
+		p := New(in, elementKey, 10, time.Second, discardLogger())
+		stage := &fakeStage{process: func(x element) (element, bool) {
+			// Later elements of a key are processed faster, which would reorder them if they were processed concurrently
+			time.Sleep(time.Duration(10-x.value) * time.Millisecond)
+			return x, true
+		}}
+		p.Add("stage", stage, 4)
+		stop := run(t, p)
+
+		for i := range 10 {
+			for _, key := range []string{"a", "b", "c"} {
+				in.Put(element{key: key, value: i})
+			}
+		}
+		stop()
+
+		for _, key := range []string{"a", "b", "c"} {
+			assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, stage.keyValues(key))
+		}
+	})
+	t.Run("stage key", func(t *testing.T) {
+		in := queue.NewQueue[element]()
+		p := New(in, elementKey, 10, time.Second, discardLogger())
+		r := p.Add("stage", &keyedStage{}, 4)
+
+		for _, key := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+			assert.Equal(t, r.shard(element{key: "a", value: 1}), r.shard(element{key: key, value: 1}))
+		}
+	})
+	t.Run("concurrent workers", func(t *testing.T) {
+		in := queue.NewQueue[element]()
+		p := New(in, elementKey, 10, time.Second, discardLogger())
+		stage := &fakeStage{process: func(x element) (element, bool) {
+			time.Sleep(50 * time.Millisecond)
+			return x, true
+		}}
+		p.Add("stage", stage, 8)
+		stop := run(t, p)
+
+		start := time.Now()
+		for i := range 8 {
+			in.Put(element{key: strconv.Itoa(i), value: i})
+		}
+		stop()
+
+		assert.Len(t, stage.values(), 8)
+		assert.Less(t, time.Since(start), 8*50*time.Millisecond)
+	})
+	t.Run("start error", func(t *testing.T) {
+		in := queue.NewQueue[element]()
+		p := New(in, elementKey, 10, time.Second, discardLogger())
+		p.Add("stage", &fakeStage{startErr: errors.New("error")}, 1)
+		r := p.Stages()[0]
+
+		assert.EqualError(t, r.Run(context.Background()), "error")
+		assert.Error(t, r.Ready())
+	})
+	t.Run("flush", func(t *testing.T) {
+		in := queue.NewQueue[element]()
+		p := New(in, elementKey, 10, time.Second, discardLogger())
+		stage := &flushingStage{}
+		p.Add("stage", stage, 2)
+		stop := run(t, p)
+
+		for i := range 3 {
+			in.Put(element{key: strconv.Itoa(i), value: i})
+		}
+		stop()
+
+		assert.Equal(t, 3, stage.flushedCount)
+	})
+	t.Run("drain timeout", func(t *testing.T) {
+		in := queue.NewBoundedQueue[element](10, queue.OverflowBlock, nil)
+		p := New(in, elementKey, 10, 20*time.Millisecond, discardLogger())
+		stage := &fakeStage{process: func(x element) (element, bool) {
+			time.Sleep(15 * time.Millisecond)
+			return x, true
+		}}
+		p.Add("stage", stage, 1)
+		for i := range 5 {
+			in.Put(element{key: "a", value: i})
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		require.NoError(t, p.Stages()[0].Run(ctx))
+
+		assert.NotEmpty(t, stage.lostValues())
+		assert.Equal(t, 5, len(stage.values())+len(stage.lostValues()))
+	})
+}
+
+// run runs the stages in order. Returns a function stopping them in order after the input is processed.
+func run(t *testing.T, p *Pipeline[element]) (stop func()) {
+	t.Helper()
+	stages := p.Stages()
+	cancels := make([]context.CancelFunc, len(stages))
+	errChs := make([]chan error, len(stages))
+	for i, stage := range stages {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[i] = cancel
+		errChs[i] = make(chan error, 1)
+		go func() { errChs[i] <- stage.Run(ctx) }()
+		require.Eventually(t, func() bool { return stage.Ready() == nil }, time.Second, time.Millisecond)
+	}
+	return func() {
+		for i := range stages {
+			cancels[i]()
+			require.NoError(t, <-errChs[i])
+		}
+	}
+}
+
+func elementKey(x element) string {
+	return x.key
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// keyedStage orders elements by value instead of key
+type keyedStage struct {
+	fakeStage
+}
+
+func (s *keyedStage) Key(x element) string {
+	return strconv.Itoa(x.value)
+}
+
+// flushingStage records how many elements were processed before the flush
+type flushingStage struct {
+	fakeStage
+	flushedCount int
+}
+
+func (s *flushingStage) Flush(_ context.Context) {
+	s.flushedCount = len(s.values())
+}
+
+type fakeStage struct {
+	startErr error
+	process  func(x element) (element, bool)
+
+	mu        sync.Mutex
+	processed []element
+	lost      []element
+}
+
+func (s *fakeStage) Start(_ context.Context) error {
+	return s.startErr
+}
+
+func (s *fakeStage) Process(_ context.Context, x element) (element, bool) {
+	result, ok := x, true
+	if s.process != nil {
+		result, ok = s.process(x)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed = append(s.processed, x)
+	return result, ok
+}
+
+func (s *fakeStage) Lost(x element) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lost = append(s.lost, x)
+}
+
+func (s *fakeStage) values() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]int, 0, len(s.processed))
+	for _, x := range s.processed {
+		values = append(values, x.value)
+	}
+	return values
+}
+
+func (s *fakeStage) keyValues(key string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []int
+	for _, x := range s.processed {
+		if x.key == key {
+			values = append(values, x.value)
+		}
+	}
+	return values
+}
+
+func (s *fakeStage) lostValues() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]int, 0, len(s.lost))
+	for _, x := range s.lost {
+		values = append(values, x.value)
+	}
+	return values
+}
@@ -1,21 +1,262 @@
 package queue
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFull   = errors.New("queue is full")
+	ErrClosed = errors.New("queue is closed")
+)
+
+// OverflowPolicy defines what TryPut does when the queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits until there is space in the queue
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest drops the oldest elements to make space for the new one
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowReject fails with ErrFull
+	OverflowReject OverflowPolicy = "reject"
+)
+
 type Queue[T any] struct {
-	ch chan T
+	ch       chan T
+	overflow OverflowPolicy
+	onDrop   func(T)
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	waiting int
+	// progressAt is when an element was last taken or put to the empty queue
+	progressAt time.Time
 }
 
+// NewQueue creates an unbuffered queue in which each Put waits for a Take
 func NewQueue[T any]() *Queue[T] {
-	return &Queue[T]{ch: make(chan T)}
+	return NewBoundedQueue[T](0, OverflowBlock, nil)
+}
+
+// NewBoundedQueue creates a queue holding up to capacity elements.
+// The overflow policy only applies to TryPut, onDrop is called with the elements dropped by OverflowDropOldest.
+func NewBoundedQueue[T any](capacity int, overflow OverflowPolicy, onDrop func(T)) *Queue[T] {
+	if overflow == OverflowDropOldest && capacity == 0 {
+		panic("queue: drop_oldest overflow policy requires a positive capacity")
+	}
+	return &Queue[T]{
+		ch:         make(chan T, capacity),
+		overflow:   overflow,
+		onDrop:     onDrop,
+		closed:     make(chan struct{}),
+		progressAt: time.Now(),
+	}
 }
 
 func (q *Queue[T]) Put(x T) {
-	q.ch <- x
+	q.PutCtx(context.Background(), x)
+}
+
+// PutCtx blocks until x is put to the queue or ctx is done. Returns false if x was not put.
+func (q *Queue[T]) PutCtx(ctx context.Context, x T) bool {
+	return q.put(ctx, x) == nil
 }
 
+// TryPut puts x to the queue applying the overflow policy if the queue is full.
+// Returns ErrFull if x is rejected, ErrClosed if the queue is closed or the ctx error if ctx is done while blocked.
+func (q *Queue[T]) TryPut(ctx context.Context, x T) error {
+	switch q.overflow {
+	case OverflowReject:
+		if q.isClosed() {
+			return ErrClosed
+		}
+		select {
+		case q.ch <- x:
+			q.putDone()
+			return nil
+		default:
+			return ErrFull
+		}
+	case OverflowDropOldest:
+		for {
+			if q.isClosed() {
+				return ErrClosed
+			}
+			select {
+			case q.ch <- x:
+				q.putDone()
+				return nil
+			default:
+			}
+			select {
+			case dropped := <-q.ch:
+				if q.onDrop != nil {
+					q.onDrop(dropped)
+				}
+			default:
+			}
+		}
+	default:
+		return q.put(ctx, x)
+	}
+}
+
+// Take blocks until an element is available. Returns the zero value if the queue is closed and empty.
 func (q *Queue[T]) Take() T {
-	return <-q.ch
+	x, _ := q.TakeCtx(context.Background())
+	return x
 }
 
-func (q *Queue[T]) AsChan() chan T {
+// TakeCtx blocks until an element is available or ctx is done.
+// The elements remaining in a closed queue are still returned, then TakeCtx fails with ErrClosed.
+func (q *Queue[T]) TakeCtx(ctx context.Context) (T, error) {
+	var zero T
+	select {
+	case x := <-q.ch:
+		q.markProgress()
+		return x, nil
+	case <-q.closed:
+		select {
+		case x := <-q.ch:
+			q.markProgress()
+			return x, nil
+		default:
+			return zero, ErrClosed
+		}
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// AsChan exposes the underlying channel. Elements received from it are not tracked by Stalled.
+func (q *Queue[T]) AsChan() <-chan T {
 	return q.ch
 }
+
+// Close makes subsequent puts fail with ErrClosed and wakes up the blocked producers.
+// Consumers can still take the remaining elements.
+func (q *Queue[T]) Close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// Cap returns the number of elements the queue can hold
+func (q *Queue[T]) Cap() int {
+	return cap(q.ch)
+}
+
+// Len returns the number of elements waiting to be taken, including the ones of the blocked producers
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ch) + q.waiting
+}
+
+// Drain passes the elements remaining in the queue to handle until the queue is empty or ctx is done.
+// Elements left in the queue after ctx is done are returned without being handled.
+//
+//	Should only be called after the producers have stopped, otherwise Drain may never return.
+func (q *Queue[T]) Drain(ctx context.Context, handle func(T)) (left []T) {
+	for ctx.Err() == nil {
+		select {
+		case x := <-q.ch:
+			q.markProgress()
+			handle(x)
+		default:
+			return nil
+		}
+	}
+	for {
+		select {
+		case x := <-q.ch:
+			left = append(left, x)
+		default:
+			return left
+		}
+	}
+}
+
+// Stalled returns an error if there are elements waiting in the queue
+// and none of them were taken for longer than threshold.
+func (q *Queue[T]) Stalled(threshold time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	since := time.Since(q.progressAt)
+	if since <= threshold {
+		return nil
+	}
+	if q.waiting > 0 {
+		return fmt.Errorf("%d producers waiting for %s", q.waiting, since.Round(time.Second))
+	}
+	if buffered := len(q.ch); buffered > 0 {
+		return fmt.Errorf("%d elements not taken for %s", buffered, since.Round(time.Second))
+	}
+	return nil
+}
+
+func (q *Queue[T]) put(ctx context.Context, x T) error {
+	if q.isClosed() {
+		return ErrClosed
+	}
+	select {
+	case q.ch <- x:
+		q.putDone()
+		return nil
+	default:
+	}
+
+	q.startWaiting()
+	defer q.stopWaiting()
+	select {
+	case q.ch <- x:
+		// The producer was blocked, so the queue had to be taken from
+		q.markProgress()
+		return nil
+	case <-q.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue[T]) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// putDone records a put that did not block. Putting to the empty queue starts the stall check.
+func (q *Queue[T]) putDone() {
+	if cap(q.ch) == 0 || len(q.ch) <= 1 {
+		q.markProgress()
+	}
+}
+
+func (q *Queue[T]) markProgress() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.progressAt = time.Now()
+}
+
+func (q *Queue[T]) startWaiting() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.ch)+q.waiting == 0 {
+		q.progressAt = time.Now()
+	}
+	q.waiting++
+}
+
+func (q *Queue[T]) stopWaiting() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting--
+}
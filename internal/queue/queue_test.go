@@ -1,8 +1,10 @@
 package queue
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -93,4 +95,158 @@ func TestQueue(t *testing.T) {
 
 		assert.True(t, blocks)
 	})
+	t.Run("drain", func(t *testing.T) {
+		q := NewQueue[int]()
+		go func() {
+			q.Put(1)
+			q.Put(2)
+		}()
+
+		var handled []int
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for len(handled) < 2 {
+				left := q.Drain(context.Background(), func(x int) { handled = append(handled, x) })
+				assert.Empty(t, left)
+			}
+		}()
+		wg.Wait()
+
+		assert.Equal(t, []int{1, 2}, handled)
+	})
+
+	t.Run("drain empty", func(t *testing.T) {
+		q := NewQueue[int]()
+
+		left := q.Drain(context.Background(), func(x int) { t.Fail() })
+
+		assert.Empty(t, left)
+	})
+
+	t.Run("drain cancelled", func(t *testing.T) {
+		q := NewQueue[int]()
+		putDone := make(chan any)
+		go func() {
+			q.Put(1)
+			close(putDone)
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var left []int
+		assert.Eventually(t, func() bool {
+			left = append(left, q.Drain(ctx, func(x int) { t.Fail() })...)
+			return len(left) == 1
+		}, time.Second, time.Millisecond)
+		<-putDone
+
+		assert.Equal(t, []int{1}, left)
+	})
+	t.Run("put ctx", func(t *testing.T) {
+		q := NewQueue[int]()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.False(t, q.PutCtx(ctx, 1))
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		q := NewQueue[int]()
+		assert.NoError(t, q.Stalled(0))
+
+		go q.Put(1)
+		assert.Eventually(t, func() bool { return q.Stalled(10*time.Millisecond) != nil }, time.Second, time.Millisecond)
+		assert.EqualError(t, q.Stalled(10*time.Millisecond), "1 producers waiting for 0s")
+
+		q.Take()
+		assert.Eventually(t, func() bool { return q.Stalled(0) == nil }, time.Second, time.Millisecond)
+	})
+	t.Run("stalled buffered", func(t *testing.T) {
+		q := NewBoundedQueue[int](2, OverflowBlock, nil)
+		q.Put(1)
+		assert.Eventually(t, func() bool { return q.Stalled(10*time.Millisecond) != nil }, time.Second, time.Millisecond)
+		assert.EqualError(t, q.Stalled(10*time.Millisecond), "1 elements not taken for 0s")
+
+		q.Take()
+		assert.NoError(t, q.Stalled(0))
+	})
+}
+
+func TestBoundedQueue(t *testing.T) {
+	t.Run("capacity", func(t *testing.T) {
+		q := NewBoundedQueue[int](2, OverflowBlock, nil)
+		q.Put(1)
+		q.Put(2)
+		assert.Equal(t, 2, q.Len())
+		assert.Equal(t, 2, q.Cap())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.False(t, q.PutCtx(ctx, 3))
+		assert.ErrorIs(t, q.TryPut(ctx, 3), context.DeadlineExceeded)
+		assert.Equal(t, 2, q.Len())
+	})
+	t.Run("reject", func(t *testing.T) {
+		q := NewBoundedQueue[int](1, OverflowReject, nil)
+		assert.NoError(t, q.TryPut(context.Background(), 1))
+		assert.ErrorIs(t, q.TryPut(context.Background(), 2), ErrFull)
+		assert.Equal(t, 1, q.Take())
+	})
+	t.Run("drop oldest", func(t *testing.T) {
+		var dropped []int
+		q := NewBoundedQueue[int](2, OverflowDropOldest, func(x int) { dropped = append(dropped, x) })
+		for i := 1; i <= 4; i++ {
+			assert.NoError(t, q.TryPut(context.Background(), i))
+		}
+		assert.Equal(t, []int{1, 2}, dropped)
+		assert.Equal(t, 3, q.Take())
+		assert.Equal(t, 4, q.Take())
+	})
+	t.Run("drop oldest unbuffered", func(t *testing.T) {
+		assert.Panics(t, func() { NewBoundedQueue[int](0, OverflowDropOldest, nil) })
+	})
+	t.Run("take ctx", func(t *testing.T) {
+		q := NewBoundedQueue[int](1, OverflowBlock, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := q.TakeCtx(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		q.Put(1)
+		x, err := q.TakeCtx(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, x)
+	})
+	t.Run("close", func(t *testing.T) {
+		q := NewBoundedQueue[int](1, OverflowBlock, nil)
+		q.Put(1)
+		blockedErr := make(chan error)
+		go func() { blockedErr <- q.TryPut(context.Background(), 2) }()
+		assert.Eventually(t, func() bool { return q.Len() == 2 }, time.Second, time.Millisecond)
+
+		q.Close()
+		q.Close()
+
+		assert.ErrorIs(t, <-blockedErr, ErrClosed)
+		assert.False(t, q.PutCtx(context.Background(), 3))
+		x, err := q.TakeCtx(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, x)
+		_, err = q.TakeCtx(context.Background())
+		assert.ErrorIs(t, err, ErrClosed)
+	})
+	t.Run("close wakes consumers", func(t *testing.T) {
+		q := NewQueue[int]()
+		takeErr := make(chan error)
+		go func() {
+			_, err := q.TakeCtx(context.Background())
+			takeErr <- err
+		}()
+
+		q.Close()
+
+		assert.ErrorIs(t, <-takeErr, ErrClosed)
+	})
 }
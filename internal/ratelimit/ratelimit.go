@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is how long a key may not be used before its limiter is forgotten
+const idleTimeout = 10 * time.Minute
+
+type entry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter is a token bucket rate limiter with a separate bucket for each key
+type Limiter struct {
+	rate  rate.Limit
+	burst int
+
+	mu          sync.Mutex
+	entries     map[string]*entry
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+// New returns a limiter allowing ratePerSecond events per second with bursts of up to burst events for each key
+func New(ratePerSecond float64, burst int) *Limiter {
+	return &Limiter{
+		rate:        rate.Limit(ratePerSecond),
+		burst:       burst,
+		entries:     make(map[string]*entry),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// Allow reports whether an event for key may happen now
+func (l *Limiter) Allow(key string) bool {
+	return l.get(key).Allow()
+}
+
+// Ready reports whether an event for key may happen now without using up the token
+func (l *Limiter) Ready(key string) bool {
+	return l.get(key).Tokens() >= 1
+}
+
+// Wait blocks until an event for key may happen or ctx is done
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+	return l.get(key).Wait(ctx)
+}
+
+func (l *Limiter) get(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastCleanup) > idleTimeout {
+		for k, e := range l.entries {
+			if now.Sub(e.lastSeen) > idleTimeout {
+				delete(l.entries, k)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.entries[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Run("burst", func(t *testing.T) {
+		l := New(0.001, 2)
+
+		assert.True(t, l.Allow("a"))
+		assert.True(t, l.Allow("a"))
+		assert.False(t, l.Allow("a"))
+	})
+	t.Run("separate keys", func(t *testing.T) {
+		l := New(0.001, 1)
+
+		assert.True(t, l.Allow("a"))
+		assert.False(t, l.Allow("a"))
+		assert.True(t, l.Allow("b"))
+	})
+	t.Run("ready", func(t *testing.T) {
+		l := New(0.001, 1)
+
+		assert.True(t, l.Ready("a"))
+		assert.True(t, l.Ready("a"))
+		assert.True(t, l.Allow("a"))
+		assert.False(t, l.Ready("a"))
+	})
+	t.Run("wait", func(t *testing.T) {
+		l := New(1000, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, l.Wait(ctx, "a"))
+		assert.NoError(t, l.Wait(ctx, "a"))
+	})
+	t.Run("wait cancelled", func(t *testing.T) {
+		l := New(0.001, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.NoError(t, l.Wait(context.Background(), "a"))
+		assert.Error(t, l.Wait(ctx, "a"))
+	})
+	t.Run("forget idle keys", func(t *testing.T) {
+		l := New(0.001, 1)
+		now := time.Now()
+		l.now = func() time.Time { return now }
+		l.Allow("a")
+		now = now.Add(2 * idleTimeout)
+		l.Allow("b")
+
+		assert.NotContains(t, l.entries, "a")
+		assert.Contains(t, l.entries, "b")
+	})
+}
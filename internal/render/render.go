@@ -0,0 +1,88 @@
+package render
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"viktig/internal/entities"
+)
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, `*`, `\*`, `_`, `\_`, `~`, `\~`, "`", "\\`", `|`, `\|`, `>`, `\>`, `#`, `\#`, `[`, `\[`, `]`, `\]`,
+)
+
+var messageTypeIcons = map[entities.MessageType]string{
+	entities.MessageTypeNew:   "💬",
+	entities.MessageTypeEdit:  "✏️",
+	entities.MessageTypeReply: "↩️",
+}
+
+var messageTypeColors = map[entities.MessageType]int{
+	entities.MessageTypeNew:   0x0077ff,
+	entities.MessageTypeEdit:  0xffa000,
+	entities.MessageTypeReply: 0x4bb34b,
+}
+
+// Color returns the RGB color of the message type, used by the sinks that show messages as colored cards
+func Color(message entities.Message) int {
+	return messageTypeColors[message.Type]
+}
+
+// Icon returns the icon shown before the text of the message
+func Icon(message entities.Message) string {
+	return messageTypeIcons[message.Type]
+}
+
+// Html renders the message with the HTML subset supported by both Telegram and Matrix, lines are separated by \n
+func Html(message entities.Message) string {
+	return SenderHtml(message) + "\n" + TextHtml(message)
+}
+
+func SenderHtml(message entities.Message) string {
+	return fmt.Sprintf("👤 <a href=\"%s\">%s</a>", message.SenderUrl(), html.EscapeString(message.SenderName()))
+}
+
+// TextHtml renders the text of the message followed by a line for each attachment
+func TextHtml(message entities.Message) string {
+	line := Icon(message) + " " + html.EscapeString(message.Text)
+	for _, attachment := range message.Attachments {
+		name := html.EscapeString(attachment.Name())
+		if attachment.Url == "" {
+			line += "\n📎 " + name
+			continue
+		}
+		line += fmt.Sprintf("\n📎 <a href=\"%s\">%s</a>", html.EscapeString(attachment.Url), name)
+	}
+	return line
+}
+
+// Text renders the message as plain text with the links after their names
+func Text(message entities.Message) string {
+	lines := []string{
+		fmt.Sprintf("👤 %s (%s)", message.SenderName(), message.SenderUrl()),
+		Icon(message) + " " + message.Text,
+	}
+	for _, attachment := range message.Attachments {
+		if attachment.Url == "" {
+			lines = append(lines, "📎 "+attachment.Name())
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("📎 %s: %s", attachment.Name(), attachment.Url))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// EscapeMarkdown escapes the text so that it is shown as is in Markdown, e.g. by Discord or Mattermost
+func EscapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// Truncate shortens the text to length characters, ending it with an ellipsis if it was longer
+func Truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
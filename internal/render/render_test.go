@@ -0,0 +1,106 @@
+package render
+
+import (
+	"testing"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHtml(t *testing.T) {
+	t.Run("new message", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeNew,
+			Text:       "Hello",
+			VkSenderId: 1234,
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/id1234\">1234</a>\n💬 Hello"
+		assert.Equal(t, expected, actual)
+	})
+	t.Run("edited message", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeEdit,
+			Text:       "Edit",
+			VkSenderId: 1234,
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/id1234\">1234</a>\n✏️ Edit"
+		assert.Equal(t, expected, actual)
+	})
+	t.Run("edited by community message", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeEdit,
+			Text:       "Edit",
+			VkSenderId: -123,
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/club123\">123</a>\n✏️ Edit"
+		assert.Equal(t, expected, actual)
+	})
+	t.Run("replied message", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeReply,
+			Text:       "Reply",
+			VkSenderId: 4321,
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/id4321\">4321</a>\n↩️ Reply"
+		assert.Equal(t, expected, actual)
+	})
+	t.Run("with sender name", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeNew,
+			Text:       "Hello",
+			VkSenderId: 1234,
+			VkSender:   &entities.VkUser{FirstName: "John", LastName: "Doe"},
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/id1234\">John Doe</a>\n💬 Hello"
+		assert.Equal(t, expected, actual)
+	})
+	t.Run("escape HTML", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeNew,
+			Text:       "<a href=\"https://x.com\">&</a>",
+			VkSenderId: 1,
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/id1\">1</a>\n💬 &lt;a href=&#34;https://x.com&#34;&gt;&amp;&lt;/a&gt;"
+		assert.Equal(t, expected, actual)
+	})
+	t.Run("attachments", func(t *testing.T) {
+		message := entities.Message{
+			Type:       entities.MessageTypeNew,
+			Text:       "Look",
+			VkSenderId: 1,
+			Attachments: []entities.Attachment{
+				{Type: "photo", Url: "https://vk.com/x.jpg?a=1&b=2"},
+				{Type: "doc", Url: "https://vk.com/doc1", Title: "<file>.pdf"},
+				{Type: "poll"},
+			},
+		}
+		actual := Html(message)
+		expected := "👤 <a href=\"https://vk.com/id1\">1</a>\n💬 Look\n" +
+			"📎 <a href=\"https://vk.com/x.jpg?a=1&amp;b=2\">photo</a>\n" +
+			"📎 <a href=\"https://vk.com/doc1\">&lt;file&gt;.pdf</a>\n" +
+			"📎 poll"
+		assert.Equal(t, expected, actual)
+	})
+}
+
+func TestText(t *testing.T) {
+	message := entities.Message{
+		Type:        entities.MessageTypeNew,
+		Text:        "Look <here>",
+		VkSenderId:  -123,
+		Attachments: []entities.Attachment{{Type: "doc", Url: "https://vk.com/doc1", Title: "file.pdf"}, {Type: "poll"}},
+	}
+	expected := "👤 123 (https://vk.com/club123)\n💬 Look <here>\n📎 file.pdf: https://vk.com/doc1\n📎 poll"
+	assert.Equal(t, expected, Text(message))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "Привет", Truncate("Привет", 6))
+	assert.Equal(t, "При…", Truncate("Привет", 4))
+}
@@ -0,0 +1,143 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidDays  = errors.New("invalid days, expected e.g. mon-fri,sun")
+	ErrInvalidClock = errors.New("invalid time, expected HH:MM")
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a daily time range on the given weekdays. A window with To not after From ends on the next day.
+type Window struct {
+	// Days are indexed by time.Weekday
+	Days [7]bool
+	// From and To are minutes since midnight
+	From int
+	To   int
+}
+
+// Schedule is a set of weekly windows in a time zone
+type Schedule struct {
+	location *time.Location
+	windows  []Window
+}
+
+func New(location *time.Location, windows []Window) *Schedule {
+	return &Schedule{location: location, windows: windows}
+}
+
+// Contains reports whether t is within one of the windows
+func (s *Schedule) Contains(t time.Time) bool {
+	_, ok := s.windowEnd(t)
+	return ok
+}
+
+// End returns the first time not within the windows since t, which is t itself if it is not within them.
+// Windows covering the whole week never end, in which case t a week later is returned.
+func (s *Schedule) End(t time.Time) time.Time {
+	limit := t.AddDate(0, 0, 7)
+	for t.Before(limit) {
+		end, ok := s.windowEnd(t)
+		if !ok {
+			return t
+		}
+		t = end
+	}
+	return limit
+}
+
+// windowEnd returns the latest end of the windows containing t
+func (s *Schedule) windowEnd(t time.Time) (time.Time, bool) {
+	local := t.In(s.location)
+	year, month, day := local.Date()
+	minute := local.Hour()*60 + local.Minute()
+	weekday := local.Weekday()
+	previous := (weekday + 6) % 7
+
+	var end time.Time
+	found := false
+	extend := func(days int, minutes int) {
+		candidate := time.Date(year, month, day+days, 0, minutes, 0, 0, s.location)
+		if !found || candidate.After(end) {
+			end = candidate
+		}
+		found = true
+	}
+	for _, w := range s.windows {
+		if w.From < w.To {
+			if w.Days[weekday] && minute >= w.From && minute < w.To {
+				extend(0, w.To)
+			}
+			continue
+		}
+		// The window ends on the next day
+		if w.Days[weekday] && minute >= w.From {
+			extend(1, w.To)
+		}
+		if w.Days[previous] && minute < w.To {
+			extend(0, w.To)
+		}
+	}
+	return end, found
+}
+
+// ParseDays parses comma separated weekdays and ranges of them, e.g. "mon-fri,sun". All days are returned for "".
+func ParseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	if strings.TrimSpace(s) == "" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, ok := weekdays[strings.ToLower(strings.TrimSpace(first))]
+		if !ok {
+			return days, ErrInvalidDays
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[strings.ToLower(strings.TrimSpace(last))]; !ok {
+				return days, ErrInvalidDays
+			}
+		}
+		// Ranges may wrap around the week, e.g. "sat-mon"
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// ParseClock parses "HH:MM" into minutes since midnight, "24:00" is the end of the day
+func ParseClock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	if !ok || len(hours) != 2 || len(minutes) != 2 {
+		return 0, ErrInvalidClock
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, ErrInvalidClock
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, ErrInvalidClock
+	}
+	return h*60 + m, nil
+}
@@ -0,0 +1,83 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	weekdays, err := ParseDays("mon-fri")
+	require.NoError(t, err)
+	weekend, err := ParseDays("sat,sun")
+	require.NoError(t, err)
+	s := New(location, []Window{
+		// Nights after weekdays
+		{Days: weekdays, From: 22 * 60, To: 8 * 60},
+		// Weekend mornings
+		{Days: weekend, From: 0, To: 11 * 60},
+	})
+	// 2024-05-03 is Friday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 5, day, hour, minute, 0, 0, location)
+	}
+
+	t.Run("contains", func(t *testing.T) {
+		// Monday morning is not quiet since the Sunday night is not
+		for _, inside := range []time.Time{at(3, 22, 0), at(3, 23, 59), at(4, 7, 59), at(4, 10, 0), at(5, 1, 0)} {
+			assert.True(t, s.Contains(inside), inside)
+		}
+		for _, outside := range []time.Time{at(3, 21, 59), at(3, 8, 0), at(4, 11, 0), at(5, 22, 30), at(6, 1, 0)} {
+			assert.False(t, s.Contains(outside), outside)
+		}
+	})
+	t.Run("other time zone", func(t *testing.T) {
+		assert.True(t, s.Contains(time.Date(2024, 5, 3, 19, 30, 0, 0, time.UTC)))
+	})
+	t.Run("end", func(t *testing.T) {
+		assert.Equal(t, at(3, 8, 0), s.End(at(3, 7, 0)))
+		assert.Equal(t, at(3, 12, 0), s.End(at(3, 12, 0)))
+		// The Friday night is followed by the Saturday morning
+		assert.True(t, at(4, 11, 0).Equal(s.End(at(3, 23, 0))))
+	})
+	t.Run("whole week", func(t *testing.T) {
+		always := New(time.UTC, []Window{{Days: [7]bool{true, true, true, true, true, true, true}, From: 0, To: 0}})
+		start := at(3, 12, 0)
+
+		assert.True(t, always.Contains(start))
+		assert.Equal(t, start.AddDate(0, 0, 7), always.End(start))
+	})
+}
+
+func TestParseDays(t *testing.T) {
+	for input, expected := range map[string][7]bool{
+		"":            {true, true, true, true, true, true, true},
+		"mon":         {false, true, false, false, false, false, false},
+		"Mon-Wed,sun": {true, true, true, true, false, false, false},
+		"fri-mon":     {true, true, false, false, false, true, true},
+	} {
+		actual, err := ParseDays(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, actual, input)
+	}
+	for _, input := range []string{"monday", "mon-", "mon,,tue", "1-5"} {
+		_, err := ParseDays(input)
+		assert.ErrorIs(t, err, ErrInvalidDays, input)
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	for input, expected := range map[string]int{"00:00": 0, "08:30": 510, "24:00": 1440} {
+		actual, err := ParseClock(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, actual, input)
+	}
+	for _, input := range []string{"", "8:30", "24:01", "12:60", "ab:cd"} {
+		_, err := ParseClock(input)
+		assert.ErrorIs(t, err, ErrInvalidClock, input)
+	}
+}
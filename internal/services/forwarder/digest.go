@@ -0,0 +1,241 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"viktig/internal/entities"
+	"viktig/internal/metrics"
+	"viktig/internal/render"
+	"viktig/internal/sinks"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxMessageLength is the Telegram limit of the message text in UTF-16 code units
+const maxMessageLength = 4096
+
+// DigestSettings batch the messages of a community into periodic summaries
+type DigestSettings struct {
+	// Interval is how long the first message of a digest waits for the others
+	Interval time.Duration
+	// MaxMessages posts the digest early once it has that many messages
+	MaxMessages int
+}
+
+// batch is the messages of a community waiting to be posted, e.g. together in a digest
+type batch struct {
+	messages []entities.Message
+	timer    *time.Timer
+}
+
+// takeBatch removes the batch of the community and returns its messages, the lock of batches must be held
+func takeBatch(batches map[string]*batch, hookId string) []entities.Message {
+	b := batches[hookId]
+	delete(batches, hookId)
+	b.timer.Stop()
+	return b.messages
+}
+
+// addToDigest buffers the message. The digest is posted once the interval since its first message passed,
+// it has MaxMessages messages or the message would not fit into it.
+// Digests are posted by the lane of the community, so that they are posted in order and do not block the worker.
+func (f *Forwarder) addToDigest(ctx context.Context, community *Community, message entities.Message) {
+	message.Sink = sinks.Telegram
+	if f.skipMuted(ctx, community, message) {
+		return
+	}
+	hookId := message.HookId
+	var full [][]entities.Message
+	f.digestsMu.Lock()
+	d, ok := f.digests[hookId]
+	if ok && textLength(renderDigest(append(d.messages[:len(d.messages):len(d.messages)], message))) > maxMessageLength {
+		full = append(full, takeBatch(f.digests, hookId))
+		ok = false
+	}
+	if !ok {
+		d = &batch{}
+		d.timer = time.AfterFunc(community.Digest.Interval, func() { f.queueFlushDigest(hookId, d) })
+		f.digests[hookId] = d
+	}
+	d.messages = append(d.messages, message)
+	if community.Digest.MaxMessages > 0 && len(d.messages) >= community.Digest.MaxMessages {
+		full = append(full, takeBatch(f.digests, hookId))
+	}
+	f.digestsMu.Unlock()
+
+	for _, messages := range full {
+		f.queueDigest(hookId, messages)
+	}
+}
+
+// Flush releases the held messages and posts all the digests, waiting for the lanes within ctx.
+// It is called on shutdown after the remaining messages are processed.
+func (f *Forwarder) Flush(ctx context.Context) {
+	f.releaseAll()
+	// The released messages may be added to the digests
+	f.drainLanes(ctx)
+	f.digestsMu.Lock()
+	digests := make(map[string]*batch, len(f.digests))
+	for hookId, d := range f.digests {
+		digests[hookId] = d
+	}
+	f.digestsMu.Unlock()
+
+	for hookId, d := range digests {
+		f.queueFlushDigest(hookId, d)
+	}
+	f.drainLanes(ctx)
+}
+
+// drainLanes waits for the work handed over to the lanes, which is cancelled once ctx is done,
+// so that the messages still waiting are kept as dead letters after the drain timeout on shutdown
+func (f *Forwarder) drainLanes(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		f.lanes.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		f.stop()
+		<-done
+	}
+}
+
+// queueFlushDigest hands posting the digest once its interval passed over to the lane of the community
+func (f *Forwarder) queueFlushDigest(hookId string, d *batch) {
+	f.lanes.add(f.hookKey(hookId), func(ctx context.Context) { f.flushDigest(ctx, hookId, d) })
+}
+
+// flushDigest posts the digest, unless it was already taken
+func (f *Forwarder) flushDigest(ctx context.Context, hookId string, d *batch) {
+	f.digestsMu.Lock()
+	if f.digests[hookId] != d {
+		f.digestsMu.Unlock()
+		return
+	}
+	messages := takeBatch(f.digests, hookId)
+	f.digestsMu.Unlock()
+
+	f.sendDigest(ctx, hookId, messages)
+}
+
+// queueDigest hands posting the taken digest over to the lane of the community
+func (f *Forwarder) queueDigest(hookId string, messages []entities.Message) {
+	f.lanes.add(f.hookKey(hookId), func(ctx context.Context) { f.sendDigest(ctx, hookId, messages) })
+}
+
+// sendDigest posts the messages as a single Telegram message and records the outcome of each of them
+func (f *Forwarder) sendDigest(ctx context.Context, hookId string, messages []entities.Message) {
+	community, ok := f.community(hookId)
+	if !ok {
+		f.l.ErrorContext(ctx, "hookId not found", "hookId", hookId)
+		for _, message := range messages {
+			f.fail(message.Context(ctx), message, metrics.FailureReasonUnknownHook, "hookId not found", 0)
+		}
+		return
+	}
+	// The chat may have been muted since the messages were added
+	unmuted := messages[:0:0]
+	for _, message := range messages {
+		if !f.skipMuted(message.Context(ctx), community, message) {
+			unmuted = append(unmuted, message)
+		}
+	}
+	messages = unmuted
+	if len(messages) == 0 {
+		return
+	}
+	if err := f.wait(ctx, community.TgChatId); err != nil {
+		f.l.ErrorContext(ctx, "digest lost on shutdown while rate limited", "hookId", hookId, "messages", len(messages))
+		failCtx := context.WithoutCancel(ctx)
+		for _, message := range messages {
+			f.fail(message.Context(failCtx), message, metrics.FailureReasonLostOnShutdown, "lost on shutdown", community.TgChatId)
+		}
+		return
+	}
+	links := make([]trace.Link, 0, len(messages))
+	for _, message := range messages {
+		links = append(links, trace.Link{SpanContext: message.SpanContext})
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"bot.SendDigest",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.Int("telegram.chat_id", community.TgChatId),
+			attribute.Int("digest.messages", len(messages)),
+		),
+	)
+	defer span.End()
+	sentMessage, err := f.send(ctx, community, renderDigest(messages), nil)
+	if err != nil {
+		f.l.ErrorContext(ctx, "error sending telegram digest", "hookId", hookId, "err", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error sending telegram digest")
+		for _, message := range messages {
+			f.fail(message.Context(ctx), message, metrics.FailureReasonTelegramError, err.Error(), community.TgChatId)
+		}
+		return
+	}
+	f.l.InfoContext(
+		ctx,
+		"sent telegram digest",
+		"id", sentMessage.ID,
+		"chatId", sentMessage.Chat.ID,
+		"messages", len(messages),
+	)
+	metrics.DigestsSent.WithLabelValues(hookId).Inc()
+	for _, message := range messages {
+		f.delivered(message.Context(ctx), message, sentMessage)
+	}
+}
+
+// renderDigest groups the messages by sender in the order of their first messages
+func renderDigest(messages []entities.Message) string {
+	var senders []int
+	bySender := make(map[int][]entities.Message)
+	for _, message := range messages {
+		if _, ok := bySender[message.VkSenderId]; !ok {
+			senders = append(senders, message.VkSenderId)
+		}
+		bySender[message.VkSenderId] = append(bySender[message.VkSenderId], message)
+	}
+
+	var b strings.Builder
+	b.WriteString(digestHeader(len(messages), len(senders)))
+	for _, sender := range senders {
+		senderMessages := bySender[sender]
+		b.WriteString("\n\n")
+		b.WriteString(render.SenderHtml(senderMessages[0]))
+		for _, message := range senderMessages {
+			b.WriteString("\n")
+			b.WriteString(render.TextHtml(message))
+		}
+	}
+	return b.String()
+}
+
+func digestHeader(messages int, senders int) string {
+	header := fmt.Sprintf("📋 %d messages", messages)
+	if messages == 1 {
+		header = "📋 1 message"
+	}
+	if senders > 1 {
+		header += fmt.Sprintf(" from %d senders", senders)
+	}
+	return header
+}
+
+// textLength returns the length of the text as counted by Telegram. Markup is counted too, so it is an upper bound.
+func textLength(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
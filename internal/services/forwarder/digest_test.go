@@ -0,0 +1,162 @@
+package forwarder
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/render"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestDigest(t *testing.T) {
+	ivan := entities.Message{HookId: "test-hook", Text: "Hello", VkSenderId: 1, VkSender: &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"}}
+	anna := entities.Message{HookId: "test-hook", Text: "Hi", VkSenderId: 2}
+
+	t.Run("max messages", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: time.Hour, MaxMessages: 3})
+		archive := &fakeArchive{}
+		s.archive = archive
+		second := ivan
+		second.Type = entities.MessageTypeEdit
+		second.Text = "Hello!"
+
+		s.Process(context.Background(), ivan)
+		s.Process(context.Background(), anna)
+		assert.Empty(t, sent.texts())
+		s.Process(context.Background(), second)
+		s.lanes.wait()
+
+		expected := "📋 3 messages from 2 senders\n\n" +
+			"👤 <a href=\"https://vk.com/id1\">Ivan Petrov</a>\n💬 Hello\n✏️ Hello!\n\n" +
+			"👤 <a href=\"https://vk.com/id2\">2</a>\n💬 Hi"
+		assert.Equal(t, []string{expected}, sent.texts())
+		require.Len(t, archive.deliveries, 3)
+		for _, delivery := range archive.deliveries {
+			assert.Equal(t, entities.DeliveryStatusSent, delivery.Status)
+			assert.Equal(t, 321, delivery.TgMessageId)
+		}
+		_, ok := s.LastSent(4321)
+		assert.True(t, ok)
+	})
+	t.Run("interval", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: 10 * time.Millisecond})
+
+		s.Process(context.Background(), ivan)
+
+		require.Eventually(t, func() bool { return len(sent.texts()) == 1 }, time.Second, time.Millisecond)
+		assert.True(t, strings.HasPrefix(sent.texts()[0], "📋 1 message\n\n"))
+	})
+	t.Run("flush", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: time.Hour})
+
+		s.Process(context.Background(), ivan)
+		s.Flush(context.Background())
+		s.Flush(context.Background())
+
+		assert.Len(t, sent.texts(), 1)
+	})
+	t.Run("size limit", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: time.Hour})
+		long := ivan
+		long.Text = strings.Repeat("a", 3000)
+
+		s.Process(context.Background(), long)
+		s.Process(context.Background(), long)
+		s.lanes.wait()
+		assert.Len(t, sent.texts(), 1)
+		s.Flush(context.Background())
+
+		require.Len(t, sent.texts(), 2)
+		for _, text := range sent.texts() {
+			assert.LessOrEqual(t, textLength(text), maxMessageLength)
+		}
+	})
+	t.Run("replayed dead letter", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: time.Hour})
+		replayed := ivan
+		replayed.DeadLetterId = 10
+
+		s.Process(context.Background(), replayed)
+
+		assert.Equal(t, []string{render.Html(replayed)}, sent.texts())
+	})
+	t.Run("interval rate limited on shutdown", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: 10 * time.Millisecond})
+		s.chatLimiter = newLimiter(1, time.Hour)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+
+		s.Process(context.Background(), ivan)
+		require.True(t, s.chatLimiter.Allow("4321"))
+		// The digest is taken by the timer flush, which waits for the rate limit
+		require.Eventually(t, func() bool {
+			s.digestsMu.Lock()
+			defer s.digestsMu.Unlock()
+			return len(s.digests) == 0
+		}, time.Second, time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.Flush(ctx)
+
+		assert.Empty(t, sent.texts())
+		assert.Equal(t, []string{"lost_on_shutdown"}, deadLetters.reasons)
+	})
+	t.Run("muted", func(t *testing.T) {
+		sent, s := setupDigest(t, DigestSettings{Interval: time.Hour})
+		mutes := fakeMutes{}
+		s.mutes = mutes
+		archive := &fakeArchive{}
+		s.archive = archive
+
+		s.Process(context.Background(), ivan)
+		mutes[4321] = true
+		s.Flush(context.Background())
+
+		assert.Empty(t, sent.texts())
+		require.Len(t, archive.deliveries, 1)
+		assert.Equal(t, entities.DeliveryStatusMuted, archive.deliveries[0].Status)
+	})
+}
+
+// setupDigest returns a started forwarder with the digest community "test-hook" and the texts it sends
+func setupDigest(t *testing.T, settings DigestSettings) (*sentTexts, *Forwarder) {
+	t.Helper()
+	fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+	sent := &sentTexts{}
+	p := gomonkey.
+		ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+			return fakeBot, nil
+		}).
+		ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, what interface{}, _ ...interface{}) (*tele.Message, error) {
+			sent.add(what.(string))
+			return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+		})
+	t.Cleanup(p.Reset)
+	_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321, Digest: &settings}})
+	require.NoError(t, s.Start(context.Background()))
+	return sent, s
+}
+
+type sentTexts struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (s *sentTexts) add(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, text)
+}
+
+func (s *sentTexts) texts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.sent...)
+}
@@ -0,0 +1,191 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"viktig/internal/queue"
+)
+
+// task is the work queued to a lane. Lost is called instead of run if the task is dropped from the full lane,
+// tasks without it are never dropped.
+type task struct {
+	run  func(ctx context.Context)
+	lost func()
+}
+
+type lane struct {
+	tasks []task
+	// progressAt is when the lane started or a task was last taken from it
+	progressAt time.Time
+}
+
+// lanes run the tasks of each key in order on a goroutine of the key, which exits once the key has no tasks.
+// Work is handed over to a lane instead of blocking the pipeline worker shared by several keys,
+// and the later messages with the key are queued behind it.
+type lanes struct {
+	ctx context.Context
+	// capacity is how many tasks put may queue for a key, unlimited if zero
+	capacity int
+	overflow queue.OverflowPolicy
+	mu       sync.Mutex
+	lanes    map[string]*lane
+	// changed is closed and replaced when a task is taken or a lane exits
+	changed chan struct{}
+}
+
+// newLanes returns lanes running the tasks with ctx, put applies the overflow policy to lanes with capacity tasks
+func newLanes(ctx context.Context, capacity int, overflow queue.OverflowPolicy) *lanes {
+	return &lanes{
+		ctx:      ctx,
+		capacity: capacity,
+		overflow: overflow,
+		lanes:    make(map[string]*lane),
+		changed:  make(chan struct{}),
+	}
+}
+
+// add queues the task, which runs once the earlier tasks of the key are done. The capacity is not applied,
+// so it is only used for the work the lanes themselves hand over, e.g. posting the batches of a community.
+func (l *lanes) add(key string, run func(ctx context.Context)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queue(key, task{run: run})
+}
+
+// put queues the task applying the overflow policy if the key has capacity tasks queued.
+// Returns queue.ErrFull if the task is rejected or the ctx error if ctx is done while blocked.
+func (l *lanes) put(ctx context.Context, key string, t task) error {
+	_, err := l.tryPut(ctx, key, t, false)
+	return err
+}
+
+// putIfBusy is put queueing the task only if the key has queued or running tasks. Reports whether it was queued.
+func (l *lanes) putIfBusy(ctx context.Context, key string, t task) (bool, error) {
+	return l.tryPut(ctx, key, t, true)
+}
+
+// wait blocks until all the lanes are done
+func (l *lanes) wait() {
+	l.mu.Lock()
+	for len(l.lanes) > 0 {
+		changed := l.changed
+		l.mu.Unlock()
+		<-changed
+		l.mu.Lock()
+	}
+	l.mu.Unlock()
+}
+
+// depth returns the number of queued tasks, not including the running ones
+func (l *lanes) depth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, ln := range l.lanes {
+		n += len(ln.tasks)
+	}
+	return n
+}
+
+// stalled returns an error if a lane has queued tasks and none of them were taken for longer than threshold
+func (l *lanes) stalled(threshold time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, ln := range l.lanes {
+		if since := time.Since(ln.progressAt); len(ln.tasks) > 0 && since > threshold {
+			return fmt.Errorf("lane %s has %d tasks not taken for %s", key, len(ln.tasks), since.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+func (l *lanes) tryPut(ctx context.Context, key string, t task, onlyIfBusy bool) (bool, error) {
+	l.mu.Lock()
+	for {
+		ln, running := l.lanes[key]
+		if onlyIfBusy && !running {
+			l.mu.Unlock()
+			return false, nil
+		}
+		if l.capacity == 0 || !running || len(ln.tasks) < l.capacity {
+			break
+		}
+		switch l.overflow {
+		case queue.OverflowReject:
+			l.mu.Unlock()
+			return false, queue.ErrFull
+		case queue.OverflowDropOldest:
+			if dropped, ok := dropOldest(ln); ok {
+				l.mu.Unlock()
+				dropped.lost()
+				l.mu.Lock()
+				continue
+			}
+			// Only the tasks that are never dropped are queued
+		default:
+			changed := l.changed
+			l.mu.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+			l.mu.Lock()
+			continue
+		}
+		break
+	}
+	l.queue(key, t)
+	l.mu.Unlock()
+	return true, nil
+}
+
+// dropOldest removes the oldest task that may be dropped, the lock must be held
+func dropOldest(ln *lane) (task, bool) {
+	for i, t := range ln.tasks {
+		if t.lost != nil {
+			ln.tasks = append(ln.tasks[:i:i], ln.tasks[i+1:]...)
+			return t, true
+		}
+	}
+	return task{}, false
+}
+
+// queue adds the task and starts the lane if it is not running, the lock must be held
+func (l *lanes) queue(key string, t task) {
+	ln, running := l.lanes[key]
+	if !running {
+		ln = &lane{progressAt: time.Now()}
+		l.lanes[key] = ln
+		go l.run(key, ln)
+	}
+	ln.tasks = append(ln.tasks, t)
+}
+
+func (l *lanes) run(key string, ln *lane) {
+	for {
+		l.mu.Lock()
+		if len(ln.tasks) == 0 {
+			delete(l.lanes, key)
+			l.notify()
+			l.mu.Unlock()
+			return
+		}
+		// The lane is kept while the task runs, so that it is busy
+		t := ln.tasks[0]
+		ln.tasks = ln.tasks[1:]
+		ln.progressAt = time.Now()
+		l.notify()
+		l.mu.Unlock()
+		t.run(l.ctx)
+	}
+}
+
+// notify wakes up the blocked puts and wait, the lock must be held
+func (l *lanes) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
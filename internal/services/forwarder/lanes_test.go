@@ -0,0 +1,123 @@
+package forwarder
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLanes(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		l := newLanes(context.Background(), 0, queue.OverflowBlock)
+		r := &recorder{}
+		unblock := make(chan struct{})
+
+		queued, err := l.putIfBusy(context.Background(), "a", r.task(-1, nil))
+		require.NoError(t, err)
+		assert.False(t, queued)
+		l.add("a", r.task(0, unblock).run)
+		require.Eventually(t, func() bool { return l.depth() == 0 }, time.Second, time.Millisecond)
+		queued, err = l.putIfBusy(context.Background(), "a", r.task(1, nil))
+		require.NoError(t, err)
+		assert.True(t, queued)
+		require.NoError(t, l.put(context.Background(), "a", r.task(2, nil)))
+		assert.Equal(t, 2, l.depth())
+		close(unblock)
+		l.wait()
+
+		assert.Equal(t, []int{0, 1, 2}, r.ran())
+		assert.Zero(t, l.depth())
+	})
+	t.Run("reject", func(t *testing.T) {
+		l := newLanes(context.Background(), 1, queue.OverflowReject)
+		r := &recorder{}
+		unblock := make(chan struct{})
+		l.add("a", r.task(0, unblock).run)
+		require.Eventually(t, func() bool { return l.depth() == 0 }, time.Second, time.Millisecond)
+		require.NoError(t, l.put(context.Background(), "a", r.task(1, nil)))
+
+		assert.ErrorIs(t, l.put(context.Background(), "a", r.task(2, nil)), queue.ErrFull)
+		require.NoError(t, l.put(context.Background(), "b", r.task(3, nil)))
+		close(unblock)
+		l.wait()
+
+		assert.ElementsMatch(t, []int{0, 1, 3}, r.ran())
+	})
+	t.Run("drop oldest", func(t *testing.T) {
+		l := newLanes(context.Background(), 1, queue.OverflowDropOldest)
+		r := &recorder{}
+		unblock := make(chan struct{})
+		l.add("a", r.task(0, unblock).run)
+		require.Eventually(t, func() bool { return l.depth() == 0 }, time.Second, time.Millisecond)
+		require.NoError(t, l.put(context.Background(), "a", r.task(1, nil)))
+
+		require.NoError(t, l.put(context.Background(), "a", r.task(2, nil)))
+		close(unblock)
+		l.wait()
+
+		assert.Equal(t, []int{0, 2}, r.ran())
+		assert.Equal(t, []int{1}, r.dropped())
+	})
+	t.Run("block", func(t *testing.T) {
+		l := newLanes(context.Background(), 1, queue.OverflowBlock)
+		r := &recorder{}
+		unblock := make(chan struct{})
+		l.add("a", r.task(0, unblock).run)
+		require.Eventually(t, func() bool { return l.depth() == 0 }, time.Second, time.Millisecond)
+		require.NoError(t, l.put(context.Background(), "a", r.task(1, nil)))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, l.put(ctx, "a", r.task(2, nil)), context.DeadlineExceeded)
+		assert.Error(t, l.stalled(time.Millisecond))
+		close(unblock)
+		require.NoError(t, l.put(context.Background(), "a", r.task(3, nil)))
+		l.wait()
+
+		assert.Equal(t, []int{0, 1, 3}, r.ran())
+		assert.NoError(t, l.stalled(time.Millisecond))
+	})
+}
+
+// recorder records which tasks ran and which were dropped
+type recorder struct {
+	mu      sync.Mutex
+	ranIds  []int
+	lostIds []int
+}
+
+// task returns a task recording i, which waits for unblock to be closed if it is not nil
+func (r *recorder) task(i int, unblock chan struct{}) task {
+	return task{
+		run: func(_ context.Context) {
+			if unblock != nil {
+				<-unblock
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.ranIds = append(r.ranIds, i)
+		},
+		lost: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.lostIds = append(r.lostIds, i)
+		},
+	}
+}
+
+func (r *recorder) ran() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int{}, r.ranIds...)
+}
+
+func (r *recorder) dropped() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int{}, r.lostIds...)
+}
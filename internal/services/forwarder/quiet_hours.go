@@ -0,0 +1,130 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"viktig/internal/entities"
+)
+
+// hold keeps the message until the end of the quiet hours if the community holds messages in them.
+// Messages received while others are held are held too, so that they are forwarded in order.
+func (f *Forwarder) hold(ctx context.Context, community *Community, message entities.Message) bool {
+	hookId := message.HookId
+	f.heldMu.Lock()
+	defer f.heldMu.Unlock()
+	b, ok := f.held[hookId]
+	if !ok {
+		if community.QuietHours == nil || !community.HoldQuiet {
+			return false
+		}
+		now := time.Now()
+		end := community.QuietHours.End(now)
+		if !end.After(now) {
+			return false
+		}
+		b = &batch{}
+		b.timer = time.AfterFunc(end.Sub(now), func() { f.queueRelease(hookId, b) })
+		f.held[hookId] = b
+		f.l.InfoContext(ctx, "holding messages until the end of quiet hours", "hookId", hookId, "until", end)
+	}
+	if f.heldMessages != nil && message.HeldId == 0 {
+		id, err := f.heldMessages.HoldMessage(ctx, message)
+		if err != nil {
+			f.l.ErrorContext(ctx, "error storing held message, it is only kept in memory", "err", err)
+		}
+		message.HeldId = id
+	}
+	b.messages = append(b.messages, message)
+	return true
+}
+
+// restoreHeld holds the messages held before the restart again, or queues their release if the quiet hours ended.
+// It only runs once, so that the messages are not held twice when the stage is restarted.
+func (f *Forwarder) restoreHeld(ctx context.Context) error {
+	f.heldMu.Lock()
+	restored := f.heldRestored
+	f.heldMu.Unlock()
+	if f.heldMessages == nil || restored {
+		return nil
+	}
+	messages, err := f.heldMessages.ListHeldMessages(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading held messages: %w", err)
+	}
+	for _, message := range messages {
+		if community, ok := f.community(message.HookId); ok && f.hold(message.Context(ctx), community, message) {
+			continue
+		}
+		f.lanes.add(f.hookKey(message.HookId), func(ctx context.Context) { f.releaseMessage(ctx, message) })
+	}
+	f.heldMu.Lock()
+	f.heldRestored = true
+	f.heldMu.Unlock()
+	if len(messages) > 0 {
+		f.l.Info("restored held messages", "messages", len(messages))
+	}
+	return nil
+}
+
+// queueRelease hands releasing the batch over to the lane of the community
+func (f *Forwarder) queueRelease(hookId string, b *batch) {
+	f.lanes.add(f.hookKey(hookId), func(ctx context.Context) { f.release(ctx, hookId, b) })
+}
+
+// release forwards the held messages once the quiet hours ended, unless they were already released.
+// The batch is kept until it is drained, so that the messages received meanwhile are held behind it.
+func (f *Forwarder) release(ctx context.Context, hookId string, b *batch) {
+	for {
+		f.heldMu.Lock()
+		if f.held[hookId] != b {
+			f.heldMu.Unlock()
+			return
+		}
+		messages := b.messages
+		b.messages = nil
+		if len(messages) == 0 {
+			delete(f.held, hookId)
+		}
+		f.heldMu.Unlock()
+		if len(messages) == 0 {
+			return
+		}
+
+		f.l.InfoContext(ctx, "releasing held messages", "hookId", hookId, "messages", len(messages))
+		for _, message := range messages {
+			f.releaseMessage(ctx, message)
+		}
+	}
+}
+
+// releaseMessage forwards the held message and removes it from the store.
+// Stored messages are kept for the next start instead if the drain timeout passed on shutdown.
+func (f *Forwarder) releaseMessage(ctx context.Context, message entities.Message) {
+	if message.HeldId != 0 && ctx.Err() != nil {
+		return
+	}
+	f.dispatch(ctx, message)
+	if message.HeldId == 0 {
+		return
+	}
+	if err := f.heldMessages.ReleaseMessage(context.WithoutCancel(ctx), message.HeldId); err != nil {
+		f.l.ErrorContext(ctx, "error removing held message", "err", err)
+	}
+}
+
+// releaseAll queues the release of all the held messages, which are sent without notification if the quiet hours did not end
+func (f *Forwarder) releaseAll() {
+	f.heldMu.Lock()
+	held := make(map[string]*batch, len(f.held))
+	for hookId, b := range f.held {
+		b.timer.Stop()
+		held[hookId] = b
+	}
+	f.heldMu.Unlock()
+
+	for hookId, b := range held {
+		f.queueRelease(hookId, b)
+	}
+}
@@ -0,0 +1,257 @@
+package forwarder
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/schedule"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestQuietHours(t *testing.T) {
+	allDays := [7]bool{true, true, true, true, true, true, true}
+	message := entities.Message{HookId: "test-hook", Text: "Hello", VkSenderId: 1}
+
+	t.Run("silent", func(t *testing.T) {
+		sent, s := setupQuiet(t, &Community{TgChatId: 4321, QuietHours: schedule.New(time.UTC, []schedule.Window{{Days: allDays}})})
+
+		s.Process(context.Background(), message)
+
+		assert.Equal(t, []bool{true}, sent.silent())
+	})
+	t.Run("outside quiet hours", func(t *testing.T) {
+		// The window is an hour long and ends an hour ago
+		now := time.Now().UTC()
+		from := (now.Hour()+22)%24*60 + now.Minute()
+		window := schedule.Window{Days: allDays, From: from, To: (from + 60) % (24 * 60)}
+		sent, s := setupQuiet(t, &Community{TgChatId: 4321, QuietHours: schedule.New(time.UTC, []schedule.Window{window})})
+
+		s.Process(context.Background(), message)
+
+		assert.Equal(t, []bool{false}, sent.silent())
+	})
+	t.Run("hold", func(t *testing.T) {
+		// The window ends within a minute
+		now := time.Now().UTC()
+		to := (now.Hour()*60 + now.Minute() + 1) % (24 * 60)
+		window := schedule.Window{Days: allDays, From: (to + 23*60) % (24 * 60), To: to}
+		quietHours := schedule.New(time.UTC, []schedule.Window{window})
+		sent, s := setupQuiet(t, &Community{TgChatId: 4321, QuietHours: quietHours, HoldQuiet: true})
+		// Shorten the wait for the end of the window
+		held := time.Now()
+		p := gomonkey.ApplyMethodFunc(quietHours, "End", func(_ time.Time) time.Time { return held.Add(20 * time.Millisecond) })
+		defer p.Reset()
+
+		s.Process(context.Background(), message)
+		s.Process(context.Background(), message)
+		assert.Empty(t, sent.silent())
+
+		require.Eventually(t, func() bool { return len(sent.silent()) == 2 }, time.Second, time.Millisecond)
+	})
+	t.Run("received while releasing", func(t *testing.T) {
+		now := time.Now().UTC()
+		to := (now.Hour()*60 + now.Minute() + 1) % (24 * 60)
+		window := schedule.Window{Days: allDays, From: (to + 23*60) % (24 * 60), To: to}
+		quietHours := schedule.New(time.UTC, []schedule.Window{window})
+		held := time.Now()
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		sending := make(chan struct{}, 1)
+		unblock := make(chan struct{})
+		sent := &sentTexts{}
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, what interface{}, _ ...interface{}) (*tele.Message, error) {
+				if strings.Contains(what.(string), "held") {
+					sending <- struct{}{}
+					<-unblock
+				}
+				sent.add(what.(string))
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			}).
+			ApplyMethodFunc(quietHours, "End", func(_ time.Time) time.Time { return held.Add(20 * time.Millisecond) })
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321, QuietHours: quietHours, HoldQuiet: true}})
+		require.NoError(t, s.Start(context.Background()))
+		heldMessage := message
+		heldMessage.Text = "held"
+		later := message
+		later.Text = "later"
+
+		s.Process(context.Background(), heldMessage)
+		<-sending
+		s.Process(context.Background(), later)
+		close(unblock)
+		s.Flush(context.Background())
+
+		texts := sent.texts()
+		require.Len(t, texts, 2)
+		assert.Contains(t, texts[0], "held")
+		assert.Contains(t, texts[1], "later")
+	})
+	t.Run("flush held", func(t *testing.T) {
+		quietHours := schedule.New(time.UTC, []schedule.Window{{Days: allDays}})
+		sent, s := setupQuiet(t, &Community{TgChatId: 4321, QuietHours: quietHours, HoldQuiet: true})
+
+		s.Process(context.Background(), message)
+		assert.Empty(t, sent.silent())
+		s.Flush(context.Background())
+
+		assert.Equal(t, []bool{true}, sent.silent())
+	})
+	t.Run("stored", func(t *testing.T) {
+		quietHours := schedule.New(time.UTC, []schedule.Window{{Days: allDays}})
+		held := newFakeHeldMessages()
+		sent, s := setupHeld(t, &Community{TgChatId: 4321, QuietHours: quietHours, HoldQuiet: true}, held)
+
+		s.Process(context.Background(), message)
+		assert.Equal(t, 1, held.len())
+		s.Flush(context.Background())
+
+		assert.Equal(t, []bool{true}, sent.silent())
+		assert.Equal(t, 0, held.len())
+	})
+	t.Run("restore", func(t *testing.T) {
+		quietHours := schedule.New(time.UTC, []schedule.Window{{Days: allDays}})
+		held := newFakeHeldMessages(message)
+		sent, s := setupHeld(t, &Community{TgChatId: 4321, QuietHours: quietHours, HoldQuiet: true}, held)
+		// The messages are not held twice when the stage is restarted
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), message)
+		assert.Empty(t, sent.silent())
+		assert.Equal(t, 2, held.len())
+		s.Flush(context.Background())
+
+		assert.Equal(t, []bool{true, true}, sent.silent())
+		assert.Equal(t, 0, held.len())
+	})
+	t.Run("restore after quiet hours", func(t *testing.T) {
+		held := newFakeHeldMessages(message)
+		sent, s := setupHeld(t, &Community{TgChatId: 4321}, held)
+
+		s.lanes.wait()
+
+		assert.Equal(t, []bool{false}, sent.silent())
+		assert.Equal(t, 0, held.len())
+	})
+	t.Run("replayed dead letter", func(t *testing.T) {
+		quietHours := schedule.New(time.UTC, []schedule.Window{{Days: allDays}})
+		sent, s := setupQuiet(t, &Community{TgChatId: 4321, QuietHours: quietHours, HoldQuiet: true})
+		replayed := message
+		replayed.DeadLetterId = 10
+
+		s.Process(context.Background(), replayed)
+
+		assert.Equal(t, []bool{true}, sent.silent())
+	})
+}
+
+// setupQuiet returns a started forwarder with the community "test-hook" and whether the sent messages were silent
+func setupQuiet(t *testing.T, community *Community) (*sentOptions, *Forwarder) {
+	t.Helper()
+	return setupHeld(t, community, nil)
+}
+
+// setupHeld is setupQuiet keeping the held messages in held if it is not nil
+func setupHeld(t *testing.T, community *Community, held HeldMessages) (*sentOptions, *Forwarder) {
+	t.Helper()
+	fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+	sent := &sentOptions{}
+	p := gomonkey.
+		ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+			return fakeBot, nil
+		}).
+		ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, opts ...interface{}) (*tele.Message, error) {
+			sent.add(opts)
+			return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+		})
+	t.Cleanup(p.Reset)
+	_, s := setup(t, map[string]*Community{"test-hook": community})
+	if held != nil {
+		s.heldMessages = held
+	}
+	require.NoError(t, s.Start(context.Background()))
+	return sent, s
+}
+
+// fakeHeldMessages keeps the held messages in memory
+type fakeHeldMessages struct {
+	mu       sync.Mutex
+	lastId   int64
+	messages map[int64]entities.Message
+}
+
+func newFakeHeldMessages(messages ...entities.Message) *fakeHeldMessages {
+	h := &fakeHeldMessages{messages: make(map[int64]entities.Message)}
+	for _, message := range messages {
+		_, _ = h.HoldMessage(context.Background(), message)
+	}
+	return h
+}
+
+func (h *fakeHeldMessages) HoldMessage(_ context.Context, message entities.Message) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastId++
+	h.messages[h.lastId] = message
+	return h.lastId, nil
+}
+
+func (h *fakeHeldMessages) ReleaseMessage(_ context.Context, id int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.messages, id)
+	return nil
+}
+
+func (h *fakeHeldMessages) ListHeldMessages(_ context.Context) ([]entities.Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var messages []entities.Message
+	for id := int64(1); id <= h.lastId; id++ {
+		if message, ok := h.messages[id]; ok {
+			message.HeldId = id
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (h *fakeHeldMessages) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.messages)
+}
+
+type sentOptions struct {
+	mu    sync.Mutex
+	flags []bool
+}
+
+func (s *sentOptions) add(opts []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silent := false
+	for _, opt := range opts {
+		if opt == tele.Silent {
+			silent = true
+		}
+	}
+	s.flags = append(s.flags, silent)
+}
+
+// silent returns whether each sent message was sent without notification
+func (s *sentOptions) silent() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool{}, s.flags...)
+}
@@ -2,107 +2,692 @@ package forwarder
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"html"
 	"log/slog"
+	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
+	"viktig/internal/buttons"
 	"viktig/internal/entities"
 	"viktig/internal/metrics"
 	"viktig/internal/queue"
+	"viktig/internal/ratelimit"
+	"viktig/internal/render"
+	"viktig/internal/schedule"
+	"viktig/internal/sinks"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	tele "gopkg.in/telebot.v3"
 )
 
-var messageTypeIcons = map[entities.MessageType]string{
-	entities.MessageTypeNew:   "💬",
-	entities.MessageTypeEdit:  "✏️",
-	entities.MessageTypeReply: "↩️",
+var tracer = otel.Tracer("viktig/internal/services/forwarder")
+
+// maxFloodRetries is how many times a message is resent after Telegram responds with "Too Many Requests"
+const maxFloodRetries = 3
+
+// Starting a sink that failed to start is retried with backoff between these bounds
+const (
+	sinkStartInitialBackoff = 5 * time.Second
+	sinkStartMaxBackoff     = 5 * time.Minute
+)
+
+// errNoBot is returned when sending to a Telegram chat without a bot token, e.g. of a community added via the admin API
+var errNoBot = errors.New("telegram bot token is not set")
+
+// Mutes pause forwarding to Telegram chats
+type Mutes interface {
+	Muted(tgChatId int) bool
+}
+
+// SendLimits are the Telegram limits for sending messages, a zero limit is not applied
+type SendLimits struct {
+	// Global is the number of messages per second to all chats
+	Global int
+	// PerChat is the number of messages per minute to a single chat
+	PerChat int
+}
+
+// LaneLimits bound the messages waiting in the lane of each chat, e.g. while it is rate limited, and of each sink
+type LaneLimits struct {
+	// Capacity is how many messages may wait in each lane, unlimited if zero
+	Capacity int
+	// Overflow is applied to the messages of a full lane, dropped and rejected messages are kept as dead letters
+	Overflow queue.OverflowPolicy
 }
 
 type Community struct {
+	// TgChatId is the chat messages are forwarded to, if not zero
 	TgChatId int
+	// Sinks are the names of the other sinks messages are forwarded to
+	Sinks   []string
+	Buttons buttons.Options
+	// Digest batches the messages into periodic summaries instead of forwarding each of them, if set
+	Digest *DigestSettings
+	// QuietHours are when messages are sent without notification, or held until their end if HoldQuiet is set
+	QuietHours *schedule.Schedule
+	HoldQuiet  bool
 }
 
+// Archive records the outcome of forwarding each message
+type Archive interface {
+	ArchiveMessage(ctx context.Context, message entities.Message, delivery entities.Delivery) error
+}
+
+// DeadLetters keeps the messages that could not be forwarded, so that they can be replayed later
+type DeadLetters interface {
+	// AddDeadLetter stores the message or records another failed attempt if it is a replayed dead letter
+	AddDeadLetter(ctx context.Context, message entities.Message, reason string, errText string) error
+	RemoveDeadLetter(ctx context.Context, id int64) error
+}
+
+// HeldMessages keep the messages held until the end of quiet hours, so that they are released after a restart
+type HeldMessages interface {
+	HoldMessage(ctx context.Context, message entities.Message) (int64, error)
+	ReleaseMessage(ctx context.Context, id int64) error
+	ListHeldMessages(ctx context.Context) ([]entities.Message, error)
+}
+
+// Forwarder is a pipeline stage sending messages to Telegram and the other sinks of their communities
 type Forwarder struct {
-	tgToken     string
-	communities map[string]*Community
-	q           *queue.Queue[entities.Message]
-	l           *slog.Logger
+	tgToken       string
+	bot           *tele.Bot
+	communitiesMu sync.RWMutex
+	communities   map[string]*Community
+	sinks         map[string]sinks.Sink
+	archive       Archive
+	deadLetters   DeadLetters
+	mutes         Mutes
+	globalLimiter *ratelimit.Limiter
+	chatLimiter   *ratelimit.Limiter
+	sentMu        sync.Mutex
+	lastSent      map[int]time.Time
+	digestsMu     sync.Mutex
+	digests       map[string]*batch
+	heldMu        sync.Mutex
+	held          map[string]*batch
+	heldMessages  HeldMessages
+	// heldRestored is set once the messages held before the restart are held again
+	heldRestored bool
+	// lanes run the work handed over by Process and the timers, until stop is called on shutdown
+	lanes *lanes
+	stop  context.CancelFunc
+	// sinkStartBackoff is the delay before starting a sink that failed to start is retried
+	sinkStartBackoff time.Duration
+	l                *slog.Logger
 }
 
 func New(
 	tgToken string,
 	communities map[string]*Community,
-	q *queue.Queue[entities.Message],
+	sinks map[string]sinks.Sink,
+	archive Archive,
+	deadLetters DeadLetters,
+	mutes Mutes,
+	heldMessages HeldMessages,
+	limits SendLimits,
+	laneLimits LaneLimits,
 	l *slog.Logger,
 ) *Forwarder {
+	stopCtx, stop := context.WithCancel(context.Background())
 	return &Forwarder{
-		tgToken:     tgToken,
-		communities: communities,
-		q:           q,
-		l:           l.With("service", "Forwarder"),
+		tgToken:          tgToken,
+		communities:      communities,
+		sinks:            sinks,
+		archive:          archive,
+		deadLetters:      deadLetters,
+		mutes:            mutes,
+		globalLimiter:    newLimiter(limits.Global, time.Second),
+		chatLimiter:      newLimiter(limits.PerChat, time.Minute),
+		lastSent:         make(map[int]time.Time),
+		digests:          make(map[string]*batch),
+		held:             make(map[string]*batch),
+		heldMessages:     heldMessages,
+		lanes:            newLanes(stopCtx, laneLimits.Capacity, laneLimits.Overflow),
+		stop:             stop,
+		sinkStartBackoff: sinkStartInitialBackoff,
+		l:                l.With("service", "Forwarder"),
 	}
 }
 
-func (f *Forwarder) Run(ctx context.Context) error {
-	botSettings := tele.Settings{Token: f.tgToken}
-	bot, err := tele.NewBot(botSettings)
-	if err != nil {
-		return fmt.Errorf("telebot error: %w", err)
+// newLimiter allows about limit events within any window for each key: the burst and the tokens refilled within the window.
+// Returns nil if limit is zero.
+func newLimiter(limit int, window time.Duration) *ratelimit.Limiter {
+	if limit == 0 {
+		return nil
+	}
+	burst := max(limit/4, 1)
+	refill := max(limit-burst, 1)
+	return ratelimit.New(float64(refill)/window.Seconds(), burst)
+}
+
+// SetCommunity adds or replaces the community whose messages are forwarded
+func (f *Forwarder) SetCommunity(hookId string, community *Community) {
+	f.communitiesMu.Lock()
+	defer f.communitiesMu.Unlock()
+	f.communities[hookId] = community
+}
+
+// RemoveCommunity stops forwarding messages of the community
+func (f *Forwarder) RemoveCommunity(hookId string) {
+	f.communitiesMu.Lock()
+	defer f.communitiesMu.Unlock()
+	delete(f.communities, hookId)
+}
+
+// LastSent returns when a message was last sent to the chat
+func (f *Forwarder) LastSent(tgChatId int) (time.Time, bool) {
+	f.sentMu.Lock()
+	defer f.sentMu.Unlock()
+	at, ok := f.lastSent[tgChatId]
+	return at, ok
+}
+
+func (f *Forwarder) community(hookId string) (*Community, bool) {
+	f.communitiesMu.RLock()
+	defer f.communitiesMu.RUnlock()
+	community, ok := f.communities[hookId]
+	return community, ok
+}
+
+// Start authenticates the Telegram bot, unless there is no token since no community is forwarded to Telegram,
+// and starts the other sinks. Sinks failing to start do not stop the others, starting them is retried in the background.
+// On the first start the messages held before a restart are held again.
+func (f *Forwarder) Start(ctx context.Context) error {
+	if err := f.start(ctx); err != nil {
+		return err
 	}
+	return f.restoreHeld(ctx)
+}
 
-	f.l.Info("forwarder is ready", "username", bot.Me.Username)
+// start is Start without restoring the held messages
+func (f *Forwarder) start(ctx context.Context) error {
+	username := ""
+	if f.tgToken != "" {
+		bot, err := f.newBot()
+		if err != nil {
+			return err
+		}
+		f.bot = bot
+		username = bot.Me.Username
+	}
+	for name, sink := range f.sinks {
+		if err := sink.Start(ctx); err != nil {
+			f.l.Error("error starting sink, retrying in the background", "sink", name, "err", err)
+			metrics.SinkUp.WithLabelValues(name).Set(0)
+			go f.retryStartSink(ctx, name, sink)
+			continue
+		}
+		metrics.SinkUp.WithLabelValues(name).Set(1)
+	}
+	f.l.Info("forwarder is ready", "username", username, "sinks", len(f.sinks))
+	return nil
+}
 
+// retryStartSink starts the sink with backoff until it starts or ctx is done.
+// Messages are still sent to the sink meanwhile, the failing ones are kept as dead letters.
+func (f *Forwarder) retryStartSink(ctx context.Context, name string, sink sinks.Sink) {
+	backoff := f.sinkStartBackoff
 	for {
 		select {
-		case message := <-f.q.AsChan():
-			community, ok := f.communities[message.HookId]
-			if !ok {
-				f.l.Error("hookId not found", "hookId", message.HookId)
-				continue
-			}
-			sentMessage, err := bot.Send(
-				tele.ChatID(community.TgChatId),
-				render(message),
-				tele.ModeHTML,
-				tele.NoPreview,
-			)
-			if err != nil {
-				f.l.Error("error sending telegram message", "err", err.Error())
-			} else {
-				f.l.Info(
-					"sent telegram message",
-					"id", sentMessage.ID,
-					"chatId", sentMessage.Chat.ID,
-				)
-				metrics.MessagesForwarded.Inc()
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if err := sink.Start(ctx); err != nil {
+			backoff = min(backoff*2, sinkStartMaxBackoff)
+			f.l.Warn("error starting sink", "sink", name, "err", err, "backoff", backoff)
+			continue
+		}
+		metrics.SinkUp.WithLabelValues(name).Set(1)
+		f.l.Info("sink started", "sink", name)
+		return
+	}
+}
+
+// Key makes messages to the same Telegram chat forwarded in order, and so the messages of each VK conversation
+func (f *Forwarder) Key(message entities.Message) string {
+	if community, ok := f.community(message.HookId); ok && community.TgChatId != 0 {
+		return strconv.Itoa(community.TgChatId)
+	}
+	return message.ConversationKey()
+}
+
+// hookKey returns the lane of the work on all the messages of the community, e.g. releasing the held ones
+func (f *Forwarder) hookKey(hookId string) string {
+	if community, ok := f.community(hookId); ok && community.TgChatId != 0 {
+		return strconv.Itoa(community.TgChatId)
+	}
+	return hookId
+}
+
+// Process forwards the message, adds it to the digest of the community or holds it until the end of quiet hours.
+// The message is queued behind the work handed over to the lane of its key, e.g. releasing the held messages,
+// and handed over to the lane itself if its chat is rate limited, so that it does not block the other chats.
+// The lane limits are applied to the queued messages. Messages that could not be forwarded are kept as dead letters if enabled.
+func (f *Forwarder) Process(ctx context.Context, message entities.Message) (entities.Message, bool) {
+	key := f.Key(message)
+	t := task{
+		run:  func(ctx context.Context) { f.process(ctx, message) },
+		lost: func() { f.overflow(message) },
+	}
+	queued, err := f.lanes.putIfBusy(ctx, key, t)
+	if err == nil && !queued && f.chatRateLimited(message) {
+		queued, err = true, f.lanes.put(ctx, key, t)
+	}
+	if errors.Is(err, queue.ErrFull) {
+		f.overflow(message)
+	} else if err != nil {
+		f.Lost(message)
+	} else if !queued {
+		f.process(ctx, message)
+	}
+	return message, true
+}
+
+// overflow keeps the message dropped or rejected from a full lane as a dead letter if enabled
+func (f *Forwarder) overflow(message entities.Message) {
+	ctx := message.Context(context.Background())
+	f.l.ErrorContext(ctx, "message dropped from the full lane", "message", message)
+	f.fail(ctx, message, metrics.FailureReasonQueueOverflow, "lane is full", 0)
+}
+
+// LaneDepth returns the number of messages waiting in the lanes
+func (f *Forwarder) LaneDepth() int {
+	return f.lanes.depth()
+}
+
+// LanesStalled reports whether a lane has messages waiting and none of them were taken for longer than threshold
+func (f *Forwarder) LanesStalled(threshold time.Duration) error {
+	return f.lanes.stalled(threshold)
+}
+
+// chatRateLimited reports whether sending the message to Telegram would wait for the rate limit of the chat
+func (f *Forwarder) chatRateLimited(message entities.Message) bool {
+	if f.chatLimiter == nil {
+		return false
+	}
+	community, ok := f.community(message.HookId)
+	return ok && community.TgChatId != 0 && !f.chatLimiter.Ready(strconv.Itoa(community.TgChatId))
+}
+
+func (f *Forwarder) process(ctx context.Context, message entities.Message) {
+	community, ok := f.community(message.HookId)
+	// Replayed dead letters are forwarded right away, so that they are removed once sent
+	if ok && message.DeadLetterId == 0 && f.hold(message.Context(ctx), community, message) {
+		return
+	}
+	f.dispatch(ctx, message)
+}
+
+// dispatch forwards the message or adds it to the Telegram digest of the community, which the other sinks do not wait for
+func (f *Forwarder) dispatch(ctx context.Context, message entities.Message) {
+	if community, ok := f.community(message.HookId); ok && community.Digest != nil && message.DeadLetterId == 0 {
+		ctx = message.Context(ctx)
+		if community.TgChatId != 0 {
+			f.addToDigest(ctx, community, message)
+		}
+		f.queueSinks(ctx, community, message, nil)
+		return
+	}
+	f.deliver(ctx, message)
+}
+
+// deliver sends the message to Telegram and hands it over to the lanes of the other sinks, or only to message.Sink if set,
+// so that a slow sink delays neither the chats nor the other sinks. A replayed dead letter is removed
+// once it was sent to all of them.
+func (f *Forwarder) deliver(ctx context.Context, message entities.Message) {
+	ctx = message.Context(ctx)
+	community, ok := f.community(message.HookId)
+	if !ok {
+		f.l.ErrorContext(ctx, "hookId not found", "hookId", message.HookId)
+		f.fail(ctx, message, metrics.FailureReasonUnknownHook, "hookId not found", 0)
+		return
+	}
+	var p *pending
+	if message.DeadLetterId != 0 {
+		// The Telegram delivery is counted until the sinks are queued, so that the dead letter is not removed before
+		p = &pending{left: 1}
+	}
+	f.queueSinks(ctx, community, message, p)
+	sent := true
+	if community.TgChatId != 0 && (message.Sink == "" || message.Sink == sinks.Telegram) {
+		sent = f.forwardTelegram(ctx, community, message)
+	}
+	f.replayed(ctx, message, p, sent)
+}
+
+// sinkKey is the lane of the messages to the sink, hook IDs can not contain a slash
+func sinkKey(name string) string {
+	return "sink/" + name
+}
+
+// queueSinks hands the message over to the lanes of the sinks of the community other than Telegram,
+// or only to message.Sink if set. The deliveries are counted in p if it is not nil.
+func (f *Forwarder) queueSinks(ctx context.Context, community *Community, message entities.Message, p *pending) {
+	for _, name := range community.Sinks {
+		if message.Sink != "" && message.Sink != name {
+			continue
+		}
+		p.add()
+		sinkMessage := message
+		sinkMessage.Sink = name
+		t := task{
+			run: func(ctx context.Context) {
+				f.replayed(ctx, message, p, f.forwardSink(message.Context(ctx), name, message))
+			},
+			lost: func() {
+				f.overflow(sinkMessage)
+				f.replayed(context.Background(), message, p, false)
+			},
+		}
+		if err := f.lanes.put(ctx, sinkKey(name), t); errors.Is(err, queue.ErrFull) {
+			t.lost()
+		} else if err != nil {
+			f.l.ErrorContext(ctx, "message lost on shutdown", "sink", name, "message", message)
+			f.fail(context.WithoutCancel(ctx), sinkMessage, metrics.FailureReasonLostOnShutdown, "lost on shutdown", 0)
+			f.replayed(ctx, message, p, false)
+		}
+	}
+}
+
+// pending counts the deliveries of a replayed dead letter
+type pending struct {
+	mu     sync.Mutex
+	left   int
+	failed bool
+}
+
+func (p *pending) add() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.left++
+}
+
+// done records a delivery and reports whether it was the last one and all of them succeeded
+func (p *pending) done(sent bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.left--
+	p.failed = p.failed || !sent
+	return p.left == 0 && !p.failed
+}
+
+// replayed records a delivery of the message counted in p, if it is not nil,
+// and removes the replayed dead letter once it was sent to all of its sinks
+func (f *Forwarder) replayed(ctx context.Context, message entities.Message, p *pending, sent bool) {
+	if p == nil || !p.done(sent) || f.deadLetters == nil {
+		return
+	}
+	if err := f.deadLetters.RemoveDeadLetter(ctx, message.DeadLetterId); err != nil {
+		f.l.ErrorContext(ctx, "error removing replayed dead letter", "id", message.DeadLetterId, "err", err)
+	}
+}
+
+// Lost keeps the message as a dead letter if enabled
+func (f *Forwarder) Lost(message entities.Message) {
+	ctx := message.Context(context.Background())
+	f.l.ErrorContext(ctx, "message lost on shutdown", "message", message)
+	f.fail(ctx, message, metrics.FailureReasonLostOnShutdown, "lost on shutdown", 0)
+}
+
+// ForwardOnce forwards messages without running the pipeline, e.g. to replay dead letters.
+// Returns the number of forwarded messages.
+func (f *Forwarder) ForwardOnce(ctx context.Context, messages []entities.Message) (int, error) {
+	if err := f.start(ctx); err != nil {
+		return 0, err
+	}
+	forwarded := 0
+	for _, message := range messages {
+		if f.forward(ctx, message) {
+			forwarded++
+		}
+	}
+	return forwarded, nil
+}
+
+// wait blocks until the rate limits allow sending a message to the chat
+func (f *Forwarder) wait(ctx context.Context, tgChatId int) error {
+	start := time.Now()
+	defer func() { metrics.TgRateLimitWait.Observe(time.Since(start).Seconds()) }()
+	if f.chatLimiter != nil {
+		if err := f.chatLimiter.Wait(ctx, strconv.Itoa(tgChatId)); err != nil {
+			return err
+		}
+	}
+	if f.globalLimiter != nil {
+		return f.globalLimiter.Wait(ctx, "")
+	}
+	return nil
+}
+
+// send sends the text to the community chat with the keyboard if it is not nil, without notification in quiet hours.
+// Waits as long as Telegram asks if the flood limit is exceeded anyway.
+func (f *Forwarder) send(
+	ctx context.Context,
+	community *Community,
+	text string,
+	keyboard func() *tele.ReplyMarkup,
+) (*tele.Message, error) {
+	if f.bot == nil {
+		return nil, errNoBot
+	}
+	tgChatId := community.TgChatId
+	silent := community.QuietHours != nil && community.QuietHours.Contains(time.Now())
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("telegram.silent", silent))
+	for attempt := 0; ; attempt++ {
+		opts := []interface{}{tele.ModeHTML, tele.NoPreview}
+		if silent {
+			opts = append(opts, tele.Silent)
+		}
+		// The keyboard is created for each attempt since telebot modifies it when sending
+		if keyboard != nil {
+			if markup := keyboard(); markup != nil {
+				opts = append(opts, markup)
 			}
+		}
+		sentMessage, err := f.bot.Send(tele.ChatID(tgChatId), text, opts...)
+		var floodErr tele.FloodError
+		if err == nil || !errors.As(err, &floodErr) || attempt == maxFloodRetries {
+			return sentMessage, err
+		}
+		f.l.WarnContext(ctx, "telegram flood limit exceeded", "chatId", tgChatId, "retryAfter", floodErr.RetryAfter)
+		select {
+		case <-time.After(time.Duration(floodErr.RetryAfter) * time.Second):
 		case <-ctx.Done():
-			f.l.Info("stopping forwarder service")
-			return nil
+			return nil, err
+		}
+	}
+}
+
+func (f *Forwarder) newBot() (*tele.Bot, error) {
+	botSettings := tele.Settings{
+		Token: f.tgToken,
+		Client: &http.Client{
+			Timeout:   time.Minute,
+			Transport: &metrics.InstrumentedTransport{Duration: metrics.TgApiRequestDuration},
+		},
+	}
+	bot, err := tele.NewBot(botSettings)
+	if err != nil {
+		return nil, fmt.Errorf("telebot error: %w", err)
+	}
+	return bot, nil
+}
+
+// forward sends the message to the sinks of its community, or only to message.Sink if set, without the lanes,
+// e.g. to replay dead letters without the pipeline.
+// Reports whether it was sent to all of them, in which case a replayed dead letter is removed.
+func (f *Forwarder) forward(ctx context.Context, message entities.Message) bool {
+	ctx = message.Context(ctx)
+	community, ok := f.community(message.HookId)
+	if !ok {
+		f.l.ErrorContext(ctx, "hookId not found", "hookId", message.HookId)
+		f.fail(ctx, message, metrics.FailureReasonUnknownHook, "hookId not found", 0)
+		return false
+	}
+	sent := true
+	if community.TgChatId != 0 && (message.Sink == "" || message.Sink == sinks.Telegram) {
+		sent = f.forwardTelegram(ctx, community, message)
+	}
+	sent = f.forwardSinks(ctx, community, message) && sent
+	if sent && message.DeadLetterId != 0 && f.deadLetters != nil {
+		if err := f.deadLetters.RemoveDeadLetter(ctx, message.DeadLetterId); err != nil {
+			f.l.ErrorContext(ctx, "error removing replayed dead letter", "id", message.DeadLetterId, "err", err)
 		}
 	}
+	return sent
 }
 
-func render(message entities.Message) string {
-	entitySlug := "id"
-	entityId := message.VkSenderId
-	if !message.IsFromUser() {
-		entitySlug = "club"
-		entityId = -message.VkSenderId
+// forwardSinks sends the message to the sinks of the community other than Telegram and reports whether it was sent
+func (f *Forwarder) forwardSinks(ctx context.Context, community *Community, message entities.Message) bool {
+	sent := true
+	for _, name := range community.Sinks {
+		if message.Sink != "" && message.Sink != name {
+			continue
+		}
+		sent = f.forwardSink(ctx, name, message) && sent
 	}
-	userName := strconv.Itoa(entityId)
-	if message.VkSender != nil {
-		userName = message.VkSender.FirstName + " " + message.VkSender.LastName
+	return sent
+}
+
+// forwardSink sends the message to the named sink and reports whether it was sent
+func (f *Forwarder) forwardSink(ctx context.Context, name string, message entities.Message) bool {
+	message.Sink = name
+	sink, ok := f.sinks[name]
+	if !ok {
+		f.l.ErrorContext(ctx, "sink not found", "sink", name)
+		f.fail(ctx, message, metrics.FailureReasonUnknownSink, "sink not found", 0)
+		return false
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"sink.Send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("sink.name", name)),
+	)
+	defer span.End()
+	if err := sink.Send(ctx, message); err != nil {
+		f.l.ErrorContext(ctx, "error sending message to sink", "sink", name, "err", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error sending message to sink")
+		metrics.SinkDeliveries.WithLabelValues(name, message.HookId, "failed").Inc()
+		f.fail(ctx, message, metrics.FailureReasonSinkError, err.Error(), 0)
+		return false
+	}
+	metrics.SinkDeliveries.WithLabelValues(name, message.HookId, "sent").Inc()
+	if !message.ReceivedAt.IsZero() {
+		metrics.SinkMessageLatency.WithLabelValues(name, message.HookId).Observe(time.Since(message.ReceivedAt).Seconds())
 	}
+	f.archiveMessage(ctx, message, entities.Delivery{Status: entities.DeliveryStatusSent})
+	return true
+}
 
-	return fmt.Sprintf(
-		"👤 <a href=\"https://vk.com/%s%d\">%s</a>\n%s %s",
-		entitySlug,
-		entityId,
-		userName,
-		messageTypeIcons[message.Type],
-		html.EscapeString(message.Text),
+// forwardTelegram sends the message to the community chat and reports whether it was sent
+func (f *Forwarder) forwardTelegram(ctx context.Context, community *Community, message entities.Message) bool {
+	message.Sink = sinks.Telegram
+	if f.skipMuted(ctx, community, message) {
+		return false
+	}
+	if err := f.wait(ctx, community.TgChatId); err != nil {
+		f.l.ErrorContext(ctx, "message lost on shutdown while rate limited", "message", message)
+		f.fail(context.WithoutCancel(ctx), message, metrics.FailureReasonLostOnShutdown, "lost on shutdown", community.TgChatId)
+		return false
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"bot.Send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("telegram.chat_id", community.TgChatId)),
 	)
+	defer span.End()
+	keyboard := func() *tele.ReplyMarkup { return buttons.Keyboard(message, community.Buttons) }
+	sentMessage, err := f.send(ctx, community, render.Html(message), keyboard)
+	if err != nil {
+		f.l.ErrorContext(ctx, "error sending telegram message", "err", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error sending telegram message")
+		f.fail(ctx, message, metrics.FailureReasonTelegramError, err.Error(), community.TgChatId)
+		return false
+	}
+	f.l.InfoContext(
+		ctx,
+		"sent telegram message",
+		"id", sentMessage.ID,
+		"chatId", sentMessage.Chat.ID,
+	)
+	f.delivered(ctx, message, sentMessage)
+	return true
+}
+
+// delivered records a message sent to Telegram, either alone or in a digest
+func (f *Forwarder) delivered(ctx context.Context, message entities.Message, sentMessage *tele.Message) {
+	f.sentMu.Lock()
+	f.lastSent[int(sentMessage.Chat.ID)] = time.Now()
+	f.sentMu.Unlock()
+	metrics.MessagesForwarded.WithLabelValues(message.HookId).Inc()
+	if !message.ReceivedAt.IsZero() {
+		metrics.MessageLatency.WithLabelValues(message.HookId).Observe(time.Since(message.ReceivedAt).Seconds())
+	}
+	f.archiveMessage(ctx, message, entities.Delivery{
+		Status:      entities.DeliveryStatusSent,
+		TgChatId:    int(sentMessage.Chat.ID),
+		TgMessageId: sentMessage.ID,
+	})
+}
+
+// skipMuted reports whether the chat of the community is muted, in which case the message is archived as muted
+// and kept as a dead letter, so that it can be replayed after the chat is unmuted
+func (f *Forwarder) skipMuted(ctx context.Context, community *Community, message entities.Message) bool {
+	if f.mutes == nil || !f.mutes.Muted(community.TgChatId) {
+		return false
+	}
+	f.l.InfoContext(ctx, "chat is muted, message not sent", "chatId", community.TgChatId)
+	metrics.MessagesMuted.WithLabelValues(message.HookId).Inc()
+	f.archiveMessage(ctx, message, entities.Delivery{
+		Status:   entities.DeliveryStatusMuted,
+		TgChatId: community.TgChatId,
+	})
+	if f.deadLetters != nil {
+		if err := f.deadLetters.AddDeadLetter(ctx, message, metrics.FailureReasonMuted, "chat is muted"); err != nil {
+			f.l.ErrorContext(ctx, "error storing dead letter", "err", err)
+		}
+	}
+	return true
+}
+
+// fail records a message that could not be forwarded in metrics, the archive and the dead-letter store
+func (f *Forwarder) fail(ctx context.Context, message entities.Message, reason string, errText string, tgChatId int) {
+	metrics.MessagesFailed.WithLabelValues(message.HookId, reason).Inc()
+	f.archiveMessage(ctx, message, entities.Delivery{
+		Status:   entities.DeliveryStatusFailed,
+		Error:    errText,
+		TgChatId: tgChatId,
+	})
+	if f.deadLetters == nil {
+		return
+	}
+	if err := f.deadLetters.AddDeadLetter(ctx, message, reason, errText); err != nil {
+		f.l.ErrorContext(ctx, "error storing dead letter", "err", err)
+	}
+}
+
+// archiveMessage records the delivery to message.Sink if the archive is enabled. Archive errors do not affect forwarding.
+func (f *Forwarder) archiveMessage(ctx context.Context, message entities.Message, delivery entities.Delivery) {
+	if f.archive == nil {
+		return
+	}
+	delivery.Sink = message.Sink
+	delivery.At = time.Now()
+	if err := f.archive.ArchiveMessage(ctx, message, delivery); err != nil {
+		f.l.ErrorContext(ctx, "error archiving message", "err", err)
+	}
 }
@@ -5,106 +5,44 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+	"viktig/internal/buttons"
 	"viktig/internal/entities"
 	"viktig/internal/queue"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	tele "gopkg.in/telebot.v3"
 )
 
-func TestRender(t *testing.T) {
-	t.Run("new message", func(t *testing.T) {
-		message := entities.Message{
-			Type:       entities.MessageTypeNew,
-			Text:       "Hello",
-			VkSenderId: 1234,
-		}
-		actual := render(message)
-		expected := "👤 <a href=\"https://vk.com/id1234\">1234</a>\n💬 Hello"
-		assert.Equal(t, expected, actual)
-	})
-	t.Run("edited message", func(t *testing.T) {
-		message := entities.Message{
-			Type:       entities.MessageTypeEdit,
-			Text:       "Edit",
-			VkSenderId: 1234,
-		}
-		actual := render(message)
-		expected := "👤 <a href=\"https://vk.com/id1234\">1234</a>\n✏️ Edit"
-		assert.Equal(t, expected, actual)
-	})
-	t.Run("edited by community message", func(t *testing.T) {
-		message := entities.Message{
-			Type:       entities.MessageTypeEdit,
-			Text:       "Edit",
-			VkSenderId: -123,
-		}
-		actual := render(message)
-		expected := "👤 <a href=\"https://vk.com/club123\">123</a>\n✏️ Edit"
-		assert.Equal(t, expected, actual)
-	})
-	t.Run("replied message", func(t *testing.T) {
-		message := entities.Message{
-			Type:       entities.MessageTypeReply,
-			Text:       "Reply",
-			VkSenderId: 4321,
-		}
-		actual := render(message)
-		expected := "👤 <a href=\"https://vk.com/id4321\">4321</a>\n↩️ Reply"
-		assert.Equal(t, expected, actual)
-	})
-	t.Run("with sender name", func(t *testing.T) {
-		message := entities.Message{
-			Type:       entities.MessageTypeNew,
-			Text:       "Hello",
-			VkSenderId: 1234,
-			VkSender:   &entities.VkUser{FirstName: "John", LastName: "Doe"},
-		}
-		actual := render(message)
-		expected := "👤 <a href=\"https://vk.com/id1234\">John Doe</a>\n💬 Hello"
-		assert.Equal(t, expected, actual)
-	})
-	t.Run("escape HTML", func(t *testing.T) {
-		message := entities.Message{
-			Type:       entities.MessageTypeNew,
-			Text:       "<a href=\"https://x.com\">&</a>",
-			VkSenderId: 1,
-		}
-		actual := render(message)
-		expected := "👤 <a href=\"https://vk.com/id1\">1</a>\n💬 &lt;a href=&#34;https://x.com&#34;&gt;&amp;&lt;/a&gt;"
-		assert.Equal(t, expected, actual)
-	})
-}
-
 func TestService(t *testing.T) {
-	t.Run("stop", func(t *testing.T) {
+	t.Run("start", func(t *testing.T) {
 		p := gomonkey.ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
 			return &tele.Bot{Me: &tele.User{Username: "mock"}}, nil
 		})
 		defer p.Reset()
-		_, _, s := setup(t, nil)
-		errCh := make(chan error)
-		ctx, cancel := context.WithCancel(context.Background())
-		go func() { errCh <- s.Run(ctx) }()
-		cancel()
+		buf, s := setup(t, nil)
 
-		assert.NoError(t, <-errCh)
+		assert.NoError(t, s.Start(context.Background()))
+		assert.Contains(t, buf.String(), "username=mock")
 	})
-	t.Run("stop on bot error", func(t *testing.T) {
+	t.Run("start error", func(t *testing.T) {
 		p := gomonkey.ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
 			return nil, fmt.Errorf("error")
 		})
 		defer p.Reset()
-		_, _, s := setup(t, nil)
-		errCh := make(chan error)
-		ctx, cancel := context.WithCancel(context.Background())
-		go func() { errCh <- s.Run(ctx) }()
-		cancel()
+		_, s := setup(t, nil)
 
-		assert.EqualError(t, <-errCh, "telebot error: error")
+		assert.EqualError(t, s.Start(context.Background()), "telebot error: error")
 	})
 	t.Run("hookId not found", func(t *testing.T) {
 		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
@@ -112,22 +50,16 @@ func TestService(t *testing.T) {
 			return fakeBot, nil
 		})
 		defer p.Reset()
-		q, buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
-		ctx, cancel := context.WithCancel(context.Background())
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() { defer wg.Done(); _ = s.Run(ctx) }()
+		buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		require.NoError(t, s.Start(context.Background()))
 
-		q.Put(entities.Message{
+		s.Process(context.Background(), entities.Message{
 			HookId:     "unknown-hook",
 			Type:       entities.MessageTypeNew,
 			Text:       "Hello",
 			VkSenderId: 1234,
 		})
 
-		cancel()
-		wg.Wait()
-
 		logOutput := buf.String()
 		assert.Contains(t, logOutput, "hookId not found")
 		assert.Contains(t, logOutput, "hookId=unknown-hook")
@@ -142,22 +74,16 @@ func TestService(t *testing.T) {
 				return nil, fmt.Errorf("error")
 			})
 		defer p.Reset()
-		q, buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
-		ctx, cancel := context.WithCancel(context.Background())
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() { defer wg.Done(); _ = s.Run(ctx) }()
+		buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		require.NoError(t, s.Start(context.Background()))
 
-		q.Put(entities.Message{
+		s.Process(context.Background(), entities.Message{
 			HookId:     "test-hook",
 			Type:       entities.MessageTypeNew,
 			Text:       "Hello",
 			VkSenderId: 1234,
 		})
 
-		cancel()
-		wg.Wait()
-
 		logOutput := buf.String()
 		assert.Contains(t, logOutput, "error sending telegram message")
 		assert.Contains(t, logOutput, "err=error")
@@ -172,40 +98,366 @@ func TestService(t *testing.T) {
 				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
 			})
 		defer p.Reset()
-		q, buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
-		ctx, cancel := context.WithCancel(context.Background())
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go func() { defer wg.Done(); _ = s.Run(ctx) }()
+		buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		require.NoError(t, s.Start(context.Background()))
 
-		q.Put(entities.Message{
+		s.Process(context.Background(), entities.Message{
 			HookId:     "test-hook",
 			Type:       entities.MessageTypeNew,
 			Text:       "Hello",
 			VkSenderId: 1234,
 		})
 
-		cancel()
-		wg.Wait()
-
 		logOutput := buf.String()
 		assert.Contains(t, logOutput, "sent telegram message")
 		assert.Contains(t, logOutput, "id=321")
 		assert.Contains(t, logOutput, "chatId=4321")
 	})
+	t.Run("trace", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		defaultProvider := otel.GetTracerProvider()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		t.Cleanup(func() { otel.SetTracerProvider(defaultProvider) })
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		require.NoError(t, s.Start(context.Background()))
+		parent := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{2},
+			TraceFlags: trace.FlagsSampled,
+		})
+
+		s.Process(context.Background(), entities.Message{
+			HookId:      "test-hook",
+			Type:        entities.MessageTypeNew,
+			Text:        "Hello",
+			VkSenderId:  1234,
+			SpanContext: parent,
+		})
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		assert.Equal(t, "bot.Send", spans[0].Name())
+		assert.Equal(t, parent.TraceID(), spans[0].SpanContext().TraceID())
+		assert.Equal(t, parent.SpanID(), spans[0].Parent().SpanID())
+		assert.Contains(t, spans[0].Attributes(), attribute.Int("telegram.chat_id", 4321))
+	})
+	t.Run("archive", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		archive := &fakeArchive{}
+		s.archive = archive
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"})
+		s.Process(context.Background(), entities.Message{HookId: "unknown-hook", Text: "Hello"})
+
+		require.Len(t, archive.deliveries, 2)
+		assert.Equal(t, entities.DeliveryStatusSent, archive.deliveries[0].Status)
+		assert.Equal(t, 4321, archive.deliveries[0].TgChatId)
+		assert.Equal(t, 321, archive.deliveries[0].TgMessageId)
+		assert.False(t, archive.deliveries[0].At.IsZero())
+		assert.Equal(t, entities.DeliveryStatusFailed, archive.deliveries[1].Status)
+		assert.Equal(t, "hookId not found", archive.deliveries[1].Error)
+	})
+	t.Run("flood retry", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		attempts := 0
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				attempts++
+				if attempts < 3 {
+					return nil, tele.FloodError{}
+				}
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		require.NoError(t, s.Start(context.Background()))
+
+		assert.True(t, s.forward(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"}))
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, 2, strings.Count(buf.String(), "telegram flood limit exceeded"))
+	})
+	t.Run("rate limit wait cancelled", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		s.chatLimiter = newLimiter(1, time.Hour)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		assert.True(t, s.forward(ctx, entities.Message{HookId: "test-hook", Text: "1"}))
+		assert.False(t, s.forward(ctx, entities.Message{HookId: "test-hook", Text: "2"}))
+		assert.Equal(t, []string{"lost_on_shutdown"}, deadLetters.reasons)
+	})
+	t.Run("rate limited chat", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		var mu sync.Mutex
+		var chats []string
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(to tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				chats = append(chats, to.Recipient())
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"limited": {TgChatId: 4321}, "test-hook": {TgChatId: 1}})
+		s.chatLimiter = newLimiter(1, time.Hour)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "limited", Text: "1"})
+		s.Process(context.Background(), entities.Message{HookId: "limited", Text: "2"})
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "3"})
+
+		mu.Lock()
+		assert.Equal(t, []string{"4321", "1"}, chats)
+		mu.Unlock()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.Flush(ctx)
+		assert.Equal(t, []string{"lost_on_shutdown"}, deadLetters.reasons)
+	})
+	t.Run("full lane", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		s.chatLimiter = newLimiter(1, time.Hour)
+		laneCtx, stop := context.WithCancel(context.Background())
+		defer stop()
+		s.lanes = newLanes(laneCtx, 1, queue.OverflowReject)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "1"})
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "2"})
+		require.Eventually(t, func() bool { return s.LaneDepth() == 0 }, time.Second, time.Millisecond)
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "3"})
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "4"})
+
+		assert.Equal(t, 1, s.LaneDepth())
+		assert.Equal(t, []string{"queue_overflow"}, deadLetters.reasons)
+	})
+	t.Run("muted", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		sent := 0
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, _ ...interface{}) (*tele.Message, error) {
+				sent++
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 1}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"muted": {TgChatId: 4321}, "test-hook": {TgChatId: 1}})
+		s.mutes = fakeMutes{4321: true}
+		archive := &fakeArchive{}
+		s.archive = archive
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+
+		assert.False(t, s.forward(context.Background(), entities.Message{HookId: "muted", Text: "Hello"}))
+		_, ok := s.LastSent(4321)
+		assert.False(t, ok)
+		assert.True(t, s.forward(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"}))
+		_, ok = s.LastSent(1)
+		assert.True(t, ok)
+
+		assert.Equal(t, 1, sent)
+		require.Len(t, archive.deliveries, 2)
+		assert.Equal(t, entities.DeliveryStatusMuted, archive.deliveries[0].Status)
+		assert.Equal(t, []string{"muted"}, deadLetters.reasons)
+		assert.Equal(t, []string{"telegram"}, deadLetters.sinks)
+	})
+	t.Run("buttons", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		var markup *tele.ReplyMarkup
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, _ interface{}, opts ...interface{}) (*tele.Message, error) {
+				for _, opt := range opts {
+					if m, ok := opt.(*tele.ReplyMarkup); ok {
+						markup = m
+					}
+				}
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{
+			"test-hook": {TgChatId: 4321, Buttons: buttons.Options{Callbacks: true}},
+		})
+		require.NoError(t, s.Start(context.Background()))
+
+		s.forward(context.Background(), entities.Message{HookId: "test-hook", VkGroupId: 10, VkPeerId: 1, VkSenderId: 1})
+
+		require.NotNil(t, markup)
+		require.Len(t, markup.InlineKeyboard[0], 2)
+		assert.Equal(t, "https://vk.com/gim10?sel=1", markup.InlineKeyboard[0][0].URL)
+		assert.Equal(t, buttons.UniqueAnswered, markup.InlineKeyboard[0][1].Unique)
+	})
+	t.Run("lost", func(t *testing.T) {
+		buf, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+
+		s.Lost(entities.Message{HookId: "test-hook", Text: "Hello"})
+
+		assert.Contains(t, buf.String(), "message lost on shutdown")
+		assert.Equal(t, []string{"lost_on_shutdown"}, deadLetters.reasons)
+	})
 }
 
-func setup(
-	t *testing.T,
-	communities map[string]*Community,
-) (*queue.Queue[entities.Message], *bytes.Buffer, *Forwarder) {
-	t.Helper()
-	q := queue.NewQueue[entities.Message]()
+func TestKey(t *testing.T) {
+	_, s := setup(t, map[string]*Community{"a": {TgChatId: 1}, "b": {TgChatId: 1}, "c": {TgChatId: 2}})
+
+	assert.Equal(t, s.Key(entities.Message{HookId: "a", VkPeerId: 10}), s.Key(entities.Message{HookId: "b", VkPeerId: 20}))
+	assert.NotEqual(t, s.Key(entities.Message{HookId: "a"}), s.Key(entities.Message{HookId: "c"}))
+	assert.Equal(t, "unknown:10", s.Key(entities.Message{HookId: "unknown", VkPeerId: 10}))
+}
+
+func TestNewLimiter(t *testing.T) {
+	t.Run("burst", func(t *testing.T) {
+		limiter := newLimiter(20, time.Minute)
+
+		allowed := 0
+		for range 20 {
+			if limiter.Allow("chat") {
+				allowed++
+			}
+		}
+
+		assert.Equal(t, 5, allowed)
+		assert.True(t, limiter.Allow("other chat"))
+	})
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, newLimiter(0, time.Minute))
+	})
+}
+
+func TestForwardOnce(t *testing.T) {
+	t.Run("dead letters", func(t *testing.T) {
+		fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+		p := gomonkey.
+			ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+				return fakeBot, nil
+			}).
+			ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, what interface{}, _ ...interface{}) (*tele.Message, error) {
+				if strings.Contains(what.(string), "fail") {
+					return nil, fmt.Errorf("error")
+				}
+				return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+			})
+		defer p.Reset()
+		_, s := setup(t, map[string]*Community{"test-hook": {TgChatId: 4321}})
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+
+		forwarded, err := s.ForwardOnce(context.Background(), []entities.Message{
+			{HookId: "test-hook", Text: "fail"},
+			{HookId: "unknown-hook", Text: "Hello"},
+			{HookId: "test-hook", Text: "Hello", DeadLetterId: 10},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, 1, forwarded)
+		assert.Equal(t, []string{"telegram_error", "unknown_hook"}, deadLetters.reasons)
+		assert.Equal(t, []int64{10}, deadLetters.removed)
+	})
+}
+
+type fakeDeadLetters struct {
+	mu      sync.Mutex
+	reasons []string
+	sinks   []string
+	removed []int64
+}
+
+func (d *fakeDeadLetters) AddDeadLetter(_ context.Context, message entities.Message, reason string, _ string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reasons = append(d.reasons, reason)
+	d.sinks = append(d.sinks, message.Sink)
+	return nil
+}
 
+func (d *fakeDeadLetters) RemoveDeadLetter(_ context.Context, id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removed = append(d.removed, id)
+	return nil
+}
+
+type fakeMutes map[int]bool
+
+func (m fakeMutes) Muted(tgChatId int) bool {
+	return m[tgChatId]
+}
+
+type fakeArchive struct {
+	mu         sync.Mutex
+	deliveries []entities.Delivery
+}
+
+func (a *fakeArchive) ArchiveMessage(_ context.Context, _ entities.Message, delivery entities.Delivery) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.deliveries = append(a.deliveries, delivery)
+	return nil
+}
+
+func setup(t *testing.T, communities map[string]*Community) (*bytes.Buffer, *Forwarder) {
+	t.Helper()
 	buf := new(bytes.Buffer)
 	log := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{}))
 
-	s := New("token", communities, q, log)
+	s := New("token", communities, nil, nil, nil, nil, nil, SendLimits{}, LaneLimits{}, log)
 
 	t.Cleanup(func() {
 		if !t.Failed() {
@@ -214,5 +466,5 @@ func setup(
 		t.Helper()
 		buf.Reset()
 	})
-	return q, buf, s
+	return buf, s
 }
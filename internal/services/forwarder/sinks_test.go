@@ -0,0 +1,246 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/sinks"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestSinks(t *testing.T) {
+	t.Run("sinks only", func(t *testing.T) {
+		discord := &fakeSink{}
+		s := setupSinks(t, &Community{Sinks: []string{"discord"}}, map[string]sinks.Sink{"discord": discord}, nil)
+		archive := &fakeArchive{}
+		s.archive = archive
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"})
+		s.lanes.wait()
+
+		assert.Equal(t, []string{"Hello"}, discord.texts())
+		require.Len(t, archive.deliveries, 1)
+		assert.Equal(t, entities.Delivery{Status: entities.DeliveryStatusSent, Sink: "discord", At: archive.deliveries[0].At}, archive.deliveries[0])
+	})
+	t.Run("telegram and sinks", func(t *testing.T) {
+		discord := &fakeSink{}
+		failing := &fakeSink{err: errors.New("error")}
+		var sent []string
+		s := setupSinks(
+			t,
+			&Community{TgChatId: 4321, Sinks: []string{"discord", "failing", "unknown"}},
+			map[string]sinks.Sink{"discord": discord, "failing": failing},
+			&sent,
+		)
+		archive := &fakeArchive{}
+		s.archive = archive
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"})
+		s.lanes.wait()
+
+		assert.Len(t, sent, 1)
+		assert.Equal(t, []string{"Hello"}, discord.texts())
+		assert.ElementsMatch(t, []string{"sink_error", "unknown_sink"}, deadLetters.reasons)
+		assert.ElementsMatch(t, []string{"failing", "unknown"}, deadLetters.sinks)
+		var archived []string
+		for _, delivery := range archive.deliveries {
+			archived = append(archived, delivery.Sink)
+		}
+		assert.ElementsMatch(t, []string{"telegram", "discord", "failing", "unknown"}, archived)
+	})
+	t.Run("slow sink", func(t *testing.T) {
+		slow := &fakeSink{unblock: make(chan struct{})}
+		var sent []string
+		s := setupSinks(t, &Community{TgChatId: 4321, Sinks: []string{"slow"}}, map[string]sinks.Sink{"slow": slow}, &sent)
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"})
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hi"})
+
+		assert.Len(t, sent, 2)
+		close(slow.unblock)
+		s.lanes.wait()
+		assert.Equal(t, []string{"Hello", "Hi"}, slow.texts())
+	})
+	t.Run("replay", func(t *testing.T) {
+		discord := &fakeSink{}
+		failing := &fakeSink{err: errors.New("error")}
+		s := setupSinks(
+			t,
+			&Community{TgChatId: 4321, Sinks: []string{"discord", "failing"}},
+			map[string]sinks.Sink{"discord": discord, "failing": failing},
+			nil,
+		)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello", DeadLetterId: 10})
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hi", DeadLetterId: 11, Sink: "discord"})
+		s.lanes.wait()
+
+		assert.Equal(t, []string{"Hello", "Hi"}, discord.texts())
+		assert.Equal(t, []int64{11}, deadLetters.removed)
+		assert.Equal(t, []string{"sink_error"}, deadLetters.reasons)
+	})
+	t.Run("replay to one sink", func(t *testing.T) {
+		discord := &fakeSink{}
+		var sent []string
+		s := setupSinks(
+			t,
+			&Community{TgChatId: 4321, Sinks: []string{"discord"}},
+			map[string]sinks.Sink{"discord": discord},
+			&sent,
+		)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+
+		forwarded, err := s.ForwardOnce(context.Background(), []entities.Message{
+			{HookId: "test-hook", Text: "Hello", DeadLetterId: 10, Sink: "discord"},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, 1, forwarded)
+		assert.Empty(t, sent)
+		assert.Equal(t, []string{"Hello"}, discord.texts())
+		assert.Equal(t, []int64{10}, deadLetters.removed)
+	})
+	t.Run("replay failed in one sink", func(t *testing.T) {
+		var sent []string
+		s := setupSinks(
+			t,
+			&Community{TgChatId: 4321, Sinks: []string{"failing"}},
+			map[string]sinks.Sink{"failing": &fakeSink{err: errors.New("error")}},
+			&sent,
+		)
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+
+		forwarded, err := s.ForwardOnce(context.Background(), []entities.Message{
+			{HookId: "test-hook", Text: "Hello", DeadLetterId: 10},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, 0, forwarded)
+		assert.Len(t, sent, 1)
+		assert.Empty(t, deadLetters.removed)
+	})
+	t.Run("without telegram", func(t *testing.T) {
+		discord := &fakeSink{}
+		_, s := setup(t, map[string]*Community{
+			"test-hook":  {Sinks: []string{"discord"}},
+			"other-hook": {TgChatId: 4321},
+		})
+		s.tgToken = ""
+		s.sinks = map[string]sinks.Sink{"discord": discord}
+		deadLetters := &fakeDeadLetters{}
+		s.deadLetters = deadLetters
+		require.NoError(t, s.Start(context.Background()))
+
+		s.Process(context.Background(), entities.Message{HookId: "test-hook", Text: "Hello"})
+		s.Process(context.Background(), entities.Message{HookId: "other-hook", Text: "Hi"})
+		s.lanes.wait()
+
+		assert.Equal(t, []string{"Hello"}, discord.texts())
+		assert.Equal(t, []string{"telegram_error"}, deadLetters.reasons)
+	})
+	t.Run("start error", func(t *testing.T) {
+		failing := &fakeSink{startErrs: 2}
+		var sent []string
+		s := setupSinks(
+			t,
+			&Community{TgChatId: 4321, Sinks: []string{"failing"}},
+			map[string]sinks.Sink{"failing": failing},
+			&sent,
+		)
+		s.sinkStartBackoff = time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		require.NoError(t, s.Start(ctx))
+		s.Process(ctx, entities.Message{HookId: "test-hook", Text: "Hello"})
+		s.lanes.wait()
+
+		assert.Len(t, sent, 1)
+		assert.Equal(t, []string{"Hello"}, failing.texts())
+		assert.Eventually(t, func() bool { return failing.startCount() == 3 }, time.Second, time.Millisecond)
+	})
+}
+
+// setupSinks creates the forwarder of the test-hook community, recording the texts sent to Telegram in sent if not nil
+func setupSinks(t *testing.T, community *Community, sinks map[string]sinks.Sink, sent *[]string) *Forwarder {
+	t.Helper()
+	fakeBot := &tele.Bot{Me: &tele.User{Username: "mock"}}
+	p := gomonkey.
+		ApplyFunc(tele.NewBot, func(_ tele.Settings) (*tele.Bot, error) {
+			return fakeBot, nil
+		}).
+		ApplyMethodFunc(fakeBot, "Send", func(_ tele.Recipient, what interface{}, _ ...interface{}) (*tele.Message, error) {
+			if sent != nil {
+				*sent = append(*sent, what.(string))
+			}
+			return &tele.Message{ID: 321, Chat: &tele.Chat{ID: 4321}}, nil
+		})
+	t.Cleanup(p.Reset)
+	_, s := setup(t, map[string]*Community{"test-hook": community})
+	s.sinks = sinks
+	return s
+}
+
+type fakeSink struct {
+	// startErrs is how many times starting the sink fails
+	startErrs int
+	starts    int
+	err       error
+	// unblock delays Send until it is closed if it is not nil
+	unblock chan struct{}
+	mu      sync.Mutex
+	sent    []entities.Message
+}
+
+func (s *fakeSink) Start(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.starts++
+	if s.starts <= s.startErrs {
+		return errors.New("error")
+	}
+	return nil
+}
+
+func (s *fakeSink) startCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.starts
+}
+
+func (s *fakeSink) Send(_ context.Context, message entities.Message) error {
+	if s.unblock != nil {
+		<-s.unblock
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, message)
+	return s.err
+}
+
+func (s *fakeSink) texts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var texts []string
+	for _, message := range s.sent {
+		texts = append(texts, message.Text)
+	}
+	return texts
+}
@@ -0,0 +1,293 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"viktig/internal/communities"
+	"viktig/internal/config"
+	"viktig/internal/storage"
+
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	adminHookIdKey = "hook_id"
+
+	maxPageLimit = 1000
+)
+
+var errInvalidQuery = errors.New("invalid query")
+
+// CommunityAdmin manages communities at runtime
+type CommunityAdmin interface {
+	List() []*config.CommunityConfig
+	Get(hookId string) (*config.CommunityConfig, error)
+	Create(ctx context.Context, community *config.CommunityConfig) error
+	Update(ctx context.Context, community *config.CommunityConfig) error
+	SetDisabled(ctx context.Context, hookId string, disabled bool) error
+	Delete(ctx context.Context, hookId string) error
+}
+
+// MessageArchive searches forwarded messages
+type MessageArchive interface {
+	ListMessages(ctx context.Context, filter storage.MessageFilter) ([]*storage.ArchivedMessage, error)
+}
+
+// DeadLetterAdmin inspects and replays messages that could not be forwarded
+type DeadLetterAdmin interface {
+	ListDeadLetters(ctx context.Context, filter storage.DeadLetterFilter) ([]*storage.DeadLetter, error)
+	// ReplayDeadLetters queues the dead letters for forwarding, all of them if ids are empty
+	ReplayDeadLetters(ctx context.Context, ids []int64) (int, error)
+	PurgeDeadLetters(ctx context.Context) (int64, error)
+}
+
+// Admin enables the admin API if AuthTokens are set. Routes are only added for the non-nil components.
+type Admin struct {
+	AuthTokens  []string
+	Communities CommunityAdmin
+	Messages    MessageArchive
+	DeadLetters DeadLetterAdmin
+}
+
+type replayDeadLettersDto struct {
+	Ids []int64 `json:"ids"`
+	All bool    `json:"all"`
+}
+
+func (s *HttpServer) addAdminRoutes(group *router.Group) {
+	auth := func(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return bearerTokenAuth(s.admin.AuthTokens, handler)
+	}
+	if s.admin.Communities != nil {
+		communityPath := fmt.Sprintf("/communities/{%s}", adminHookIdKey)
+		group.GET("/communities", auth(s.listCommunitiesHandler))
+		group.POST("/communities", auth(s.createCommunityHandler))
+		group.GET(communityPath, auth(s.getCommunityHandler))
+		group.PUT(communityPath, auth(s.updateCommunityHandler))
+		group.DELETE(communityPath, auth(s.deleteCommunityHandler))
+		group.POST(communityPath+"/disable", auth(s.setCommunityDisabledHandler(true)))
+		group.POST(communityPath+"/enable", auth(s.setCommunityDisabledHandler(false)))
+	}
+	if s.admin.Messages != nil {
+		group.GET("/messages", auth(s.listMessagesHandler))
+	}
+	if s.admin.DeadLetters != nil {
+		group.GET("/dlq", auth(s.listDeadLettersHandler))
+		group.POST("/dlq/replay", auth(s.replayDeadLettersHandler))
+		group.DELETE("/dlq", auth(s.purgeDeadLettersHandler))
+	}
+}
+
+func (s *HttpServer) listCommunitiesHandler(ctx *fasthttp.RequestCtx) {
+	list := s.admin.Communities.List()
+	redacted := make([]*config.CommunityConfig, 0, len(list))
+	for _, community := range list {
+		redacted = append(redacted, redactCommunity(community))
+	}
+	s.writeJson(ctx, fasthttp.StatusOK, redacted)
+}
+
+func (s *HttpServer) getCommunityHandler(ctx *fasthttp.RequestCtx) {
+	community, err := s.admin.Communities.Get(adminHookId(ctx))
+	if err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusOK, redactCommunity(community))
+}
+
+func (s *HttpServer) createCommunityHandler(ctx *fasthttp.RequestCtx) {
+	community := &config.CommunityConfig{}
+	if err := jsoniter.Unmarshal(ctx.Request.Body(), community); err != nil {
+		s.adminError(ctx, communities.ErrInvalid)
+		return
+	}
+	if err := s.admin.Communities.Create(ctx, community); err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusCreated, redactCommunity(community))
+}
+
+// updateCommunityHandler replaces the community, the hook ID in the body may be omitted
+func (s *HttpServer) updateCommunityHandler(ctx *fasthttp.RequestCtx) {
+	hookId := adminHookId(ctx)
+	community := &config.CommunityConfig{}
+	if err := jsoniter.Unmarshal(ctx.Request.Body(), community); err != nil {
+		s.adminError(ctx, communities.ErrInvalid)
+		return
+	}
+	if community.HookId == "" {
+		community.HookId = hookId
+	} else if community.HookId != hookId {
+		s.adminError(ctx, communities.ErrInvalid)
+		return
+	}
+	if err := s.admin.Communities.Update(ctx, community); err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusOK, redactCommunity(community))
+}
+
+func (s *HttpServer) deleteCommunityHandler(ctx *fasthttp.RequestCtx) {
+	if err := s.admin.Communities.Delete(ctx, adminHookId(ctx)); err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func (s *HttpServer) setCommunityDisabledHandler(disabled bool) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		hookId := adminHookId(ctx)
+		if err := s.admin.Communities.SetDisabled(ctx, hookId, disabled); err != nil {
+			s.adminError(ctx, err)
+			return
+		}
+		community, err := s.admin.Communities.Get(hookId)
+		if err != nil {
+			s.adminError(ctx, err)
+			return
+		}
+		s.writeJson(ctx, fasthttp.StatusOK, redactCommunity(community))
+	}
+}
+
+// listMessagesHandler searches the archive. Times are RFC 3339, results are paginated with after_id.
+func (s *HttpServer) listMessagesHandler(ctx *fasthttp.RequestCtx) {
+	filter, err := messageFilter(ctx.QueryArgs())
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	messages, err := s.admin.Messages.ListMessages(ctx, filter)
+	if err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusOK, messages)
+}
+
+func messageFilter(args *fasthttp.Args) (filter storage.MessageFilter, err error) {
+	filter.HookId = string(args.Peek("hook_id"))
+	filter.Query = string(args.Peek("q"))
+	if value := args.Peek("sender_id"); len(value) > 0 {
+		if filter.VkSenderId, err = strconv.Atoi(string(value)); err != nil {
+			return filter, fmt.Errorf("%w: sender_id", errInvalidQuery)
+		}
+	}
+	if value := args.Peek("from"); len(value) > 0 {
+		if filter.From, err = time.Parse(time.RFC3339, string(value)); err != nil {
+			return filter, fmt.Errorf("%w: from", errInvalidQuery)
+		}
+	}
+	if value := args.Peek("to"); len(value) > 0 {
+		if filter.To, err = time.Parse(time.RFC3339, string(value)); err != nil {
+			return filter, fmt.Errorf("%w: to", errInvalidQuery)
+		}
+	}
+	filter.AfterId, filter.Limit, err = page(args)
+	return filter, err
+}
+
+// page parses the pagination parameters
+func page(args *fasthttp.Args) (afterId int64, limit int, err error) {
+	if value := args.Peek("after_id"); len(value) > 0 {
+		if afterId, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("%w: after_id", errInvalidQuery)
+		}
+	}
+	if value := args.Peek("limit"); len(value) > 0 {
+		if limit, err = strconv.Atoi(string(value)); err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("%w: limit must be between 1 and %d", errInvalidQuery, maxPageLimit)
+		}
+	}
+	return afterId, limit, nil
+}
+
+func (s *HttpServer) listDeadLettersHandler(ctx *fasthttp.RequestCtx) {
+	filter := storage.DeadLetterFilter{}
+	var err error
+	if filter.AfterId, filter.Limit, err = page(ctx.QueryArgs()); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	letters, err := s.admin.DeadLetters.ListDeadLetters(ctx, filter)
+	if err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusOK, letters)
+}
+
+// replayDeadLettersHandler queues either the listed dead letters or all of them, which must be requested explicitly
+func (s *HttpServer) replayDeadLettersHandler(ctx *fasthttp.RequestCtx) {
+	dto := &replayDeadLettersDto{}
+	if err := jsoniter.Unmarshal(ctx.Request.Body(), dto); err != nil || dto.All == (len(dto.Ids) > 0) {
+		ctx.Error("either ids or all must be set", fasthttp.StatusBadRequest)
+		return
+	}
+	queued, err := s.admin.DeadLetters.ReplayDeadLetters(ctx, dto.Ids)
+	if err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusAccepted, map[string]int{"queued": queued})
+}
+
+func (s *HttpServer) purgeDeadLettersHandler(ctx *fasthttp.RequestCtx) {
+	purged, err := s.admin.DeadLetters.PurgeDeadLetters(ctx)
+	if err != nil {
+		s.adminError(ctx, err)
+		return
+	}
+	s.writeJson(ctx, fasthttp.StatusOK, map[string]int64{"purged": purged})
+}
+
+// adminError responds with the status matching err. Validation details are returned to the client
+// since the admin API is only available to authenticated clients.
+func (s *HttpServer) adminError(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, communities.ErrNotFound):
+		ctx.Error(err.Error(), fasthttp.StatusNotFound)
+	case errors.Is(err, communities.ErrExists):
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+	case errors.Is(err, communities.ErrInvalid):
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+	default:
+		s.l.Error("admin request error", "path", string(ctx.Path()), "err", err)
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusInternalServerError), fasthttp.StatusInternalServerError)
+	}
+}
+
+func adminHookId(ctx *fasthttp.RequestCtx) string {
+	hookId, _ := ctx.UserValue(adminHookIdKey).(string)
+	return hookId
+}
+
+// redactCommunity returns a copy of community without secrets
+func redactCommunity(community *config.CommunityConfig) *config.CommunityConfig {
+	redacted := *community
+	redacted.SecretKey = ""
+	redacted.SecretKeys = nil
+	redacted.VkToken = ""
+	return &redacted
+}
+
+func (s *HttpServer) writeJson(ctx *fasthttp.RequestCtx, status int, v any) {
+	body, err := jsoniter.Marshal(v)
+	if err != nil {
+		s.l.Error("error marshalling response", "err", err)
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusInternalServerError), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.Response.SetStatusCode(status)
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(body)
+}
@@ -0,0 +1,257 @@
+package http_server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"viktig/internal/communities"
+	"viktig/internal/config"
+	"viktig/internal/health"
+	"viktig/internal/storage"
+
+	"github.com/fasthttp/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAdminCommunities(t *testing.T) {
+	t.Run("unauthorized", func(t *testing.T) {
+		client, _ := makeAdminClient(t)
+		resp, err := client.Get("http://localhost/api/admin/communities")
+		require.NoError(t, err)
+		assert.Equal(t, fasthttp.StatusUnauthorized, resp.StatusCode)
+	})
+	t.Run("create", func(t *testing.T) {
+		client, s := makeAdminClient(t)
+		body := `{"hook_id":"new-hook","secret_key":"secret","confirmation_string":"confirmation","tg_chat_id":1234}`
+
+		resp, respBody := adminRequest(t, client, http.MethodPost, "/communities", body)
+		assert.Equal(t, fasthttp.StatusCreated, resp.StatusCode)
+		assert.JSONEq(t, `{"hook_id":"new-hook","confirmation_string":"confirmation","tg_chat_id":1234,"disabled":false}`, respBody)
+		community, ok := s.community("new-hook")
+		require.True(t, ok)
+		assert.Equal(t, []string{"secret"}, community.SecretKeys)
+
+		resp, _ = adminRequest(t, client, http.MethodPost, "/communities", body)
+		assert.Equal(t, fasthttp.StatusConflict, resp.StatusCode)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		client, _ := makeAdminClient(t)
+		resp, _ := adminRequest(t, client, http.MethodPost, "/communities", `{"hook_id":"new-hook"}`)
+		assert.Equal(t, fasthttp.StatusBadRequest, resp.StatusCode)
+		resp, _ = adminRequest(t, client, http.MethodPost, "/communities", `not json`)
+		assert.Equal(t, fasthttp.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("list", func(t *testing.T) {
+		client, _ := makeAdminClient(t)
+		resp, respBody := adminRequest(t, client, http.MethodGet, "/communities", "")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `[{"hook_id":"test-hook","confirmation_string":"confirmation","tg_chat_id":1234,"disabled":false}]`, respBody)
+	})
+	t.Run("update", func(t *testing.T) {
+		client, s := makeAdminClient(t)
+		resp, _ := adminRequest(
+			t, client, http.MethodPut, "/communities/test-hook",
+			`{"secret_keys":["new-secret"],"confirmation_string":"new-confirmation","tg_chat_id":1234}`,
+		)
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		community, _ := s.community("test-hook")
+		assert.Equal(t, &Community{SecretKeys: []string{"new-secret"}, ConfirmationString: "new-confirmation"}, community)
+
+		resp, _ = adminRequest(
+			t, client, http.MethodPut, "/communities/test-hook",
+			`{"hook_id":"other-hook","secret_key":"secret","confirmation_string":"confirmation","tg_chat_id":1234}`,
+		)
+		assert.Equal(t, fasthttp.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("disable and enable", func(t *testing.T) {
+		client, s := makeAdminClient(t)
+		resp, respBody := adminRequest(t, client, http.MethodPost, "/communities/test-hook/disable", "")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		assert.Contains(t, respBody, `"disabled":true`)
+		_, ok := s.community("test-hook")
+		assert.False(t, ok)
+
+		resp, _ = adminRequest(t, client, http.MethodPost, "/communities/test-hook/enable", "")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		_, ok = s.community("test-hook")
+		assert.True(t, ok)
+	})
+	t.Run("delete", func(t *testing.T) {
+		client, s := makeAdminClient(t)
+		resp, _ := adminRequest(t, client, http.MethodDelete, "/communities/test-hook", "")
+		assert.Equal(t, fasthttp.StatusNoContent, resp.StatusCode)
+		_, ok := s.community("test-hook")
+		assert.False(t, ok)
+
+		resp, _ = adminRequest(t, client, http.MethodGet, "/communities/test-hook", "")
+		assert.Equal(t, fasthttp.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestAdminMessages(t *testing.T) {
+	t.Run("filter", func(t *testing.T) {
+		archive := &fakeMessageArchive{}
+		client, _ := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}, Messages: archive})
+		resp, respBody := adminRequest(
+			t, client, http.MethodGet,
+			"/messages?hook_id=test-hook&sender_id=1234&from=2024-05-01T00:00:00Z&to=2024-05-02T00:00:00Z&q=order&after_id=10&limit=5",
+			"",
+		)
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `[]`, respBody)
+		assert.Equal(t, storage.MessageFilter{
+			HookId:     "test-hook",
+			VkSenderId: 1234,
+			From:       time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			To:         time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+			Query:      "order",
+			AfterId:    10,
+			Limit:      5,
+		}, archive.filter)
+	})
+	t.Run("invalid filter", func(t *testing.T) {
+		client, _ := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}, Messages: &fakeMessageArchive{}})
+		for _, query := range []string{"sender_id=x", "from=yesterday", "limit=0", "limit=100000", "after_id=x"} {
+			resp, _ := adminRequest(t, client, http.MethodGet, "/messages?"+query, "")
+			assert.Equal(t, fasthttp.StatusBadRequest, resp.StatusCode, query)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		client, _ := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}})
+		resp, _ := adminRequest(t, client, http.MethodGet, "/messages", "")
+		assert.Equal(t, fasthttp.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestAdminDeadLetters(t *testing.T) {
+	t.Run("list", func(t *testing.T) {
+		dlq := &fakeDeadLetterAdmin{}
+		client, _ := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}, DeadLetters: dlq})
+		resp, respBody := adminRequest(t, client, http.MethodGet, "/dlq?after_id=5&limit=10", "")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `[]`, respBody)
+		assert.Equal(t, storage.DeadLetterFilter{AfterId: 5, Limit: 10}, dlq.filter)
+	})
+	t.Run("replay", func(t *testing.T) {
+		dlq := &fakeDeadLetterAdmin{}
+		client, _ := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}, DeadLetters: dlq})
+		resp, respBody := adminRequest(t, client, http.MethodPost, "/dlq/replay", `{"ids":[1,2]}`)
+		assert.Equal(t, fasthttp.StatusAccepted, resp.StatusCode)
+		assert.JSONEq(t, `{"queued":2}`, respBody)
+		assert.Equal(t, []int64{1, 2}, dlq.replayed)
+
+		resp, _ = adminRequest(t, client, http.MethodPost, "/dlq/replay", `{"all":true}`)
+		assert.Equal(t, fasthttp.StatusAccepted, resp.StatusCode)
+		assert.Empty(t, dlq.replayed)
+
+		for _, body := range []string{`{}`, `{"all":true,"ids":[1]}`, `not json`} {
+			resp, _ = adminRequest(t, client, http.MethodPost, "/dlq/replay", body)
+			assert.Equal(t, fasthttp.StatusBadRequest, resp.StatusCode, body)
+		}
+	})
+	t.Run("purge", func(t *testing.T) {
+		client, _ := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}, DeadLetters: &fakeDeadLetterAdmin{}})
+		resp, respBody := adminRequest(t, client, http.MethodDelete, "/dlq", "")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `{"purged":3}`, respBody)
+	})
+}
+
+type fakeDeadLetterAdmin struct {
+	filter   storage.DeadLetterFilter
+	replayed []int64
+}
+
+func (d *fakeDeadLetterAdmin) ListDeadLetters(_ context.Context, filter storage.DeadLetterFilter) ([]*storage.DeadLetter, error) {
+	d.filter = filter
+	return make([]*storage.DeadLetter, 0), nil
+}
+
+func (d *fakeDeadLetterAdmin) ReplayDeadLetters(_ context.Context, ids []int64) (int, error) {
+	d.replayed = ids
+	if len(ids) == 0 {
+		return 5, nil
+	}
+	return len(ids), nil
+}
+
+func (d *fakeDeadLetterAdmin) PurgeDeadLetters(_ context.Context) (int64, error) {
+	return 3, nil
+}
+
+type fakeMessageArchive struct {
+	filter storage.MessageFilter
+}
+
+func (a *fakeMessageArchive) ListMessages(_ context.Context, filter storage.MessageFilter) ([]*storage.ArchivedMessage, error) {
+	a.filter = filter
+	return make([]*storage.ArchivedMessage, 0), nil
+}
+
+// serverCommunities applies community changes to the test server like the app does
+type serverCommunities struct {
+	s *HttpServer
+}
+
+func (c serverCommunities) SetCommunity(community *config.CommunityConfig) {
+	c.s.SetCommunity(community.HookId, &Community{
+		SecretKeys:         community.AllSecretKeys(),
+		ConfirmationString: community.ConfirmationString,
+	})
+}
+
+func (c serverCommunities) RemoveCommunity(hookId string) {
+	c.s.RemoveCommunity(hookId)
+}
+
+func makeAdminClient(t *testing.T) (http.Client, *HttpServer) {
+	t.Helper()
+	manager := communities.New(nil, nil, slog.Default())
+	require.NoError(t, manager.Load(context.Background(), []*config.CommunityConfig{{
+		HookId:             "test-hook",
+		SecretKey:          "secret",
+		ConfirmationString: "confirmation",
+		TgChatId:           1234,
+	}}))
+	client, s := makeAdminServerClient(Admin{AuthTokens: []string{"admin-token"}, Communities: manager})
+	s.SetCommunity("test-hook", &Community{SecretKeys: []string{"secret"}, ConfirmationString: "confirmation"})
+	manager.Subscribe(serverCommunities{s})
+	return client, s
+}
+
+func makeAdminServerClient(admin Admin) (http.Client, *HttpServer) {
+	s := New(
+		"",
+		0,
+		nil,
+		make(map[string]*Community),
+		admin,
+		nil,
+		time.Second,
+		CallbackProtection{},
+		nil,
+		health.NewRegistry(),
+		slog.Default(),
+	)
+	r := router.New()
+	s.addAdminRoutes(r.Group("/api/admin"))
+	return makeTestClient(r.Handler), s
+}
+
+func adminRequest(t *testing.T, client http.Client, method, path, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://localhost/api/admin"+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(respBody)
+}
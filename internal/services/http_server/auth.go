@@ -1,21 +1,36 @@
 package http_server
 
 import (
+	"crypto/subtle"
 	"fmt"
-	"reflect"
 
 	"github.com/valyala/fasthttp"
 )
 
-func bearerTokenAuth(token string, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
-	expectedHeader := []byte(fmt.Sprintf("Bearer %s", token))
+func bearerTokenAuth(tokens []string, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	expectedHeaders := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if token != "" {
+			expectedHeaders = append(expectedHeaders, fmt.Sprintf("Bearer %s", token))
+		}
+	}
 
 	return func(ctx *fasthttp.RequestCtx) {
 		header := ctx.Request.Header.Peek("Authorization")
-		if reflect.DeepEqual(header, expectedHeader) {
+		if matchesAny(string(header), expectedHeaders) {
 			handler(ctx)
 		} else {
 			ctx.Error("unauthorized", fasthttp.StatusUnauthorized)
 		}
 	}
 }
+
+// matchesAny compares value to each of the expected values in constant time.
+// All the expected values are compared so that timing does not reveal which of them matched.
+func matchesAny(value string, expected []string) bool {
+	matches := 0
+	for _, e := range expected {
+		matches |= subtle.ConstantTimeCompare([]byte(value), []byte(e))
+	}
+	return matches == 1
+}
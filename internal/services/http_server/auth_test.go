@@ -31,7 +31,7 @@ func makeTestClient(handler fasthttp.RequestHandler) http.Client {
 
 func TestBearerTokenAuth(t *testing.T) {
 	t.Run("unauthorized", func(t *testing.T) {
-		client := makeTestClient(bearerTokenAuth("test-token", alwaysOkHandler))
+		client := makeTestClient(bearerTokenAuth([]string{"test-token"}, alwaysOkHandler))
 		resp, _ := client.Get("http://localhost/")
 		body, _ := io.ReadAll(resp.Body)
 		assert.Equal(t, fasthttp.StatusUnauthorized, resp.StatusCode)
@@ -39,7 +39,7 @@ func TestBearerTokenAuth(t *testing.T) {
 	})
 
 	t.Run("authorized", func(t *testing.T) {
-		client := makeTestClient(bearerTokenAuth("test-token", alwaysOkHandler))
+		client := makeTestClient(bearerTokenAuth([]string{"test-token"}, alwaysOkHandler))
 		req, _ := http.NewRequest("GET", "http://localhost/", nil)
 		req.Header.Set("Authorization", "Bearer test-token")
 		resp, _ := client.Do(req)
@@ -48,7 +48,7 @@ func TestBearerTokenAuth(t *testing.T) {
 		assert.Equal(t, string(body), "ok")
 	})
 	t.Run("no token", func(t *testing.T) {
-		client := makeTestClient(bearerTokenAuth("", alwaysOkHandler))
+		client := makeTestClient(bearerTokenAuth([]string{""}, alwaysOkHandler))
 		req, _ := http.NewRequest("GET", "http://localhost/", nil)
 		req.Header.Set("Authorization", "Bearer ")
 		resp, _ := client.Do(req)
@@ -56,4 +56,26 @@ func TestBearerTokenAuth(t *testing.T) {
 		assert.Equal(t, fasthttp.StatusUnauthorized, resp.StatusCode)
 		assert.Equal(t, string(body), "unauthorized")
 	})
+	t.Run("rotation", func(t *testing.T) {
+		client := makeTestClient(bearerTokenAuth([]string{"old-token", "new-token"}, alwaysOkHandler))
+		for _, token := range []string{"old-token", "new-token"} {
+			req, _ := http.NewRequest("GET", "http://localhost/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, _ := client.Do(req)
+			assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		}
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer other-token")
+		resp, _ := client.Do(req)
+		assert.Equal(t, fasthttp.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestMatchesAny(t *testing.T) {
+	expected := []string{"a", "bc"}
+	assert.True(t, matchesAny("a", expected))
+	assert.True(t, matchesAny("bc", expected))
+	assert.False(t, matchesAny("b", expected))
+	assert.False(t, matchesAny("", expected))
+	assert.False(t, matchesAny("a", nil))
 }
@@ -1,5 +1,10 @@
 package http_server
 
+import (
+	"fmt"
+	"viktig/internal/entities"
+)
+
 type typeDto struct {
 	Type       string `json:"type"`
 	EventId    string `json:"event_id"`
@@ -19,6 +24,86 @@ type editOrReplyMessageDto struct {
 }
 
 type vkMessage struct {
-	SenderId int    `json:"from_id"`
-	Text     string `json:"text"`
+	SenderId    int            `json:"from_id"`
+	PeerId      int            `json:"peer_id"`
+	MessageId   int            `json:"conversation_message_id"`
+	Text        string         `json:"text"`
+	Attachments []vkAttachment `json:"attachments"`
+}
+
+type vkAttachment struct {
+	Type  string `json:"type"`
+	Photo *struct {
+		Sizes []vkImage `json:"sizes"`
+	} `json:"photo"`
+	Sticker *struct {
+		Images []vkImage `json:"images"`
+	} `json:"sticker"`
+	Doc *struct {
+		Title string `json:"title"`
+		Url   string `json:"url"`
+	} `json:"doc"`
+	Link *struct {
+		Title string `json:"title"`
+		Url   string `json:"url"`
+	} `json:"link"`
+	Video *struct {
+		Title   string `json:"title"`
+		OwnerId int    `json:"owner_id"`
+		Id      int    `json:"id"`
+	} `json:"video"`
+	Wall *struct {
+		OwnerId int `json:"owner_id"`
+		FromId  int `json:"from_id"`
+		Id      int `json:"id"`
+	} `json:"wall"`
+	AudioMessage *struct {
+		LinkMp3 string `json:"link_mp3"`
+	} `json:"audio_message"`
+}
+
+type vkImage struct {
+	Url   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+// attachments converts the VK attachments, keeping the type of those without a link
+func (m *vkMessage) attachments() []entities.Attachment {
+	var result []entities.Attachment
+	for _, a := range m.Attachments {
+		attachment := entities.Attachment{Type: a.Type}
+		switch {
+		case a.Photo != nil:
+			attachment.Url = largest(a.Photo.Sizes)
+		case a.Sticker != nil:
+			attachment.Url = largest(a.Sticker.Images)
+		case a.Doc != nil:
+			attachment.Url, attachment.Title = a.Doc.Url, a.Doc.Title
+		case a.Link != nil:
+			attachment.Url, attachment.Title = a.Link.Url, a.Link.Title
+		case a.Video != nil:
+			attachment.Url = fmt.Sprintf("https://vk.com/video%d_%d", a.Video.OwnerId, a.Video.Id)
+			attachment.Title = a.Video.Title
+		case a.Wall != nil:
+			ownerId := a.Wall.OwnerId
+			if ownerId == 0 {
+				ownerId = a.Wall.FromId
+			}
+			attachment.Url = fmt.Sprintf("https://vk.com/wall%d_%d", ownerId, a.Wall.Id)
+		case a.AudioMessage != nil:
+			attachment.Url = a.AudioMessage.LinkMp3
+		}
+		result = append(result, attachment)
+	}
+	return result
+}
+
+func largest(images []vkImage) string {
+	url, width := "", -1
+	for _, image := range images {
+		if image.Width > width {
+			url, width = image.Url, image.Width
+		}
+	}
+	return url
 }
@@ -1,23 +1,35 @@
 package http_server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 	"viktig/internal/entities"
 	"viktig/internal/metrics"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	messageTypeChallenge = "confirmation"
 
 	responseBodyOk = "ok"
+
+	// enqueueTimeout limits how long a request may wait for space in a full queue with the block overflow policy,
+	// so that the response is sent before VK gives up on the request
+	enqueueTimeout = 3 * time.Second
 )
 
+var tracer = otel.Tracer("viktig/internal/services/http_server")
+
 var forwardedMessageTypes = map[string]entities.MessageType{
 	"message_new":   entities.MessageTypeNew,
 	"message_edit":  entities.MessageTypeEdit,
@@ -25,21 +37,38 @@ var forwardedMessageTypes = map[string]entities.MessageType{
 }
 
 func (s *HttpServer) vkHandler(ctx *fasthttp.RequestCtx) {
+	if s.stopping.Load() {
+		ctx.Error("shutting down", fasthttp.StatusServiceUnavailable)
+		return
+	}
+
 	var err error
+	rejectReason := rejectReasonBadRequest
+	hookId, _ := ctx.UserValue(hookIdKey).(string)
+	spanCtx, span := tracer.Start(
+		context.Background(),
+		"vk_callback",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("hook_id", hookId)),
+	)
 	defer func() {
 		if err != nil {
-			slog.Error(fmt.Sprintf("error handling request: %+v", err))
-			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			slog.ErrorContext(spanCtx, fmt.Sprintf("error handling request: %+v", err))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "error handling request")
+			metrics.HttpRequestsRejected.WithLabelValues(rejectReason).Inc()
+			ctx.Error(fasthttp.StatusMessage(fasthttp.StatusBadRequest), fasthttp.StatusBadRequest)
 		}
+		span.End()
 	}()
 
-	hookId, ok := ctx.UserValue(hookIdKey).(string)
-	if !ok || hookId == "" {
+	if hookId == "" {
 		err = errors.New("invalid hookId")
 		return
 	}
-	community, ok := s.communities[hookId]
+	community, ok := s.community(hookId)
 	if !ok {
+		rejectReason = rejectReasonUnknownHook
 		err = fmt.Errorf("hookId not found: %s", hookId)
 		return
 	}
@@ -49,28 +78,33 @@ func (s *HttpServer) vkHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if dto.Secret != community.SecretKey {
+	if !matchesAny(dto.Secret, community.SecretKeys) {
+		rejectReason = rejectReasonWrongSecret
 		err = fmt.Errorf("secret key does not match for hookId %s", hookId)
 		return
 	}
 
-	slog.Info(
+	span.SetAttributes(
+		attribute.String("vk.event_type", dto.Type),
+		attribute.String("vk.event_id", dto.EventId),
+	)
+	slog.InfoContext(
+		spanCtx,
 		"received vk event",
 		"type", dto.Type,
 		"id", dto.EventId,
 		"groupId", dto.GroupId,
 		"apiVersion", dto.ApiVersion,
 	)
-	metrics.VKEventsReceived.With((prometheus.Labels{"type": dto.Type})).Inc()
+	metrics.VKEventsReceived.With((prometheus.Labels{"type": dto.Type, "hook_id": hookId})).Inc()
 
 	if dto.Type == messageTypeChallenge {
 		err = s.handleChallenge(ctx, community)
 	} else if messageType, ok := forwardedMessageTypes[dto.Type]; ok {
-		err = s.handleMessage(ctx, hookId, messageType)
+		err = s.handleMessage(spanCtx, ctx, hookId, dto.EventId, dto.GroupId, messageType)
 	} else {
-		text := fmt.Sprintf("unsupported message type: %s", dto.Type)
-		slog.Warn(text, "messageType", dto.Type)
-		ctx.Error(text, fasthttp.StatusBadRequest)
+		slog.WarnContext(spanCtx, "unsupported message type", "messageType", dto.Type)
+		ctx.Error("unsupported message type", fasthttp.StatusBadRequest)
 	}
 }
 
@@ -83,8 +117,11 @@ func (s *HttpServer) handleChallenge(ctx *fasthttp.RequestCtx, community *Commun
 }
 
 func (s *HttpServer) handleMessage(
+	spanCtx context.Context,
 	ctx *fasthttp.RequestCtx,
 	hookId string,
+	eventId string,
+	groupId int,
 	messageType entities.MessageType,
 ) error {
 	var message *vkMessage
@@ -103,12 +140,28 @@ func (s *HttpServer) handleMessage(
 		message = &dto.Object
 	}
 
-	s.q.Put(entities.Message{
-		HookId:     hookId,
-		Type:       messageType,
-		Text:       message.Text,
-		VkSenderId: message.SenderId,
+	enqueueCtx, cancel := context.WithTimeout(spanCtx, enqueueTimeout)
+	defer cancel()
+	err := s.q.TryPut(enqueueCtx, entities.Message{
+		HookId:      hookId,
+		EventId:     eventId,
+		Type:        messageType,
+		Text:        message.Text,
+		VkSenderId:  message.SenderId,
+		VkGroupId:   groupId,
+		VkPeerId:    message.PeerId,
+		VkMessageId: message.MessageId,
+		Attachments: message.attachments(),
+		ReceivedAt:  time.Now(),
+		SpanContext: trace.SpanContextFromContext(spanCtx),
 	})
+	if err != nil {
+		// VK retries the event later if the response is not successful
+		slog.WarnContext(spanCtx, "message not queued", "err", err)
+		metrics.HttpRequestsRejected.WithLabelValues(rejectReasonQueueFull).Inc()
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusServiceUnavailable), fasthttp.StatusServiceUnavailable)
+		return nil
+	}
 
 	ctx.Response.SetStatusCode(fasthttp.StatusOK)
 	ctx.Response.Header.SetContentType("text/plain")
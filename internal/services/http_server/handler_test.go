@@ -0,0 +1,115 @@
+package http_server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/health"
+	"viktig/internal/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestVkHandler(t *testing.T) {
+	t.Run("stopping", func(t *testing.T) {
+		s := makeTestServer(map[string]*Community{"test-hook": {}})
+		s.stopping.Store(true)
+		client := makeVkHandlerClient(s, "test-hook")
+
+		resp, _ := client.Post("http://localhost/", "application/json", strings.NewReader(`{}`))
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, fasthttp.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "shutting down", string(body))
+	})
+	t.Run("secret rotation", func(t *testing.T) {
+		s := makeTestServer(map[string]*Community{"test-hook": {
+			SecretKeys:         []string{"old-secret", "new-secret"},
+			ConfirmationString: "confirmation",
+		}})
+		client := makeVkHandlerClient(s, "test-hook")
+
+		for _, secret := range []string{"old-secret", "new-secret"} {
+			resp, _ := client.Post(
+				"http://localhost/",
+				"application/json",
+				strings.NewReader(`{"type":"confirmation","secret":"`+secret+`"}`),
+			)
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+			assert.Equal(t, "confirmation", string(body))
+		}
+	})
+	t.Run("wrong secret", func(t *testing.T) {
+		s := makeTestServer(map[string]*Community{"test-hook": {
+			SecretKeys:         []string{"secret"},
+			ConfirmationString: "confirmation",
+		}})
+		client := makeVkHandlerClient(s, "test-hook")
+
+		resp, _ := client.Post(
+			"http://localhost/",
+			"application/json",
+			strings.NewReader(`{"type":"confirmation","secret":"other"}`),
+		)
+
+		assert.Equal(t, fasthttp.StatusBadRequest, resp.StatusCode)
+	})
+	t.Run("message", func(t *testing.T) {
+		s := makeTestServer(map[string]*Community{"test-hook": {SecretKeys: []string{"secret"}}})
+		s.q = queue.NewBoundedQueue[entities.Message](1, queue.OverflowReject, nil)
+		client := makeVkHandlerClient(s, "test-hook")
+		body := `{"type":"message_new","event_id":"event","group_id":10,"secret":"secret",` +
+			`"object":{"message":{"from_id":1234,"peer_id":1234,"conversation_message_id":5,"text":"Hello","attachments":[` +
+			`{"type":"photo","photo":{"sizes":[{"url":"https://vk.com/s.jpg","width":75},{"url":"https://vk.com/x.jpg","width":604}]}},` +
+			`{"type":"doc","doc":{"title":"file.pdf","url":"https://vk.com/doc1"}},` +
+			`{"type":"video","video":{"title":"Video","owner_id":-10,"id":456}},` +
+			`{"type":"poll","poll":{}}]}}}`
+
+		resp, _ := client.Post("http://localhost/", "application/json", strings.NewReader(body))
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+
+		message := s.q.Take()
+		assert.Equal(t, "test-hook", message.HookId)
+		assert.Equal(t, "event", message.EventId)
+		assert.Equal(t, 10, message.VkGroupId)
+		assert.Equal(t, 1234, message.VkPeerId)
+		assert.Equal(t, 1234, message.VkSenderId)
+		assert.Equal(t, 5, message.VkMessageId)
+		assert.Equal(t, []entities.Attachment{
+			{Type: "photo", Url: "https://vk.com/x.jpg"},
+			{Type: "doc", Url: "https://vk.com/doc1", Title: "file.pdf"},
+			{Type: "video", Url: "https://vk.com/video-10_456", Title: "Video"},
+			{Type: "poll"},
+		}, message.Attachments)
+	})
+	t.Run("queue full", func(t *testing.T) {
+		s := makeTestServer(map[string]*Community{"test-hook": {SecretKeys: []string{"secret"}}})
+		s.q = queue.NewBoundedQueue[entities.Message](1, queue.OverflowReject, nil)
+		client := makeVkHandlerClient(s, "test-hook")
+		body := `{"type":"message_new","secret":"secret","object":{"message":{"from_id":1234,"text":"Hello"}}}`
+
+		resp, _ := client.Post("http://localhost/", "application/json", strings.NewReader(body))
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		resp, _ = client.Post("http://localhost/", "application/json", strings.NewReader(body))
+		assert.Equal(t, fasthttp.StatusServiceUnavailable, resp.StatusCode)
+
+		assert.Equal(t, "Hello", s.q.Take().Text)
+	})
+}
+
+func makeTestServer(communities map[string]*Community) *HttpServer {
+	return New("", 0, nil, communities, Admin{}, nil, time.Second, CallbackProtection{}, nil, health.NewRegistry(), slog.Default())
+}
+
+func makeVkHandlerClient(s *HttpServer, hookId string) http.Client {
+	return makeTestClient(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue(hookIdKey, hookId)
+		s.vkHandler(ctx)
+	})
+}
@@ -0,0 +1,42 @@
+package http_server
+
+import (
+	jsoniter "github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+)
+
+const responseBodyNotReady = "not ready"
+
+func (s *HttpServer) healthzHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Response.SetStatusCode(fasthttp.StatusOK)
+	ctx.Response.Header.SetContentType("text/plain")
+	ctx.Response.SetBody([]byte(responseBodyOk))
+}
+
+func (s *HttpServer) readyzHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.SetContentType("text/plain")
+	if s.health.Report().Ready {
+		ctx.Response.SetStatusCode(fasthttp.StatusOK)
+		ctx.Response.SetBody([]byte(responseBodyOk))
+	} else {
+		ctx.Response.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.Response.SetBody([]byte(responseBodyNotReady))
+	}
+}
+
+func (s *HttpServer) readyzDetailsHandler(ctx *fasthttp.RequestCtx) {
+	report := s.health.Report()
+	body, err := jsoniter.Marshal(report)
+	if err != nil {
+		s.l.Error("error marshalling health report", "err", err)
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusInternalServerError), fasthttp.StatusInternalServerError)
+		return
+	}
+	if report.Ready {
+		ctx.Response.SetStatusCode(fasthttp.StatusOK)
+	} else {
+		ctx.Response.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	}
+	ctx.Response.Header.SetContentType("application/json")
+	ctx.Response.SetBody(body)
+}
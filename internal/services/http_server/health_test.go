@@ -0,0 +1,61 @@
+package http_server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+	"viktig/internal/health"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	t.Run("ready", func(t *testing.T) {
+		registry := health.NewRegistry()
+		registry.Add("a", func() error { return nil })
+		s := New("", 0, nil, nil, Admin{}, nil, time.Second, CallbackProtection{}, nil, registry, slog.Default())
+		client := makeTestClient(s.readyzHandler)
+
+		resp, _ := client.Get("http://localhost/readyz")
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		assert.Equal(t, "ok", string(body))
+	})
+	t.Run("not ready", func(t *testing.T) {
+		registry := health.NewRegistry()
+		registry.Add("a", func() error { return nil })
+		registry.Add("b", func() error { return errors.New("error") })
+		s := New("", 0, nil, nil, Admin{}, nil, time.Second, CallbackProtection{}, nil, registry, slog.Default())
+		client := makeTestClient(s.readyzHandler)
+
+		resp, _ := client.Get("http://localhost/readyz")
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, fasthttp.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "not ready", string(body))
+	})
+	t.Run("details", func(t *testing.T) {
+		registry := health.NewRegistry()
+		registry.Add("a", func() error { return nil })
+		registry.Add("b", func() error { return errors.New("error") })
+		s := New("", 0, []string{"test-token"}, nil, Admin{}, nil, time.Second, CallbackProtection{}, nil, registry, slog.Default())
+		client := makeTestClient(bearerTokenAuth(s.metricsAuthTokens, s.readyzDetailsHandler))
+
+		req, _ := http.NewRequest("GET", "http://localhost/readyz/details", nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		resp, _ := client.Do(req)
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, fasthttp.StatusServiceUnavailable, resp.StatusCode)
+		assert.JSONEq(
+			t,
+			`{"ready":false,"components":{"a":{"ready":true},"b":{"ready":false,"error":"error"}}}`,
+			string(body),
+		)
+	})
+}
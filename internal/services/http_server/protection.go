@@ -0,0 +1,110 @@
+package http_server
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"viktig/internal/metrics"
+	"viktig/internal/ratelimit"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	rejectReasonIpNotAllowed    = "ip_not_allowed"
+	rejectReasonIpRateLimited   = "ip_rate_limited"
+	rejectReasonHookRateLimited = "hook_rate_limited"
+	rejectReasonBodyTooLarge    = "body_too_large"
+	rejectReasonMalformed       = "malformed_request"
+	rejectReasonUnknownHook     = "unknown_hook"
+	rejectReasonBadRequest      = "bad_request"
+	rejectReasonWrongSecret     = "wrong_secret"
+	rejectReasonQueueFull       = "queue_full"
+)
+
+// CallbackProtection limits who and how often may call the VK callback endpoint. Zero value means no limits.
+type CallbackProtection struct {
+	// MaxBodySize is the maximum request body size in bytes, fasthttp.DefaultMaxRequestBodySize if not set
+	MaxBodySize int
+	// IpLimiter limits requests by client IP
+	IpLimiter *ratelimit.Limiter
+	// HookLimiter limits requests by community
+	HookLimiter *ratelimit.Limiter
+	// AllowedNets restrict client IPs if not empty
+	AllowedNets []netip.Prefix
+	// TrustedProxies are allowed to set the client IP with the X-Forwarded-For header
+	TrustedProxies []netip.Prefix
+}
+
+func (s *HttpServer) protect(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ip := s.clientIp(ctx)
+		if len(s.protection.AllowedNets) > 0 && !containsIp(s.protection.AllowedNets, ip) {
+			s.reject(ctx, ip, rejectReasonIpNotAllowed, fasthttp.StatusForbidden)
+			return
+		}
+		if s.protection.IpLimiter != nil && !s.protection.IpLimiter.Allow(ip.String()) {
+			s.reject(ctx, ip, rejectReasonIpRateLimited, fasthttp.StatusTooManyRequests)
+			return
+		}
+		// Unknown hooks are not limited by hook so that random hook IDs do not take up memory
+		hookId, _ := ctx.UserValue(hookIdKey).(string)
+		if _, ok := s.community(hookId); ok && s.protection.HookLimiter != nil &&
+			!s.protection.HookLimiter.Allow(hookId) {
+			s.reject(ctx, ip, rejectReasonHookRateLimited, fasthttp.StatusTooManyRequests)
+			return
+		}
+		handler(ctx)
+	}
+}
+
+// errorHandler handles the requests that could not be read, e.g. exceeding the max body size
+func (s *HttpServer) errorHandler(ctx *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		s.reject(ctx, s.clientIp(ctx), rejectReasonBodyTooLarge, fasthttp.StatusRequestEntityTooLarge)
+	} else {
+		s.reject(ctx, s.clientIp(ctx), rejectReasonMalformed, fasthttp.StatusBadRequest)
+	}
+}
+
+// reject responds with a generic error message so that no request contents are echoed back
+func (s *HttpServer) reject(ctx *fasthttp.RequestCtx, ip netip.Addr, reason string, statusCode int) {
+	s.l.Warn("rejected request", "reason", reason, "ip", ip.String(), "path", string(ctx.Path()))
+	metrics.HttpRequestsRejected.WithLabelValues(reason).Inc()
+	ctx.Error(fasthttp.StatusMessage(statusCode), statusCode)
+}
+
+// clientIp returns the remote address or, if the request came from a trusted proxy,
+// the rightmost address in X-Forwarded-For that is not a trusted proxy
+func (s *HttpServer) clientIp(ctx *fasthttp.RequestCtx) netip.Addr {
+	ip, _ := netip.AddrFromSlice(ctx.RemoteIP())
+	ip = ip.Unmap()
+	if !containsIp(s.protection.TrustedProxies, ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range ctx.Request.Header.PeekAll(fasthttp.HeaderXForwardedFor) {
+		forwarded = append(forwarded, strings.Split(string(header), ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return ip
+		}
+		ip = addr.Unmap()
+		if !containsIp(s.protection.TrustedProxies, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func containsIp(nets []netip.Prefix, ip netip.Addr) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
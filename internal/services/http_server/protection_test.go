@@ -0,0 +1,131 @@
+package http_server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+	"viktig/internal/health"
+	"viktig/internal/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestProtect(t *testing.T) {
+	t.Run("allowed", func(t *testing.T) {
+		s := makeProtectedServer(CallbackProtection{AllowedNets: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}})
+		client := makeTestClient(s.protect(alwaysOkHandler))
+
+		resp, _ := client.Get("http://localhost/")
+
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+	})
+	t.Run("not allowed", func(t *testing.T) {
+		s := makeProtectedServer(CallbackProtection{AllowedNets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+		client := makeTestClient(s.protect(alwaysOkHandler))
+
+		resp, _ := client.Get("http://localhost/")
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, fasthttp.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, "Forbidden", string(body))
+	})
+	t.Run("ip rate limit", func(t *testing.T) {
+		s := makeProtectedServer(CallbackProtection{IpLimiter: ratelimit.New(0.001, 1)})
+		client := makeTestClient(s.protect(alwaysOkHandler))
+
+		resp, _ := client.Get("http://localhost/")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		resp, _ = client.Get("http://localhost/")
+		assert.Equal(t, fasthttp.StatusTooManyRequests, resp.StatusCode)
+	})
+	t.Run("hook rate limit", func(t *testing.T) {
+		s := makeProtectedServer(CallbackProtection{HookLimiter: ratelimit.New(0.001, 1)})
+		client := makeTestClient(func(ctx *fasthttp.RequestCtx) {
+			ctx.SetUserValue(hookIdKey, string(ctx.Path()[1:]))
+			s.protect(alwaysOkHandler)(ctx)
+		})
+
+		resp, _ := client.Get("http://localhost/test-hook")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		resp, _ = client.Get("http://localhost/test-hook")
+		assert.Equal(t, fasthttp.StatusTooManyRequests, resp.StatusCode)
+		resp, _ = client.Get("http://localhost/other-hook")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		resp, _ = client.Get("http://localhost/unknown-hook")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+		resp, _ = client.Get("http://localhost/unknown-hook")
+		assert.Equal(t, fasthttp.StatusOK, resp.StatusCode)
+	})
+	t.Run("body too large", func(t *testing.T) {
+		s := makeProtectedServer(CallbackProtection{MaxBodySize: 10})
+		listener, client := makeTestServerClient(&fasthttp.Server{
+			Handler:            alwaysOkHandler,
+			ErrorHandler:       s.errorHandler,
+			MaxRequestBodySize: s.protection.MaxBodySize,
+		})
+		defer listener.Close()
+
+		resp, _ := client.Post("http://localhost/", "text/plain", strings.NewReader(strings.Repeat("a", 11)))
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, fasthttp.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Equal(t, "Request Entity Too Large", string(body))
+	})
+}
+
+func TestClientIp(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name           string
+		remoteIp       string
+		forwardedFor   []string
+		trustedProxies []netip.Prefix
+		expected       string
+	}{
+		{"direct", "1.2.3.4", nil, proxies, "1.2.3.4"},
+		{"untrusted proxy", "1.2.3.4", []string{"5.6.7.8"}, proxies, "1.2.3.4"},
+		{"no trusted proxies", "10.0.0.1", []string{"5.6.7.8"}, nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1", []string{"5.6.7.8"}, proxies, "5.6.7.8"},
+		{"spoofed", "10.0.0.1", []string{"9.9.9.9, 5.6.7.8"}, proxies, "5.6.7.8"},
+		{"proxy chain", "10.0.0.1", []string{"5.6.7.8, 10.0.0.2"}, proxies, "5.6.7.8"},
+		{"multiple headers", "10.0.0.1", []string{"9.9.9.9", "5.6.7.8"}, proxies, "5.6.7.8"},
+		{"malformed", "10.0.0.1", []string{"5.6.7.8, garbage"}, proxies, "10.0.0.1"},
+		{"only proxies", "10.0.0.1", []string{"10.0.0.2"}, proxies, "10.0.0.2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := makeProtectedServer(CallbackProtection{TrustedProxies: test.trustedProxies})
+			ctx := &fasthttp.RequestCtx{}
+			ctx.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP(test.remoteIp)})
+			for _, header := range test.forwardedFor {
+				ctx.Request.Header.Add(fasthttp.HeaderXForwardedFor, header)
+			}
+
+			assert.Equal(t, test.expected, s.clientIp(ctx).String())
+		})
+	}
+}
+
+func makeProtectedServer(protection CallbackProtection) *HttpServer {
+	communities := map[string]*Community{"test-hook": {}, "other-hook": {}}
+	return New("", 0, nil, communities, Admin{}, nil, time.Second, protection, nil, health.NewRegistry(), slog.Default())
+}
+
+func makeTestServerClient(server *fasthttp.Server) (net.Listener, http.Client) {
+	listener := fasthttputil.NewInmemoryListener()
+	go server.Serve(listener)
+
+	return listener, http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return listener.Dial()
+		},
+	}}
+}
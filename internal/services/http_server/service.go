@@ -2,10 +2,16 @@ package http_server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 	"viktig/internal/entities"
+	"viktig/internal/health"
 	"viktig/internal/queue"
 
 	"github.com/fasthttp/router"
@@ -16,63 +22,139 @@ import (
 
 const hookIdKey = "community_hook_id"
 
+var errStopped = errors.New("stopped")
+
 type Community struct {
-	SecretKey          string
+	SecretKeys         []string
 	ConfirmationString string
 }
 
 type HttpServer struct {
-	host             string
-	port             int
-	metricsAuthToken string
-	communities      map[string]*Community
-	q                *queue.Queue[entities.Message]
-	l                *slog.Logger
+	host              string
+	port              int
+	metricsAuthTokens []string
+	communitiesMu     sync.RWMutex
+	communities       map[string]*Community
+	admin             Admin
+	q                 *queue.Queue[entities.Message]
+	drainTimeout      time.Duration
+	protection        CallbackProtection
+	tlsConfig         *tls.Config
+	health            *health.Registry
+	ready             health.Probe
+	stopping          atomic.Bool
+	l                 *slog.Logger
 }
 
 func New(
 	host string,
 	port int,
-	metricsAuthToken string,
+	metricsAuthTokens []string,
 	communities map[string]*Community,
+	admin Admin,
 	q *queue.Queue[entities.Message],
+	drainTimeout time.Duration,
+	protection CallbackProtection,
+	tlsConfig *tls.Config,
+	healthRegistry *health.Registry,
 	l *slog.Logger,
 ) *HttpServer {
 	return &HttpServer{
-		host:             host,
-		port:             port,
-		metricsAuthToken: metricsAuthToken,
-		communities:      communities,
-		q:                q,
-		l:                l.With("service", "HttpServer"),
+		host:              host,
+		port:              port,
+		metricsAuthTokens: metricsAuthTokens,
+		communities:       communities,
+		admin:             admin,
+		q:                 q,
+		drainTimeout:      drainTimeout,
+		protection:        protection,
+		tlsConfig:         tlsConfig,
+		health:            healthRegistry,
+		l:                 l.With("service", "HttpServer"),
 	}
 }
 
+// Ready reports whether the server is accepting VK events
+func (s *HttpServer) Ready() error {
+	return s.ready.Check()
+}
+
+// SetCommunity adds or replaces the community accepting events at hookId
+func (s *HttpServer) SetCommunity(hookId string, community *Community) {
+	s.communitiesMu.Lock()
+	defer s.communitiesMu.Unlock()
+	s.communities[hookId] = community
+}
+
+// RemoveCommunity stops accepting events at hookId
+func (s *HttpServer) RemoveCommunity(hookId string) {
+	s.communitiesMu.Lock()
+	defer s.communitiesMu.Unlock()
+	delete(s.communities, hookId)
+}
+
+func (s *HttpServer) community(hookId string) (*Community, bool) {
+	s.communitiesMu.RLock()
+	defer s.communitiesMu.RUnlock()
+	community, ok := s.communities[hookId]
+	return community, ok
+}
+
 func (s *HttpServer) Run(ctx context.Context) error {
 	r := router.New()
-	if s.metricsAuthToken != "" {
+	r.GET("/healthz", s.healthzHandler)
+	r.GET("/readyz", s.readyzHandler)
+	if len(s.metricsAuthTokens) > 0 {
 		r.GET(
 			"/metrics",
 			bearerTokenAuth(
-				s.metricsAuthToken,
+				s.metricsAuthTokens,
 				fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler()),
 			),
 		)
+		r.GET("/readyz/details", bearerTokenAuth(s.metricsAuthTokens, s.readyzDetailsHandler))
 	}
 	api := r.Group("/api")
-	api.POST(fmt.Sprintf("/vk/callback/{%s}", hookIdKey), s.vkHandler)
+	api.POST(fmt.Sprintf("/vk/callback/{%s}", hookIdKey), s.protect(s.vkHandler))
+	if len(s.admin.AuthTokens) > 0 {
+		s.addAdminRoutes(api.Group("/admin"))
+	}
 
 	socketAddress := fmt.Sprintf("%s:%d", s.host, s.port)
 	l, err := net.Listen("tcp", socketAddress)
 	if err != nil {
 		return err
 	}
-	go func() {
-		<-ctx.Done()
-		s.l.Info("stopping http server")
-		_ = l.Close()
-	}()
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	server := &fasthttp.Server{
+		Handler:            r.Handler,
+		ErrorHandler:       s.errorHandler,
+		MaxRequestBodySize: s.protection.MaxBodySize,
+	}
+	serveErrorCh := make(chan error, 1)
+	s.stopping.Store(false)
+	s.l.Info("starting http server", "address", socketAddress, "tls", s.tlsConfig != nil)
+	go func() { serveErrorCh <- server.Serve(l) }()
+	s.ready.SetReady()
+	defer s.ready.SetNotReady(errStopped)
+
+	select {
+	case err = <-serveErrorCh:
+		return err
+	case <-ctx.Done():
+	}
 
-	s.l.Info("starting http server", "address", socketAddress)
-	return fasthttp.Serve(l, r.Handler)
+	// New VK events are rejected with 5xx while the server is shutting down so that VK retries them later.
+	// Events that are already being handled are awaited.
+	s.l.Info("stopping http server")
+	s.stopping.Store(true)
+	s.ready.SetNotReady(errStopped)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if err = server.ShutdownWithContext(shutdownCtx); err != nil {
+		return fmt.Errorf("http server shutdown error: %w", err)
+	}
+	return <-serveErrorCh
 }
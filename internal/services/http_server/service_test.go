@@ -0,0 +1,57 @@
+package http_server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"viktig/internal/health"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService(t *testing.T) {
+	t.Run("tls", func(t *testing.T) {
+		// borrow a certificate for 127.0.0.1 and a client trusting it
+		certSource := httptest.NewTLSServer(http.NotFoundHandler())
+		tlsConfig := &tls.Config{Certificates: certSource.TLS.Certificates}
+		client := certSource.Client()
+		certSource.Close()
+
+		port := freePort(t)
+		s := New("127.0.0.1", port, nil, nil, Admin{}, nil, time.Second, CallbackProtection{}, tlsConfig, health.NewRegistry(), slog.Default())
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- s.Run(ctx) }()
+
+		url := "https://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/healthz"
+		var resp *http.Response
+		require.Eventually(t, func() bool {
+			var err error
+			resp, err = client.Get(url)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		cancel()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "ok", string(body))
+		assert.NoError(t, <-errCh)
+	})
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
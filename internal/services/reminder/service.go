@@ -0,0 +1,256 @@
+package reminder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"viktig/internal/buttons"
+	"viktig/internal/entities"
+	"viktig/internal/health"
+	"viktig/internal/metrics"
+	"viktig/internal/storage"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	defaultCheckInterval = time.Minute
+
+	levelReminder   = 1
+	levelEscalation = 2
+
+	// maxUserId is the largest VK peer ID of a user, larger ones are group chats
+	maxUserId = 2_000_000_000
+)
+
+var errStopped = errors.New("stopped")
+
+var levelNames = map[int]string{
+	levelReminder:   "reminder",
+	levelEscalation: "escalation",
+}
+
+type Community struct {
+	TgChatId int
+}
+
+// Conversations are the VK conversations waiting for a community reply
+type Conversations interface {
+	Open() []storage.Conversation
+	SetReminders(ctx context.Context, conversation storage.Conversation, reminders int) error
+}
+
+// Mutes pause posting to Telegram chats
+type Mutes interface {
+	Muted(tgChatId int) bool
+}
+
+// Settings define when reminders are posted, a zero duration disables the reminder
+type Settings struct {
+	// ReminderAfter is how long a conversation may be open before a reminder is posted to the community chat
+	ReminderAfter time.Duration
+	// EscalateAfter is how long a conversation may be open before an escalation is posted
+	EscalateAfter time.Duration
+	// EscalationChatId receives escalations instead of the community chat if set
+	EscalationChatId int
+	// EscalationMention is added to escalations, e.g. "@lead"
+	EscalationMention string
+}
+
+// Reminder posts reminders to Telegram about VK conversations left without a community reply
+type Reminder struct {
+	tgToken       string
+	apiUrl        string
+	checkInterval time.Duration
+	bot           *tele.Bot
+	communitiesMu sync.RWMutex
+	communities   map[string]*Community
+	conversations Conversations
+	mutes         Mutes
+	settings      Settings
+	now           func() time.Time
+	ready         health.Probe
+	l             *slog.Logger
+}
+
+func New(
+	tgToken string,
+	communities map[string]*Community,
+	conversations Conversations,
+	mutes Mutes,
+	settings Settings,
+	l *slog.Logger,
+) *Reminder {
+	return &Reminder{
+		tgToken:       tgToken,
+		checkInterval: defaultCheckInterval,
+		communities:   communities,
+		conversations: conversations,
+		mutes:         mutes,
+		settings:      settings,
+		now:           time.Now,
+		l:             l.With("service", "Reminder"),
+	}
+}
+
+// Ready reports whether the bot is authenticated and conversations are checked
+func (r *Reminder) Ready() error {
+	return r.ready.Check()
+}
+
+// SetCommunity adds or replaces the community whose conversations are reminded about
+func (r *Reminder) SetCommunity(hookId string, community *Community) {
+	r.communitiesMu.Lock()
+	defer r.communitiesMu.Unlock()
+	r.communities[hookId] = community
+}
+
+func (r *Reminder) RemoveCommunity(hookId string) {
+	r.communitiesMu.Lock()
+	defer r.communitiesMu.Unlock()
+	delete(r.communities, hookId)
+}
+
+func (r *Reminder) community(hookId string) (*Community, bool) {
+	r.communitiesMu.RLock()
+	defer r.communitiesMu.RUnlock()
+	community, ok := r.communities[hookId]
+	return community, ok
+}
+
+// Run checks the open conversations every check interval until ctx is done
+func (r *Reminder) Run(ctx context.Context) error {
+	bot, err := tele.NewBot(tele.Settings{
+		Token: r.tgToken,
+		URL:   r.apiUrl,
+		Client: &http.Client{
+			Timeout:   time.Minute,
+			Transport: &metrics.InstrumentedTransport{Duration: metrics.TgApiRequestDuration},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("telebot error: %w", err)
+	}
+	r.bot = bot
+	r.ready.SetReady()
+	defer r.ready.SetNotReady(errStopped)
+	r.l.Info("reminder is ready", "reminderAfter", r.settings.ReminderAfter, "escalateAfter", r.settings.EscalateAfter)
+
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.l.Info("stopping reminder service")
+			return nil
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// check posts the reminders that are due. Failed ones are retried on the next check.
+func (r *Reminder) check(ctx context.Context) {
+	now := r.now()
+	for _, conversation := range r.conversations.Open() {
+		level := r.level(now.Sub(conversation.OpenedAt))
+		if level <= conversation.Reminders {
+			continue
+		}
+		community, ok := r.community(conversation.HookId)
+		if !ok {
+			continue
+		}
+		tgChatId := community.TgChatId
+		if level == levelEscalation && r.settings.EscalationChatId != 0 {
+			tgChatId = r.settings.EscalationChatId
+		}
+		// Communities forwarded only to other sinks have no chat to remind
+		if tgChatId == 0 {
+			continue
+		}
+		// Reminders are posted once the chat is unmuted
+		if r.mutes != nil && r.mutes.Muted(tgChatId) {
+			continue
+		}
+		if err := r.send(tgChatId, conversation, level, now); err != nil {
+			r.l.Error("error sending reminder", "chatId", tgChatId, "hookId", conversation.HookId, "err", err)
+			continue
+		}
+		metrics.RemindersSent.WithLabelValues(conversation.HookId, levelNames[level]).Inc()
+		if err := r.conversations.SetReminders(ctx, conversation, level); err != nil {
+			r.l.Error("error saving reminder", "hookId", conversation.HookId, "err", err)
+		}
+	}
+}
+
+// level returns the reminder due for a conversation open for the given time
+func (r *Reminder) level(open time.Duration) int {
+	if r.settings.EscalateAfter > 0 && open >= r.settings.EscalateAfter {
+		return levelEscalation
+	}
+	if r.settings.ReminderAfter > 0 && open >= r.settings.ReminderAfter {
+		return levelReminder
+	}
+	return 0
+}
+
+func (r *Reminder) send(tgChatId int, conversation storage.Conversation, level int, now time.Time) error {
+	opts := []interface{}{tele.ModeHTML, tele.NoPreview}
+	// The dialog link button, callback buttons are only added to forwarded messages
+	link := entities.Message{HookId: conversation.HookId, VkGroupId: conversation.VkGroupId, VkPeerId: conversation.VkPeerId}
+	if keyboard := buttons.Keyboard(link, buttons.Options{}); keyboard != nil {
+		opts = append(opts, keyboard)
+	}
+	_, err := r.bot.Send(tele.ChatID(tgChatId), r.render(conversation, level, now), opts...)
+	return err
+}
+
+func (r *Reminder) render(conversation storage.Conversation, level int, now time.Time) string {
+	icon := "⏰"
+	if level == levelEscalation {
+		icon = "🚨"
+	}
+	text := fmt.Sprintf(
+		"%s No reply for %s to %s in %s",
+		icon,
+		formatDuration(now.Sub(conversation.OpenedAt)),
+		senderLink(conversation),
+		html.EscapeString(conversation.HookId),
+	)
+	if level == levelEscalation && r.settings.EscalationMention != "" {
+		text += " " + html.EscapeString(r.settings.EscalationMention)
+	}
+	return text
+}
+
+// senderLink links the user who opened the conversation, group chats are shown by their peer ID
+func senderLink(conversation storage.Conversation) string {
+	name := conversation.VkSenderName
+	if name == "" {
+		name = fmt.Sprintf("id%d", conversation.VkPeerId)
+	}
+	if conversation.VkPeerId >= maxUserId {
+		return html.EscapeString(name)
+	}
+	return fmt.Sprintf("<a href=\"https://vk.com/id%d\">%s</a>", conversation.VkPeerId, html.EscapeString(name))
+}
+
+// formatDuration formats the duration in minutes, e.g. "2h5m"
+func formatDuration(d time.Duration) string {
+	s := d.Truncate(time.Minute).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
@@ -0,0 +1,210 @@
+package reminder
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/conversations"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	testChatId       = -100
+	testEscalationId = -200
+)
+
+func TestCheck(t *testing.T) {
+	openedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("reminder and escalation", func(t *testing.T) {
+		api, r := setup(t, openedAt)
+
+		r.now = func() time.Time { return openedAt.Add(29 * time.Minute) }
+		r.check(context.Background())
+		assert.Empty(t, api.sent())
+
+		r.now = func() time.Time { return openedAt.Add(31 * time.Minute) }
+		r.check(context.Background())
+		r.check(context.Background())
+		require.Len(t, api.sent(), 1)
+		assert.Equal(t, "-100", api.sent()[0]["chat_id"])
+		assert.Equal(
+			t,
+			`⏰ No reply for 31m to <a href="https://vk.com/id1234">Ivan Petrov</a> in hook`,
+			api.sent()[0]["text"],
+		)
+		assert.Contains(t, api.sent()[0]["reply_markup"], "https://vk.com/gim10?sel=1234")
+
+		r.now = func() time.Time { return openedAt.Add(2 * time.Hour) }
+		r.check(context.Background())
+		require.Len(t, api.sent(), 2)
+		assert.Equal(t, "-200", api.sent()[1]["chat_id"])
+		assert.Equal(
+			t,
+			`🚨 No reply for 2h to <a href="https://vk.com/id1234">Ivan Petrov</a> in hook @lead`,
+			api.sent()[1]["text"],
+		)
+	})
+	t.Run("escalation only", func(t *testing.T) {
+		api, r := setup(t, openedAt)
+		r.now = func() time.Time { return openedAt.Add(3 * time.Hour) }
+
+		r.check(context.Background())
+		r.check(context.Background())
+
+		require.Len(t, api.sent(), 1)
+		assert.True(t, strings.HasPrefix(api.sent()[0]["text"].(string), "🚨"))
+	})
+	t.Run("muted", func(t *testing.T) {
+		api, r := setup(t, openedAt)
+		mutes := fakeMutes{testChatId: true}
+		r.mutes = mutes
+		r.now = func() time.Time { return openedAt.Add(time.Hour) }
+
+		r.check(context.Background())
+		assert.Empty(t, api.sent())
+
+		delete(mutes, testChatId)
+		r.check(context.Background())
+		assert.Len(t, api.sent(), 1)
+	})
+	t.Run("send error", func(t *testing.T) {
+		api, r := setup(t, openedAt)
+		api.fail = true
+		r.now = func() time.Time { return openedAt.Add(time.Hour) }
+
+		r.check(context.Background())
+		api.fail = false
+		r.check(context.Background())
+
+		assert.Len(t, api.sent(), 2)
+	})
+	t.Run("unknown community", func(t *testing.T) {
+		api, r := setup(t, openedAt)
+		r.RemoveCommunity("hook")
+		r.now = func() time.Time { return openedAt.Add(time.Hour) }
+
+		r.check(context.Background())
+
+		assert.Empty(t, api.sent())
+	})
+}
+
+func TestRun(t *testing.T) {
+	api, r := setup(t, time.Now().Add(-time.Hour))
+	r.apiUrl = api.url
+	r.checkInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- r.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return len(api.sent()) == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, r.Ready())
+	cancel()
+
+	assert.NoError(t, <-errCh)
+	assert.Error(t, r.Ready())
+}
+
+func TestFormatDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		30 * time.Second:                  "0s",
+		31*time.Minute + 10*time.Second:   "31m",
+		2 * time.Hour:                     "2h",
+		26*time.Hour + 5*time.Minute + 59: "26h5m",
+	} {
+		assert.Equal(t, expected, formatDuration(d))
+	}
+}
+
+// setup returns a reminder with a conversation of the community "hook" opened at openedAt
+func setup(t *testing.T, openedAt time.Time) (*fakeApi, *Reminder) {
+	t.Helper()
+	api := &fakeApi{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	api.url = srv.URL
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tracker := conversations.New(nil, log)
+	require.NoError(t, tracker.Track(context.Background(), entities.Message{
+		HookId:     "hook",
+		Type:       entities.MessageTypeNew,
+		VkSenderId: 1234,
+		VkGroupId:  10,
+		VkPeerId:   1234,
+		VkSender:   &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		ReceivedAt: openedAt,
+	}))
+	r := New(
+		"token",
+		map[string]*Community{"hook": {TgChatId: testChatId}},
+		tracker,
+		nil,
+		Settings{
+			ReminderAfter:     30 * time.Minute,
+			EscalateAfter:     2 * time.Hour,
+			EscalationChatId:  testEscalationId,
+			EscalationMention: "@lead",
+		},
+		log,
+	)
+	bot, err := tele.NewBot(tele.Settings{Token: "token", URL: srv.URL, Offline: true})
+	require.NoError(t, err)
+	r.bot = bot
+	return api, r
+}
+
+type fakeMutes map[int]bool
+
+func (m fakeMutes) Muted(tgChatId int) bool {
+	return m[tgChatId]
+}
+
+// fakeApi is a Telegram Bot API stand-in recording the sent messages
+type fakeApi struct {
+	url      string
+	fail     bool
+	mu       sync.Mutex
+	messages []map[string]any
+}
+
+func (a *fakeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	params := map[string]any{}
+	_ = json.NewDecoder(r.Body).Decode(&params)
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case method == "getMe":
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"bot"}}`))
+	case a.fail:
+		a.mu.Lock()
+		a.messages = append(a.messages, params)
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":500,"description":"Internal Server Error"}`))
+	default:
+		a.mu.Lock()
+		a.messages = append(a.messages, params)
+		a.mu.Unlock()
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":-100}}}`))
+	}
+}
+
+func (a *fakeApi) sent() []map[string]any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]map[string]any{}, a.messages...)
+}
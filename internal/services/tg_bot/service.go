@@ -0,0 +1,422 @@
+package tg_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"viktig/internal/buttons"
+	"viktig/internal/health"
+	"viktig/internal/metrics"
+
+	"github.com/go-vk-api/vk"
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	pollTimeout = 30 * time.Second
+	timeLayout  = "2006-01-02 15:04 MST"
+
+	replyNotAdmin    = "Only chat admins can use this command"
+	replyBadDuration = "Usage: /mute 2h, /mute 1d or /mute to mute until /unmute"
+	replyMutedLost   = "Messages received meanwhile will be lost since dead letters are disabled"
+)
+
+var errStopped = errors.New("stopped")
+
+var commands = []tele.Command{
+	{Text: "status", Description: "Show the forwarded communities and the last message time"},
+	{Text: "mute", Description: "Pause forwarding, e.g. /mute 2h"},
+	{Text: "unmute", Description: "Resume forwarding"},
+	{Text: "whoami", Description: "Show the chat ID"},
+}
+
+type Community struct {
+	TgChatId int
+	// VkToken is the community token used by the buttons calling the VK API
+	VkToken string
+}
+
+// Activity reports when messages were last sent to the chats
+type Activity interface {
+	LastSent(tgChatId int) (time.Time, bool)
+}
+
+// Mutes pause forwarding to the chats
+type Mutes interface {
+	Mute(ctx context.Context, tgChatId int, until time.Time) error
+	Unmute(ctx context.Context, tgChatId int) error
+	MutedUntil(tgChatId int) (time.Time, bool)
+}
+
+// TgBot handles the commands sent to the bot in the destination chats and the buttons of the forwarded messages
+type TgBot struct {
+	tgToken       string
+	commands      bool
+	deadLetters   bool
+	apiUrl        string
+	vkApiUrl      string
+	communitiesMu sync.RWMutex
+	communities   map[string]*Community
+	activity      Activity
+	mutes         Mutes
+	startedAt     time.Time
+	ready         health.Probe
+	l             *slog.Logger
+}
+
+// New creates the bot, which only handles commands if commands is true.
+// deadLetters tells whether the messages to muted chats are kept to be replayed.
+func New(
+	tgToken string,
+	commands bool,
+	deadLetters bool,
+	communities map[string]*Community,
+	activity Activity,
+	mutes Mutes,
+	l *slog.Logger,
+) *TgBot {
+	return &TgBot{
+		tgToken:     tgToken,
+		commands:    commands,
+		deadLetters: deadLetters,
+		communities: communities,
+		activity:    activity,
+		mutes:       mutes,
+		startedAt:   time.Now(),
+		l:           l.With("service", "TgBot"),
+	}
+}
+
+// Ready reports whether the bot is authenticated and receiving updates
+func (b *TgBot) Ready() error {
+	return b.ready.Check()
+}
+
+// SetCommunity adds or replaces the community shown in the chat status
+func (b *TgBot) SetCommunity(hookId string, community *Community) {
+	b.communitiesMu.Lock()
+	defer b.communitiesMu.Unlock()
+	b.communities[hookId] = community
+}
+
+func (b *TgBot) RemoveCommunity(hookId string) {
+	b.communitiesMu.Lock()
+	defer b.communitiesMu.Unlock()
+	delete(b.communities, hookId)
+}
+
+// chatCommunities returns the sorted hook IDs of the communities forwarded to the chat
+func (b *TgBot) chatCommunities(tgChatId int) []string {
+	b.communitiesMu.RLock()
+	defer b.communitiesMu.RUnlock()
+	var hookIds []string
+	for hookId, community := range b.communities {
+		if community.TgChatId == tgChatId {
+			hookIds = append(hookIds, hookId)
+		}
+	}
+	slices.Sort(hookIds)
+	return hookIds
+}
+
+func (b *TgBot) Run(ctx context.Context) error {
+	bot, err := tele.NewBot(tele.Settings{
+		Token:  b.tgToken,
+		URL:    b.apiUrl,
+		Poller: &tele.LongPoller{Timeout: pollTimeout},
+		Client: &http.Client{
+			Timeout:   pollTimeout + time.Minute,
+			Transport: &metrics.InstrumentedTransport{Duration: metrics.TgApiRequestDuration},
+		},
+		OnError: b.onError,
+	})
+	if err != nil {
+		return fmt.Errorf("telebot error: %w", err)
+	}
+	b.handle(bot)
+	if b.commands {
+		if err = bot.SetCommands(commands); err != nil {
+			b.l.Warn("error setting bot commands", "err", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bot.Start()
+	}()
+	b.ready.SetReady()
+	defer b.ready.SetNotReady(errStopped)
+	b.l.Info("tgBot is ready", "username", bot.Me.Username)
+
+	<-ctx.Done()
+	b.l.Info("stopping tgBot service")
+	bot.Stop()
+	<-done
+	return nil
+}
+
+func (b *TgBot) handle(bot *tele.Bot) {
+	if b.commands {
+		bot.Handle("/status", b.adminOnly(b.statusHandler))
+		bot.Handle("/mute", b.adminOnly(b.muteHandler))
+		bot.Handle("/unmute", b.adminOnly(b.unmuteHandler))
+		bot.Handle("/whoami", b.adminOnly(b.whoamiHandler))
+	}
+	bot.Handle(&tele.InlineButton{Unique: buttons.UniqueRead}, b.readHandler)
+	bot.Handle(&tele.InlineButton{Unique: buttons.UniqueAnswered}, b.answeredHandler)
+	bot.Handle(&tele.InlineButton{Unique: buttons.UniqueBlock}, b.adminOnly(b.blockHandler))
+}
+
+func (b *TgBot) onError(err error, c tele.Context) {
+	if c != nil && c.Chat() != nil {
+		b.l.Error("error handling telegram update", "chatId", c.Chat().ID, "err", err)
+		return
+	}
+	b.l.Error("telegram bot error", "err", err)
+}
+
+// adminOnly restricts the handler to the chat admins, anyone may use it in a private chat with the bot
+func (b *TgBot) adminOnly(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		if c.Chat().Type == tele.ChatPrivate {
+			return next(c)
+		}
+		// Anonymous admins send messages on behalf of the chat, while button callbacks come with the bot message
+		senderChat := c.Message().SenderChat
+		if c.Callback() == nil && senderChat != nil && senderChat.ID == c.Chat().ID {
+			return next(c)
+		}
+		if c.Sender() == nil {
+			return nil
+		}
+		admins, err := c.Bot().AdminsOf(c.Chat())
+		if err != nil {
+			return fmt.Errorf("error getting chat admins: %w", err)
+		}
+		for _, admin := range admins {
+			if admin.User != nil && admin.User.ID == c.Sender().ID {
+				return next(c)
+			}
+		}
+		if c.Callback() != nil {
+			return c.Respond(&tele.CallbackResponse{Text: replyNotAdmin, ShowAlert: true})
+		}
+		return c.Reply(replyNotAdmin)
+	}
+}
+
+func (b *TgBot) statusHandler(c tele.Context) error {
+	tgChatId := int(c.Chat().ID)
+	lines := make([]string, 0, 4)
+	if hookIds := b.chatCommunities(tgChatId); len(hookIds) > 0 {
+		lines = append(lines, "Communities: "+strings.Join(hookIds, ", "))
+	} else {
+		lines = append(lines, "No communities are forwarded to this chat")
+	}
+	lines = append(lines, "Uptime: "+time.Since(b.startedAt).Round(time.Second).String())
+	if at, ok := b.activity.LastSent(tgChatId); ok {
+		lines = append(lines, fmt.Sprintf("Last message: %s (%s ago)", formatTime(at), time.Since(at).Round(time.Second)))
+	} else {
+		lines = append(lines, "Last message: none since the start")
+	}
+	if until, muted := b.mutes.MutedUntil(tgChatId); muted {
+		lines = append(lines, mutedText(until))
+	}
+	return c.Reply(strings.Join(lines, "\n"))
+}
+
+// muteHandler pauses forwarding for the duration from the payload, or until /unmute if it is empty
+func (b *TgBot) muteHandler(c tele.Context) error {
+	var until time.Time
+	if payload := strings.TrimSpace(c.Message().Payload); payload != "" {
+		duration, err := parseDuration(payload)
+		if err != nil {
+			return c.Reply(replyBadDuration)
+		}
+		until = time.Now().Add(duration)
+	}
+	tgChatId := int(c.Chat().ID)
+	if err := b.mutes.Mute(context.Background(), tgChatId, until); err != nil {
+		return fmt.Errorf("error muting chat: %w", err)
+	}
+	b.l.Info("chat muted", "chatId", tgChatId, "until", until, "by", senderName(c))
+	if !b.deadLetters {
+		return c.Reply(mutedText(until) + "\n" + replyMutedLost)
+	}
+	return c.Reply(mutedText(until))
+}
+
+func (b *TgBot) unmuteHandler(c tele.Context) error {
+	tgChatId := int(c.Chat().ID)
+	if err := b.mutes.Unmute(context.Background(), tgChatId); err != nil {
+		return fmt.Errorf("error unmuting chat: %w", err)
+	}
+	b.l.Info("chat unmuted", "chatId", tgChatId, "by", senderName(c))
+	return c.Reply("Forwarding resumed")
+}
+
+func (b *TgBot) whoamiHandler(c tele.Context) error {
+	text := fmt.Sprintf("Chat ID: <code>%d</code>", c.Chat().ID)
+	if c.Sender() != nil {
+		text += fmt.Sprintf("\nYour user ID: <code>%d</code>", c.Sender().ID)
+	}
+	return c.Reply(text, tele.ModeHTML)
+}
+
+// readHandler marks the VK conversation as read and removes the button
+func (b *TgBot) readHandler(c tele.Context) error {
+	data, community, err := b.callbackCommunity(c)
+	if err != nil {
+		return err
+	}
+	err = b.callVk(community.VkToken, "messages.markAsRead", vk.RequestParams{
+		"peer_id":                   data.VkId,
+		"group_id":                  data.VkGroupId,
+		"mark_conversation_as_read": 1,
+	})
+	if err != nil {
+		_ = c.Respond(&tele.CallbackResponse{Text: "Error marking the conversation as read", ShowAlert: true})
+		return fmt.Errorf("error marking conversation as read: %w", err)
+	}
+	if _, err = c.Bot().EditReplyMarkup(c.Callback(), buttons.Without(c.Message().ReplyMarkup, buttons.UniqueRead)); err != nil {
+		b.l.Warn("error removing button", "chatId", c.Chat().ID, "err", err)
+	}
+	return c.Respond(&tele.CallbackResponse{Text: "Marked as read"})
+}
+
+// answeredHandler shows who handled the message and removes the button
+func (b *TgBot) answeredHandler(c tele.Context) error {
+	if err := b.appendStatus(c, "✅ Answered by "+senderName(c), buttons.UniqueAnswered); err != nil {
+		return err
+	}
+	return c.Respond(&tele.CallbackResponse{Text: "Marked as answered"})
+}
+
+// blockHandler bans the sender in the VK community and shows who blocked them
+func (b *TgBot) blockHandler(c tele.Context) error {
+	data, community, err := b.callbackCommunity(c)
+	if err != nil {
+		return err
+	}
+	err = b.callVk(community.VkToken, "groups.ban", vk.RequestParams{
+		"group_id": data.VkGroupId,
+		"owner_id": data.VkId,
+	})
+	if err != nil {
+		_ = c.Respond(&tele.CallbackResponse{Text: "Error blocking the sender", ShowAlert: true})
+		return fmt.Errorf("error blocking sender: %w", err)
+	}
+	b.l.Info("sender blocked", "hookId", data.HookId, "vkUserId", data.VkId, "by", senderName(c))
+	if err = b.appendStatus(c, "🚫 Sender blocked by "+senderName(c), buttons.UniqueBlock); err != nil {
+		return err
+	}
+	return c.Respond(&tele.CallbackResponse{Text: "Sender blocked"})
+}
+
+// callbackCommunity returns the callback data and the community it belongs to, which must be forwarded to the chat
+// of the callback and have a VK token. The data must be on a button of the message, so that it was set by the bot.
+func (b *TgBot) callbackCommunity(c tele.Context) (buttons.Data, *Community, error) {
+	data, err := buttons.ParseData(c.Callback().Data)
+	if err != nil {
+		_ = c.Respond(&tele.CallbackResponse{Text: "This button is not supported anymore", ShowAlert: true})
+		return data, nil, err
+	}
+	if !buttons.Has(c.Message().ReplyMarkup, c.Callback().Unique, c.Callback().Data) {
+		_ = c.Respond(&tele.CallbackResponse{Text: "This button is not supported anymore", ShowAlert: true})
+		return data, nil, fmt.Errorf("callback data is not on the message buttons: %s", c.Callback().Data)
+	}
+	b.communitiesMu.RLock()
+	community, ok := b.communities[data.HookId]
+	b.communitiesMu.RUnlock()
+	if !ok || community.TgChatId != int(c.Chat().ID) {
+		_ = c.Respond(&tele.CallbackResponse{Text: "The community is not forwarded to this chat", ShowAlert: true})
+		return data, nil, fmt.Errorf("hookId %s is not forwarded to chat %d", data.HookId, c.Chat().ID)
+	}
+	if community.VkToken == "" {
+		_ = c.Respond(&tele.CallbackResponse{Text: "The community has no VK token", ShowAlert: true})
+		return data, nil, fmt.Errorf("no VK token for hookId %s", data.HookId)
+	}
+	return data, community, nil
+}
+
+// appendStatus adds a line to the message keeping its formatting and removes the button with the given unique name
+func (b *TgBot) appendStatus(c tele.Context, status string, unique string) error {
+	message := c.Message()
+	markup := buttons.Without(message.ReplyMarkup, unique)
+	if err := c.Edit(message.Text+"\n\n"+status, message.Entities, markup, tele.NoPreview); err != nil {
+		return fmt.Errorf("error editing message: %w", err)
+	}
+	return nil
+}
+
+func (b *TgBot) callVk(token string, method string, params vk.RequestParams) error {
+	options := []vk.Option{
+		vk.WithToken(token),
+		vk.WithHTTPClient(&http.Client{
+			Timeout:   time.Minute,
+			Transport: &metrics.InstrumentedTransport{Duration: metrics.VkApiRequestDuration},
+		}),
+	}
+	client, err := vk.NewClientWithOptions(options...)
+	if err != nil {
+		return err
+	}
+	if b.vkApiUrl != "" {
+		client.BaseURL = b.vkApiUrl
+	}
+	return client.CallMethod(method, params, nil)
+}
+
+// parseDuration parses a positive Go duration, also accepting whole days such as "1d"
+func parseDuration(s string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+	return duration, nil
+}
+
+func mutedText(until time.Time) string {
+	if until.IsZero() {
+		return "Forwarding is paused until /unmute"
+	}
+	return "Forwarding is paused until " + formatTime(until)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+func senderName(c tele.Context) string {
+	sender := c.Sender()
+	if sender == nil {
+		return ""
+	}
+	if sender.Username != "" {
+		return "@" + sender.Username
+	}
+	if name := strings.TrimSpace(sender.FirstName + " " + sender.LastName); name != "" {
+		return name
+	}
+	return strconv.FormatInt(sender.ID, 10)
+}
@@ -0,0 +1,394 @@
+package tg_bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/mutes"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	testChatId  = -100
+	testAdminId = 42
+)
+
+func TestCommands(t *testing.T) {
+	t.Run("whoami", func(t *testing.T) {
+		api, _, bot := setup(t)
+
+		bot.ProcessUpdate(command("/whoami", testAdminId))
+
+		assert.Equal(t, "Chat ID: <code>-100</code>\nYour user ID: <code>42</code>", api.lastReply())
+	})
+	t.Run("not admin", func(t *testing.T) {
+		api, _, bot := setup(t)
+
+		bot.ProcessUpdate(command("/whoami", 1))
+
+		assert.Equal(t, replyNotAdmin, api.lastReply())
+	})
+	t.Run("private chat", func(t *testing.T) {
+		api, _, bot := setup(t)
+		update := command("/whoami", 1)
+		update.Message.Chat = &tele.Chat{ID: 1, Type: tele.ChatPrivate}
+
+		bot.ProcessUpdate(update)
+
+		assert.Equal(t, "Chat ID: <code>1</code>\nYour user ID: <code>1</code>", api.lastReply())
+		assert.NotContains(t, api.methods(), "getChatAdministrators")
+	})
+	t.Run("mute", func(t *testing.T) {
+		api, s, bot := setup(t)
+
+		bot.ProcessUpdate(command("/mute 2h", testAdminId))
+
+		until, muted := s.mutes.MutedUntil(testChatId)
+		assert.True(t, muted)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), until, time.Second)
+		assert.Equal(t, mutedText(until), api.lastReply())
+
+		bot.ProcessUpdate(command("/unmute", testAdminId))
+
+		_, muted = s.mutes.MutedUntil(testChatId)
+		assert.False(t, muted)
+		assert.Equal(t, "Forwarding resumed", api.lastReply())
+	})
+	t.Run("mute until unmute", func(t *testing.T) {
+		api, s, bot := setup(t)
+
+		bot.ProcessUpdate(command("/mute", testAdminId))
+
+		until, muted := s.mutes.MutedUntil(testChatId)
+		assert.True(t, muted)
+		assert.True(t, until.IsZero())
+		assert.Equal(t, "Forwarding is paused until /unmute", api.lastReply())
+	})
+	t.Run("mute without dead letters", func(t *testing.T) {
+		api, s, bot := setup(t)
+		s.deadLetters = false
+
+		bot.ProcessUpdate(command("/mute", testAdminId))
+
+		_, muted := s.mutes.MutedUntil(testChatId)
+		assert.True(t, muted)
+		assert.Equal(t, "Forwarding is paused until /unmute\n"+replyMutedLost, api.lastReply())
+	})
+	t.Run("mute invalid duration", func(t *testing.T) {
+		api, s, bot := setup(t)
+
+		bot.ProcessUpdate(command("/mute soon", testAdminId))
+
+		_, muted := s.mutes.MutedUntil(testChatId)
+		assert.False(t, muted)
+		assert.Equal(t, replyBadDuration, api.lastReply())
+	})
+	t.Run("status", func(t *testing.T) {
+		api, s, bot := setup(t)
+		s.SetCommunity("b", &Community{TgChatId: testChatId})
+		s.SetCommunity("c", &Community{TgChatId: 1})
+		s.activity = fakeActivity{testChatId: time.Now().Add(-time.Minute)}
+		require.NoError(t, s.mutes.Mute(context.Background(), testChatId, time.Time{}))
+
+		bot.ProcessUpdate(command("/status", testAdminId))
+
+		lines := strings.Split(api.lastReply(), "\n")
+		require.Len(t, lines, 4)
+		assert.Equal(t, "Communities: a, b", lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "Uptime: "))
+		assert.True(t, strings.HasSuffix(lines[2], "(1m0s ago)"))
+		assert.Equal(t, "Forwarding is paused until /unmute", lines[3])
+	})
+}
+
+func TestCallbacks(t *testing.T) {
+	keyboard := &tele.ReplyMarkup{InlineKeyboard: [][]tele.InlineButton{{
+		{Text: "Open dialog", URL: "https://vk.com/gim10?sel=1234"},
+		{Text: "Mark as read", Data: "\fread|10|1234|a"},
+		{Text: "Block sender", Data: "\fblock|10|1234|a"},
+		{Text: "Mark as answered", Data: "\fanswered"},
+	}}}
+
+	t.Run("read", func(t *testing.T) {
+		api, s, bot := setup(t)
+		vkApi := setupVk(t, s)
+
+		bot.ProcessUpdate(callback("\fread|10|1234|a", testAdminId, keyboard))
+
+		assert.Equal(t, []string{"messages.markAsRead"}, vkApi.methods())
+		assert.Equal(t, "1234", vkApi.lastForm.Get("peer_id"))
+		assert.Equal(t, "10", vkApi.lastForm.Get("group_id"))
+		assert.Equal(t, "vk-token", vkApi.lastForm.Get("access_token"))
+		assert.Equal(t, []string{"editMessageReplyMarkup", "answerCallbackQuery"}, api.methods())
+		assert.Equal(t, "Marked as read", api.lastReply())
+		markup := api.lastParams("editMessageReplyMarkup")["reply_markup"]
+		assert.NotContains(t, markup, "read|")
+		assert.Contains(t, markup, "block|")
+	})
+	t.Run("answered", func(t *testing.T) {
+		api, _, bot := setup(t)
+
+		bot.ProcessUpdate(callback("\fanswered", 1, keyboard))
+
+		assert.Equal(t, []string{"editMessageText", "answerCallbackQuery"}, api.methods())
+		params := api.lastParams("editMessageText")
+		assert.Equal(t, "Message\n\n✅ Answered by Ivan Petrov", params["text"])
+		assert.NotContains(t, params["reply_markup"], "answered")
+		assert.Contains(t, params["reply_markup"], "block|")
+	})
+	t.Run("block", func(t *testing.T) {
+		api, s, bot := setup(t)
+		vkApi := setupVk(t, s)
+
+		bot.ProcessUpdate(callback("\fblock|10|1234|a", testAdminId, keyboard))
+
+		assert.Equal(t, []string{"groups.ban"}, vkApi.methods())
+		assert.Equal(t, "1234", vkApi.lastForm.Get("owner_id"))
+		assert.Equal(t, "Message\n\n🚫 Sender blocked by Ivan Petrov", api.lastParams("editMessageText")["text"])
+		assert.Equal(t, "Sender blocked", api.lastReply())
+	})
+	t.Run("block not admin", func(t *testing.T) {
+		api, s, bot := setup(t)
+		vkApi := setupVk(t, s)
+
+		bot.ProcessUpdate(callback("\fblock|10|1234|a", 1, keyboard))
+
+		assert.Empty(t, vkApi.methods())
+		assert.Equal(t, replyNotAdmin, api.lastReply())
+		assert.Equal(t, true, api.lastParams("answerCallbackQuery")["show_alert"])
+	})
+	t.Run("no VK token", func(t *testing.T) {
+		api, _, bot := setup(t)
+
+		bot.ProcessUpdate(callback("\fread|10|1234|a", testAdminId, keyboard))
+
+		assert.Equal(t, []string{"answerCallbackQuery"}, api.methods())
+		assert.Equal(t, "The community has no VK token", api.lastReply())
+	})
+	t.Run("other chat", func(t *testing.T) {
+		api, s, bot := setup(t)
+		vkApi := setupVk(t, s)
+		s.SetCommunity("a", &Community{TgChatId: testChatId + 1, VkToken: "vk-token"})
+
+		bot.ProcessUpdate(callback("\fblock|10|1234|a", testAdminId, keyboard))
+
+		assert.Empty(t, vkApi.methods())
+		assert.Equal(t, "The community is not forwarded to this chat", api.lastReply())
+	})
+	t.Run("forged data", func(t *testing.T) {
+		api, s, bot := setup(t)
+		vkApi := setupVk(t, s)
+
+		bot.ProcessUpdate(callback("\fblock|20|5678|a", testAdminId, keyboard))
+
+		assert.Empty(t, vkApi.methods())
+		assert.Equal(t, "This button is not supported anymore", api.lastReply())
+	})
+	t.Run("VK error", func(t *testing.T) {
+		api, s, bot := setup(t)
+		vkApi := setupVk(t, s)
+		vkApi.err = true
+
+		bot.ProcessUpdate(callback("\fread|10|1234|a", testAdminId, keyboard))
+
+		assert.Equal(t, []string{"answerCallbackQuery"}, api.methods())
+		assert.Equal(t, "Error marking the conversation as read", api.lastReply())
+	})
+}
+
+func TestRun(t *testing.T) {
+	api, s, _ := setup(t)
+	s.apiUrl = api.url
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- s.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return s.Ready() == nil }, time.Second, time.Millisecond)
+	cancel()
+
+	assert.NoError(t, <-errCh)
+	assert.Error(t, s.Ready())
+	assert.Contains(t, api.methods(), "setMyCommands")
+}
+
+func TestParseDuration(t *testing.T) {
+	for input, expected := range map[string]time.Duration{"2h": 2 * time.Hour, "30m": 30 * time.Minute, "1d": 24 * time.Hour} {
+		actual, err := parseDuration(input)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	for _, input := range []string{"", "0", "-1h", "xd", "soon"} {
+		_, err := parseDuration(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func setup(t *testing.T) (*fakeApi, *TgBot, *tele.Bot) {
+	t.Helper()
+	api := &fakeApi{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	api.url = srv.URL
+
+	log := slog.New(slog.NewTextHandler(&bytes.Buffer{}, &slog.HandlerOptions{}))
+	s := New(
+		"token",
+		true,
+		true,
+		map[string]*Community{"a": {TgChatId: testChatId}},
+		fakeActivity{},
+		mutes.New(nil),
+		log,
+	)
+	bot, err := tele.NewBot(tele.Settings{
+		Token:       "token",
+		URL:         srv.URL,
+		Offline:     true,
+		Synchronous: true,
+		OnError:     s.onError,
+	})
+	require.NoError(t, err)
+	s.handle(bot)
+	return api, s, bot
+}
+
+// setupVk sets the VK token of the community "a" and points the bot to a fake VK API
+func setupVk(t *testing.T, s *TgBot) *fakeVkApi {
+	t.Helper()
+	vkApi := &fakeVkApi{}
+	srv := httptest.NewServer(vkApi)
+	t.Cleanup(srv.Close)
+	s.vkApiUrl = srv.URL
+	s.SetCommunity("a", &Community{TgChatId: testChatId, VkToken: "vk-token"})
+	return vkApi
+}
+
+func callback(data string, senderId int64, markup *tele.ReplyMarkup) tele.Update {
+	return tele.Update{Callback: &tele.Callback{
+		ID:     "1",
+		Sender: &tele.User{ID: senderId, FirstName: "Ivan", LastName: "Petrov"},
+		Message: &tele.Message{
+			ID:          1,
+			Text:        "Message",
+			Chat:        &tele.Chat{ID: testChatId, Type: tele.ChatSuperGroup},
+			ReplyMarkup: markup,
+		},
+		Data: data,
+	}}
+}
+
+func command(text string, senderId int64) tele.Update {
+	return tele.Update{Message: &tele.Message{
+		Text:   text,
+		Chat:   &tele.Chat{ID: testChatId, Type: tele.ChatSuperGroup},
+		Sender: &tele.User{ID: senderId},
+	}}
+}
+
+type fakeActivity map[int]time.Time
+
+func (a fakeActivity) LastSent(tgChatId int) (time.Time, bool) {
+	at, ok := a[tgChatId]
+	return at, ok
+}
+
+// fakeApi is a Telegram Bot API stand-in recording the called methods and the sent texts
+type fakeApi struct {
+	url     string
+	mu      sync.Mutex
+	calls   []string
+	params  []map[string]any
+	replies []string
+}
+
+func (a *fakeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	params := map[string]any{}
+	_ = json.NewDecoder(r.Body).Decode(&params)
+
+	a.mu.Lock()
+	a.calls = append(a.calls, method)
+	a.params = append(a.params, params)
+	if text, ok := params["text"].(string); ok {
+		a.replies = append(a.replies, text)
+	}
+	a.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch method {
+	case "getUpdates":
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"ok":true,"result":[]}`))
+	case "getChatAdministrators":
+		_, _ = w.Write([]byte(`{"ok":true,"result":[{"status":"administrator","user":{"id":42}}]}`))
+	default:
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":-100}}}`))
+	}
+}
+
+func (a *fakeApi) methods() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.calls...)
+}
+
+// lastParams returns the parameters of the last call of the method
+func (a *fakeApi) lastParams(method string) map[string]any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := len(a.calls) - 1; i >= 0; i-- {
+		if a.calls[i] == method {
+			return a.params[i]
+		}
+	}
+	return nil
+}
+
+func (a *fakeApi) lastReply() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.replies) == 0 {
+		return ""
+	}
+	return a.replies[len(a.replies)-1]
+}
+
+// fakeVkApi is a VK API stand-in recording the called methods and the last form
+type fakeVkApi struct {
+	err      bool
+	mu       sync.Mutex
+	calls    []string
+	lastForm url.Values
+}
+
+func (a *fakeVkApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	a.mu.Lock()
+	a.calls = append(a.calls, strings.TrimPrefix(r.URL.Path, "/"))
+	a.lastForm = r.PostForm
+	a.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if a.err {
+		_, _ = w.Write([]byte(`{"error":{"error_code":15,"error_msg":"Access denied"}}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"response":1}`))
+}
+
+func (a *fakeVkApi) methods() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.calls...)
+}
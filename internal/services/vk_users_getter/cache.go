@@ -0,0 +1,61 @@
+package vk_users_getter
+
+import (
+	"sync"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/metrics"
+)
+
+const (
+	usersCacheName = "vk_users"
+	usersCacheTTL  = time.Hour
+	usersCacheSize = 10000
+)
+
+type cachedUser struct {
+	user      *entities.VkUser
+	expiresAt time.Time
+}
+
+// usersCache keeps VK users for usersCacheTTL so that active conversations do not result in users.get calls
+// for every message.
+type usersCache struct {
+	mu    sync.Mutex
+	users map[int]cachedUser
+	now   func() time.Time
+}
+
+func newUsersCache() *usersCache {
+	return &usersCache{users: make(map[int]cachedUser), now: time.Now}
+}
+
+func (c *usersCache) get(id int) (*entities.VkUser, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.users[id]
+	if !ok || c.now().After(cached.expiresAt) {
+		metrics.CacheRequests.WithLabelValues(usersCacheName, "miss").Inc()
+		return nil, false
+	}
+	metrics.CacheRequests.WithLabelValues(usersCacheName, "hit").Inc()
+	return cached.user, true
+}
+
+func (c *usersCache) put(id int, user *entities.VkUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.users) >= usersCacheSize {
+		for cachedId, cached := range c.users {
+			if now.After(cached.expiresAt) {
+				delete(c.users, cachedId)
+			}
+		}
+	}
+	if len(c.users) >= usersCacheSize {
+		clear(c.users)
+	}
+	c.users[id] = cachedUser{user: user, expiresAt: now.Add(usersCacheTTL)}
+}
@@ -0,0 +1,51 @@
+package vk_users_getter
+
+import (
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsersCache(t *testing.T) {
+	t.Run("hit", func(t *testing.T) {
+		c := newUsersCache()
+		user := &entities.VkUser{FirstName: "John", LastName: "Doe"}
+		c.put(1, user)
+
+		actual, ok := c.get(1)
+
+		assert.True(t, ok)
+		assert.Equal(t, user, actual)
+	})
+	t.Run("miss", func(t *testing.T) {
+		c := newUsersCache()
+		c.put(1, &entities.VkUser{})
+
+		_, ok := c.get(2)
+
+		assert.False(t, ok)
+	})
+	t.Run("expired", func(t *testing.T) {
+		c := newUsersCache()
+		now := time.Now()
+		c.now = func() time.Time { return now }
+		c.put(1, &entities.VkUser{})
+		c.now = func() time.Time { return now.Add(usersCacheTTL + time.Second) }
+
+		_, ok := c.get(1)
+
+		assert.False(t, ok)
+	})
+	t.Run("size limit", func(t *testing.T) {
+		c := newUsersCache()
+		for i := range usersCacheSize + 1 {
+			c.put(i, &entities.VkUser{})
+		}
+
+		assert.LessOrEqual(t, len(c.users), usersCacheSize)
+		_, ok := c.get(usersCacheSize)
+		assert.True(t, ok)
+	})
+}
@@ -3,37 +3,45 @@ package vk_users_getter
 import (
 	"context"
 	"log/slog"
+	"net/http"
+	"time"
 
 	"viktig/internal/entities"
-	"viktig/internal/queue"
+	"viktig/internal/metrics"
 
 	"github.com/go-vk-api/vk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("viktig/internal/services/vk_users_getter")
+
+// VkUsersGetter is a pipeline stage adding the VK user info to messages
 type VkUsersGetter struct {
 	apiToken string
-	qi       *queue.Queue[entities.Message]
-	qo       *queue.Queue[entities.Message]
+	client   *vk.Client
+	cache    *usersCache
 	l        *slog.Logger
 }
 
-func New(
-	apiToken string,
-	inQueue *queue.Queue[entities.Message],
-	outQueue *queue.Queue[entities.Message],
-	l *slog.Logger,
-) *VkUsersGetter {
+func New(apiToken string, l *slog.Logger) *VkUsersGetter {
 	return &VkUsersGetter{
 		apiToken: apiToken,
-		qi:       inQueue,
-		qo:       outQueue,
+		cache:    newUsersCache(),
 		l:        l.With("service", "VkUsersGetter"),
 	}
 }
 
-func (s *VkUsersGetter) Run(ctx context.Context) error {
+// Start creates the VK client and checks the API token
+func (s *VkUsersGetter) Start(_ context.Context) error {
 	client, err := vk.NewClientWithOptions(
 		vk.WithToken(s.apiToken),
+		vk.WithHTTPClient(&http.Client{
+			Timeout:   time.Minute,
+			Transport: &metrics.InstrumentedTransport{Duration: metrics.VkApiRequestDuration},
+		}),
 		withLang("ru"), // disables names transliteration
 	)
 	if err != nil {
@@ -42,27 +50,47 @@ func (s *VkUsersGetter) Run(ctx context.Context) error {
 	if err = checkVKClient(client); err != nil {
 		return err
 	}
+	s.client = client
 	s.l.Info("vkUsersGetter is ready")
+	return nil
+}
+
+// Process passes on the message with the sender info. Messages are passed on without it if the VK API fails.
+func (s *VkUsersGetter) Process(ctx context.Context, message entities.Message) (entities.Message, bool) {
+	return s.enrich(ctx, message), true
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			s.l.Info("stopping vkUsersGetter service")
-			return nil
-		case message := <-s.qi.AsChan():
-			// Retrieve VK users based on the sender ID of the incoming message
-			if message.IsFromUser() {
-				var users []*entities.VkUser
-				err := client.CallMethod("users.get", vk.RequestParams{"user_id": message.VkSenderId}, &users)
-				if err != nil || len(users) != 1 {
-					s.l.Error("error getting user info", "entries", len(users), "err", err)
-				} else {
-					message.VkSender = users[0]
-				}
-			}
-			s.qo.Put(message)
-		}
+func (s *VkUsersGetter) Lost(message entities.Message) {
+	s.l.ErrorContext(message.Context(context.Background()), "message lost on shutdown", "message", message)
+	metrics.MessagesFailed.WithLabelValues(message.HookId, metrics.FailureReasonLostOnShutdown).Inc()
+}
+
+// enrich retrieves VK users based on the sender ID of the incoming message
+func (s *VkUsersGetter) enrich(ctx context.Context, message entities.Message) entities.Message {
+	if !message.IsFromUser() {
+		return message
+	}
+	if user, ok := s.cache.get(message.VkSenderId); ok {
+		message.VkSender = user
+		return message
+	}
+	ctx, span := tracer.Start(
+		message.Context(ctx),
+		"users.get",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("vk.user_id", message.VkSenderId)),
+	)
+	defer span.End()
+	var users []*entities.VkUser
+	err := s.client.CallMethod("users.get", vk.RequestParams{"user_id": message.VkSenderId}, &users)
+	if err != nil || len(users) != 1 {
+		s.l.ErrorContext(ctx, "error getting user info", "entries", len(users), "err", err)
+		span.SetStatus(codes.Error, "error getting user info")
+	} else {
+		message.VkSender = users[0]
+		s.cache.put(message.VkSenderId, users[0])
 	}
+	return message
 }
 
 func checkVKClient(client *vk.Client) error {
@@ -0,0 +1,197 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/render"
+	"viktig/internal/sinks"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// maxDescriptionLength is the Discord limit of the embed description in characters
+	maxDescriptionLength = 4096
+	// maxImages is how many images Discord shows in the gallery of an embed
+	maxImages = 4
+	// postedSize is how many posted messages are remembered to be edited
+	postedSize = 10000
+)
+
+var errNotFound = errors.New("discord message not found")
+
+// Discord posts messages to a Discord channel with a webhook. Edits of VK messages update the posted messages.
+type Discord struct {
+	webhookUrl *url.URL
+	username   string
+	client     *http.Client
+	retry      sinks.Retry
+	posted     *sinks.IdMap
+	l          *slog.Logger
+}
+
+// New creates the sink posting with webhookUrl. The username overrides the webhook name if set.
+func New(name string, webhookUrl string, username string, l *slog.Logger) (*Discord, error) {
+	u, err := url.Parse(webhookUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discord webhook url: %w", err)
+	}
+	retry := sinks.DefaultRetry
+	retry.RetryAfter = retryAfter
+	return &Discord{
+		webhookUrl: u,
+		username:   username,
+		client:     sinks.NewHttpClient(name),
+		retry:      retry,
+		posted:     sinks.NewIdMap(postedSize),
+		l:          l.With("sink", name),
+	}, nil
+}
+
+// Start checks that the webhook exists
+func (d *Discord) Start(ctx context.Context) error {
+	if err := d.do(ctx, http.MethodGet, d.webhookUrl.String(), nil, nil); err != nil {
+		return fmt.Errorf("discord webhook error: %w", err)
+	}
+	return nil
+}
+
+// Send posts the message, or updates the posted one if the message is an edit
+func (d *Discord) Send(ctx context.Context, message entities.Message) error {
+	payload := d.render(message)
+	key := sinks.MessageKey(message)
+	if id, ok := d.posted.Get(key); ok && key != "" && message.Type == entities.MessageTypeEdit {
+		err := d.do(ctx, http.MethodPatch, d.messageUrl(id), payload, nil)
+		if !errors.Is(err, errNotFound) {
+			return err
+		}
+		d.l.WarnContext(ctx, "edited discord message not found, posting a new one", "id", id)
+	}
+
+	postUrl := *d.webhookUrl
+	query := postUrl.Query()
+	query.Set("wait", "true")
+	postUrl.RawQuery = query.Encode()
+	posted := &postedMessage{}
+	if err := d.do(ctx, http.MethodPost, postUrl.String(), payload, posted); err != nil {
+		return err
+	}
+	d.l.InfoContext(ctx, "posted discord message", "id", posted.Id)
+	if key != "" {
+		d.posted.Put(key, posted.Id)
+	}
+	return nil
+}
+
+func (d *Discord) messageUrl(id string) string {
+	u := *d.webhookUrl
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/messages/" + id
+	return u.String()
+}
+
+// do sends the request, decoding the response into result if it is not nil.
+// Returns errNotFound if the edited message does not exist.
+func (d *Discord) do(ctx context.Context, method string, u string, payload any, result any) error {
+	request := sinks.JsonRequest{Method: method, Url: u, Payload: payload, Result: result}
+	err := sinks.DoJson(ctx, d.client, d.retry, request, d.l)
+	var statusErr *sinks.StatusError
+	if method == http.MethodPatch && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	return err
+}
+
+// retryAfter returns how long Discord asks to wait, given in seconds in the body along with the Retry-After header
+func retryAfter(body []byte) time.Duration {
+	limited := struct {
+		RetryAfter float64 `json:"retry_after"`
+	}{}
+	if err := jsoniter.Unmarshal(body, &limited); err == nil && limited.RetryAfter > 0 {
+		return time.Duration(limited.RetryAfter * float64(time.Second))
+	}
+	return 0
+}
+
+type postedMessage struct {
+	Id string `json:"id"`
+}
+
+type webhookMessage struct {
+	Username        string          `json:"username,omitempty"`
+	Embeds          []embed         `json:"embeds"`
+	AllowedMentions allowedMentions `json:"allowed_mentions"`
+}
+
+type allowedMentions struct {
+	Parse []string `json:"parse"`
+}
+
+type embed struct {
+	// Url is the same for all the embeds of a message, so that Discord shows their images as a gallery
+	Url         string       `json:"url"`
+	Author      *embedAuthor `json:"author,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Color       int          `json:"color,omitempty"`
+	Timestamp   string       `json:"timestamp,omitempty"`
+	Image       *embedImage  `json:"image,omitempty"`
+}
+
+type embedAuthor struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type embedImage struct {
+	Url string `json:"url"`
+}
+
+// render makes an embed with the sender and the text, and adds embeds for the images after the first one
+func (d *Discord) render(message entities.Message) webhookMessage {
+	main := embed{
+		Url:    dialogUrl(message),
+		Author: &embedAuthor{Name: message.SenderName(), Url: message.SenderUrl()},
+		Color:  render.Color(message),
+	}
+	if !message.ReceivedAt.IsZero() {
+		main.Timestamp = message.ReceivedAt.UTC().Format(time.RFC3339)
+	}
+	lines := []string{render.Icon(message) + " " + render.EscapeMarkdown(message.Text)}
+	var images []string
+	for _, attachment := range message.Attachments {
+		switch {
+		case attachment.IsImage() && len(images) < maxImages:
+			images = append(images, attachment.Url)
+		case attachment.Url != "":
+			lines = append(lines, fmt.Sprintf("📎 [%s](%s)", render.EscapeMarkdown(attachment.Name()), attachment.Url))
+		default:
+			lines = append(lines, "📎 "+render.EscapeMarkdown(attachment.Name()))
+		}
+	}
+	main.Description = render.Truncate(strings.Join(lines, "\n"), maxDescriptionLength)
+
+	embeds := []embed{main}
+	for i, image := range images {
+		if i == 0 {
+			embeds[0].Image = &embedImage{Url: image}
+			continue
+		}
+		embeds = append(embeds, embed{Url: main.Url, Image: &embedImage{Url: image}})
+	}
+	return webhookMessage{Username: d.username, Embeds: embeds, AllowedMentions: allowedMentions{Parse: []string{}}}
+}
+
+// dialogUrl returns the link to the VK conversation of the message, or to the sender if it is unknown
+func dialogUrl(message entities.Message) string {
+	if dialogUrl := message.DialogUrl(); dialogUrl != "" {
+		return dialogUrl
+	}
+	return message.SenderUrl()
+}
@@ -0,0 +1,207 @@
+package discord
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscord(t *testing.T) {
+	message := entities.Message{
+		HookId:      "test-hook",
+		Type:        entities.MessageTypeNew,
+		Text:        "Hello *world*",
+		VkSenderId:  1234,
+		VkGroupId:   10,
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		VkSender:    &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		Attachments: []entities.Attachment{
+			{Type: "photo", Url: "https://vk.com/1.jpg"},
+			{Type: "doc", Url: "https://vk.com/doc1", Title: "file.pdf"},
+			{Type: "photo", Url: "https://vk.com/2.jpg"},
+			{Type: "poll"},
+		},
+		ReceivedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	t.Run("start", func(t *testing.T) {
+		api := newFakeDiscord(t)
+
+		assert.NoError(t, newTestDiscord(t, api.url()).Start(context.Background()))
+		assert.Error(t, newTestDiscord(t, api.server.URL+"/api/webhooks/2/wrong").Start(context.Background()))
+	})
+	t.Run("embeds", func(t *testing.T) {
+		api := newFakeDiscord(t)
+		d := newTestDiscord(t, api.url())
+
+		require.NoError(t, d.Send(context.Background(), message))
+
+		require.Len(t, api.requests, 1)
+		request := api.requests[0]
+		assert.Equal(t, http.MethodPost, request.method)
+		assert.Equal(t, "true", request.query.Get("wait"))
+		assert.Equal(t, "viktig", request.payload.Username)
+		assert.Equal(t, []string{}, request.payload.AllowedMentions.Parse)
+		require.Len(t, request.payload.Embeds, 2)
+		main := request.payload.Embeds[0]
+		assert.Equal(t, &embedAuthor{Name: "Ivan Petrov", Url: "https://vk.com/id1234"}, main.Author)
+		assert.Equal(t, "💬 Hello \\*world\\*\n📎 [file.pdf](https://vk.com/doc1)\n📎 poll", main.Description)
+		assert.Equal(t, "2024-05-01T12:00:00Z", main.Timestamp)
+		assert.Equal(t, "https://vk.com/1.jpg", main.Image.Url)
+		assert.Equal(t, embed{Url: main.Url, Image: &embedImage{Url: "https://vk.com/2.jpg"}}, request.payload.Embeds[1])
+		assert.Equal(t, "https://vk.com/gim10?sel=1234", main.Url)
+	})
+	t.Run("edit", func(t *testing.T) {
+		api := newFakeDiscord(t)
+		d := newTestDiscord(t, api.url())
+		edit := message
+		edit.Type = entities.MessageTypeEdit
+		edit.Text = "Edited"
+
+		require.NoError(t, d.Send(context.Background(), message))
+		require.NoError(t, d.Send(context.Background(), edit))
+
+		require.Len(t, api.requests, 2)
+		assert.Equal(t, http.MethodPatch, api.requests[1].method)
+		assert.Equal(t, "/api/webhooks/1/token/messages/1", api.requests[1].path)
+		assert.Contains(t, api.requests[1].payload.Embeds[0].Description, "✏️ Edited")
+	})
+	t.Run("edit of deleted message", func(t *testing.T) {
+		api := newFakeDiscord(t)
+		d := newTestDiscord(t, api.url())
+		edit := message
+		edit.Type = entities.MessageTypeEdit
+
+		require.NoError(t, d.Send(context.Background(), message))
+		api.messages = map[string]bool{}
+		require.NoError(t, d.Send(context.Background(), edit))
+
+		require.Len(t, api.requests, 3)
+		assert.Equal(t, http.MethodPatch, api.requests[1].method)
+		assert.Equal(t, http.MethodPost, api.requests[2].method)
+	})
+	t.Run("edit of unknown message", func(t *testing.T) {
+		api := newFakeDiscord(t)
+		edit := message
+		edit.Type = entities.MessageTypeEdit
+
+		require.NoError(t, newTestDiscord(t, api.url()).Send(context.Background(), edit))
+
+		require.Len(t, api.requests, 1)
+		assert.Equal(t, http.MethodPost, api.requests[0].method)
+	})
+	t.Run("rate limit", func(t *testing.T) {
+		api := newFakeDiscord(t)
+		api.limited = 1
+
+		require.NoError(t, newTestDiscord(t, api.url()).Send(context.Background(), message))
+
+		assert.Len(t, api.requests, 2)
+	})
+	t.Run("server error", func(t *testing.T) {
+		api := newFakeDiscord(t)
+		api.failing = 1
+
+		require.NoError(t, newTestDiscord(t, api.url()).Send(context.Background(), message))
+
+		assert.Len(t, api.requests, 2)
+	})
+	t.Run("error", func(t *testing.T) {
+		api := newFakeDiscord(t)
+
+		err := newTestDiscord(t, api.server.URL+"/api/webhooks/2/wrong").Send(context.Background(), message)
+
+		assert.ErrorContains(t, err, "401 Unauthorized")
+	})
+}
+
+func newTestDiscord(t *testing.T, webhookUrl string) *Discord {
+	t.Helper()
+	d, err := New("discord", webhookUrl, "viktig", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	d.retry.InitialBackoff = time.Millisecond
+	return d
+}
+
+type fakeRequest struct {
+	method  string
+	path    string
+	query   url.Values
+	payload webhookMessage
+}
+
+// fakeDiscord serves the webhook /api/webhooks/1/token
+type fakeDiscord struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests []fakeRequest
+	messages map[string]bool
+	// limited is how many requests are rejected with "Too Many Requests"
+	limited int
+	// failing is how many requests are rejected with "Bad Gateway"
+	failing int
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	api := &fakeDiscord{messages: make(map[string]bool)}
+	api.server = httptest.NewServer(http.HandlerFunc(api.handle))
+	t.Cleanup(api.server.Close)
+	return api
+}
+
+func (api *fakeDiscord) url() string {
+	return api.server.URL + "/api/webhooks/1/token"
+}
+
+func (api *fakeDiscord) handle(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if r.Method != http.MethodGet {
+		request := fakeRequest{method: r.Method, path: r.URL.Path, query: r.URL.Query()}
+		_ = jsoniter.NewDecoder(r.Body).Decode(&request.payload)
+		api.requests = append(api.requests, request)
+	}
+	if api.limited > 0 {
+		api.limited--
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"message":"You are being rate limited.","retry_after":0.01,"global":false}`))
+		return
+	}
+	if api.failing > 0 {
+		api.failing--
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	switch {
+	case r.URL.Path != "/api/webhooks/1/token" && r.Method != http.MethodPatch:
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"message":"Invalid Webhook Token","code":50027}`))
+	case r.Method == http.MethodGet:
+		_, _ = w.Write([]byte(`{"id":"1","name":"viktig"}`))
+	case r.Method == http.MethodPost:
+		id := strconv.Itoa(len(api.messages) + 1)
+		api.messages[id] = true
+		_, _ = w.Write([]byte(`{"id":"` + id + `"}`))
+	case r.Method == http.MethodPatch:
+		id := r.URL.Path[len("/api/webhooks/1/token/messages/"):]
+		if !api.messages[id] {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"Unknown Message","code":10008}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"` + id + `"}`))
+	}
+}
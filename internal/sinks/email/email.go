@@ -0,0 +1,280 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/render"
+	"viktig/internal/sinks"
+)
+
+// Security of the SMTP connection
+const (
+	SecurityStartTls = "starttls"
+	SecurityTls      = "tls"
+	// SecurityNone is only meant for local relays
+	SecurityNone = "none"
+)
+
+const (
+	// timeout limits the whole SMTP session of each message
+	timeout = 30 * time.Second
+	// threadsSize is how many conversations are remembered to thread their emails
+	threadsSize = 10000
+)
+
+var errNoStartTls = errors.New("smtp server does not support STARTTLS")
+
+type Settings struct {
+	Host     string
+	Port     int
+	Security string
+	// Username enables PLAIN authentication with Password if set
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Email sends each message as a multipart text and HTML email.
+// Emails of a VK conversation reply to each other, so that mail clients show them as one thread.
+type Email struct {
+	settings Settings
+	from     *mail.Address
+	// rootCAs are trusted instead of the system ones if set
+	rootCAs *x509.CertPool
+	// threads keeps the Message-ID of the last email and the subject of each conversation
+	threads  *sinks.IdMap
+	subjects *sinks.IdMap
+	l        *slog.Logger
+}
+
+func New(name string, settings Settings, l *slog.Logger) (*Email, error) {
+	from, err := mail.ParseAddress(settings.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	return &Email{
+		settings: settings,
+		from:     from,
+		threads:  sinks.NewIdMap(threadsSize),
+		subjects: sinks.NewIdMap(threadsSize),
+		l:        l.With("sink", name),
+	}, nil
+}
+
+// Start checks that the SMTP server accepts the connection and the credentials
+func (e *Email) Start(ctx context.Context) error {
+	c, err := e.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("smtp error: %w", err)
+	}
+	defer c.Close()
+	return c.Quit()
+}
+
+// Send emails the message as a reply to the previous email of its conversation
+func (e *Email) Send(ctx context.Context, message entities.Message) error {
+	conversation := message.ConversationKey()
+	messageId, err := e.messageId()
+	if err != nil {
+		return err
+	}
+	data, err := e.compose(message, messageId)
+	if err != nil {
+		return err
+	}
+
+	c, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Mail(e.from.Address); err != nil {
+		return err
+	}
+	for _, to := range e.settings.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	e.threads.Put(conversation, messageId)
+	e.l.InfoContext(ctx, "sent email", "messageId", messageId)
+	return c.Quit()
+}
+
+// connect opens an SMTP session, secured and authenticated as configured
+func (e *Email) connect(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(e.settings.Host, strconv.Itoa(e.settings.Port))
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if e.settings.Security == SecurityTls {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: e.tlsConfig()}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, e.settings.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = e.secure(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// secure upgrades the connection with STARTTLS if configured and authenticates
+func (e *Email) secure(c *smtp.Client) error {
+	if e.settings.Security == SecurityStartTls {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errNoStartTls
+		}
+		if err := c.StartTLS(e.tlsConfig()); err != nil {
+			return err
+		}
+	}
+	if e.settings.Username == "" {
+		return nil
+	}
+	return c.Auth(smtp.PlainAuth("", e.settings.Username, e.settings.Password, e.settings.Host))
+}
+
+func (e *Email) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: e.settings.Host, RootCAs: e.rootCAs, MinVersion: tls.VersionTLS12}
+}
+
+// messageId returns a new unique Message-ID in the domain of the sender
+func (e *Email) messageId() (string, error) {
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), e.domain()), nil
+}
+
+func (e *Email) domain() string {
+	return e.from.Address[strings.LastIndex(e.from.Address, "@")+1:]
+}
+
+// threadRoot is the same for all the emails of a conversation, so that they are threaded even after a restart
+func (e *Email) threadRoot(message entities.Message) string {
+	peerId := message.VkPeerId
+	if peerId == 0 {
+		peerId = message.VkSenderId
+	}
+	return fmt.Sprintf("<vk.%s.%d@%s>", hex.EncodeToString([]byte(message.HookId)), peerId, e.domain())
+}
+
+// subject is kept for the conversation, since replies of the community do not have the name of the user
+func (e *Email) subject(message entities.Message) string {
+	conversation := message.ConversationKey()
+	if subject, ok := e.subjects.Get(conversation); ok {
+		return subject
+	}
+	subject := fmt.Sprintf("[%s] VK conversation %d", message.HookId, message.VkPeerId)
+	if message.IsFromUser() {
+		subject = fmt.Sprintf("[%s] %s", message.HookId, message.SenderName())
+		e.subjects.Put(conversation, subject)
+	}
+	return subject
+}
+
+// compose renders the email with the text and HTML alternatives and the threading headers
+func (e *Email) compose(message entities.Message, messageId string) ([]byte, error) {
+	root := e.threadRoot(message)
+	inReplyTo := root
+	if previous, ok := e.threads.Get(message.ConversationKey()); ok {
+		inReplyTo = previous
+	}
+	references := root
+	if inReplyTo != root {
+		references += " " + inReplyTo
+	}
+	from := mail.Address{Name: message.SenderName() + " via VK", Address: e.from.Address}
+	date := message.ReceivedAt
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	headers := []struct{ name, value string }{
+		{"From", from.String()},
+		{"To", strings.Join(e.settings.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", e.subject(message))},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", messageId},
+		{"In-Reply-To", inReplyTo},
+		{"References", references},
+		{"Auto-Submitted", "auto-generated"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + w.Boundary()},
+	}
+	for _, header := range headers {
+		buf.WriteString(header.name + ": " + header.value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	html := "<html><body>" + strings.ReplaceAll(render.Html(message), "\n", "<br>\r\n") + "</body></html>"
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", render.Text(message)},
+		{"text/html; charset=utf-8", html},
+	} {
+		partWriter, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(partWriter)
+		if _, err = qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,325 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail(t *testing.T) {
+	message := entities.Message{
+		HookId:      "test-hook",
+		Type:        entities.MessageTypeNew,
+		Text:        "Hello <b>",
+		VkSenderId:  1234,
+		VkGroupId:   10,
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		VkSender:    &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		Attachments: []entities.Attachment{
+			{Type: "photo", Url: "https://vk.com/photo1.jpg"},
+			{Type: "doc", Url: "https://vk.com/doc1", Title: "file.pdf"},
+		},
+		ReceivedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	reply := message
+	reply.VkSenderId = -10
+	reply.VkSender = nil
+	reply.Text = "Hi"
+	reply.Attachments = nil
+
+	t.Run("multipart", func(t *testing.T) {
+		server := newFakeSmtp(t, fakeSmtpOptions{})
+		e := server.email(t, SecurityNone)
+
+		require.NoError(t, e.Send(context.Background(), message))
+
+		mails := server.received()
+		require.Len(t, mails, 1)
+		received := mails[0]
+		assert.Equal(t, "viktig@example.com", received.from)
+		assert.Equal(t, []string{"support@example.com", "admin@example.com"}, received.to)
+		msg := received.parse(t)
+		assert.Equal(t, "[test-hook] Ivan Petrov", decodeHeader(t, msg.Header.Get("Subject")))
+		assert.Equal(t, `"Ivan Petrov via VK" <viktig@example.com>`, msg.Header.Get("From"))
+
+		parts := parts(t, msg)
+		require.Len(t, parts, 2)
+		assert.Contains(t, parts["text/plain; charset=utf-8"], "Hello <b>")
+		assert.Contains(t, parts["text/plain; charset=utf-8"], "https://vk.com/doc1")
+		assert.Contains(t, parts["text/html; charset=utf-8"], "Hello &lt;b&gt;")
+		assert.Contains(t, parts["text/html; charset=utf-8"], `href="https://vk.com/photo1.jpg"`)
+		assert.Contains(t, parts["text/html; charset=utf-8"], `href="https://vk.com/doc1"`)
+	})
+	t.Run("thread", func(t *testing.T) {
+		server := newFakeSmtp(t, fakeSmtpOptions{})
+		e := server.email(t, SecurityNone)
+
+		require.NoError(t, e.Send(context.Background(), message))
+		require.NoError(t, e.Send(context.Background(), reply))
+
+		mails := server.received()
+		require.Len(t, mails, 2)
+		first, second := mails[0].parse(t), mails[1].parse(t)
+		root := first.Header.Get("References")
+		assert.Equal(t, root, first.Header.Get("In-Reply-To"))
+		assert.NotEqual(t, root, first.Header.Get("Message-ID"))
+		assert.Equal(t, first.Header.Get("Message-ID"), second.Header.Get("In-Reply-To"))
+		assert.Equal(t, root+" "+first.Header.Get("Message-ID"), second.Header.Get("References"))
+		assert.Equal(t, decodeHeader(t, first.Header.Get("Subject")), decodeHeader(t, second.Header.Get("Subject")))
+
+		restarted := server.email(t, SecurityNone)
+		require.NoError(t, restarted.Send(context.Background(), reply))
+		assert.Equal(t, root, server.received()[2].parse(t).Header.Get("References"))
+	})
+	t.Run("starttls", func(t *testing.T) {
+		server := newFakeSmtp(t, fakeSmtpOptions{tlsConfig: newTlsConfig(t)})
+		e := server.email(t, SecurityStartTls)
+		e.settings.Username, e.settings.Password = "user", "password"
+
+		require.NoError(t, e.Start(context.Background()))
+		require.NoError(t, e.Send(context.Background(), message))
+
+		mails := server.received()
+		require.Len(t, mails, 1)
+		assert.True(t, mails[0].tls)
+		assert.Equal(t, "\x00user\x00password", mails[0].auth)
+	})
+	t.Run("starttls unsupported", func(t *testing.T) {
+		server := newFakeSmtp(t, fakeSmtpOptions{})
+
+		assert.ErrorIs(t, server.email(t, SecurityStartTls).Send(context.Background(), message), errNoStartTls)
+		assert.Empty(t, server.received())
+	})
+	t.Run("tls", func(t *testing.T) {
+		server := newFakeSmtp(t, fakeSmtpOptions{tlsConfig: newTlsConfig(t), implicitTls: true})
+		e := server.email(t, SecurityTls)
+
+		require.NoError(t, e.Send(context.Background(), message))
+
+		mails := server.received()
+		require.Len(t, mails, 1)
+		assert.True(t, mails[0].tls)
+	})
+	t.Run("rejected", func(t *testing.T) {
+		server := newFakeSmtp(t, fakeSmtpOptions{rejectRcpt: true})
+
+		assert.Error(t, server.email(t, SecurityNone).Send(context.Background(), message))
+		assert.Empty(t, server.received())
+	})
+}
+
+func decodeHeader(t *testing.T, header string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(header)
+	require.NoError(t, err)
+	return decoded
+}
+
+// parts returns the decoded bodies of the multipart email by content type
+func parts(t *testing.T, msg *mail.Message) map[string]string {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+	result := map[string]string{}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return result
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		result[part.Header.Get("Content-Type")] = string(body)
+	}
+}
+
+type receivedMail struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+	auth string
+}
+
+func (m receivedMail) parse(t *testing.T) *mail.Message {
+	msg, err := mail.ReadMessage(strings.NewReader(m.data))
+	require.NoError(t, err)
+	return msg
+}
+
+type fakeSmtpOptions struct {
+	// tlsConfig enables STARTTLS, or TLS from the start of the connection with implicitTls
+	tlsConfig   *tls.Config
+	implicitTls bool
+	rejectRcpt  bool
+}
+
+// fakeSmtp is a minimal SMTP server
+type fakeSmtp struct {
+	fakeSmtpOptions
+	listener net.Listener
+	rootCAs  *x509.CertPool
+	mu       sync.Mutex
+	mails    []receivedMail
+}
+
+func newFakeSmtp(t *testing.T, options fakeSmtpOptions) *fakeSmtp {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	server := &fakeSmtp{fakeSmtpOptions: options, listener: listener}
+	if options.tlsConfig != nil {
+		server.rootCAs = x509.NewCertPool()
+		server.rootCAs.AddCert(options.tlsConfig.Certificates[0].Leaf)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if server.implicitTls {
+				conn = tls.Server(conn, server.tlsConfig)
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeSmtp) received() []receivedMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedMail(nil), s.mails...)
+}
+
+func (s *fakeSmtp) email(t *testing.T, security string) *Email {
+	host, port, err := net.SplitHostPort(s.listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	e, err := New("mail", Settings{
+		Host:     host,
+		Port:     portNumber,
+		Security: security,
+		From:     "viktig@example.com",
+		To:       []string{"support@example.com", "admin@example.com"},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	e.rootCAs = s.rootCAs
+	return e
+}
+
+func (s *fakeSmtp) serve(conn net.Conn) {
+	defer conn.Close()
+	_, secure := conn.(*tls.Conn)
+	text := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	reply := func(line string) {
+		text.WriteString(line + "\r\n")
+		text.Flush()
+	}
+	var current receivedMail
+	reply("220 localhost ready")
+	for {
+		line, err := text.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			if s.tlsConfig != nil && !secure {
+				reply("250-localhost")
+				reply("250-STARTTLS")
+			} else {
+				reply("250-localhost")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			text = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		case "AUTH":
+			fields := strings.Fields(line)
+			decoded, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			if err != nil {
+				reply("501 invalid credentials")
+				continue
+			}
+			current.auth = string(decoded)
+			reply("235 authenticated")
+		case "MAIL":
+			current.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 ok")
+		case "RCPT":
+			if s.rejectRcpt {
+				reply("550 no such user")
+				continue
+			}
+			current.to = append(current.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := text.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			current.data = data.String()
+			current.tls = secure
+			s.mu.Lock()
+			s.mails = append(s.mails, current)
+			s.mu.Unlock()
+			current = receivedMail{auth: current.auth}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// newTlsConfig borrows the self-signed certificate of httptest
+func newTlsConfig(t *testing.T) *tls.Config {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	certificate := server.TLS.Certificates[0]
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	certificate.Leaf = leaf
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}
+}
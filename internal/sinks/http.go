@@ -0,0 +1,171 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Retry sets how requests failing with a network error, 429 or 5xx response are retried
+type Retry struct {
+	// Retries is how many times a request is retried after the first attempt
+	Retries int
+	// InitialBackoff is the delay before the first retry, doubled for each next one up to MaxBackoff.
+	// Retry-After of the response is waited instead if it is set, the request is not retried if it is longer than MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryAfter returns how long to wait given the body of a 429 response without Retry-After, zero if unknown.
+	// It is set for APIs telling it in the body.
+	RetryAfter func(body []byte) time.Duration
+}
+
+var DefaultRetry = Retry{Retries: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+
+// StatusError is an unsuccessful response
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// retryable reports whether the request may succeed if sent again
+func (e *StatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// Do sends the request made by newRequest until it succeeds or retries are exhausted.
+// Returns the body of the successful response, or a *StatusError if the response was not successful.
+func Do(
+	ctx context.Context,
+	client *http.Client,
+	retry Retry,
+	newRequest func(ctx context.Context) (*http.Request, error),
+	l *slog.Logger,
+) ([]byte, error) {
+	backoff := retry.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		body, wait, err := do(ctx, client, retry, newRequest)
+		if err == nil {
+			return body, nil
+		}
+		var statusErr *StatusError
+		if (errors.As(err, &statusErr) && !statusErr.retryable()) || attempt >= retry.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+		if wait > retry.MaxBackoff {
+			l.WarnContext(ctx, "request failed, not retrying since the server asks to wait too long", "err", err, "wait", wait)
+			return nil, err
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff = min(backoff*2, retry.MaxBackoff)
+		}
+		l.WarnContext(ctx, "request failed, retrying", "err", err, "attempt", attempt+1, "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// JsonRequest is a request to a JSON API sent with DoJson
+type JsonRequest struct {
+	Method string
+	Url    string
+	Header http.Header
+	// Payload is sent as the JSON body if not nil
+	Payload any
+	// Result is decoded from the body of the successful response if not nil
+	Result any
+}
+
+// DoJson sends the request, retrying like Do
+func DoJson(ctx context.Context, client *http.Client, retry Retry, request JsonRequest, l *slog.Logger) error {
+	var body []byte
+	if request.Payload != nil {
+		var err error
+		if body, err = jsoniter.Marshal(request.Payload); err != nil {
+			return err
+		}
+	}
+	respBody, err := Do(ctx, client, retry, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, request.Method, request.Url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range request.Header {
+			req.Header[name] = values
+		}
+		if request.Payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, nil
+	}, l)
+	if err != nil || request.Result == nil {
+		return err
+	}
+	return jsoniter.Unmarshal(respBody, request.Result)
+}
+
+// PostJson posts the payload as JSON to url, retrying like Do
+func PostJson(ctx context.Context, client *http.Client, retry Retry, url string, payload any, l *slog.Logger) error {
+	return DoJson(ctx, client, retry, JsonRequest{Method: http.MethodPost, Url: url, Payload: payload}, l)
+}
+
+// do sends the request once. Returns how long the server asks to wait before retrying if it does.
+func do(
+	ctx context.Context,
+	client *http.Client,
+	retry Retry,
+	newRequest func(ctx context.Context) (*http.Request, error),
+) ([]byte, time.Duration, error) {
+	req, err := newRequest(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		err = &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(body))}
+		wait := retryAfter(resp.Header.Get("Retry-After"))
+		if wait == 0 && resp.StatusCode == http.StatusTooManyRequests && retry.RetryAfter != nil {
+			wait = retry.RetryAfter(body)
+		}
+		return nil, wait, err
+	}
+	return body, 0, nil
+}
+
+// retryAfter parses the Retry-After header given in seconds, the HTTP date form is not used by the supported services
+func retryAfter(value string) time.Duration {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
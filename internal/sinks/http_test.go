@@ -0,0 +1,98 @@
+package sinks
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	retry := Retry{Retries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	serve := func(statuses ...int) (*httptest.Server, *int) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			status := statuses[min(requests, len(statuses)-1)]
+			requests++
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0.001")
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("body"))
+		}))
+		t.Cleanup(server.Close)
+		return server, &requests
+	}
+	get := func(server *httptest.Server) func(ctx context.Context) (*http.Request, error) {
+		return func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		}
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		server, requests := serve(http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK)
+
+		body, err := Do(context.Background(), server.Client(), retry, get(server), l)
+
+		require.NoError(t, err)
+		assert.Equal(t, "body", string(body))
+		assert.Equal(t, 3, *requests)
+	})
+	t.Run("retries exhausted", func(t *testing.T) {
+		server, requests := serve(http.StatusServiceUnavailable)
+
+		_, err := Do(context.Background(), server.Client(), retry, get(server), l)
+
+		statusErr := &StatusError{}
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+		assert.Equal(t, 3, *requests)
+	})
+	t.Run("retry after too long", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests++
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		t.Cleanup(server.Close)
+
+		_, err := Do(context.Background(), server.Client(), retry, get(server), l)
+
+		statusErr := &StatusError{}
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusTooManyRequests, statusErr.StatusCode)
+		assert.Equal(t, 1, requests)
+	})
+	t.Run("not retried", func(t *testing.T) {
+		server, requests := serve(http.StatusBadRequest)
+
+		_, err := Do(context.Background(), server.Client(), retry, get(server), l)
+
+		assert.EqualError(t, err, "400 Bad Request: body")
+		assert.Equal(t, 1, *requests)
+	})
+}
+
+func TestPostJson(t *testing.T) {
+	var contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	err := PostJson(context.Background(), server.Client(), Retry{}, server.URL, map[string]string{"text": "Hello"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", contentType)
+	assert.JSONEq(t, `{"text": "Hello"}`, body)
+}
@@ -0,0 +1,144 @@
+package jsonl
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatedTimeFormat sorts the rotated files by the time of rotation
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// File appends to the file at path, which is rotated once a write would make it exceed maxSize.
+// Rotated files are named after the time of rotation, e.g. audit-20240501T120000.000000000.jsonl,
+// and only the maxBackups newest of them are kept unless it is zero. File is not safe for concurrent use.
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	// file is nil after rotating until the next write opens the file again
+	file *os.File
+	size int64
+	now  func() time.Time
+	l    *slog.Logger
+}
+
+func NewFile(path string, maxSize int64, maxBackups int, l *slog.Logger) (*File, error) {
+	f := &File{path: path, maxSize: maxSize, maxBackups: maxBackups, now: time.Now, l: l.With("path", path)}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	if f.file != nil && f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.rotate()
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+// rotate closes the file and renames it after the current time, so that the next write starts a new one.
+// Errors are only logged, since the written lines are kept in the file if it could not be renamed,
+// and rotating is tried again by the next write.
+func (f *File) rotate() {
+	if err := f.file.Close(); err != nil {
+		f.l.Error("error closing file", "err", err)
+	}
+	f.file = nil
+	if err := f.rename(); err != nil {
+		f.l.Error("error rotating file", "err", err)
+		return
+	}
+	if err := f.removeOld(); err != nil {
+		f.l.Error("error removing rotated files", "err", err)
+	}
+}
+
+// rename renames the file after the current time, which is increased if a rotated file already has it,
+// so that no file is overwritten
+func (f *File) rename() error {
+	prefix, ext := f.rotatedName()
+	var rotated string
+	for at := f.now().UTC(); ; at = at.Add(time.Nanosecond) {
+		rotated = filepath.Join(filepath.Dir(f.path), prefix+at.Format(rotatedTimeFormat)+ext)
+		if _, err := os.Stat(rotated); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return os.Rename(f.path, rotated)
+}
+
+// removeOld removes the rotated files but the maxBackups newest ones
+func (f *File) removeOld() error {
+	if f.maxBackups == 0 {
+		return nil
+	}
+	prefix, ext := f.rotatedName()
+	dir := filepath.Dir(f.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		if _, err = time.Parse(rotatedTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	if len(rotated) <= f.maxBackups {
+		return nil
+	}
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-f.maxBackups] {
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatedName returns the file name parts preceding and following the time in the rotated file names
+func (f *File) rotatedName() (string, string) {
+	name := filepath.Base(f.path)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-", ext
+}
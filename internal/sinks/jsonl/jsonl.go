@@ -0,0 +1,52 @@
+package jsonl
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/sinks"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Jsonl writes each message as a JSON line, e.g. to stdout or to a rotating File
+type Jsonl struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+	l   *slog.Logger
+}
+
+// record is the payload of the webhook sink with the time the message was processed at
+type record struct {
+	sinks.Payload
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+func New(name string, w io.Writer, l *slog.Logger) *Jsonl {
+	return &Jsonl{w: w, now: time.Now, l: l.With("sink", name)}
+}
+
+func (j *Jsonl) Start(_ context.Context) error {
+	return nil
+}
+
+// Send writes the message with a single write, so that lines of concurrent writers are not mixed
+func (j *Jsonl) Send(ctx context.Context, message entities.Message) error {
+	line, err := jsoniter.Marshal(record{Payload: sinks.NewPayload(message), ProcessedAt: j.now().UTC()})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.w.Write(line); err != nil {
+		return err
+	}
+	j.l.DebugContext(ctx, "wrote message")
+	return nil
+}
@@ -0,0 +1,171 @@
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonl(t *testing.T) {
+	message := entities.Message{
+		HookId:      "test-hook",
+		EventId:     "event",
+		Type:        entities.MessageTypeEdit,
+		Text:        "Hello",
+		VkSenderId:  1234,
+		VkGroupId:   10,
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		VkSender:    &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		ReceivedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	buf := &bytes.Buffer{}
+	j := New("audit", buf, discardLogger())
+	j.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC) }
+	require.NoError(t, j.Start(context.Background()))
+
+	require.NoError(t, j.Send(context.Background(), message))
+	require.NoError(t, j.Send(context.Background(), message))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"event_id": "event",
+		"hook_id": "test-hook",
+		"type": "edit",
+		"text": "Hello",
+		"received_at": "2024-05-01T12:00:00Z",
+		"processed_at": "2024-05-01T12:00:01Z",
+		"vk": {
+			"group_id": 10,
+			"peer_id": 1234,
+			"message_id": 5,
+			"dialog_url": "https://vk.com/gim10?sel=1234",
+			"sender": {
+				"id": 1234,
+				"is_user": true,
+				"name": "Ivan Petrov",
+				"first_name": "Ivan",
+				"last_name": "Petrov",
+				"url": "https://vk.com/id1234"
+			}
+		},
+		"attachments": []
+	}`, lines[0])
+}
+
+func TestFile(t *testing.T) {
+	t.Run("append", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o640))
+
+		f, err := NewFile(path, 0, 0, discardLogger())
+		require.NoError(t, err)
+		_, err = f.Write([]byte("second\n"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		assert.Equal(t, "first\nsecond\n", readFile(t, path))
+	})
+	t.Run("rotate", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "audit.jsonl")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "audit-other.jsonl"), nil, 0o640))
+		f, err := NewFile(path, 10, 2, discardLogger())
+		require.NoError(t, err)
+		defer f.Close()
+		now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		f.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+
+		for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+			_, err = f.Write([]byte(line))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, "line4\n", readFile(t, path))
+		assert.Equal(t, "line2\n", readFile(t, filepath.Join(dir, "audit-20240501T120002.000000000.jsonl")))
+		assert.Equal(t, "line3\n", readFile(t, filepath.Join(dir, "audit-20240501T120003.000000000.jsonl")))
+		assert.NoFileExists(t, filepath.Join(dir, "audit-20240501T120001.000000000.jsonl"))
+		assert.FileExists(t, filepath.Join(dir, "audit-other.jsonl"))
+	})
+	t.Run("keep all", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := NewFile(filepath.Join(dir, "audit.jsonl"), 1, 0, discardLogger())
+		require.NoError(t, err)
+		defer f.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err = f.Write([]byte("line\n"))
+			require.NoError(t, err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 3)
+	})
+}
+
+func TestFileErrors(t *testing.T) {
+	t.Run("rename", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		f, err := NewFile(path, 1, 0, discardLogger())
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.Write([]byte("line1\n"))
+		require.NoError(t, err)
+		// The file can not be renamed once it was removed, e.g. by another tool
+		require.NoError(t, os.Remove(path))
+
+		for _, line := range []string{"line2\n", "line3\n"} {
+			_, err = f.Write([]byte(line))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, "line3\n", readFile(t, path))
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		assert.Len(t, entries, 2)
+	})
+	t.Run("remove", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "audit.jsonl")
+		// A directory named like a rotated file can not be removed while it is not empty
+		undeletable := filepath.Join(dir, "audit-20000101T000000.000000000.jsonl")
+		require.NoError(t, os.MkdirAll(filepath.Join(undeletable, "file"), 0o750))
+		f, err := NewFile(path, 1, 1, discardLogger())
+		require.NoError(t, err)
+		defer f.Close()
+
+		for _, line := range []string{"line1\n", "line2\n", "line3\n"} {
+			_, err = f.Write([]byte(line))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, "line3\n", readFile(t, path))
+		assert.DirExists(t, undeletable)
+	})
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,174 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/render"
+	"viktig/internal/sinks"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// postedSize is how many posted messages are remembered to be edited
+	postedSize = 10000
+	htmlFormat = "org.matrix.custom.html"
+)
+
+// Matrix posts messages to a Matrix room via the client-server API. Edits of VK messages replace the posted messages.
+type Matrix struct {
+	homeserverUrl string
+	accessToken   string
+	roomId        string
+	client        *http.Client
+	retry         sinks.Retry
+	posted        *sinks.IdMap
+	// txnPrefix and txnCounter make the transaction IDs unique across restarts
+	txnPrefix  string
+	txnCounter atomic.Int64
+	l          *slog.Logger
+}
+
+func New(name string, homeserverUrl string, accessToken string, roomId string, l *slog.Logger) *Matrix {
+	retry := sinks.DefaultRetry
+	retry.RetryAfter = retryAfter
+	return &Matrix{
+		homeserverUrl: strings.TrimSuffix(homeserverUrl, "/"),
+		accessToken:   accessToken,
+		roomId:        roomId,
+		client:        sinks.NewHttpClient(name),
+		retry:         retry,
+		posted:        sinks.NewIdMap(postedSize),
+		txnPrefix:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		l:             l.With("sink", name),
+	}
+}
+
+// Start checks the access token and joins the room, which the user must be invited to unless it already joined
+func (m *Matrix) Start(ctx context.Context) error {
+	whoami := struct {
+		UserId string `json:"user_id"`
+	}{}
+	if err := m.do(ctx, http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return fmt.Errorf("matrix auth error: %w", err)
+	}
+	if err := m.do(ctx, http.MethodPost, "/join/"+url.PathEscape(m.roomId), struct{}{}, nil); err != nil {
+		return fmt.Errorf("matrix join error: %w", err)
+	}
+	m.l.Info("joined matrix room", "userId", whoami.UserId, "roomId", m.roomId)
+	return nil
+}
+
+// Send posts the message, or replaces the posted one if the message is an edit
+func (m *Matrix) Send(ctx context.Context, message entities.Message) error {
+	content := newContent(message)
+	key := sinks.MessageKey(message)
+	originalId, edit := m.posted.Get(key)
+	edit = edit && key != "" && message.Type == entities.MessageTypeEdit
+	if edit {
+		content = replacement(content, originalId)
+	}
+
+	// The transaction ID is kept across retries, so that the homeserver does not post the message twice
+	txnId := m.txnPrefix + "-" + strconv.FormatInt(m.txnCounter.Add(1), 10)
+	sent := struct {
+		EventId string `json:"event_id"`
+	}{}
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(m.roomId), txnId)
+	if err := m.do(ctx, http.MethodPut, path, content, &sent); err != nil {
+		return err
+	}
+	m.l.InfoContext(ctx, "sent matrix message", "eventId", sent.EventId, "edit", edit)
+	// Edits refer to the original event, so only new messages are remembered
+	if key != "" && !edit {
+		m.posted.Put(key, sent.EventId)
+	}
+	return nil
+}
+
+// do sends a request to the client-server API, decoding the response into result if it is not nil
+func (m *Matrix) do(ctx context.Context, method string, path string, payload any, result any) error {
+	request := sinks.JsonRequest{
+		Method:  method,
+		Url:     m.homeserverUrl + "/_matrix/client/v3" + path,
+		Header:  http.Header{"Authorization": {"Bearer " + m.accessToken}},
+		Payload: payload,
+		Result:  result,
+	}
+	err := sinks.DoJson(ctx, m.client, m.retry, request, m.l)
+	var statusErr *sinks.StatusError
+	if errors.As(err, &statusErr) {
+		return apiError(statusErr)
+	}
+	return err
+}
+
+// retryAfter returns how long the homeserver asks to wait, which older homeservers only tell in the body
+func retryAfter(body []byte) time.Duration {
+	limited := struct {
+		RetryAfterMs int64 `json:"retry_after_ms"`
+	}{}
+	if err := jsoniter.Unmarshal(body, &limited); err == nil && limited.RetryAfterMs > 0 {
+		return time.Duration(limited.RetryAfterMs) * time.Millisecond
+	}
+	return 0
+}
+
+// apiError includes the Matrix error code and message if the response has them
+func apiError(statusErr *sinks.StatusError) error {
+	matrixErr := struct {
+		ErrCode string `json:"errcode"`
+		Error   string `json:"error"`
+	}{}
+	if err := jsoniter.Unmarshal([]byte(statusErr.Body), &matrixErr); err == nil && matrixErr.ErrCode != "" {
+		return fmt.Errorf("%s: %s: %s", statusErr.Status, matrixErr.ErrCode, matrixErr.Error)
+	}
+	return statusErr
+}
+
+type content struct {
+	MsgType       string     `json:"msgtype"`
+	Body          string     `json:"body"`
+	Format        string     `json:"format"`
+	FormattedBody string     `json:"formatted_body"`
+	NewContent    *content   `json:"m.new_content,omitempty"`
+	RelatesTo     *relatesTo `json:"m.relates_to,omitempty"`
+}
+
+type relatesTo struct {
+	RelType string `json:"rel_type"`
+	EventId string `json:"event_id"`
+}
+
+// newContent renders the message like for Telegram, with line breaks since HTML ignores newlines
+func newContent(message entities.Message) content {
+	return content{
+		MsgType:       "m.text",
+		Body:          render.Text(message),
+		Format:        htmlFormat,
+		FormattedBody: strings.ReplaceAll(render.Html(message), "\n", "<br>"),
+	}
+}
+
+// replacement makes the content an m.replace edit of the event, with a fallback for clients not supporting edits
+func replacement(c content, eventId string) content {
+	newContent := c
+	return content{
+		MsgType:       c.MsgType,
+		Body:          "* " + c.Body,
+		Format:        c.Format,
+		FormattedBody: "* " + c.FormattedBody,
+		NewContent:    &newContent,
+		RelatesTo:     &relatesTo{RelType: "m.replace", EventId: eventId},
+	}
+}
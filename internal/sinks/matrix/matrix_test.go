@@ -0,0 +1,179 @@
+package matrix
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRoomId = "!room:example.com"
+
+func TestMatrix(t *testing.T) {
+	message := entities.Message{
+		HookId:      "test-hook",
+		Type:        entities.MessageTypeNew,
+		Text:        "Hello <world>",
+		VkSenderId:  1234,
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		VkSender:    &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		Attachments: []entities.Attachment{{Type: "doc", Url: "https://vk.com/doc1", Title: "file.pdf"}},
+	}
+
+	t.Run("start", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+
+		require.NoError(t, newTestMatrix(server, "token").Start(context.Background()))
+
+		assert.Equal(t, []string{testRoomId}, server.joined)
+		assert.ErrorContains(t, newTestMatrix(server, "wrong").Start(context.Background()), "M_UNKNOWN_TOKEN")
+	})
+	t.Run("message", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+
+		require.NoError(t, newTestMatrix(server, "token").Send(context.Background(), message))
+
+		require.Len(t, server.events, 1)
+		assert.Equal(t, content{
+			MsgType: "m.text",
+			Body:    "👤 Ivan Petrov (https://vk.com/id1234)\n💬 Hello <world>\n📎 file.pdf: https://vk.com/doc1",
+			Format:  "org.matrix.custom.html",
+			FormattedBody: "👤 <a href=\"https://vk.com/id1234\">Ivan Petrov</a><br>💬 Hello &lt;world&gt;<br>" +
+				"📎 <a href=\"https://vk.com/doc1\">file.pdf</a>",
+		}, server.events[0])
+	})
+	t.Run("edit", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+		m := newTestMatrix(server, "token")
+		edit := message
+		edit.Type = entities.MessageTypeEdit
+		edit.Text = "Edited"
+
+		require.NoError(t, m.Send(context.Background(), message))
+		require.NoError(t, m.Send(context.Background(), edit))
+		require.NoError(t, m.Send(context.Background(), edit))
+
+		require.Len(t, server.events, 3)
+		for _, event := range server.events[1:] {
+			assert.Equal(t, &relatesTo{RelType: "m.replace", EventId: "$1"}, event.RelatesTo)
+			require.NotNil(t, event.NewContent)
+			assert.Contains(t, event.NewContent.Body, "✏️ Edited")
+			assert.Nil(t, event.NewContent.RelatesTo)
+			assert.True(t, strings.HasPrefix(event.Body, "* "))
+		}
+	})
+	t.Run("edit of unknown message", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+		edit := message
+		edit.Type = entities.MessageTypeEdit
+
+		require.NoError(t, newTestMatrix(server, "token").Send(context.Background(), edit))
+
+		require.Len(t, server.events, 1)
+		assert.Nil(t, server.events[0].RelatesTo)
+	})
+	t.Run("rate limit", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+		server.limited = 1
+
+		require.NoError(t, newTestMatrix(server, "token").Send(context.Background(), message))
+
+		assert.Len(t, server.events, 1)
+		assert.Equal(t, 1, len(server.txnIds))
+	})
+	t.Run("server error", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+		server.failing = 1
+
+		require.NoError(t, newTestMatrix(server, "token").Send(context.Background(), message))
+
+		assert.Len(t, server.events, 1)
+		assert.Equal(t, 1, len(server.txnIds))
+	})
+	t.Run("error", func(t *testing.T) {
+		server := newFakeHomeserver(t)
+
+		err := newTestMatrix(server, "wrong").Send(context.Background(), message)
+
+		assert.EqualError(t, err, "401 Unauthorized: M_UNKNOWN_TOKEN: Invalid access token")
+	})
+}
+
+func newTestMatrix(server *fakeHomeserver, accessToken string) *Matrix {
+	m := New("matrix", server.server.URL+"/", accessToken, testRoomId, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	m.retry.InitialBackoff = time.Millisecond
+	return m
+}
+
+// fakeHomeserver implements the client-server API endpoints used by the sink
+type fakeHomeserver struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	joined []string
+	events []content
+	// txnIds are the transaction IDs of the events, retried requests reuse them
+	txnIds map[string]bool
+	// limited is how many requests are rejected with M_LIMIT_EXCEEDED
+	limited int
+	// failing is how many sent events are rejected with "Bad Gateway"
+	failing int
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	s := &fakeHomeserver{txnIds: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_matrix/client/v3/account/whoami", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"user_id":"@viktig:example.com"}`))
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/join/{roomId}", func(w http.ResponseWriter, r *http.Request) {
+		s.joined = append(s.joined, r.PathValue("roomId"))
+		_, _ = w.Write([]byte(`{"room_id":"` + r.PathValue("roomId") + `"}`))
+	})
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{roomId}/send/m.room.message/{txnId}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("roomId") != testRoomId {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))
+			return
+		}
+		s.txnIds[r.PathValue("txnId")] = true
+		if s.failing > 0 {
+			s.failing--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if s.limited > 0 {
+			s.limited--
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":10}`))
+			return
+		}
+		event := content{}
+		_ = jsoniter.NewDecoder(r.Body).Decode(&event)
+		s.events = append(s.events, event)
+		_, _ = w.Write([]byte(`{"event_id":"$` + strconv.Itoa(len(s.events)) + `"}`))
+	})
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
@@ -0,0 +1,108 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"viktig/internal/entities"
+	"viktig/internal/render"
+	"viktig/internal/sinks"
+)
+
+const (
+	// maxTextLength keeps the attachment text within the Mattermost post size limit
+	maxTextLength = 16383
+	// maxImages limits the attachments showing images
+	maxImages = 4
+)
+
+// Mattermost posts messages with an incoming webhook as message attachments with Markdown text, edits as new posts
+type Mattermost struct {
+	webhookUrl string
+	username   string
+	channel    string
+	client     *http.Client
+	retry      sinks.Retry
+	l          *slog.Logger
+}
+
+// New creates the sink posting with webhookUrl. The username and the channel override the webhook settings if set,
+// which Mattermost only allows if enabled for integrations.
+func New(name string, webhookUrl string, username string, channel string, l *slog.Logger) *Mattermost {
+	return &Mattermost{
+		webhookUrl: webhookUrl,
+		username:   username,
+		channel:    channel,
+		client:     sinks.NewHttpClient(name),
+		retry:      sinks.DefaultRetry,
+		l:          l.With("sink", name),
+	}
+}
+
+// Start does nothing, the webhook is only checked by the first post
+func (m *Mattermost) Start(_ context.Context) error {
+	return nil
+}
+
+// Send posts the message
+func (m *Mattermost) Send(ctx context.Context, message entities.Message) error {
+	if err := sinks.PostJson(ctx, m.client, m.retry, m.webhookUrl, m.render(message), m.l); err != nil {
+		return err
+	}
+	m.l.InfoContext(ctx, "posted mattermost message")
+	return nil
+}
+
+type payload struct {
+	Username    string       `json:"username,omitempty"`
+	Channel     string       `json:"channel,omitempty"`
+	Attachments []attachment `json:"attachments"`
+}
+
+type attachment struct {
+	Fallback   string `json:"fallback"`
+	Color      string `json:"color,omitempty"`
+	AuthorName string `json:"author_name,omitempty"`
+	AuthorLink string `json:"author_link,omitempty"`
+	Text       string `json:"text,omitempty"`
+	ImageUrl   string `json:"image_url,omitempty"`
+}
+
+// render makes an attachment with the sender, the text and the links, and adds attachments for the images after the first one
+func (m *Mattermost) render(message entities.Message) payload {
+	main := attachment{
+		Fallback:   render.Text(message),
+		Color:      fmt.Sprintf("#%06x", render.Color(message)),
+		AuthorName: message.SenderName(),
+		AuthorLink: message.SenderUrl(),
+	}
+	lines := []string{render.Icon(message) + " " + render.EscapeMarkdown(message.Text)}
+	var images []string
+	for _, a := range message.Attachments {
+		switch {
+		case a.IsImage() && len(images) < maxImages:
+			images = append(images, a.Url)
+		case a.Url != "":
+			lines = append(lines, fmt.Sprintf("📎 [%s](%s)", render.EscapeMarkdown(a.Name()), a.Url))
+		default:
+			lines = append(lines, "📎 "+render.EscapeMarkdown(a.Name()))
+		}
+	}
+	if dialogUrl := message.DialogUrl(); dialogUrl != "" {
+		lines = append(lines, fmt.Sprintf("[Open dialog](%s)", dialogUrl))
+	}
+	main.Text = render.Truncate(strings.Join(lines, "\n"), maxTextLength)
+
+	attachments := []attachment{main}
+	for i, image := range images {
+		if i == 0 {
+			attachments[0].ImageUrl = image
+			continue
+		}
+		attachments = append(attachments, attachment{Fallback: "📎 " + image, Color: main.Color, ImageUrl: image})
+	}
+	return payload{Username: m.username, Channel: m.channel, Attachments: attachments}
+}
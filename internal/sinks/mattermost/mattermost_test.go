@@ -0,0 +1,101 @@
+package mattermost
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/sinks"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMattermost(t *testing.T) {
+	message := entities.Message{
+		HookId:     "test-hook",
+		Type:       entities.MessageTypeEdit,
+		Text:       "Hello *world*",
+		VkSenderId: -10,
+		Attachments: []entities.Attachment{
+			{Type: "photo", Url: "https://vk.com/1.jpg"},
+			{Type: "link", Url: "https://example.com", Title: "Example"},
+			{Type: "photo", Url: "https://vk.com/2.jpg"},
+		},
+	}
+
+	t.Run("attachments", func(t *testing.T) {
+		webhook := newFakeWebhook(t)
+
+		require.NoError(t, newTestMattermost(webhook.server.URL).Send(context.Background(), message))
+
+		require.Len(t, webhook.payloads, 1)
+		p := webhook.payloads[0]
+		assert.Equal(t, "viktig", p.Username)
+		assert.Equal(t, "town-square", p.Channel)
+		require.Len(t, p.Attachments, 2)
+		assert.Equal(t, attachment{
+			Fallback:   "👤 10 (https://vk.com/club10)\n✏️ Hello *world*\n📎 photo: https://vk.com/1.jpg\n📎 Example: https://example.com\n📎 photo: https://vk.com/2.jpg",
+			Color:      "#ffa000",
+			AuthorName: "10",
+			AuthorLink: "https://vk.com/club10",
+			Text:       "✏️ Hello \\*world\\*\n📎 [Example](https://example.com)",
+			ImageUrl:   "https://vk.com/1.jpg",
+		}, p.Attachments[0])
+		assert.Equal(t, "https://vk.com/2.jpg", p.Attachments[1].ImageUrl)
+	})
+	t.Run("retry", func(t *testing.T) {
+		webhook := newFakeWebhook(t)
+		webhook.statuses = []int{http.StatusBadGateway}
+
+		require.NoError(t, newTestMattermost(webhook.server.URL).Send(context.Background(), message))
+
+		assert.Len(t, webhook.payloads, 2)
+	})
+	t.Run("error", func(t *testing.T) {
+		webhook := newFakeWebhook(t)
+		webhook.statuses = []int{http.StatusBadRequest}
+
+		err := newTestMattermost(webhook.server.URL).Send(context.Background(), message)
+
+		assert.ErrorContains(t, err, "400 Bad Request")
+		assert.Len(t, webhook.payloads, 1)
+	})
+}
+
+func newTestMattermost(webhookUrl string) *Mattermost {
+	m := New("mattermost", webhookUrl, "viktig", "town-square", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	m.retry = sinks.Retry{Retries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	return m
+}
+
+// fakeWebhook responds like a Mattermost incoming webhook, with the statuses in order before succeeding
+type fakeWebhook struct {
+	server   *httptest.Server
+	payloads []payload
+	statuses []int
+}
+
+func newFakeWebhook(t *testing.T) *fakeWebhook {
+	w := &fakeWebhook{}
+	w.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p := payload{}
+		_ = jsoniter.NewDecoder(r.Body).Decode(&p)
+		w.payloads = append(w.payloads, p)
+		if len(w.statuses) > 0 {
+			status := w.statuses[0]
+			w.statuses = w.statuses[1:]
+			rw.WriteHeader(status)
+			_, _ = rw.Write([]byte(`{"id":"web.incoming_webhook.error","message":"Unable to parse incoming data."}`))
+			return
+		}
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	t.Cleanup(w.server.Close)
+	return w
+}
@@ -0,0 +1,80 @@
+package sinks
+
+import (
+	"time"
+
+	"viktig/internal/entities"
+)
+
+// PayloadVersion is increased on incompatible changes of Payload
+const PayloadVersion = 1
+
+// Payload is the versioned JSON representation of a message. Fields are only added within a version.
+type Payload struct {
+	Version     int          `json:"version"`
+	EventId     string       `json:"event_id"`
+	HookId      string       `json:"hook_id"`
+	Type        string       `json:"type"`
+	Text        string       `json:"text"`
+	ReceivedAt  time.Time    `json:"received_at"`
+	Vk          vkPayload    `json:"vk"`
+	Attachments []attachment `json:"attachments"`
+}
+
+type vkPayload struct {
+	GroupId int `json:"group_id"`
+	PeerId  int `json:"peer_id"`
+	// MessageId is the ID of the message within its conversation, the same for the new message and its edits
+	MessageId int           `json:"message_id"`
+	DialogUrl string        `json:"dialog_url,omitempty"`
+	Sender    senderPayload `json:"sender"`
+}
+
+type senderPayload struct {
+	// Id is negative for communities
+	Id        int    `json:"id"`
+	IsUser    bool   `json:"is_user"`
+	Name      string `json:"name"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Url       string `json:"url"`
+}
+
+type attachment struct {
+	Type  string `json:"type"`
+	Url   string `json:"url,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+func NewPayload(message entities.Message) Payload {
+	sender := senderPayload{
+		Id:     message.VkSenderId,
+		IsUser: message.IsFromUser(),
+		Name:   message.SenderName(),
+		Url:    message.SenderUrl(),
+	}
+	if message.VkSender != nil {
+		sender.FirstName = message.VkSender.FirstName
+		sender.LastName = message.VkSender.LastName
+	}
+	attachments := make([]attachment, 0, len(message.Attachments))
+	for _, a := range message.Attachments {
+		attachments = append(attachments, attachment{Type: a.Type, Url: a.Url, Title: a.Title})
+	}
+	return Payload{
+		Version:    PayloadVersion,
+		EventId:    message.EventId,
+		HookId:     message.HookId,
+		Type:       message.Type.String(),
+		Text:       message.Text,
+		ReceivedAt: message.ReceivedAt.UTC(),
+		Vk: vkPayload{
+			GroupId:   message.VkGroupId,
+			PeerId:    message.VkPeerId,
+			MessageId: message.VkMessageId,
+			DialogUrl: message.DialogUrl(),
+			Sender:    sender,
+		},
+		Attachments: attachments,
+	}
+}
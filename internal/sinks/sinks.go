@@ -0,0 +1,80 @@
+package sinks
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Telegram is the name of the built-in sink forwarding messages to the community Telegram chat
+const Telegram = "telegram"
+
+// requestTimeout limits each request to a sink
+const requestTimeout = 30 * time.Second
+
+// Sink is a destination besides Telegram that messages are forwarded to
+type Sink interface {
+	// Start checks that the sink is reachable
+	Start(ctx context.Context) error
+	Send(ctx context.Context, message entities.Message) error
+}
+
+// NewHttpClient returns a client observing the request durations of the sink.
+// Requests are labeled by HTTP method, since the URLs of webhooks contain secrets.
+func NewHttpClient(sink string) *http.Client {
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &metrics.InstrumentedTransport{
+			Duration: metrics.SinkRequestDuration.MustCurryWith(prometheus.Labels{"sink": sink}),
+			Method:   func(req *http.Request) string { return req.Method },
+		},
+	}
+}
+
+// MessageKey identifies the VK message across its edits, or returns an empty string if its ID is unknown
+func MessageKey(message entities.Message) string {
+	if message.VkMessageId == 0 {
+		return ""
+	}
+	return message.HookId + ":" + strconv.Itoa(message.VkPeerId) + ":" + strconv.Itoa(message.VkMessageId)
+}
+
+// IdMap keeps the IDs of the messages posted to a sink by their MessageKey, so that edits can update them.
+// The oldest IDs are evicted once size is reached.
+type IdMap struct {
+	mu    sync.Mutex
+	size  int
+	ids   map[string]string
+	order []string
+}
+
+func NewIdMap(size int) *IdMap {
+	return &IdMap{size: size, ids: make(map[string]string, size)}
+}
+
+func (m *IdMap) Get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.ids[key]
+	return id, ok
+}
+
+func (m *IdMap) Put(key string, id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.ids[key]; !ok {
+		if len(m.order) >= m.size {
+			delete(m.ids, m.order[0])
+			m.order = m.order[1:]
+		}
+		m.order = append(m.order, key)
+	}
+	m.ids[key] = id
+}
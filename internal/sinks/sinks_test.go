@@ -0,0 +1,29 @@
+package sinks
+
+import (
+	"testing"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdMap(t *testing.T) {
+	m := NewIdMap(2)
+	m.Put("a", "1")
+	m.Put("b", "2")
+	m.Put("a", "3")
+	m.Put("c", "4")
+
+	_, ok := m.Get("a")
+	assert.False(t, ok)
+	for key, expected := range map[string]string{"b": "2", "c": "4"} {
+		id, ok := m.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, expected, id)
+	}
+}
+
+func TestMessageKey(t *testing.T) {
+	assert.Equal(t, "test-hook:1234:5", MessageKey(entities.Message{HookId: "test-hook", VkPeerId: 1234, VkMessageId: 5}))
+	assert.Empty(t, MessageKey(entities.Message{HookId: "test-hook", VkPeerId: 1234}))
+}
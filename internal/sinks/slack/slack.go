@@ -0,0 +1,114 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"viktig/internal/entities"
+	"viktig/internal/render"
+	"viktig/internal/sinks"
+)
+
+const (
+	// maxSectionLength is the Slack limit of the section block text in characters
+	maxSectionLength = 3000
+	// maxImages limits the image blocks of a message
+	maxImages = 4
+)
+
+var mrkdwnEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Slack posts messages with an incoming webhook as Block Kit blocks.
+// Incoming webhooks can not update messages, so edits are posted as new messages.
+type Slack struct {
+	webhookUrl string
+	client     *http.Client
+	retry      sinks.Retry
+	l          *slog.Logger
+}
+
+func New(name string, webhookUrl string, l *slog.Logger) *Slack {
+	return &Slack{
+		webhookUrl: webhookUrl,
+		client:     sinks.NewHttpClient(name),
+		retry:      sinks.DefaultRetry,
+		l:          l.With("sink", name),
+	}
+}
+
+// Start does nothing, since incoming webhooks can not be checked without posting a message
+func (s *Slack) Start(_ context.Context) error {
+	return nil
+}
+
+// Send posts the message, retrying on 429 and 5xx responses
+func (s *Slack) Send(ctx context.Context, message entities.Message) error {
+	if err := sinks.PostJson(ctx, s.client, s.retry, s.webhookUrl, renderPayload(message), s.l); err != nil {
+		return err
+	}
+	s.l.InfoContext(ctx, "posted slack message")
+	return nil
+}
+
+type payload struct {
+	// Text is shown in notifications, it is mrkdwn too, so <!channel> in it would mention the channel unless escaped
+	Text        string  `json:"text"`
+	Blocks      []block `json:"blocks"`
+	UnfurlLinks bool    `json:"unfurl_links"`
+	UnfurlMedia bool    `json:"unfurl_media"`
+}
+
+type block struct {
+	Type     string       `json:"type"`
+	Text     *textObject  `json:"text,omitempty"`
+	Elements []textObject `json:"elements,omitempty"`
+	ImageUrl string       `json:"image_url,omitempty"`
+	AltText  string       `json:"alt_text,omitempty"`
+}
+
+type textObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// renderPayload makes a section with the sender and the text, an image block for each image
+// and a context block with the other attachments and the dialog link
+func renderPayload(message entities.Message) payload {
+	section := fmt.Sprintf("*%s*\n%s %s", link(message.SenderUrl(), message.SenderName()), render.Icon(message), escape(message.Text))
+	blocks := []block{{Type: "section", Text: &textObject{Type: "mrkdwn", Text: render.Truncate(section, maxSectionLength)}}}
+	var footer []textObject
+	images := 0
+	for _, attachment := range message.Attachments {
+		switch {
+		case attachment.IsImage() && images < maxImages:
+			blocks = append(blocks, block{Type: "image", ImageUrl: attachment.Url, AltText: attachment.Name()})
+			images++
+		case attachment.Url != "":
+			footer = append(footer, textObject{Type: "mrkdwn", Text: "📎 " + link(attachment.Url, attachment.Name())})
+		default:
+			footer = append(footer, textObject{Type: "mrkdwn", Text: "📎 " + escape(attachment.Name())})
+		}
+	}
+	if dialogUrl := message.DialogUrl(); dialogUrl != "" {
+		footer = append(footer, textObject{Type: "mrkdwn", Text: link(dialogUrl, "Open dialog")})
+	}
+	if len(footer) > 0 {
+		blocks = append(blocks, block{Type: "context", Elements: footer})
+	}
+	return payload{
+		Text:   render.Truncate(escape(message.SenderName()+": "+message.Text), maxSectionLength),
+		Blocks: blocks,
+	}
+}
+
+func escape(text string) string {
+	return mrkdwnEscaper.Replace(text)
+}
+
+// link makes a mrkdwn link, in which the text may not contain the separator
+func link(url string, text string) string {
+	return "<" + url + "|" + strings.ReplaceAll(escape(text), "|", "¦") + ">"
+}
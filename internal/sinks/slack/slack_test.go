@@ -0,0 +1,106 @@
+package slack
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/sinks"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlack(t *testing.T) {
+	message := entities.Message{
+		HookId:     "test-hook",
+		Type:       entities.MessageTypeNew,
+		Text:       "Is <b> & <c> ready?",
+		VkSenderId: 1234,
+		VkGroupId:  10,
+		VkPeerId:   1234,
+		VkSender:   &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		Attachments: []entities.Attachment{
+			{Type: "photo", Url: "https://vk.com/1.jpg"},
+			{Type: "doc", Url: "https://vk.com/doc1", Title: "a|b.pdf"},
+		},
+	}
+
+	t.Run("blocks", func(t *testing.T) {
+		webhook := newFakeWebhook(t)
+
+		require.NoError(t, newTestSlack(webhook.server.URL).Send(context.Background(), message))
+
+		require.Len(t, webhook.payloads, 1)
+		assert.Equal(t, payload{
+			Text: "Ivan Petrov: Is &lt;b&gt; &amp; &lt;c&gt; ready?",
+			Blocks: []block{
+				{Type: "section", Text: &textObject{
+					Type: "mrkdwn",
+					Text: "*<https://vk.com/id1234|Ivan Petrov>*\n💬 Is &lt;b&gt; &amp; &lt;c&gt; ready?",
+				}},
+				{Type: "image", ImageUrl: "https://vk.com/1.jpg", AltText: "photo"},
+				{Type: "context", Elements: []textObject{
+					{Type: "mrkdwn", Text: "📎 <https://vk.com/doc1|a¦b.pdf>"},
+					{Type: "mrkdwn", Text: "<https://vk.com/gim10?sel=1234|Open dialog>"},
+				}},
+			},
+		}, webhook.payloads[0])
+	})
+	t.Run("retry", func(t *testing.T) {
+		webhook := newFakeWebhook(t)
+		webhook.statuses = []int{http.StatusTooManyRequests, http.StatusInternalServerError}
+
+		require.NoError(t, newTestSlack(webhook.server.URL).Send(context.Background(), message))
+
+		assert.Len(t, webhook.payloads, 3)
+	})
+	t.Run("error", func(t *testing.T) {
+		webhook := newFakeWebhook(t)
+		webhook.statuses = []int{http.StatusNotFound}
+
+		err := newTestSlack(webhook.server.URL).Send(context.Background(), message)
+
+		assert.EqualError(t, err, "404 Not Found: no_service")
+		assert.Len(t, webhook.payloads, 1)
+	})
+}
+
+func newTestSlack(webhookUrl string) *Slack {
+	s := New("slack", webhookUrl, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.retry = sinks.Retry{Retries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	return s
+}
+
+// fakeWebhook responds like a Slack incoming webhook, with the statuses in order before succeeding
+type fakeWebhook struct {
+	server   *httptest.Server
+	payloads []payload
+	statuses []int
+}
+
+func newFakeWebhook(t *testing.T) *fakeWebhook {
+	w := &fakeWebhook{}
+	w.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p := payload{}
+		_ = jsoniter.NewDecoder(r.Body).Decode(&p)
+		w.payloads = append(w.payloads, p)
+		if len(w.statuses) > 0 {
+			status := w.statuses[0]
+			w.statuses = w.statuses[1:]
+			rw.WriteHeader(status)
+			if status == http.StatusNotFound {
+				_, _ = rw.Write([]byte("no_service"))
+			}
+			return
+		}
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	t.Cleanup(w.server.Close)
+	return w
+}
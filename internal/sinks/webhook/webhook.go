@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"viktig/internal/entities"
+	"viktig/internal/sinks"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Headers of the requests
+const (
+	HeaderSignature      = "X-Viktig-Signature"
+	HeaderTimestamp      = "X-Viktig-Timestamp"
+	HeaderIdempotencyKey = "Idempotency-Key"
+)
+
+// Webhook posts messages as signed JSON payloads. The signature is the hex HMAC-SHA256
+// of the timestamp header, a dot and the body, so that the receiver can reject replayed requests.
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+	retry  sinks.Retry
+	now    func() time.Time
+	l      *slog.Logger
+}
+
+// New creates the sink posting to url, each attempt limited by timeout
+func New(name string, url string, secret string, timeout time.Duration, retry sinks.Retry, l *slog.Logger) *Webhook {
+	client := sinks.NewHttpClient(name)
+	client.Timeout = timeout
+	return &Webhook{
+		url:    url,
+		secret: []byte(secret),
+		client: client,
+		retry:  retry,
+		now:    time.Now,
+		l:      l.With("sink", name),
+	}
+}
+
+// Start does nothing, since the receiver is only expected to accept the payloads
+func (w *Webhook) Start(_ context.Context) error {
+	return nil
+}
+
+// Send posts the message, retrying with backoff on network errors, 429 and 5xx responses.
+// Retries and replayed dead letters have the same idempotency key.
+func (w *Webhook) Send(ctx context.Context, message entities.Message) error {
+	body, err := jsoniter.Marshal(sinks.NewPayload(message))
+	if err != nil {
+		return err
+	}
+	key := IdempotencyKey(message)
+	_, err = sinks.Do(ctx, w.client, w.retry, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		timestamp := strconv.FormatInt(w.now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderSignature, "sha256="+Sign(w.secret, timestamp, body))
+		if key != "" {
+			req.Header.Set(HeaderIdempotencyKey, key)
+		}
+		return req, nil
+	}, w.l)
+	if err != nil {
+		return err
+	}
+	w.l.InfoContext(ctx, "posted webhook", "idempotencyKey", key)
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of the request, which receivers compute to verify it
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IdempotencyKey is unique for each VK event, since each event has a single message.
+// Falls back to a hash of the message and the time it was received at if the event ID is unknown,
+// and is empty if that time is unknown too, since edits of a message may have the same text.
+func IdempotencyKey(message entities.Message) string {
+	if message.EventId != "" {
+		return message.HookId + ":" + message.EventId
+	}
+	if message.ReceivedAt.IsZero() {
+		return ""
+	}
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(
+		hash,
+		"%d:%d:%d:%s:%d:%s",
+		message.VkPeerId,
+		message.VkMessageId,
+		message.VkSenderId,
+		message.Type,
+		message.ReceivedAt.UnixNano(),
+		message.Text,
+	)
+	return message.HookId + ":" + hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+	"viktig/internal/sinks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "secret"
+
+func TestWebhook(t *testing.T) {
+	message := entities.Message{
+		HookId:      "test-hook",
+		EventId:     "event",
+		Type:        entities.MessageTypeNew,
+		Text:        "Hello",
+		VkSenderId:  1234,
+		VkGroupId:   10,
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		VkSender:    &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		Attachments: []entities.Attachment{{Type: "doc", Url: "https://vk.com/doc1", Title: "file.pdf"}},
+		ReceivedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	retry := sinks.Retry{Retries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	t.Run("payload", func(t *testing.T) {
+		receiver := newFakeReceiver(t)
+		w := New("crm", receiver.server.URL, testSecret, time.Second, retry, discardLogger())
+		w.now = func() time.Time { return time.Unix(1714564800, 0) }
+
+		require.NoError(t, w.Send(context.Background(), message))
+
+		require.Len(t, receiver.requests, 1)
+		request := receiver.requests[0]
+		assert.True(t, request.valid)
+		assert.Equal(t, "1714564800", request.timestamp)
+		assert.Equal(t, "test-hook:event", request.idempotencyKey)
+		assert.JSONEq(t, `{
+			"version": 1,
+			"event_id": "event",
+			"hook_id": "test-hook",
+			"type": "new",
+			"text": "Hello",
+			"received_at": "2024-05-01T12:00:00Z",
+			"vk": {
+				"group_id": 10,
+				"peer_id": 1234,
+				"message_id": 5,
+				"dialog_url": "https://vk.com/gim10?sel=1234",
+				"sender": {
+					"id": 1234,
+					"is_user": true,
+					"name": "Ivan Petrov",
+					"first_name": "Ivan",
+					"last_name": "Petrov",
+					"url": "https://vk.com/id1234"
+				}
+			},
+			"attachments": [{"type": "doc", "url": "https://vk.com/doc1", "title": "file.pdf"}]
+		}`, request.body)
+	})
+	t.Run("retry", func(t *testing.T) {
+		receiver := newFakeReceiver(t)
+		receiver.statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+
+		require.NoError(t, New("crm", receiver.server.URL, testSecret, time.Second, retry, discardLogger()).Send(context.Background(), message))
+
+		require.Len(t, receiver.requests, 3)
+		for _, request := range receiver.requests {
+			assert.True(t, request.valid)
+			assert.Equal(t, "test-hook:event", request.idempotencyKey)
+		}
+	})
+	t.Run("rejected", func(t *testing.T) {
+		receiver := newFakeReceiver(t)
+
+		err := New("crm", receiver.server.URL, "wrong", time.Second, retry, discardLogger()).Send(context.Background(), message)
+
+		assert.EqualError(t, err, "401 Unauthorized: invalid signature")
+		assert.Len(t, receiver.requests, 1)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		receiver := newFakeReceiver(t)
+		receiver.delay = 100 * time.Millisecond
+
+		err := New("crm", receiver.server.URL, testSecret, 10*time.Millisecond, sinks.Retry{}, discardLogger()).
+			Send(context.Background(), message)
+
+		assert.ErrorContains(t, err, "Client.Timeout exceeded")
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	assert.Equal(t, "test-hook:event", IdempotencyKey(entities.Message{HookId: "test-hook", EventId: "event"}))
+	assert.Empty(t, IdempotencyKey(entities.Message{HookId: "test-hook", VkPeerId: 1234}))
+
+	edit := entities.Message{
+		HookId:      "test-hook",
+		Type:        entities.MessageTypeEdit,
+		Text:        "Hello",
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		ReceivedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	key := IdempotencyKey(edit)
+	assert.True(t, strings.HasPrefix(key, "test-hook:"))
+	assert.Equal(t, key, IdempotencyKey(edit))
+	nextEdit := edit
+	nextEdit.ReceivedAt = nextEdit.ReceivedAt.Add(time.Second)
+	assert.NotEqual(t, key, IdempotencyKey(nextEdit))
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+type receivedRequest struct {
+	body           string
+	timestamp      string
+	idempotencyKey string
+	// valid is whether the signature matches testSecret
+	valid bool
+}
+
+// fakeReceiver verifies the signatures like a receiver would, responding with the statuses in order before succeeding
+type fakeReceiver struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests []receivedRequest
+	statuses []int
+	delay    time.Duration
+}
+
+func newFakeReceiver(t *testing.T) *fakeReceiver {
+	r := &fakeReceiver{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(r.delay)
+		body, _ := io.ReadAll(req.Body)
+		request := receivedRequest{
+			body:           string(body),
+			timestamp:      req.Header.Get(HeaderTimestamp),
+			idempotencyKey: req.Header.Get(HeaderIdempotencyKey),
+		}
+		request.valid = req.Header.Get(HeaderSignature) == "sha256="+Sign([]byte(testSecret), request.timestamp, body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, request)
+		if !request.valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("invalid signature"))
+			return
+		}
+		if len(r.statuses) > 0 {
+			w.WriteHeader(r.statuses[0])
+			r.statuses = r.statuses[1:]
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
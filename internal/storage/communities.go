@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"viktig/internal/config"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func (s *Storage) ListCommunities(ctx context.Context) ([]*config.CommunityConfig, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT config FROM communities ORDER BY hook_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var communities []*config.CommunityConfig
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		community := &config.CommunityConfig{}
+		if err = jsoniter.UnmarshalFromString(data, community); err != nil {
+			return nil, err
+		}
+		communities = append(communities, community)
+	}
+	return communities, rows.Err()
+}
+
+func (s *Storage) GetCommunity(ctx context.Context, hookId string) (*config.CommunityConfig, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, "SELECT config FROM communities WHERE hook_id = ?", hookId).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	community := &config.CommunityConfig{}
+	if err = jsoniter.UnmarshalFromString(data, community); err != nil {
+		return nil, err
+	}
+	return community, nil
+}
+
+// configCommunityPrefix is the metadata key prefix of the communities last applied from the config file
+const configCommunityPrefix = "config_community/"
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// SaveCommunity creates or replaces the community with the same hook ID
+func (s *Storage) SaveCommunity(ctx context.Context, community *config.CommunityConfig) error {
+	_, err := saveCommunity(ctx, s.db, community)
+	return err
+}
+
+// AppliedConfigCommunities returns the communities last saved with ApplyConfigCommunities by hook ID,
+// even if they were changed or deleted since then
+func (s *Storage) AppliedConfigCommunities(ctx context.Context) (map[string]*config.CommunityConfig, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT value FROM metadata WHERE substr(key, 1, length(?1)) = ?1", configCommunityPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	communities := make(map[string]*config.CommunityConfig)
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		community := &config.CommunityConfig{}
+		if err = jsoniter.UnmarshalFromString(data, community); err != nil {
+			return nil, err
+		}
+		communities[community.HookId] = community
+	}
+	return communities, rows.Err()
+}
+
+// ApplyConfigCommunities saves the communities from the config file and records them as applied in one transaction
+func (s *Storage) ApplyConfigCommunities(ctx context.Context, communities []*config.CommunityConfig) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, community := range communities {
+		data, err := saveCommunity(ctx, tx, community)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO metadata (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value",
+			configCommunityPrefix+community.HookId,
+			data,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// saveCommunity saves the community and returns it as stored
+func saveCommunity(ctx context.Context, db execer, community *config.CommunityConfig) (string, error) {
+	data, err := jsoniter.MarshalToString(community)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		"INSERT INTO communities (hook_id, config) VALUES (?, ?) ON CONFLICT (hook_id) DO UPDATE SET config = excluded.config",
+		community.HookId,
+		data,
+	)
+	return data, err
+}
+
+func (s *Storage) DeleteCommunity(ctx context.Context, hookId string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM communities WHERE hook_id = ?", hookId)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
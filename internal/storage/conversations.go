@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Conversation is a VK conversation waiting for a community reply
+type Conversation struct {
+	HookId       string
+	VkPeerId     int
+	VkGroupId    int
+	VkSenderName string
+	// OpenedAt is when the first unanswered message was received
+	OpenedAt time.Time
+	// Reminders is the number of reminders posted about the conversation
+	Reminders int
+}
+
+// ListConversations returns the open conversations, the oldest first
+func (s *Storage) ListConversations(ctx context.Context) ([]Conversation, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT hook_id, vk_peer_id, vk_group_id, vk_sender_name, opened_at, reminders
+		FROM conversations ORDER BY opened_at, hook_id, vk_peer_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	for rows.Next() {
+		var conversation Conversation
+		var openedAt int64
+		err = rows.Scan(
+			&conversation.HookId,
+			&conversation.VkPeerId,
+			&conversation.VkGroupId,
+			&conversation.VkSenderName,
+			&openedAt,
+			&conversation.Reminders,
+		)
+		if err != nil {
+			return nil, err
+		}
+		conversation.OpenedAt = time.UnixMilli(openedAt).UTC()
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// SaveConversation creates or replaces the conversation
+func (s *Storage) SaveConversation(ctx context.Context, conversation Conversation) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO conversations (hook_id, vk_peer_id, vk_group_id, vk_sender_name, opened_at, reminders)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hook_id, vk_peer_id) DO UPDATE SET
+			vk_group_id = excluded.vk_group_id,
+			vk_sender_name = excluded.vk_sender_name,
+			opened_at = excluded.opened_at,
+			reminders = excluded.reminders`,
+		conversation.HookId,
+		conversation.VkPeerId,
+		conversation.VkGroupId,
+		conversation.VkSenderName,
+		conversation.OpenedAt.UnixMilli(),
+		conversation.Reminders,
+	)
+	return err
+}
+
+// DeleteConversation removes the conversation if it is open
+func (s *Storage) DeleteConversation(ctx context.Context, hookId string, vkPeerId int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM conversations WHERE hook_id = ? AND vk_peer_id = ?", hookId, vkPeerId)
+	return err
+}
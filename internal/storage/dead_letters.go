@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"viktig/internal/entities"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const defaultDeadLettersLimit = 100
+
+// DeadLetter is a message that could not be forwarded
+type DeadLetter struct {
+	Id            int64     `json:"id"`
+	HookId        string    `json:"hook_id"`
+	EventId       string    `json:"event_id"`
+	Type          string    `json:"type"`
+	Text          string    `json:"text"`
+	VkSenderId    int       `json:"vk_sender_id"`
+	Reason        string    `json:"reason"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	// Message is the message to replay, with DeadLetterId set
+	Message entities.Message `json:"-"`
+}
+
+// DeadLetterFilter selects dead letters, zero fields are ignored
+type DeadLetterFilter struct {
+	Ids []int64
+	// AfterId is the ID of the last dead letter on the previous page
+	AfterId int64
+	Limit   int
+}
+
+// storedMessage is the part of entities.Message needed to replay it
+type storedMessage struct {
+	EventId     string                `json:"event_id"`
+	HookId      string                `json:"hook_id"`
+	Type        int                   `json:"type"`
+	Text        string                `json:"text"`
+	VkSenderId  int                   `json:"vk_sender_id"`
+	VkGroupId   int                   `json:"vk_group_id,omitempty"`
+	VkPeerId    int                   `json:"vk_peer_id,omitempty"`
+	VkMessageId int                   `json:"vk_message_id,omitempty"`
+	VkSender    *entities.VkUser      `json:"vk_sender"`
+	Attachments []entities.Attachment `json:"attachments,omitempty"`
+	ReceivedAt  time.Time             `json:"received_at"`
+	Sink        string                `json:"sink,omitempty"`
+}
+
+func marshalMessage(message entities.Message) (string, error) {
+	return jsoniter.MarshalToString(storedMessage{
+		EventId:     message.EventId,
+		HookId:      message.HookId,
+		Type:        int(message.Type),
+		Text:        message.Text,
+		VkSenderId:  message.VkSenderId,
+		VkGroupId:   message.VkGroupId,
+		VkPeerId:    message.VkPeerId,
+		VkMessageId: message.VkMessageId,
+		VkSender:    message.VkSender,
+		Attachments: message.Attachments,
+		ReceivedAt:  message.ReceivedAt,
+		Sink:        message.Sink,
+	})
+}
+
+func (stored storedMessage) message() entities.Message {
+	return entities.Message{
+		HookId:      stored.HookId,
+		EventId:     stored.EventId,
+		Type:        entities.MessageType(stored.Type),
+		Text:        stored.Text,
+		VkSenderId:  stored.VkSenderId,
+		VkGroupId:   stored.VkGroupId,
+		VkPeerId:    stored.VkPeerId,
+		VkMessageId: stored.VkMessageId,
+		VkSender:    stored.VkSender,
+		Attachments: stored.Attachments,
+		ReceivedAt:  stored.ReceivedAt,
+		Sink:        stored.Sink,
+	}
+}
+
+// AddDeadLetter stores a message that could not be forwarded.
+// If the message is a replayed dead letter, its attempt is recorded instead.
+func (s *Storage) AddDeadLetter(ctx context.Context, message entities.Message, reason string, errText string) error {
+	now := time.Now().UnixMilli()
+	if message.DeadLetterId != 0 {
+		res, err := s.db.ExecContext(
+			ctx,
+			"UPDATE dead_letters SET reason = ?, error = ?, attempts = attempts + 1, last_failed_at = ? WHERE id = ?",
+			reason,
+			errText,
+			now,
+			message.DeadLetterId,
+		)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected > 0 {
+			return err
+		}
+		// The dead letter was removed while the message was being replayed
+	}
+
+	data, err := marshalMessage(message)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(
+		ctx,
+		`INSERT INTO dead_letters (hook_id, message, reason, error, attempts, first_failed_at, last_failed_at)
+		VALUES (?, ?, ?, ?, 1, ?, ?)`,
+		message.HookId,
+		data,
+		reason,
+		errText,
+		now,
+		now,
+	)
+	return err
+}
+
+// RemoveDeadLetter removes a dead letter after it was replayed
+func (s *Storage) RemoveDeadLetter(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = ?", id)
+	return err
+}
+
+// ListDeadLetters returns the dead letters matching filter in the order they were added
+func (s *Storage) ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	conditions := []string{"id > ?"}
+	args := []any{filter.AfterId}
+	if len(filter.Ids) > 0 {
+		conditions = append(conditions, fmt.Sprintf("id IN (?%s)", strings.Repeat(", ?", len(filter.Ids)-1)))
+		for _, id := range filter.Ids {
+			args = append(args, id)
+		}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultDeadLettersLimit
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT id, message, reason, error, attempts, first_failed_at, last_failed_at
+			FROM dead_letters WHERE %s ORDER BY id LIMIT ?`,
+			strings.Join(conditions, " AND "),
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]*DeadLetter, 0)
+	for rows.Next() {
+		letter := &DeadLetter{}
+		var data string
+		var firstFailedAt, lastFailedAt int64
+		if err = rows.Scan(
+			&letter.Id, &data, &letter.Reason, &letter.Error, &letter.Attempts, &firstFailedAt, &lastFailedAt,
+		); err != nil {
+			return nil, err
+		}
+		stored := storedMessage{}
+		if err = jsoniter.UnmarshalFromString(data, &stored); err != nil {
+			return nil, fmt.Errorf("dead letter %d: %w", letter.Id, err)
+		}
+		letter.Message = stored.message()
+		letter.Message.DeadLetterId = letter.Id
+		letter.HookId = stored.HookId
+		letter.EventId = stored.EventId
+		letter.Type = letter.Message.Type.String()
+		letter.Text = stored.Text
+		letter.VkSenderId = stored.VkSenderId
+		letter.FirstFailedAt = time.UnixMilli(firstFailedAt).UTC()
+		letter.LastFailedAt = time.UnixMilli(lastFailedAt).UTC()
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// PurgeDeadLetters removes all dead letters. Returns the number of removed ones.
+func (s *Storage) PurgeDeadLetters(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM dead_letters")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
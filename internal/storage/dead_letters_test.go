@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	message := entities.Message{
+		EventId:     "event",
+		HookId:      "test-hook",
+		Type:        entities.MessageTypeEdit,
+		Text:        "Hello",
+		VkSenderId:  1234,
+		VkGroupId:   10,
+		VkPeerId:    1234,
+		VkMessageId: 5,
+		VkSender:    &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+		Attachments: []entities.Attachment{{Type: "photo", Url: "https://vk.com/x.jpg"}},
+		ReceivedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Sink:        "discord",
+	}
+
+	t.Run("add and replay", func(t *testing.T) {
+		s := openTestStorage(t)
+		require.NoError(t, s.AddDeadLetter(ctx, message, "telegram_error", "error"))
+		letters, err := s.ListDeadLetters(ctx, DeadLetterFilter{})
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		letter := letters[0]
+		assert.Equal(t, "test-hook", letter.HookId)
+		assert.Equal(t, "edit", letter.Type)
+		assert.Equal(t, "telegram_error", letter.Reason)
+		assert.Equal(t, 1, letter.Attempts)
+		replayed := message
+		replayed.DeadLetterId = letter.Id
+		assert.Equal(t, replayed, letter.Message)
+
+		require.NoError(t, s.AddDeadLetter(ctx, letter.Message, "unknown_hook", "hookId not found"))
+		letters, err = s.ListDeadLetters(ctx, DeadLetterFilter{})
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		assert.Equal(t, 2, letters[0].Attempts)
+		assert.Equal(t, "unknown_hook", letters[0].Reason)
+		assert.Equal(t, letter.FirstFailedAt, letters[0].FirstFailedAt)
+
+		require.NoError(t, s.RemoveDeadLetter(ctx, letter.Id))
+		letters, err = s.ListDeadLetters(ctx, DeadLetterFilter{})
+		require.NoError(t, err)
+		assert.Empty(t, letters)
+	})
+	t.Run("replayed after purge", func(t *testing.T) {
+		s := openTestStorage(t)
+		replayed := message
+		replayed.DeadLetterId = 100
+		require.NoError(t, s.AddDeadLetter(ctx, replayed, "telegram_error", "error"))
+		letters, err := s.ListDeadLetters(ctx, DeadLetterFilter{})
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		assert.Equal(t, 1, letters[0].Attempts)
+	})
+	t.Run("filter and purge", func(t *testing.T) {
+		s := openTestStorage(t)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, s.AddDeadLetter(ctx, message, "telegram_error", "error"))
+		}
+		letters, err := s.ListDeadLetters(ctx, DeadLetterFilter{Ids: []int64{1, 3}})
+		require.NoError(t, err)
+		require.Len(t, letters, 2)
+		assert.Equal(t, int64(3), letters[1].Id)
+		letters, err = s.ListDeadLetters(ctx, DeadLetterFilter{AfterId: 1, Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		assert.Equal(t, int64(2), letters[0].Id)
+
+		purged, err := s.PurgeDeadLetters(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), purged)
+	})
+}
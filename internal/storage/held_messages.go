@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"viktig/internal/entities"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// HoldMessage stores a message held until the end of quiet hours and returns its ID
+func (s *Storage) HoldMessage(ctx context.Context, message entities.Message) (int64, error) {
+	data, err := marshalMessage(message)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, "INSERT INTO held_messages (hook_id, message) VALUES (?, ?)", message.HookId, data)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ReleaseMessage removes a held message after it was released
+func (s *Storage) ReleaseMessage(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM held_messages WHERE id = ?", id)
+	return err
+}
+
+// ListHeldMessages returns the held messages with HeldId set in the order they were held
+func (s *Storage) ListHeldMessages(ctx context.Context) ([]entities.Message, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, message FROM held_messages ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []entities.Message
+	for rows.Next() {
+		var id int64
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		stored := storedMessage{}
+		if err = jsoniter.UnmarshalFromString(data, &stored); err != nil {
+			return nil, fmt.Errorf("held message %d: %w", id, err)
+		}
+		message := stored.message()
+		message.HeldId = id
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
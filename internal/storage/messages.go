@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"viktig/internal/entities"
+)
+
+const defaultMessagesLimit = 100
+
+// ArchivedMessage is a forwarded message with the outcome of forwarding it
+type ArchivedMessage struct {
+	Id           int64                   `json:"id"`
+	EventId      string                  `json:"event_id"`
+	HookId       string                  `json:"hook_id"`
+	Type         string                  `json:"type"`
+	Text         string                  `json:"text"`
+	VkSenderId   int                     `json:"vk_sender_id"`
+	VkSenderName string                  `json:"vk_sender_name"`
+	ReceivedAt   time.Time               `json:"received_at"`
+	Status       entities.DeliveryStatus `json:"status"`
+	Error        string                  `json:"error,omitempty"`
+	Sink         string                  `json:"sink"`
+	TgChatId     int                     `json:"tg_chat_id,omitempty"`
+	TgMessageId  int                     `json:"tg_message_id,omitempty"`
+	ProcessedAt  time.Time               `json:"processed_at"`
+}
+
+// MessageFilter selects archived messages, zero fields are ignored
+type MessageFilter struct {
+	HookId     string
+	VkSenderId int
+	From       time.Time
+	To         time.Time
+	// Query is searched in message texts and sender names, all the words must match
+	Query string
+	// AfterId is the ID of the last message on the previous page
+	AfterId int64
+	Limit   int
+}
+
+// ArchiveMessage stores the message along with its delivery outcome
+func (s *Storage) ArchiveMessage(ctx context.Context, message entities.Message, delivery entities.Delivery) error {
+	senderName := ""
+	if message.VkSender != nil {
+		senderName = message.VkSender.FirstName + " " + message.VkSender.LastName
+	}
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO messages (
+			event_id, hook_id, type, text, vk_sender_id, vk_sender_name, received_at,
+			status, error, sink, tg_chat_id, tg_message_id, processed_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		message.EventId,
+		message.HookId,
+		message.Type.String(),
+		message.Text,
+		message.VkSenderId,
+		senderName,
+		message.ReceivedAt.UnixMilli(),
+		string(delivery.Status),
+		delivery.Error,
+		delivery.Sink,
+		delivery.TgChatId,
+		delivery.TgMessageId,
+		delivery.At.UnixMilli(),
+	)
+	return err
+}
+
+// ListMessages returns the archived messages matching filter in the order they were archived
+func (s *Storage) ListMessages(ctx context.Context, filter MessageFilter) ([]*ArchivedMessage, error) {
+	var conditions []string
+	var args []any
+	if filter.HookId != "" {
+		conditions = append(conditions, "m.hook_id = ?")
+		args = append(args, filter.HookId)
+	}
+	if filter.VkSenderId != 0 {
+		conditions = append(conditions, "m.vk_sender_id = ?")
+		args = append(args, filter.VkSenderId)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "m.received_at >= ?")
+		args = append(args, filter.From.UnixMilli())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "m.received_at < ?")
+		args = append(args, filter.To.UnixMilli())
+	}
+	if query := ftsQuery(filter.Query); query != "" {
+		conditions = append(conditions, "m.id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)")
+		args = append(args, query)
+	}
+	conditions = append(conditions, "m.id > ?")
+	args = append(args, filter.AfterId)
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultMessagesLimit
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT
+				m.id, m.event_id, m.hook_id, m.type, m.text, m.vk_sender_id, m.vk_sender_name, m.received_at,
+				m.status, m.error, m.sink, m.tg_chat_id, m.tg_message_id, m.processed_at
+			FROM messages m WHERE %s ORDER BY m.id LIMIT ?`,
+			strings.Join(conditions, " AND "),
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*ArchivedMessage, 0)
+	for rows.Next() {
+		m := &ArchivedMessage{}
+		var receivedAt, processedAt int64
+		if err = rows.Scan(
+			&m.Id, &m.EventId, &m.HookId, &m.Type, &m.Text, &m.VkSenderId, &m.VkSenderName, &receivedAt,
+			&m.Status, &m.Error, &m.Sink, &m.TgChatId, &m.TgMessageId, &processedAt,
+		); err != nil {
+			return nil, err
+		}
+		m.ReceivedAt = time.UnixMilli(receivedAt).UTC()
+		m.ProcessedAt = time.UnixMilli(processedAt).UTC()
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// ftsQuery converts a user query into an FTS5 query matching all the words, so that FTS5 syntax is not interpreted
+func ftsQuery(query string) string {
+	words := strings.Fields(query)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessages(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+	receivedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	archive := func(hookId string, senderId int, text string, receivedAt time.Time) {
+		require.NoError(t, s.ArchiveMessage(
+			ctx,
+			entities.Message{
+				EventId:    "event",
+				HookId:     hookId,
+				Type:       entities.MessageTypeNew,
+				Text:       text,
+				VkSenderId: senderId,
+				VkSender:   &entities.VkUser{FirstName: "Ivan", LastName: "Petrov"},
+				ReceivedAt: receivedAt,
+			},
+			entities.Delivery{Status: entities.DeliveryStatusSent, Sink: "telegram", TgChatId: 4321, TgMessageId: 321, At: receivedAt},
+		))
+	}
+	archive("a", 1, "Hello, where is my order?", receivedAt)
+	archive("a", 2, "Good morning", receivedAt.Add(time.Hour))
+	archive("b", 1, "Order \"42\" is late", receivedAt.Add(24*time.Hour))
+
+	texts := func(filter MessageFilter) []string {
+		messages, err := s.ListMessages(ctx, filter)
+		require.NoError(t, err)
+		texts := make([]string, 0, len(messages))
+		for _, message := range messages {
+			texts = append(texts, message.Text)
+		}
+		return texts
+	}
+
+	t.Run("all", func(t *testing.T) {
+		messages, err := s.ListMessages(ctx, MessageFilter{})
+		require.NoError(t, err)
+		require.Len(t, messages, 3)
+		assert.Equal(t, &ArchivedMessage{
+			Id:           1,
+			EventId:      "event",
+			HookId:       "a",
+			Type:         "new",
+			Text:         "Hello, where is my order?",
+			VkSenderId:   1,
+			VkSenderName: "Ivan Petrov",
+			ReceivedAt:   receivedAt,
+			Status:       entities.DeliveryStatusSent,
+			Sink:         "telegram",
+			TgChatId:     4321,
+			TgMessageId:  321,
+			ProcessedAt:  receivedAt,
+		}, messages[0])
+	})
+	t.Run("community and sender", func(t *testing.T) {
+		assert.Equal(t, []string{"Good morning"}, texts(MessageFilter{HookId: "a", VkSenderId: 2}))
+	})
+	t.Run("date range", func(t *testing.T) {
+		filter := MessageFilter{From: receivedAt.Add(time.Minute), To: receivedAt.Add(24 * time.Hour)}
+		assert.Equal(t, []string{"Good morning"}, texts(filter))
+	})
+	t.Run("full text", func(t *testing.T) {
+		assert.Equal(t, []string{"Hello, where is my order?", "Order \"42\" is late"}, texts(MessageFilter{Query: "order"}))
+		assert.Equal(t, []string{"Order \"42\" is late"}, texts(MessageFilter{Query: "order \"42"}))
+		assert.Len(t, texts(MessageFilter{Query: "petrov"}), 3)
+		assert.Empty(t, texts(MessageFilter{Query: "NOT AND"}))
+	})
+	t.Run("pagination", func(t *testing.T) {
+		assert.Equal(t, []string{"Good morning"}, texts(MessageFilter{AfterId: 1, Limit: 1}))
+	})
+}
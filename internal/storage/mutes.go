@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Mute pauses forwarding to a Telegram chat until Until, or until it is removed if Until is zero
+type Mute struct {
+	TgChatId int
+	Until    time.Time
+}
+
+func (s *Storage) ListMutes(ctx context.Context) ([]Mute, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT tg_chat_id, until FROM mutes ORDER BY tg_chat_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mutes []Mute
+	for rows.Next() {
+		var mute Mute
+		var until int64
+		if err = rows.Scan(&mute.TgChatId, &until); err != nil {
+			return nil, err
+		}
+		if until != 0 {
+			mute.Until = time.UnixMilli(until).UTC()
+		}
+		mutes = append(mutes, mute)
+	}
+	return mutes, rows.Err()
+}
+
+// SaveMute creates or replaces the mute of the chat
+func (s *Storage) SaveMute(ctx context.Context, mute Mute) error {
+	var until int64
+	if !mute.Until.IsZero() {
+		until = mute.Until.UnixMilli()
+	}
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO mutes (tg_chat_id, until) VALUES (?, ?) ON CONFLICT (tg_chat_id) DO UPDATE SET until = excluded.until",
+		mute.TgChatId,
+		until,
+	)
+	return err
+}
+
+// DeleteMute removes the mute of the chat if there is one
+func (s *Storage) DeleteMute(ctx context.Context, tgChatId int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM mutes WHERE tg_chat_id = ?", tgChatId)
+	return err
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// migrations are applied in order, the number of applied migrations is stored as the database user_version
+var migrations = []string{
+	`CREATE TABLE communities (
+		hook_id TEXT PRIMARY KEY,
+		config TEXT NOT NULL
+	)`,
+	`CREATE TABLE messages (
+		id INTEGER PRIMARY KEY,
+		event_id TEXT NOT NULL,
+		hook_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		text TEXT NOT NULL,
+		vk_sender_id INTEGER NOT NULL,
+		vk_sender_name TEXT NOT NULL,
+		received_at INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL,
+		tg_chat_id INTEGER NOT NULL,
+		tg_message_id INTEGER NOT NULL,
+		processed_at INTEGER NOT NULL
+	);
+	CREATE INDEX messages_hook_id_received_at ON messages (hook_id, received_at);
+	CREATE INDEX messages_vk_sender_id ON messages (vk_sender_id);
+	CREATE VIRTUAL TABLE messages_fts USING fts5(text, vk_sender_name, content='messages', content_rowid='id');
+	CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, text, vk_sender_name) VALUES (new.id, new.text, new.vk_sender_name);
+	END;
+	CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, text, vk_sender_name)
+		VALUES ('delete', old.id, old.text, old.vk_sender_name);
+	END`,
+	`CREATE TABLE dead_letters (
+		id INTEGER PRIMARY KEY,
+		hook_id TEXT NOT NULL,
+		message TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		error TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		first_failed_at INTEGER NOT NULL,
+		last_failed_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE mutes (
+		tg_chat_id INTEGER PRIMARY KEY,
+		until INTEGER NOT NULL
+	)`,
+	`CREATE TABLE conversations (
+		hook_id TEXT NOT NULL,
+		vk_peer_id INTEGER NOT NULL,
+		vk_group_id INTEGER NOT NULL,
+		vk_sender_name TEXT NOT NULL,
+		opened_at INTEGER NOT NULL,
+		reminders INTEGER NOT NULL,
+		PRIMARY KEY (hook_id, vk_peer_id)
+	)`,
+	`ALTER TABLE messages ADD COLUMN sink TEXT NOT NULL DEFAULT 'telegram'`,
+	`CREATE TABLE metadata (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	INSERT INTO metadata (key, value) SELECT 'communities_seeded', '1' WHERE EXISTS (SELECT 1 FROM communities)`,
+	// The communities of seeded databases are taken as the ones last applied from the config file
+	`INSERT INTO metadata (key, value)
+	SELECT 'config_community/' || hook_id, config FROM communities
+	WHERE EXISTS (SELECT 1 FROM metadata WHERE key = 'communities_seeded');
+	DELETE FROM metadata WHERE key = 'communities_seeded'`,
+	`CREATE TABLE held_messages (
+		id INTEGER PRIMARY KEY,
+		hook_id TEXT NOT NULL,
+		message TEXT NOT NULL
+	)`,
+}
+
+// Storage keeps the app state in an SQLite database
+type Storage struct {
+	db *sql.DB
+}
+
+// Open opens the database at path, creating it if needed, and applies migrations
+func Open(ctx context.Context, path string) (*Storage, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{db: db}
+	if err = s.migrate(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) migrate(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var version int
+	if err = tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database version %d is newer than supported %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		if _, err = tx.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", len(migrations))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
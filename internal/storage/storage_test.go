@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+	"viktig/internal/config"
+	"viktig/internal/entities"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	t.Run("reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "viktig.db")
+		s, err := Open(context.Background(), path)
+		require.NoError(t, err)
+		require.NoError(t, s.SaveCommunity(context.Background(), &config.CommunityConfig{HookId: "test-hook"}))
+		require.NoError(t, s.Close())
+
+		s, err = Open(context.Background(), path)
+		require.NoError(t, err)
+		defer s.Close()
+		communities, err := s.ListCommunities(context.Background())
+		require.NoError(t, err)
+		assert.Len(t, communities, 1)
+	})
+	t.Run("newer version", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "viktig.db")
+		s, err := Open(context.Background(), path)
+		require.NoError(t, err)
+		_, err = s.db.Exec("PRAGMA user_version = 1000")
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		_, err = Open(context.Background(), path)
+		assert.ErrorContains(t, err, "newer than supported")
+	})
+}
+
+func TestCommunities(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+
+	community := &config.CommunityConfig{
+		HookId:             "test-hook",
+		SecretKeys:         []string{"secret"},
+		ConfirmationString: "confirmation",
+		TgChatId:           1234,
+	}
+	require.NoError(t, s.SaveCommunity(ctx, community))
+	actual, err := s.GetCommunity(ctx, "test-hook")
+	require.NoError(t, err)
+	assert.Equal(t, community, actual)
+
+	community.Disabled = true
+	require.NoError(t, s.SaveCommunity(ctx, community))
+	communities, err := s.ListCommunities(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []*config.CommunityConfig{community}, communities)
+
+	require.NoError(t, s.DeleteCommunity(ctx, "test-hook"))
+	_, err = s.GetCommunity(ctx, "test-hook")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, s.DeleteCommunity(ctx, "test-hook"), ErrNotFound)
+
+	applied, err := s.AppliedConfigCommunities(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+	require.NoError(t, s.ApplyConfigCommunities(ctx, []*config.CommunityConfig{community}))
+	applied, err = s.AppliedConfigCommunities(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*config.CommunityConfig{"test-hook": community}, applied)
+	communities, err = s.ListCommunities(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []*config.CommunityConfig{community}, communities)
+
+	// The applied version is kept when the community is deleted with the admin API
+	require.NoError(t, s.DeleteCommunity(ctx, "test-hook"))
+	applied, err = s.AppliedConfigCommunities(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*config.CommunityConfig{"test-hook": community}, applied)
+}
+
+func openTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	s, err := Open(context.Background(), filepath.Join(t.TempDir(), "viktig.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestMutes(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+	until := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.SaveMute(ctx, Mute{TgChatId: 1, Until: until}))
+	require.NoError(t, s.SaveMute(ctx, Mute{TgChatId: 2, Until: until}))
+	require.NoError(t, s.SaveMute(ctx, Mute{TgChatId: 2}))
+	mutes, err := s.ListMutes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Mute{{TgChatId: 1, Until: until}, {TgChatId: 2}}, mutes)
+
+	require.NoError(t, s.DeleteMute(ctx, 1))
+	require.NoError(t, s.DeleteMute(ctx, 3))
+	mutes, err = s.ListMutes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Mute{{TgChatId: 2}}, mutes)
+}
+
+func TestHeldMessages(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+	receivedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	first, err := s.HoldMessage(ctx, entities.Message{HookId: "test-hook", Text: "a", ReceivedAt: receivedAt})
+	require.NoError(t, err)
+	second, err := s.HoldMessage(ctx, entities.Message{HookId: "test-hook", Text: "b", ReceivedAt: receivedAt})
+	require.NoError(t, err)
+	messages, err := s.ListHeldMessages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []entities.Message{
+		{HookId: "test-hook", Text: "a", ReceivedAt: receivedAt, HeldId: first},
+		{HookId: "test-hook", Text: "b", ReceivedAt: receivedAt, HeldId: second},
+	}, messages)
+
+	require.NoError(t, s.ReleaseMessage(ctx, first))
+	messages, err = s.ListHeldMessages(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "b", messages[0].Text)
+}
+
+func TestConversations(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+	openedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	first := Conversation{HookId: "a", VkPeerId: 1, VkGroupId: 10, VkSenderName: "Ivan Petrov", OpenedAt: openedAt}
+	second := Conversation{HookId: "b", VkPeerId: 1, OpenedAt: openedAt.Add(time.Minute)}
+
+	require.NoError(t, s.SaveConversation(ctx, second))
+	require.NoError(t, s.SaveConversation(ctx, first))
+	second.Reminders = 1
+	require.NoError(t, s.SaveConversation(ctx, second))
+	conversations, err := s.ListConversations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Conversation{first, second}, conversations)
+
+	require.NoError(t, s.DeleteConversation(ctx, "a", 1))
+	require.NoError(t, s.DeleteConversation(ctx, "a", 2))
+	conversations, err = s.ListConversations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Conversation{second}, conversations)
+}
@@ -0,0 +1,255 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"viktig/internal/metrics"
+)
+
+type Service interface {
+	Run(ctx context.Context) error
+}
+
+// Readier is implemented by services reporting when they finished starting, e.g. connected to an API.
+// Other services are considered running as soon as they are run.
+type Readier interface {
+	Ready() error
+}
+
+// readyPollInterval is how often a starting service is checked for readiness
+const readyPollInterval = 100 * time.Millisecond
+
+// Policy describes how a failed service is restarted.
+//
+//	A service is restarted after a backoff that starts at InitialBackoff and doubles with every restart
+//	within Window, up to MaxBackoff. If the service fails more than MaxRestarts times within Window,
+//	it is considered permanently failing and the supervisor stops. Zero MaxRestarts means no limit.
+type Policy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxRestarts    int
+	Window         time.Duration
+}
+
+// DefaultPolicy restarts the service until it is stopped, since the services depend on external APIs
+// and an outage of any length should not stop the app.
+var DefaultPolicy = Policy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	Window:         10 * time.Minute,
+}
+
+type State int
+
+const (
+	StateStarting State = iota
+	StateRunning
+	StateRestarting
+	StateFailed
+	StateStopped
+)
+
+var stateNames = map[State]string{
+	StateStarting:   "starting",
+	StateRunning:    "running",
+	StateRestarting: "restarting",
+	StateFailed:     "failed",
+	StateStopped:    "stopped",
+}
+
+func (s State) String() string {
+	return stateNames[s]
+}
+
+type Status struct {
+	State     State
+	Restarts  int
+	LastError error
+}
+
+type supervisedService struct {
+	name    string
+	service Service
+	policy  Policy
+
+	mu       sync.Mutex
+	status   Status
+	restarts []time.Time
+}
+
+type Supervisor struct {
+	services []*supervisedService
+	l        *slog.Logger
+}
+
+func New(l *slog.Logger) *Supervisor {
+	return &Supervisor{l: l.With("service", "Supervisor")}
+}
+
+// Add registers a service to be run by the supervisor. Must not be called after Run.
+func (s *Supervisor) Add(name string, service Service, policy Policy) {
+	s.services = append(s.services, &supervisedService{name: name, service: service, policy: policy})
+}
+
+// Run runs all services and restarts the ones that fail according to their policies.
+//
+//	Returns nil after all services have stopped due to ctx cancellation,
+//	or an error if any of the services is permanently failing. In the latter case other services are stopped too.
+//	Services are stopped one by one in the order they were added, so producers should be added before their consumers.
+func (s *Supervisor) Run(ctx context.Context) error {
+	errorCh := make(chan error, len(s.services))
+	stops := make([]func(), 0, len(s.services))
+	for _, svc := range s.services {
+		svcCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := s.supervise(svcCtx, svc); err != nil {
+				errorCh <- err
+			}
+		}()
+		stops = append(stops, func() {
+			cancel()
+			<-done
+		})
+	}
+
+	var errs []error
+	select {
+	case <-ctx.Done():
+	case err := <-errorCh:
+		errs = append(errs, err)
+	}
+	for i, stop := range stops {
+		s.l.Info("stopping service", "supervisedService", s.services[i].name)
+		stop()
+	}
+	close(errorCh)
+
+	for err := range errorCh {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Statuses returns a snapshot of the statuses of all services by name.
+func (s *Supervisor) Statuses() map[string]Status {
+	res := make(map[string]Status, len(s.services))
+	for _, svc := range s.services {
+		svc.mu.Lock()
+		res[svc.name] = svc.status
+		svc.mu.Unlock()
+	}
+	return res
+}
+
+func (s *Supervisor) supervise(ctx context.Context, svc *supervisedService) error {
+	l := s.l.With("supervisedService", svc.name)
+	for {
+		svc.setState(StateStarting)
+		stopWatching := svc.watchReady(ctx)
+		err := svc.service.Run(ctx)
+		stopWatching()
+		if ctx.Err() != nil {
+			svc.setState(StateStopped)
+			if err != nil {
+				l.Error("service stopped with error", "err", err)
+			}
+			return nil
+		}
+		if err == nil {
+			err = errors.New("service exited unexpectedly")
+		}
+
+		backoff, ok := svc.registerFailure(time.Now(), err)
+		if !ok {
+			svc.setState(StateFailed)
+			l.Error("service is permanently failing", "err", err)
+			return fmt.Errorf("service %s is permanently failing: %w", svc.name, err)
+		}
+		svc.setState(StateRestarting)
+		l.Warn("service failed, restarting", "err", err, "backoff", backoff)
+		metrics.ServiceRestarts.WithLabelValues(svc.name).Inc()
+
+		select {
+		case <-ctx.Done():
+			svc.setState(StateStopped)
+			return nil
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// watchReady sets the state to running once the service is ready. Returns a function that stops watching.
+func (svc *supervisedService) watchReady(ctx context.Context) func() {
+	readier, ok := svc.service.(Readier)
+	if !ok {
+		svc.setState(StateRunning)
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(readyPollInterval)
+		defer ticker.Stop()
+		for {
+			if readier.Ready() == nil {
+				svc.setState(StateRunning)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (svc *supervisedService) setState(state State) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.status.State = state
+	metrics.ServiceState.WithLabelValues(svc.name).Set(float64(state))
+}
+
+// registerFailure records a failure and returns the backoff before the next restart,
+// or false if the service exceeded its restart limit.
+func (svc *supervisedService) registerFailure(now time.Time, err error) (time.Duration, bool) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	svc.status.LastError = err
+	recent := svc.restarts[:0]
+	for _, t := range svc.restarts {
+		if now.Sub(t) < svc.policy.Window {
+			recent = append(recent, t)
+		}
+	}
+	svc.restarts = recent
+	if svc.policy.MaxRestarts > 0 && len(svc.restarts) >= svc.policy.MaxRestarts {
+		return 0, false
+	}
+
+	backoff := svc.policy.InitialBackoff
+	for range svc.restarts {
+		if backoff >= svc.policy.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	backoff = min(backoff, svc.policy.MaxBackoff)
+	svc.restarts = append(svc.restarts, now)
+	svc.status.Restarts++
+	return backoff, true
+}
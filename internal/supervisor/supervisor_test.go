@@ -0,0 +1,217 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type serviceFunc func(ctx context.Context) error
+
+func (f serviceFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+var testPolicy = Policy{
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+	MaxRestarts:    3,
+	Window:         time.Minute,
+}
+
+func blockingService(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// readyService is ready once ready is set
+type readyService struct {
+	ready atomic.Bool
+}
+
+func (s *readyService) Run(ctx context.Context) error {
+	return blockingService(ctx)
+}
+
+func (s *readyService) Ready() error {
+	if !s.ready.Load() {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+func TestSupervisor(t *testing.T) {
+	t.Run("stop", func(t *testing.T) {
+		s, _ := setup(t)
+		s.Add("a", serviceFunc(blockingService), testPolicy)
+		s.Add("b", serviceFunc(blockingService), testPolicy)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- s.Run(ctx) }()
+		cancel()
+
+		assert.NoError(t, <-errCh)
+		assert.Equal(t, StateStopped, s.Statuses()["a"].State)
+		assert.Equal(t, StateStopped, s.Statuses()["b"].State)
+	})
+	t.Run("stop in order", func(t *testing.T) {
+		s, _ := setup(t)
+		stopped := make(chan string, 3)
+		for _, name := range []string{"producer", "processor", "consumer"} {
+			s.Add(name, serviceFunc(func(ctx context.Context) error {
+				<-ctx.Done()
+				time.Sleep(time.Millisecond)
+				stopped <- name
+				return nil
+			}), testPolicy)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- s.Run(ctx) }()
+		cancel()
+
+		assert.NoError(t, <-errCh)
+		assert.Equal(t, "producer", <-stopped)
+		assert.Equal(t, "processor", <-stopped)
+		assert.Equal(t, "consumer", <-stopped)
+	})
+	t.Run("starting", func(t *testing.T) {
+		s, _ := setup(t)
+		svc := &readyService{}
+		s.Add("slow", svc, testPolicy)
+		s.Add("plain", serviceFunc(blockingService), testPolicy)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- s.Run(ctx) }()
+
+		assert.Eventually(t, func() bool { return s.Statuses()["plain"].State == StateRunning }, time.Second, time.Millisecond)
+		assert.Equal(t, StateStarting, s.Statuses()["slow"].State)
+		svc.ready.Store(true)
+		assert.Eventually(t, func() bool { return s.Statuses()["slow"].State == StateRunning }, time.Second, time.Millisecond)
+		cancel()
+
+		assert.NoError(t, <-errCh)
+		assert.Equal(t, StateStopped, s.Statuses()["slow"].State)
+	})
+	t.Run("restart", func(t *testing.T) {
+		s, buf := setup(t)
+		var runs atomic.Int32
+		s.Add("flaky", serviceFunc(func(ctx context.Context) error {
+			if runs.Add(1) < 3 {
+				return errors.New("transient")
+			}
+			return blockingService(ctx)
+		}), testPolicy)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- s.Run(ctx) }()
+
+		assert.Eventually(t, func() bool { return runs.Load() == 3 }, time.Second, time.Millisecond)
+		status := s.Statuses()["flaky"]
+		assert.Equal(t, 2, status.Restarts)
+		assert.EqualError(t, status.LastError, "transient")
+		cancel()
+
+		assert.NoError(t, <-errCh)
+		assert.Contains(t, buf.String(), "service failed, restarting")
+	})
+	t.Run("permanent failure", func(t *testing.T) {
+		s, _ := setup(t)
+		var runs atomic.Int32
+		s.Add("broken", serviceFunc(func(ctx context.Context) error {
+			runs.Add(1)
+			return errors.New("broken")
+		}), testPolicy)
+		s.Add("healthy", serviceFunc(blockingService), testPolicy)
+
+		err := s.Run(context.Background())
+
+		assert.EqualError(t, err, "service broken is permanently failing: broken")
+		assert.Equal(t, int32(testPolicy.MaxRestarts+1), runs.Load())
+		assert.Equal(t, StateFailed, s.Statuses()["broken"].State)
+		assert.Equal(t, StateStopped, s.Statuses()["healthy"].State)
+	})
+	t.Run("outage", func(t *testing.T) {
+		s, _ := setup(t)
+		var runs atomic.Int32
+		s.Add("dependent", serviceFunc(func(ctx context.Context) error {
+			if runs.Add(1) <= 20 {
+				return errors.New("api is down")
+			}
+			return blockingService(ctx)
+		}), Policy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Window: 5 * time.Millisecond})
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- s.Run(ctx) }()
+
+		assert.Eventually(t, func() bool { return s.Statuses()["dependent"].State == StateRunning && runs.Load() > 20 }, time.Second, time.Millisecond)
+		assert.Equal(t, 20, s.Statuses()["dependent"].Restarts)
+		cancel()
+
+		assert.NoError(t, <-errCh)
+	})
+	t.Run("unexpected exit", func(t *testing.T) {
+		s, _ := setup(t)
+		s.Add("exiting", serviceFunc(func(ctx context.Context) error { return nil }), testPolicy)
+
+		err := s.Run(context.Background())
+
+		assert.EqualError(t, err, "service exiting is permanently failing: service exited unexpectedly")
+	})
+}
+
+func TestRegisterFailure(t *testing.T) {
+	svc := &supervisedService{policy: Policy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     3 * time.Second,
+		MaxRestarts:    3,
+		Window:         time.Minute,
+	}}
+	now := time.Now()
+	err := errors.New("error")
+
+	backoff, ok := svc.registerFailure(now, err)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, backoff)
+	backoff, ok = svc.registerFailure(now, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, backoff)
+	backoff, ok = svc.registerFailure(now, err)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, backoff)
+	_, ok = svc.registerFailure(now, err)
+	assert.False(t, ok)
+
+	backoff, ok = svc.registerFailure(now.Add(2*time.Minute), err)
+	assert.True(t, ok, "old failures are outside of the window")
+	assert.Equal(t, time.Second, backoff)
+}
+
+func setup(t *testing.T) (*Supervisor, *bytes.Buffer) {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	return New(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{}))), buf
+}
+
+func TestRegisterFailureUnlimited(t *testing.T) {
+	svc := &supervisedService{policy: DefaultPolicy}
+	now := time.Now()
+	err := errors.New("error")
+
+	// An outage much longer than the window
+	for i := 0; i < 180; i++ {
+		backoff, ok := svc.registerFailure(now, err)
+		assert.True(t, ok)
+		assert.LessOrEqual(t, backoff, DefaultPolicy.MaxBackoff)
+		now = now.Add(backoff)
+	}
+	backoff, ok := svc.registerFailure(now, err)
+	assert.True(t, ok)
+	assert.Equal(t, DefaultPolicy.MaxBackoff, backoff)
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestSetup(t *testing.T) {
+	var exported atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" {
+			exported.Add(1)
+		}
+	}))
+	defer collector.Close()
+	defaultProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(defaultProvider)
+
+	shutdown, err := Setup(context.Background(), strings.TrimPrefix(collector.URL, "http://"), true, 1)
+	require.NoError(t, err)
+	_, span := otel.Tracer("test").Start(context.Background(), "test")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	assert.Equal(t, int32(1), exported.Load())
+}
+
+func TestNewProvider(t *testing.T) {
+	t.Run("sampled", func(t *testing.T) {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := NewProvider(exporter, 1)
+		_, span := provider.Tracer("test").Start(context.Background(), "test")
+		span.End()
+		require.NoError(t, provider.ForceFlush(context.Background()))
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		assert.Equal(t, "test", spans[0].Name)
+		assert.Contains(t, spans[0].Resource.Attributes(), semconv.ServiceName(serviceName))
+	})
+	t.Run("not sampled", func(t *testing.T) {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := NewProvider(exporter, 0)
+		_, span := provider.Tracer("test").Start(context.Background(), "test")
+		span.End()
+		require.NoError(t, provider.ForceFlush(context.Background()))
+
+		assert.Empty(t, exporter.GetSpans())
+	})
+}